@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// Chunks of a restricted document carry acl_restricted=true, the owner in
+// acl_owner, and the groups allowed to read it both as a comma-separated
+// acl_groups and as one boolean acl_group_<name> key per group, since Chroma
+// metadata cannot hold lists. Documents without them are readable by everyone.
+const (
+	metaACLRestricted = "acl_restricted"
+	metaACLOwner      = "acl_owner"
+	metaACLGroups     = "acl_groups"
+	aclGroupPrefix    = "acl_group_"
+)
+
+// headerUserGroups carries the caller's groups, set like X-User-ID by the
+// authenticating proxy in front of the server.
+const headerUserGroups = "X-User-Groups"
+
+// Access says who may read a document. The zero Access leaves it readable by
+// everyone.
+type Access struct {
+	Owner  string   `json:"owner,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func (a Access) restricted() bool {
+	return a.Owner != "" || len(a.Groups) > 0
+}
+
+// attributes returns the chunk metadata recording a.
+func (a Access) attributes() []*chroma.MetaAttribute {
+	if !a.restricted() {
+		return nil
+	}
+	attrs := []*chroma.MetaAttribute{chroma.NewBoolAttribute(metaACLRestricted, true)}
+	if a.Owner != "" {
+		attrs = append(attrs, chroma.NewStringAttribute(metaACLOwner, a.Owner))
+	}
+	if len(a.Groups) > 0 {
+		attrs = append(attrs, chroma.NewStringAttribute(metaACLGroups, strings.Join(a.Groups, ",")))
+		for _, g := range a.Groups {
+			attrs = append(attrs, chroma.NewBoolAttribute(attributeKey(aclGroupPrefix, g), true))
+		}
+	}
+	return attrs
+}
+
+// readAccess reads a document's access from the "owner" and "groups" fields
+// of an upload. groups is a comma-separated list or a JSON array.
+func readAccess(field requestFields) (Access, error) {
+	a := Access{Owner: strings.TrimSpace(field("owner"))}
+	groups, err := readGroups(field("groups"))
+	if err != nil {
+		return Access{}, err
+	}
+	a.Groups = groups
+	return a, nil
+}
+
+func readGroups(v string) ([]string, error) {
+	v = strings.TrimSpace(v)
+	var raw []string
+	if strings.HasPrefix(v, "[") {
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			return nil, fmt.Errorf("groups must be a list of names")
+		}
+	} else if v != "" {
+		raw = strings.Split(v, ",")
+	}
+	return cleanGroups(raw)
+}
+
+// cleanGroups trims group names and drops empty ones.
+func cleanGroups(raw []string) ([]string, error) {
+	var groups []string
+	for _, g := range raw {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if attributeKey(aclGroupPrefix, g) == aclGroupPrefix {
+			return nil, fmt.Errorf("group %q needs a letter or digit", g)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// Caller is who a request is served for, as far as document access goes.
+type Caller struct {
+	ID     string   // X-User-ID, "" when anonymous
+	Groups []string // X-User-Groups
+	Admin  bool     // presented ADMIN_TOKEN; reads every document
+	Tenant string   // X-Tenant-ID, else ID; what quotas are counted against
+}
+
+type callerKey struct{}
+
+// withCaller returns ctx carrying c.
+func withCaller(ctx context.Context, c Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// callerFrom returns the caller ctx carries. ok is false for work the server
+// does on its own, such as maintenance, which is not restricted.
+func callerFrom(ctx context.Context) (c Caller, ok bool) {
+	c, ok = ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// caller identifies the caller of r from the identity headers the
+// authenticating proxy sets, and the admin token.
+func (s *Server) caller(r *http.Request) Caller {
+	c := Caller{ID: strings.TrimSpace(r.Header.Get("X-User-ID"))}
+	c.Groups, _ = readGroups(r.Header.Get(headerUserGroups))
+	c.Tenant = strings.TrimSpace(r.Header.Get(headerTenant))
+	if c.Tenant == "" {
+		c.Tenant = c.ID
+	}
+	if s.cfg.AdminToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		c.Admin = subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) == 1
+	}
+	return c
+}
+
+// accessWhere matches the chunks ctx's caller may read: unrestricted ones
+// (Chroma's $ne also matches records without the key), the caller's own and
+// those shared with one of the caller's groups. It is nil when nothing needs
+// filtering out.
+func accessWhere(ctx context.Context) chroma.WhereClause {
+	c, ok := callerFrom(ctx)
+	if !ok || c.Admin {
+		return nil
+	}
+	clauses := []chroma.WhereClause{chroma.NotEqBool(metaACLRestricted, true)}
+	if c.ID != "" {
+		clauses = append(clauses, chroma.EqString(metaACLOwner, c.ID))
+	}
+	for _, g := range c.Groups {
+		clauses = append(clauses, chroma.EqBool(attributeKey(aclGroupPrefix, g), true))
+	}
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return chroma.Or(clauses...)
+}
+
+// hiddenWhere matches the chunks ctx's caller may not read, the complement of
+// accessWhere: restricted ones neither owned by the caller nor shared with one
+// of the caller's groups. It is nil when the caller may read everything.
+func hiddenWhere(ctx context.Context) chroma.WhereClause {
+	c, ok := callerFrom(ctx)
+	if !ok || c.Admin {
+		return nil
+	}
+	clauses := []chroma.WhereClause{chroma.EqBool(metaACLRestricted, true)}
+	if c.ID != "" {
+		clauses = append(clauses, chroma.NotEqString(metaACLOwner, c.ID))
+	}
+	for _, g := range c.Groups {
+		clauses = append(clauses, chroma.NotEqBool(attributeKey(aclGroupPrefix, g), true))
+	}
+	return andWhere(clauses...)
+}
+
+// mayModify reports whether ctx's caller may change the document a chunk with
+// metadata meta belongs to: its owner, anyone of its tenant when it is not
+// restricted, and the admin. Work the server does on its own may change any.
+func mayModify(ctx context.Context, meta map[string]any) bool {
+	c, ok := callerFrom(ctx)
+	if !ok || c.Admin {
+		return true
+	}
+	if owner, _ := meta[metaACLOwner].(string); owner != "" {
+		return c.ID != "" && owner == c.ID
+	}
+	if restricted, _ := meta[metaACLRestricted].(bool); restricted {
+		return false
+	}
+	tenant, _ := tenantFrom(ctx)
+	return meta[metaTenant] == tenant
+}
+
+// accessStore adds the caller's access filter to every read of a VectorStore,
+// so no handler can return chunks of documents the caller may not see.
+type accessStore struct {
+	VectorStore
+}
+
+// restrictWhere ANDs the access filter onto a where set by earlier options.
+func restrictWhere(where *chroma.WhereFilter, access chroma.WhereClause) error {
+	if *where == nil {
+		*where = access
+		return nil
+	}
+	clause, ok := (*where).(chroma.WhereClause)
+	if !ok {
+		return fmt.Errorf("unsupported where filter %T", *where)
+	}
+	*where = andWhere(clause, access)
+	return nil
+}
+
+func (a accessStore) Get(ctx context.Context, opts ...chroma.CollectionGetOption) (chroma.GetResult, error) {
+	if access := accessWhere(ctx); access != nil {
+		opts = append(opts[:len(opts):len(opts)], func(op *chroma.CollectionGetOp) error {
+			return restrictWhere(&op.Where, access)
+		})
+	}
+	return a.VectorStore.Get(ctx, opts...)
+}
+
+func (a accessStore) Query(ctx context.Context, opts ...chroma.CollectionQueryOption) (chroma.QueryResult, error) {
+	if access := accessWhere(ctx); access != nil {
+		opts = append(opts[:len(opts):len(opts)], func(op *chroma.CollectionQueryOp) error {
+			return restrictWhere(&op.Where, access)
+		})
+	}
+	return a.VectorStore.Query(ctx, opts...)
+}
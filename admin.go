@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled entirely when no token is configured.
+func (s *Server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled; set ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// -------------------- Purge --------------------
+
+// purgeConfirmTTL is how long a purge confirmation token stays valid.
+const purgeConfirmTTL = 2 * time.Minute
+
+type purgeRequest struct {
+	Document  string `json:"document"`  // only chunks of this document (metadata "context")
+	Namespace string `json:"namespace"` // only chunks uploaded into this namespace
+	Confirm   string `json:"confirm"`   // token returned by the first, unconfirmed call
+}
+
+type purgeResponse struct {
+	Matched   int    `json:"matched"`
+	Deleted   int    `json:"deleted"`
+	Confirm   string `json:"confirm,omitempty"`
+	ExpiresIn int    `json:"expires_in,omitempty"` // seconds
+}
+
+// purgeTokens maps confirmation tokens to the filter they were issued for,
+// so a token can only confirm the exact purge that was previewed.
+type purgeTokens struct {
+	sync.Mutex
+	m map[string]pendingPurge
+}
+
+type pendingPurge struct {
+	filter  string
+	expires time.Time
+}
+
+func (p purgeRequest) filterKey() string {
+	return "document=" + p.Document + "|namespace=" + p.Namespace
+}
+
+func (p purgeRequest) where() chroma.WhereClause {
+	var doc, ns chroma.WhereClause
+	if p.Document != "" {
+		doc = chroma.EqString("context", p.Document)
+	}
+	if p.Namespace != "" {
+		ns = chroma.EqString("namespace", p.Namespace)
+	}
+	return andWhere(doc, ns)
+}
+
+func readPurgeRequest(r *http.Request) (purgeRequest, error) {
+	var req purgeRequest
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+	_ = r.ParseForm()
+	req.Document = r.FormValue("document")
+	req.Namespace = r.FormValue("namespace")
+	req.Confirm = r.FormValue("confirm")
+	return req, nil
+}
+
+// purgeHandler deletes all chunks in the collection, optionally only those of
+// one document or namespace. It works in two steps: a call without "confirm"
+// reports how many chunks match and returns a short-lived confirmation token;
+// repeating the call with that token performs the deletion.
+func (s *Server) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Purge request received")
+
+	defer r.Body.Close()
+	ctx := r.Context()
+
+	req, err := readPurgeRequest(r)
+	if err != nil {
+		http.Error(w, "expected {document, namespace, confirm}", http.StatusBadRequest)
+		return
+	}
+
+	ids, docs, err := collectionDocuments(ctx, s.store, req.where())
+	if err != nil {
+		http.Error(w, "failed to list chunks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Confirm == "" {
+		token, err := s.newPurgeToken(req.filterKey())
+		if err != nil {
+			http.Error(w, "failed to issue confirmation token", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, purgeResponse{
+			Matched:   len(ids),
+			Confirm:   token,
+			ExpiresIn: int(purgeConfirmTTL.Seconds()),
+		})
+		return
+	}
+
+	if !s.consumePurgeToken(req.Confirm, req.filterKey()) {
+		http.Error(w, "invalid or expired confirmation token", http.StatusConflict)
+		return
+	}
+
+	if err := deleteIDs(ctx, s.store, ids); err != nil {
+		http.Error(w, "failed to delete chunks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// self-query and maintenance go by the saved sources, so drop them too
+	for _, doc := range docs {
+		s.removeSource(doc)
+	}
+	log.Printf("Purged %d chunks of %d documents (%s)", len(ids), len(docs), req.filterKey())
+
+	writeJSON(w, http.StatusOK, purgeResponse{Matched: len(ids), Deleted: len(ids)})
+}
+
+func (s *Server) newPurgeToken(filter string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.state.pendingPurges.Lock()
+	defer s.state.pendingPurges.Unlock()
+	now := time.Now()
+	for t, p := range s.state.pendingPurges.m {
+		if now.After(p.expires) {
+			delete(s.state.pendingPurges.m, t)
+		}
+	}
+	s.state.pendingPurges.m[token] = pendingPurge{filter: filter, expires: now.Add(purgeConfirmTTL)}
+	return token, nil
+}
+
+func (s *Server) consumePurgeToken(token, filter string) bool {
+	s.state.pendingPurges.Lock()
+	defer s.state.pendingPurges.Unlock()
+	p, ok := s.state.pendingPurges.m[token]
+	if !ok {
+		return false
+	}
+	delete(s.state.pendingPurges.m, token)
+	return p.filter == filter && time.Now().Before(p.expires)
+}
+
+// -------------------- Collection helpers --------------------
+
+// chromaPageSize is how many records are fetched or deleted per Chroma call.
+const chromaPageSize = 1000
+
+// collectionIDs pages through collection c and returns the IDs of all records
+// matching where (all records when where is nil).
+func collectionIDs(ctx context.Context, c VectorStore, where chroma.WhereClause) ([]chroma.DocumentID, error) {
+	var ids []chroma.DocumentID
+	for offset := 0; ; offset += chromaPageSize {
+		opts := []chroma.CollectionGetOption{
+			chroma.WithIncludeGet(chroma.IncludeMetadatas),
+			chroma.WithLimitGet(chromaPageSize),
+			chroma.WithOffsetGet(offset),
+		}
+		if where != nil {
+			opts = append(opts, chroma.WithWhereGet(where))
+		}
+		res, err := c.Get(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		page := res.GetIDs()
+		ids = append(ids, page...)
+		if len(page) < chromaPageSize {
+			return ids, nil
+		}
+	}
+}
+
+// collectionDocuments is collectionIDs that also returns the names of the
+// documents the matching records belong to.
+func collectionDocuments(ctx context.Context, c VectorStore, where chroma.WhereClause) ([]chroma.DocumentID, []string, error) {
+	var ids []chroma.DocumentID
+	var docs []string
+	seen := map[string]bool{}
+	for offset := 0; ; offset += chromaPageSize {
+		opts := []chroma.CollectionGetOption{
+			chroma.WithIncludeGet(chroma.IncludeMetadatas),
+			chroma.WithLimitGet(chromaPageSize),
+			chroma.WithOffsetGet(offset),
+		}
+		if where != nil {
+			opts = append(opts, chroma.WithWhereGet(where))
+		}
+		res, err := c.Get(ctx, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		page := res.GetIDs()
+		ids = append(ids, page...)
+		for _, m := range res.GetMetadatas() {
+			if m == nil {
+				continue
+			}
+			if doc, ok := m.GetString("context"); ok && doc != "" && !seen[doc] {
+				seen[doc] = true
+				docs = append(docs, doc)
+			}
+		}
+		if len(page) < chromaPageSize {
+			return ids, docs, nil
+		}
+	}
+}
+
+// deleteIDs removes the given records from c in pages.
+func deleteIDs(ctx context.Context, c VectorStore, ids []chroma.DocumentID) error {
+	for i := 0; i < len(ids); i += chromaPageSize {
+		j := min(i+chromaPageSize, len(ids))
+		err := withRetry(ctx, "chroma delete", func() error {
+			return c.Delete(ctx, chroma.WithIDsDelete(ids[i:j]...))
+		})
+		if err != nil {
+			return fmt.Errorf("deleting records %d-%d: %w", i, j, err)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// -------------------- Embedding cache --------------------
+
+// cacheEntry describes one embedding cache file.
+type cacheEntry struct {
+	File     string    `json:"file"`
+	Key      string    `json:"key,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Chunks   int       `json:"chunks"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+	Valid    bool      `json:"valid"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type cacheResponse struct {
+	Entries []cacheEntry `json:"entries"`
+	Removed int          `json:"removed,omitempty"`
+}
+
+// cacheHandler inspects (GET) or clears (DELETE) the embedding cache. DELETE
+// removes the entry named by the "file" query parameter, or every entry.
+func (s *Server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Cache admin request received")
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := s.listCacheEntries()
+		if err != nil {
+			http.Error(w, "failed to read cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, cacheResponse{Entries: entries})
+
+	case http.MethodDelete:
+		removed, err := s.clearCache(r.URL.Query().Get("file"))
+		if os.IsNotExist(err) {
+			http.Error(w, "cache entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to clear cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries, err := s.listCacheEntries()
+		if err != nil {
+			http.Error(w, "failed to read cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, cacheResponse{Entries: entries, Removed: removed})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listCacheEntries() ([]cacheEntry, error) {
+	files, err := os.ReadDir(s.embedCacheDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []cacheEntry{}, nil
+		}
+		return nil, err
+	}
+
+	entries := make([]cacheEntry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		e := cacheEntry{File: f.Name()}
+		if info, err := f.Info(); err == nil {
+			e.Bytes = info.Size()
+			e.Modified = info.ModTime()
+		}
+		emb, cf, ok, err := s.loadEmbeddingsFromFile(filepath.Join(s.embedCacheDir(), f.Name()))
+		if cf != nil {
+			e.Key, e.Model = cf.Key, cf.Model
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		e.Valid = ok && err == nil
+		e.Chunks = len(emb)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// clearCache removes one cache file (by name) or, if file is empty, all of them.
+func (s *Server) clearCache(file string) (int, error) {
+	s.state.embedCacheMu.Lock()
+	defer s.state.embedCacheMu.Unlock()
+
+	if file != "" {
+		if filepath.Base(file) != file || file == "." || file == ".." || filepath.Ext(file) != ".json" {
+			return 0, fmt.Errorf("invalid cache file name %q", file)
+		}
+		if err := os.Remove(filepath.Join(s.embedCacheDir(), file)); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	files, err := os.ReadDir(s.embedCacheDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.embedCacheDir(), f.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
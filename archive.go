@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// metaArchive and metaArchivePath record, on chunks of a document that came in
+// an archive upload, the archive's name and the document's path inside it.
+const (
+	metaArchive     = "archive"
+	metaArchivePath = "archive_path"
+)
+
+// maxArchiveFiles bounds how many files one uploaded archive may hold.
+const maxArchiveFiles = 500
+
+// archiveEntry is a file found in an uploaded archive: its content when it is
+// ingested, or why it is skipped.
+type archiveEntry struct {
+	Path    string
+	Content string
+	Skipped string
+}
+
+// archiveReport is the response to an archive upload, one outcome per file.
+type archiveReport struct {
+	Archive   string            `json:"archive"`
+	Documents []documentOutcome `json:"documents"`
+}
+
+// isArchive reports whether an uploaded file is a zip or gzipped tar archive.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// isSupportedText reports whether a file is one the upload pipeline reads as text.
+func isSupportedText(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".txt", ".md":
+		return true
+	}
+	return false
+}
+
+// uploadedArchive returns the archive uploaded in "files", or nil when the
+// upload is not a single archive.
+func uploadedArchive(r *http.Request) *multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	files := r.MultipartForm.File["files"]
+	if len(files) != 1 || !isArchive(files[0].Filename) {
+		return nil
+	}
+	return files[0]
+}
+
+// readArchive extracts the files of a zip or tar.gz archive. Directories and
+// hidden files (including macOS resource forks) are left out; files that are
+// not .txt or .md, whose content is not text, or whose path is unusable as a
+// document name are returned as skipped. The extracted content is bounded by
+// maxInflatedBody in total.
+func readArchive(fh *multipart.FileHeader) ([]archiveEntry, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	budget := int64(maxInflatedBody)
+	var entries []archiveEntry
+	add := func(name string, open func() (io.ReadCloser, error)) error {
+		p, skip, hidden := archivePath(name)
+		if hidden {
+			return nil
+		}
+		if len(entries) == maxArchiveFiles {
+			return statusErrorf(http.StatusBadRequest, "archive holds more than %d files", maxArchiveFiles)
+		}
+		if skip != "" {
+			entries = append(entries, archiveEntry{Path: p, Skipped: skip})
+			return nil
+		}
+		rc, err := open()
+		if err != nil {
+			return statusErrorf(http.StatusBadRequest, "%s: %v", p, err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(io.LimitReader(rc, budget+1))
+		if err != nil {
+			return statusErrorf(http.StatusBadRequest, "%s: %v", p, err)
+		}
+		if budget -= int64(len(b)); budget < 0 {
+			return statusErrorf(http.StatusRequestEntityTooLarge, "archive expands beyond %d bytes", maxInflatedBody)
+		}
+		text, err := decodeText(b)
+		if err != nil {
+			entries = append(entries, archiveEntry{Path: p, Skipped: err.Error()})
+			return nil
+		}
+		entries = append(entries, archiveEntry{Path: p, Content: text})
+		return nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(fh.Filename), ".zip") {
+		zr, err := zip.NewReader(f, fh.Size)
+		if err != nil {
+			return nil, statusErrorf(http.StatusBadRequest, "invalid zip archive: %v", err)
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			if err := add(zf.Name, zf.Open); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid tar.gz archive: %v", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, statusErrorf(http.StatusBadRequest, "invalid tar.gz archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := add(hdr.Name, func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// archivePath cleans the path of an archive member into the document name it
+// is ingested under. skip says why the file is not ingested; hidden files are
+// not reported at all.
+func archivePath(name string) (p, skip string, hidden bool) {
+	p = path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	p = strings.TrimPrefix(p, "./")
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, ".") && seg != "." && seg != ".." || seg == "__MACOSX" {
+			return p, "", true
+		}
+	}
+	switch {
+	case path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../"):
+		return p, "path leaves the archive", false
+	case len(p) > maxDocumentID:
+		return p, fmt.Sprintf("path is too long (max %d bytes)", maxDocumentID), false
+	case !isSupportedText(p):
+		return p, "unsupported file type; only .txt and .md are ingested", false
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if err := validateDocumentID(seg); err != nil {
+			return p, "unusable path: " + err.Error(), false
+		}
+	}
+	return p, "", false
+}
+
+// ingestArchive ingests every supported file of an uploaded archive as its own
+// document, named by its path in the archive, with base supplying the chunking
+// parameters and metadata shared by all of them. Each file is ingested on its
+// own, so a failure does not undo the ones before it; the response reports
+// every file, with the status of the first failure.
+func (s *Server) ingestArchive(w http.ResponseWriter, r *http.Request, fh *multipart.FileHeader, base ingestRequest) {
+	entries, err := readArchive(fh)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if !slices.ContainsFunc(entries, func(e archiveEntry) bool { return e.Skipped == "" }) {
+		http.Error(w, "archive contains no .txt or .md files", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Archive %s: %d files", fh.Filename, len(entries))
+
+	status := http.StatusOK
+	report := archiveReport{Archive: fh.Filename, Documents: make([]documentOutcome, len(entries))}
+	for i, e := range entries {
+		if e.Skipped != "" {
+			report.Documents[i] = documentOutcome{ID: e.Path, Skipped: e.Skipped}
+			continue
+		}
+		req := base
+		req.FileName = e.Path
+		req.Content = e.Content
+		req.Attributes = append(slices.Clip(base.Attributes),
+			chroma.NewStringAttribute(metaArchive, fh.Filename),
+			chroma.NewStringAttribute(metaArchivePath, e.Path),
+		)
+		res, err := s.ingest(r.Context(), req)
+		report.Documents[i] = res.outcome()
+		if err != nil {
+			report.Documents[i].Error = err.Error()
+			if status == http.StatusOK {
+				status = errorStatus(err)
+			}
+		}
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one ingestion attempt.
+type AuditEntry struct {
+	Time       time.Time  `json:"time"`
+	Who        string     `json:"who"`
+	Action     string     `json:"action"` // "upload", "alias", "delete", "sync", "reindex"
+	Document   string     `json:"document"`
+	SHA256     string     `json:"sha256,omitempty"`
+	Chunks     int        `json:"chunks"`
+	Chunking   string     `json:"chunking,omitempty"`
+	Model      string     `json:"model,omitempty"`
+	DurationMS int64      `json:"duration_ms"`
+	Outcome    string     `json:"outcome"` // "ok" | "error"
+	Status     int        `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	RequestID  string     `json:"request_id,omitempty"`
+	Sync       *SyncStats `json:"sync,omitempty"` // what a "sync" run did
+}
+
+// The audit log is an append-only JSON Lines file under RAG_DATA_DIR, so the
+// history of how the knowledge base was built survives restarts without
+// running a database next to Chroma.
+
+func (s *Server) auditLogPath() string {
+	return filepath.Join(s.cfg.RAGDataDir, "audit.jsonl")
+}
+
+// appendAudit writes e to the audit log. Failures are logged, not returned:
+// auditing must never fail the request it describes.
+func (s *Server) appendAudit(e AuditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit: marshal failed: %v", err)
+		return
+	}
+
+	s.state.auditMu.Lock()
+	defer s.state.auditMu.Unlock()
+
+	path := s.auditLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// readAudit returns the entries matching keep, newest first.
+func (s *Server) readAudit(keep func(AuditEntry) bool) ([]AuditEntry, error) {
+	s.state.auditMu.Lock()
+	defer s.state.auditMu.Unlock()
+
+	f, err := os.Open(s.auditLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // skip a torn last line rather than hide the whole log
+		}
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, sc.Err()
+}
+
+type auditResponse struct {
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// auditHandler lists ingestion records, newest first, optionally filtered by
+// document and action, and paginated with limit and offset.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Audit request received")
+
+	limit, offset, err := readPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc := r.URL.Query().Get("document")
+	action := r.URL.Query().Get("action")
+
+	entries, err := s.readAudit(func(e AuditEntry) bool {
+		return (doc == "" || e.Document == doc) && (action == "" || e.Action == action)
+	})
+	if err != nil {
+		http.Error(w, "failed to read audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := []AuditEntry{}
+	if offset < len(entries) {
+		page = entries[offset:min(offset+limit, len(entries))]
+	}
+	writeJSON(w, http.StatusOK, auditResponse{Limit: limit, Offset: offset, Entries: page})
+}
+
+// callerIdentity names who made a request: the X-User-ID header when a proxy
+// in front of the service sets it, otherwise the client address.
+func callerIdentity(r *http.Request) string {
+	if u := strings.TrimSpace(r.Header.Get("X-User-ID")); u != "" {
+		return u
+	}
+	return r.RemoteAddr
+}
+
+func contentSHA256(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
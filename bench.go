@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// Benchmark limits, so a typo cannot tie up the embedding API for hours.
+const (
+	maxBenchDocuments   = 10000
+	maxBenchWords       = 100000
+	maxBenchQueries     = 10000
+	maxBenchConcurrency = 32
+)
+
+// BenchmarkRequest sizes a synthetic load test. Zero values take the defaults.
+type BenchmarkRequest struct {
+	Documents        int   `json:"documents"`          // default 20
+	WordsPerDocument int   `json:"words_per_document"` // default 1000
+	Queries          int   `json:"queries"`            // default 50
+	Concurrency      int   `json:"concurrency"`        // parallel documents/queries, default 4
+	Generate         bool  `json:"generate"`           // include the LLM answer stage in queries
+	Seed             int64 `json:"seed"`               // corpus and workload seed, default 1
+	Keep             bool  `json:"keep"`               // keep the benchmark collection afterwards
+}
+
+// StageStats summarizes the latencies of one pipeline stage, in milliseconds.
+type StageStats struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors,omitempty"`
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P95MS  float64 `json:"p95_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+// BenchmarkResult reports a finished benchmark.
+type BenchmarkResult struct {
+	Request    BenchmarkRequest      `json:"request"`
+	Collection string                `json:"collection"`
+	Chunks     int                   `json:"chunks"`
+	Ingest     map[string]StageStats `json:"ingest"` // chunk, embed, store, total (per document)
+	Query      map[string]StageStats `json:"query"`  // embed, retrieve, generate, total (per query)
+	IngestSecs float64               `json:"ingest_seconds"`
+	QuerySecs  float64               `json:"query_seconds"`
+	QueriesPS  float64               `json:"queries_per_second"`
+}
+
+func (r *BenchmarkRequest) applyDefaults() error {
+	if r.Documents == 0 {
+		r.Documents = 20
+	}
+	if r.WordsPerDocument == 0 {
+		r.WordsPerDocument = 1000
+	}
+	if r.Queries == 0 {
+		r.Queries = 50
+	}
+	if r.Concurrency == 0 {
+		r.Concurrency = 4
+	}
+	if r.Seed == 0 {
+		r.Seed = 1
+	}
+	switch {
+	case r.Documents < 1 || r.Documents > maxBenchDocuments:
+		return fmt.Errorf("documents must be 1..%d", maxBenchDocuments)
+	case r.WordsPerDocument < 1 || r.WordsPerDocument > maxBenchWords:
+		return fmt.Errorf("words_per_document must be 1..%d", maxBenchWords)
+	case r.Queries < 0 || r.Queries > maxBenchQueries:
+		return fmt.Errorf("queries must be 0..%d", maxBenchQueries)
+	case r.Concurrency < 1 || r.Concurrency > maxBenchConcurrency:
+		return fmt.Errorf("concurrency must be 1..%d", maxBenchConcurrency)
+	}
+	return nil
+}
+
+// -------------------- Synthetic corpus --------------------
+
+var (
+	benchTopics = []string{
+		"vacation", "payroll", "security", "onboarding", "travel", "expenses", "hardware",
+		"benefits", "compliance", "networking", "backups", "procurement", "training", "support",
+	}
+	benchNouns = []string{
+		"policy", "request", "approval", "manager", "employee", "system", "account", "report",
+		"deadline", "budget", "device", "contract", "team", "process", "ticket", "invoice",
+	}
+	benchVerbs = []string{
+		"requires", "covers", "limits", "allows", "describes", "updates", "reviews", "tracks",
+	}
+	benchModifiers = []string{
+		"annual", "monthly", "regional", "temporary", "mandatory", "optional", "remote", "internal",
+	}
+)
+
+// benchSentence is one synthetic sentence about topic.
+func benchSentence(rng *rand.Rand, topic string) string {
+	pick := func(words []string) string { return words[rng.IntN(len(words))] }
+	return fmt.Sprintf("The %s %s %s %s the %s %s within %d days.",
+		pick(benchModifiers), topic, pick(benchNouns), pick(benchVerbs),
+		pick(benchModifiers), pick(benchNouns), 1+rng.IntN(90))
+}
+
+// benchDocument generates a Markdown document of roughly words words, with a
+// heading per section so the structure-aware chunkers have something to use.
+func benchDocument(rng *rand.Rand, i, words int) (name, content string) {
+	topic := benchTopics[i%len(benchTopics)]
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s handbook %d\n\n", strings.ToUpper(topic[:1])+topic[1:], i+1)
+	n := 0
+	for section := 1; n < words; section++ {
+		fmt.Fprintf(&b, "## Section %d\n\n", section)
+		for p := 0; p < 4 && n < words; p++ {
+			s := benchSentence(rng, topic)
+			b.WriteString(s)
+			b.WriteString(" ")
+			n += len(strings.Fields(s))
+		}
+		b.WriteString("\n\n")
+	}
+	return fmt.Sprintf("bench-%05d.md", i+1), b.String()
+}
+
+// benchQuery is a synthetic question in the corpus's vocabulary.
+func benchQuery(rng *rand.Rand) string {
+	pick := func(words []string) string { return words[rng.IntN(len(words))] }
+	return fmt.Sprintf("What does the %s %s %s say about the %s?",
+		pick(benchModifiers), pick(benchTopics), pick(benchNouns), pick(benchNouns))
+}
+
+// -------------------- Timing --------------------
+
+// stageTimer collects latencies per stage from concurrent workers.
+type stageTimer struct {
+	mu     sync.Mutex
+	times  map[string][]time.Duration
+	errors map[string]int
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{times: map[string][]time.Duration{}, errors: map[string]int{}}
+}
+
+// time runs fn and records its latency, or an error, under stage.
+func (t *stageTimer) time(stage string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.errors[stage]++
+		return err
+	}
+	t.times[stage] = append(t.times[stage], d)
+	return nil
+}
+
+func (t *stageTimer) stats() map[string]StageStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]StageStats{}
+	for stage, ds := range t.times {
+		out[stage] = latencyStats(ds, t.errors[stage])
+	}
+	for stage, n := range t.errors {
+		if _, ok := out[stage]; !ok {
+			out[stage] = StageStats{Errors: n}
+		}
+	}
+	return out
+}
+
+func latencyStats(ds []time.Duration, errors int) StageStats {
+	s := StageStats{Count: len(ds), Errors: errors}
+	if len(ds) == 0 {
+		return s
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	// nearest-rank percentiles
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(sorted))+0.999999) - 1
+		return sorted[min(max(i, 0), len(sorted)-1)]
+	}
+	s.MeanMS = ms(total / time.Duration(len(sorted)))
+	s.P50MS = ms(rank(0.50))
+	s.P95MS = ms(rank(0.95))
+	s.MaxMS = ms(sorted[len(sorted)-1])
+	return s
+}
+
+// forEach runs fn(i) for i in [0, n) on up to workers goroutines, stopping
+// early when ctx is done.
+func forEach(ctx context.Context, n, workers int, fn func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// -------------------- Runner --------------------
+
+// runBenchmark ingests a synthetic corpus into a dedicated collection and then
+// replays a query workload against it, timing each pipeline stage. Embedding
+// bypasses the cache so the numbers reflect the real embedding backend.
+// Classification and the audit log are skipped; they are not on the hot path.
+func (s *Server) runBenchmark(ctx context.Context, req BenchmarkRequest) (BenchmarkResult, error) {
+	res := BenchmarkResult{
+		Request:    req,
+		Collection: "bench_" + newJobID(),
+	}
+
+	coll, err := s.chroma.GetOrCreateCollection(ctx, res.Collection, collectionCreateOptions(s.cfg)...)
+	if err != nil {
+		return res, fmt.Errorf("creating benchmark collection: %w", err)
+	}
+	if !req.Keep {
+		defer func() {
+			// the request context may be gone by now
+			if err := s.chroma.DeleteCollection(context.Background(), res.Collection); err != nil {
+				log.Printf("failed to delete benchmark collection %s: %v", res.Collection, err)
+			}
+		}()
+	}
+
+	chunker, err := s.newChunker(s.cfg.chunkParams())
+	if err != nil {
+		return res, err
+	}
+
+	// generate the corpus up front so generation is not part of the timings
+	rng := rand.New(rand.NewPCG(uint64(req.Seed), 0))
+	names := make([]string, req.Documents)
+	contents := make([]string, req.Documents)
+	for i := range names {
+		names[i], contents[i] = benchDocument(rng, i, req.WordsPerDocument)
+	}
+	queries := make([]string, req.Queries)
+	for i := range queries {
+		queries[i] = benchQuery(rng)
+	}
+
+	// 1) Ingest
+	ingestTimer := newStageTimer()
+	var chunksMu sync.Mutex
+	start := time.Now()
+	forEach(ctx, len(names), req.Concurrency, func(i int) {
+		_ = ingestTimer.time("total", func() error {
+			var chunks []Chunk
+			_ = ingestTimer.time("chunk", func() error {
+				chunks = chunker.Chunk(names[i], contents[i])
+				return nil
+			})
+
+			var vecs map[string][]float32
+			if err := ingestTimer.time("embed", func() (err error) {
+				vecs, err = s.embedder.Embed(ctx, chunks)
+				return err
+			}); err != nil {
+				log.Printf("benchmark: embedding %s failed: %v", names[i], err)
+				return err
+			}
+
+			ids := make([]chroma.DocumentID, 0, len(chunks))
+			embs := make([]embeddings.Embedding, 0, len(chunks))
+			texts := make([]string, 0, len(chunks))
+			metas := make([]chroma.DocumentMetadata, 0, len(chunks))
+			for _, c := range chunks {
+				vec, ok := vecs[c.ID]
+				if !ok {
+					return fmt.Errorf("missing embedding for chunk %s", c.ID)
+				}
+				emb, quantAttrs := storedEmbedding(vec, s.cfg.EmbedQuantize)
+				ids = append(ids, chroma.DocumentID(c.ID))
+				embs = append(embs, emb)
+				texts = append(texts, c.Text)
+				metas = append(metas, chroma.NewDocumentMetadata(append([]*chroma.MetaAttribute{
+					chroma.NewStringAttribute("context", names[i]),
+					chroma.NewStringAttribute("doc_id", c.ID),
+				}, quantAttrs...)...))
+			}
+
+			if err := ingestTimer.time("store", func() error {
+				_, err := addInBatches(ctx, coll, s.cfg.ChromaBatchSize, ids, embs, texts, metas, nil)
+				return err
+			}); err != nil {
+				log.Printf("benchmark: storing %s failed: %v", names[i], err)
+				return err
+			}
+
+			chunksMu.Lock()
+			res.Chunks += len(ids)
+			chunksMu.Unlock()
+			return nil
+		})
+	})
+	res.IngestSecs = time.Since(start).Seconds()
+	res.Ingest = ingestTimer.stats()
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	// 2) Query
+	queryTimer := newStageTimer()
+	start = time.Now()
+	forEach(ctx, len(queries), req.Concurrency, func(i int) {
+		_ = queryTimer.time("total", func() error {
+			var qVec []float32
+			if err := queryTimer.time("embed", func() (err error) {
+				qVec, err = s.embedQuery(ctx, queries[i])
+				return err
+			}); err != nil {
+				return err
+			}
+
+			var hits []retrievedChunk
+			if err := queryTimer.time("retrieve", func() (err error) {
+				hits, err = s.queryCollection(ctx, coll, qVec, nil, 5)
+				return err
+			}); err != nil {
+				return err
+			}
+
+			if !req.Generate {
+				return nil
+			}
+			retrieved := make([]string, 0, len(hits))
+			for _, h := range hits {
+				retrieved = append(retrieved, h.Text)
+			}
+			return queryTimer.time("generate", func() error {
+				_, err := s.llm.Generate(ctx, buildPrompt(strings.Join(retrieved, "\n"), nil, queries[i]))
+				return err
+			})
+		})
+	})
+	res.QuerySecs = time.Since(start).Seconds()
+	res.Query = queryTimer.stats()
+	if n := res.Query["total"].Count; n > 0 && res.QuerySecs > 0 {
+		res.QueriesPS = float64(n) / res.QuerySecs
+	}
+	return res, ctx.Err()
+}
+
+// benchmarkHandler runs a synthetic load test and reports per-stage latencies.
+// It runs synchronously and may take minutes for large corpora; the benchmark
+// stops if the client disconnects.
+func (s *Server) benchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Benchmark request received")
+
+	defer r.Body.Close()
+
+	var req BenchmarkRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "expected {documents, words_per_document, queries, concurrency, generate, seed, keep}", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := req.applyDefaults(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.runBenchmark(r.Context(), req)
+	if err != nil {
+		http.Error(w, "benchmark failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
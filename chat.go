@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// chatTurn is a chat request whose context has been retrieved and whose
+// prompt is ready for generation.
+type chatTurn struct {
+	srv     *Server
+	req     ChatRequest
+	format  answerFormat
+	prompt  string
+	guard   *outputGuard
+	profile *Profile     // nil without one
+	resp    ChatResponse // context, citations and filter; the answer is added by finish
+}
+
+// prepareChat validates a normalized chat request, retrieves context for the
+// question and renders the prompt.
+func (s *Server) prepareChat(ctx context.Context, req ChatRequest) (*chatTurn, error) {
+	// the profile's format comes before the pipeline's: it is the request's
+	// choice of style, the pipeline the operator's defaults
+	profile, err := s.requestProfile(&req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	pipeName, pipe, err := s.requestPipeline(&req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	boost, err := s.requestRecency(req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	tmpl, err := s.requestTemplate(req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	format, err := requestFormat(req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	guard, err := s.requestGuard(req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	neighbors, err := s.requestNeighbors(req)
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	switch req.Verify {
+	case "", verifyEmbedding, verifyLLM:
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "invalid verify %q: want embedding or llm", req.Verify)
+	}
+
+	var debug *ChatDebug
+	if req.Debug {
+		debug = &ChatDebug{Query: req.Query, SearchQuery: req.Query, Candidates: []DebugChunk{}}
+	}
+	if req.WholeDoc && len(req.Collections) > 0 {
+		return nil, statusErrorf(http.StatusBadRequest, "whole_doc cannot be combined with collections")
+	}
+
+	// The prework is fanned out: a whole_doc document is fetched, the filter
+	// resolved and the question embedded concurrently, so a document that
+	// turns out small enough leaves the embedding unused. Self-query rewrites
+	// the search text, so its embedding waits for the rewrite, and its LLM call
+	// waits for the document so as not to be spent on one that is whole.
+	var (
+		hits       []retrievedChunk
+		whole      bool
+		searchText = req.Query
+		filter     *SelfQueryFilter
+		where      chroma.WhereClause
+		qVec       []float32
+		embedMS    float64
+	)
+	embed := func(ctx context.Context, text string) error {
+		start := time.Now()
+		vec, err := s.embedQuery(ctx, pipe.Embed.Prefix+text)
+		if err != nil {
+			return statusErrorf(http.StatusInternalServerError, "%v", err)
+		}
+		qVec, embedMS = vec, msSince(start)
+		return nil
+	}
+	selfQuery := req.SelfQuery
+	g, gctx := errgroup.WithContext(ctx)
+	if req.WholeDoc && selfQuery {
+		if hits, whole, err = s.wholeDocument(ctx, req.Doc); err != nil {
+			return nil, err
+		}
+	} else if req.WholeDoc {
+		doc := req.Doc
+		g.Go(func() (err error) {
+			hits, whole, err = s.wholeDocument(gctx, doc)
+			return err
+		})
+	}
+	if !(selfQuery && whole) {
+		g.Go(func() (err error) {
+			// 1) Resolve the filter, with any self-query restriction
+			searchText, filter = s.prepareRetrieval(gctx, &req)
+			if where, err = s.chatWhere(req); err != nil {
+				return statusErrorf(http.StatusBadRequest, "%v", err)
+			}
+			if selfQuery {
+				return embed(gctx, searchText)
+			}
+			return nil
+		})
+		if !selfQuery {
+			// 1b) Embed the question (the latest user turn) meanwhile
+			query := req.Query
+			g.Go(func() error { return embed(gctx, query) })
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	if !whole {
+		if debug != nil {
+			debug.SearchQuery = searchText
+			debug.EmbedMS = embedMS
+			if where != nil {
+				debug.Where, _ = where.MarshalJSON()
+			}
+		}
+
+		// 2) Query Chroma, narrowed by any metadata filters on the request,
+		// then rank the candidates
+		topK := req.topK
+		if topK == 0 {
+			topK = chatTopK
+		}
+		start := time.Now()
+		candidates, err := s.retrieveCandidates(ctx, qVec, where, req.Collections, topK, boost)
+		if err != nil {
+			return nil, statusErrorf(retrievalErrorStatus(err), "chroma query failed: %v", err)
+		}
+		if debug != nil {
+			// before ranking, which rescores and reorders candidates in place
+			sorted := slices.Clone(candidates)
+			sort.SliceStable(sorted, func(a, b int) bool { return sorted[a].Score > sorted[b].Score })
+			debug.Candidates = debugChunks(sorted)
+		}
+		hits = rankHits(candidates, topK, boost)
+		hits = pipe.rerank(hits)
+		// a failure only costs the neighbors
+		if hits, err = s.expandNeighbors(ctx, hits, neighbors); err != nil {
+			logf(ctx, "neighborhood expansion failed: %v", err)
+		}
+		hits = pipe.compress(req.Query, hits)
+		if debug != nil {
+			debug.RetrieveMS = msSince(start)
+		}
+	} else {
+		filter = nil
+		if debug != nil {
+			debug.Candidates = debugChunks(hits)
+		}
+	}
+
+	// 3) Pull retrieved texts (documents) and where they came from
+	retrieved := make([]string, 0, len(hits))
+	citations := make([]Citation, 0, len(hits))
+	for _, h := range hits {
+		retrieved = append(retrieved, h.Text)
+		citations = append(citations, h.citation(len(req.Collections) > 0))
+	}
+
+	// 4) Build the prompt
+	prompt, err := renderPrompt(tmpl, promptData{
+		Context:  strings.Join(retrieved, "\n"),
+		Chunks:   retrieved,
+		Question: req.Query,
+		History:  req.Messages,
+	})
+	if err != nil {
+		return nil, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	if instr := format.instruction(); instr != "" {
+		prompt += "\n\n" + instr
+	}
+	if debug != nil {
+		debug.Ranked = debugChunks(hits)
+		debug.Prompt = prompt
+		if profile != nil {
+			debug.System = profile.systemInstruction()
+		}
+	}
+
+	return &chatTurn{
+		srv:     s,
+		req:     req,
+		format:  format,
+		prompt:  prompt,
+		guard:   guard,
+		profile: profile,
+		resp:    ChatResponse{Context: retrieved, Citations: citations, Filter: filter, WholeDoc: whole, Pipeline: pipeName, Profile: req.Profile, Debug: debug},
+	}, nil
+}
+
+// generation returns ctx carrying what the answer's generation is asked to
+// follow: the output guard's limits and the profile.
+func (t *chatTurn) generation(ctx context.Context) context.Context {
+	ctx = t.guard.context(ctx)
+	if t.profile != nil {
+		ctx = t.profile.context(ctx)
+	}
+	return ctx
+}
+
+// finish shapes the generated (and guarded) answer for the requested format
+// and, if asked, verifies it. With retry, an answer the format rejects is
+// regenerated once with the error appended to the prompt.
+func (t *chatTurn) finish(ctx context.Context, answer string, retry bool) (ChatResponse, error) {
+	// 5) Shape the answer
+	formatted, data, err := t.format.apply(answer)
+	if err != nil && retry {
+		prompt := fmt.Sprintf("%s\n\nYour previous reply was rejected: %v. Reply again, following the format exactly.", t.prompt, err)
+		t.guard.reset()
+		if answer, err = t.srv.llm.Generate(t.generation(ctx), prompt); err != nil {
+			return ChatResponse{}, statusErrorf(http.StatusInternalServerError, "gemini failed: %v", err)
+		}
+		formatted, data, err = t.format.apply(t.guard.apply(answer))
+	}
+	if err != nil {
+		return ChatResponse{}, statusErrorf(http.StatusBadGateway, "%v", err)
+	}
+
+	resp := t.resp
+	resp.Answer = formatted
+	resp.Data = data
+	resp.Truncated = t.guard.truncated
+
+	// 6) Optionally check each sentence of a prose answer against the context;
+	// the answer is still useful if the check itself fails
+	if t.req.Verify != "" && data == nil {
+		if resp.Grounding, err = t.srv.verifyGrounding(ctx, t.req.Verify, formatted, resp.Context); err != nil {
+			logf(ctx, "grounding verification failed: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// answerChat runs the RAG pipeline for a normalized chat request: retrieve
+// context for the question, then have the LLM answer from it. The chat is
+// recorded in the query log.
+func (s *Server) answerChat(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	start := time.Now()
+	t, resp, err := s.generateChat(ctx, req)
+	s.logQuery(ctx, start, req, t, resp, err)
+	return resp, err
+}
+
+// generateChat is answerChat without the query log; t is nil when the request
+// failed before retrieval.
+func (s *Server) generateChat(ctx context.Context, req ChatRequest) (*chatTurn, ChatResponse, error) {
+	t, err := s.prepareChat(ctx, req)
+	if err != nil {
+		return nil, ChatResponse{}, err
+	}
+	start := time.Now()
+	var answer string
+	err = retryCall(ctx, "gemini generate", retryAlways, func() (err error) {
+		t.guard.reset()
+		answer, err = s.llm.Generate(t.generation(ctx), t.prompt)
+		return err
+	})
+	if err != nil {
+		resp, err := t.degrade(ctx, err)
+		return t, resp, err
+	}
+	answer = t.guard.apply(answer)
+	t.debugGeneration(start, answer, nil)
+	resp, err := t.finish(ctx, answer, true)
+	return t, resp, err
+}
+
+// generateStream streams the answer to t through onDelta, ending it where the
+// output guard cuts it. A failure before the first delta is retried like other
+// upstream calls; once text has been sent (sent is true) it cannot be taken
+// back, so a failure is final.
+func (t *chatTurn) generateStream(ctx context.Context, onDelta func(string) error) (answer string, usage *LLMUsage, sent bool, err error) {
+	var streamErr error
+	gctx := t.generation(ctx)
+	err = retryCall(ctx, "gemini stream", retryAlways, func() error {
+		t.guard.reset()
+		var err error
+		answer, usage, err = t.srv.llm.GenerateStream(gctx, t.prompt, func(delta string) error {
+			keep, done := t.guard.accept(delta)
+			if keep != "" {
+				sent = true
+				if err := onDelta(keep); err != nil {
+					return err
+				}
+			}
+			if done {
+				return errOutputComplete
+			}
+			return nil
+		})
+		if errors.Is(err, errOutputComplete) {
+			err = nil
+		}
+		if err != nil && sent {
+			streamErr = err
+			return nil
+		}
+		return err
+	})
+	if streamErr != nil {
+		err = streamErr
+	}
+	if err == nil {
+		answer = t.guard.apply(answer)
+	}
+	return answer, usage, sent, err
+}
+
+// sseWriter writes named Server-Sent Events with JSON data.
+type sseWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+// newSSEWriter starts an event stream, or returns false if w cannot stream.
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &sseWriter{w: w, f: f}, true
+}
+
+// send writes one event; an empty name writes an unnamed ("message") event.
+func (s *sseWriter) send(event string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		if _, err := fmt.Fprintf(s.w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", b); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+// chatContextEvent is the first event of a streamed chat answer.
+type chatContextEvent struct {
+	Context   []string         `json:"context"`
+	Citations []Citation       `json:"citations"`
+	Filter    *SelfQueryFilter `json:"filter,omitempty"`
+	WholeDoc  bool             `json:"whole_doc,omitempty"`
+}
+
+// chatDoneEvent is the terminal event of a streamed chat answer.
+type chatDoneEvent struct {
+	Answer            string          `json:"answer"`
+	AnswerUnavailable bool            `json:"answer_unavailable,omitempty"`
+	Truncated         bool            `json:"truncated,omitempty"`
+	Data              json.RawMessage `json:"data,omitempty"`
+	Usage             *LLMUsage       `json:"usage,omitempty"`
+	Grounding         *Grounding      `json:"grounding,omitempty"`
+	Debug             *ChatDebug      `json:"debug,omitempty"`
+}
+
+// streamChat answers a chat request as Server-Sent Events: a "context" event
+// with the retrieved chunks and citations, "token" events with answer deltas
+// as the LLM produces them, and a terminal "done" event with the final
+// (formatted) answer, token usage and grounding, or an "error" event.
+func (s *Server) streamChat(w http.ResponseWriter, r *http.Request, req ChatRequest) {
+	ctx := r.Context()
+	start := time.Now()
+	var (
+		t    *chatTurn
+		resp ChatResponse
+		err  error
+	)
+	defer func() { s.logQuery(ctx, start, req, t, resp, err) }()
+
+	// retrieval errors can still be answered with a plain HTTP status
+	if t, err = s.prepareChat(ctx, req); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		err = statusErrorf(http.StatusInternalServerError, "streaming unsupported")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fail := func(err error) {
+		_ = sse.send("error", map[string]string{"error": err.Error(), "request_id": requestID(ctx)})
+	}
+
+	if err := sse.send("context", chatContextEvent{Context: t.resp.Context, Citations: t.resp.Citations, Filter: t.resp.Filter, WholeDoc: t.resp.WholeDoc}); err != nil {
+		return
+	}
+
+	genStart := time.Now()
+	answer, usage, sent, err := t.generateStream(ctx, func(delta string) error {
+		return sse.send("token", map[string]string{"delta": delta})
+	})
+	if err != nil && !sent {
+		if resp, err = t.degrade(ctx, err); err != nil {
+			fail(err)
+			return
+		}
+		_ = sse.send("done", chatDoneEvent{Answer: resp.Answer, AnswerUnavailable: true, Debug: resp.Debug})
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("gemini failed: %w", err)
+		fail(err)
+		return
+	}
+	t.debugGeneration(genStart, answer, usage)
+
+	// the tokens are already out, so a rejected format cannot be retried
+	if resp, err = t.finish(ctx, answer, false); err != nil {
+		fail(err)
+		return
+	}
+	_ = sse.send("done", chatDoneEvent{Answer: resp.Answer, Truncated: resp.Truncated, Data: resp.Data, Usage: usage, Grounding: resp.Grounding, Debug: resp.Debug})
+}
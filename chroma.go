@@ -2,13 +2,33 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"time"
 
 	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	chhttp "github.com/amikos-tech/chroma-go/pkg/commons/http"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
 )
 
-func process(ctx context.Context) {
+// VectorStore is the part of a Chroma collection the server uses. Every
+// chroma.Collection is one; tests and other backends only need these methods.
+type VectorStore interface {
+	Name() string
+	Metadata() chroma.CollectionMetadata
+	Dimension() int
+	Add(ctx context.Context, opts ...chroma.CollectionAddOption) error
+	Update(ctx context.Context, opts ...chroma.CollectionUpdateOption) error
+	Delete(ctx context.Context, opts ...chroma.CollectionDeleteOption) error
+	Count(ctx context.Context) (int, error)
+	Get(ctx context.Context, opts ...chroma.CollectionGetOption) (chroma.GetResult, error)
+	Query(ctx context.Context, opts ...chroma.CollectionQueryOption) (chroma.QueryResult, error)
+}
+
+func process(ctx context.Context, collection chroma.Collection) {
 
 	err := collection.Add(ctx,
 		chroma.WithIDGenerator(chroma.NewULIDGenerator()),
@@ -42,3 +62,115 @@ func process(ctx context.Context) {
 		return
 	}
 }
+
+// andWhere combines the non-nil clauses into a single filter. Chroma rejects
+// $and with fewer than two operands, so zero or one clause is returned as is.
+func andWhere(clauses ...chroma.WhereClause) chroma.WhereClause {
+	var out []chroma.WhereClause
+	for _, c := range clauses {
+		if c != nil {
+			out = append(out, c)
+		}
+	}
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return out[0]
+	default:
+		return chroma.And(out...)
+	}
+}
+
+// chromaRetries is how many times a Chroma call is attempted before giving up.
+const chromaRetries = 3
+
+// withRetry runs the Chroma call fn like retryCall, giving up at once on
+// failures a retry cannot fix (see chromaRetryable).
+func withRetry(ctx context.Context, op string, fn func() error) error {
+	return retryCall(ctx, op, chromaRetryable, fn)
+}
+
+// chromaRetryable reports whether a failed Chroma call may succeed when made
+// again: Chroma did not answer, answered with a server error, or timed out.
+// Other answers, such as a 4xx for an invalid filter, and the errors the
+// client raises before sending anything fail the same way every time.
+func chromaRetryable(err error) bool {
+	var ce *chhttp.ChromaError
+	if errors.As(err, &ce) {
+		switch {
+		case ce.ErrorCode == 0, ce.ErrorCode >= 500:
+			return true
+		case ce.ErrorCode == http.StatusRequestTimeout, ce.ErrorCode == http.StatusTooManyRequests:
+			return true
+		}
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// retryAlways retries every failure, for upstreams whose errors do not tell
+// transient failures apart.
+func retryAlways(error) bool { return true }
+
+// retryCall runs fn until it succeeds, fails in a way retryable rejects, ctx
+// is done, or chromaRetries attempts have failed, backing off exponentially
+// between attempts.
+func retryCall(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	backoff := 200 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= chromaRetries; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == chromaRetries || !retryable(err) {
+			break
+		}
+		logf(ctx, "%s failed (attempt %d/%d), retrying in %s: %v", op, attempt, chromaRetries, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// addInBatches writes records to c in batches of batchSize, retrying each
+// batch on its own, so large documents neither exceed request size limits nor
+// lose all progress to one failure. It returns how many records were written;
+// onBatch, when set, is called with that number after each batch.
+func addInBatches(
+	ctx context.Context,
+	c VectorStore,
+	batchSize int,
+	ids []chroma.DocumentID,
+	embs []embeddings.Embedding,
+	texts []string,
+	metas []chroma.DocumentMetadata,
+	onBatch func(written int),
+) (int, error) {
+	if batchSize <= 0 {
+		batchSize = len(ids)
+	}
+	for i := 0; i < len(ids); i += batchSize {
+		j := min(i+batchSize, len(ids))
+		err := withRetry(ctx, "chroma add", func() error {
+			return c.Add(ctx,
+				chroma.WithIDs(ids[i:j]...),
+				chroma.WithEmbeddings(embs[i:j]...),
+				chroma.WithTexts(texts[i:j]...),
+				chroma.WithMetadatas(metas[i:j]...),
+			)
+		})
+		if err != nil {
+			return i, fmt.Errorf("batch %d-%d: %w", i, j, err)
+		}
+		if onBatch != nil {
+			onBatch(j)
+		}
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chunker splits a document into the chunks that get embedded and stored.
+type Chunker interface {
+	Chunk(docID, text string) []Chunk
+}
+
+// ChunkParams selects a chunking strategy and its parameters. The unit of Size
+// and Overlap depends on the strategy: sentences for "sentence", characters
+// (bytes) for "fixed".
+type ChunkParams struct {
+	Strategy string `json:"strategy"`
+	Size     int    `json:"chunk_size"`
+	Overlap  int    `json:"overlap"`
+}
+
+// defaultChunkParams are the built-in chunking parameters, used when the
+// config does not set CHUNK_STRATEGY.
+func defaultChunkParams() ChunkParams {
+	return ChunkParams{Strategy: "sentence", Size: defaultChunkSize("sentence"), Overlap: 0}
+}
+
+// chunkParams are the configured defaults for any parameter a request does not
+// set: CHUNK_STRATEGY, CHUNK_LENGTH and CHUNK_OVERLAP, where an unset length is
+// the strategy's default size.
+func (c Config) chunkParams() ChunkParams {
+	return ChunkParams{Strategy: c.ChunkStrategy, Size: c.ChunkLength, Overlap: c.ChunkOverlap}.withDefaults(defaultChunkParams())
+}
+
+// defaultChunkSize is the chunk size used when a strategy is chosen without one.
+func defaultChunkSize(strategy string) int {
+	if strategy == "fixed" {
+		return 800
+	}
+	return 2
+}
+
+func (p ChunkParams) Validate() error {
+	switch p.Strategy {
+	case "sentence", "fixed":
+	default:
+		return fmt.Errorf("unknown chunking strategy %q (want sentence or fixed)", p.Strategy)
+	}
+	if p.Size <= 0 {
+		return fmt.Errorf("chunk_size must be positive")
+	}
+	if p.Overlap < 0 || p.Overlap >= p.Size {
+		return fmt.Errorf("overlap must be between 0 and chunk_size-1")
+	}
+	return nil
+}
+
+// withDefaults fills in unset fields from def: an empty strategy becomes
+// def's, and a zero size becomes def's size for def's strategy or the
+// strategy's default size for any other.
+func (p ChunkParams) withDefaults(def ChunkParams) ChunkParams {
+	if p.Strategy == "" {
+		p.Strategy = def.Strategy
+	}
+	if p.Size == 0 {
+		if p.Strategy == def.Strategy && def.Size > 0 {
+			p.Size = def.Size
+		} else {
+			p.Size = defaultChunkSize(p.Strategy)
+		}
+	}
+	return p
+}
+
+// String identifies the parameters in cache keys and logs, e.g. "sentence/2/0".
+func (p ChunkParams) String() string {
+	return fmt.Sprintf("%s/%d/%d", p.Strategy, p.Size, p.Overlap)
+}
+
+// newChunker builds the Chunker for validated params. Either strategy keeps
+// tables whole (see tableChunker).
+func newChunker(p ChunkParams) (Chunker, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if p.Strategy == "fixed" {
+		return tableChunker{prose: &fixedChunker{size: p.Size, overlap: p.Overlap}}, nil
+	}
+	return tableChunker{prose: &sentenceChunker{sentencesPerChunk: p.Size, overlap: p.Overlap}}, nil
+}
+
+// sentenceChunker groups consecutive sentences into chunks of up to
+// sentencesPerChunk sentences each, repeating the last overlap sentences of a
+// chunk at the start of the next. Every chunk records where it came from
+// (title, heading path, page and offsets) so citations can point back into the
+// source document.
+type sentenceChunker struct {
+	sentencesPerChunk int
+	overlap           int
+}
+
+func (c *sentenceChunker) Chunk(docID, text string) []Chunk {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	layout := scanLayout(docID, text)
+	sentences := splitSentences(text)
+
+	var chunks []Chunk
+	var current []sentenceSpan
+	fresh := 0 // sentences in current that were not carried over from the previous chunk
+
+	flush := func() {
+		parts := make([]string, len(current))
+		for i, s := range current {
+			parts[i] = strings.Join(strings.Fields(text[s.start:s.end]), " ")
+		}
+		chunks = append(chunks, layout.chunk(docID, len(chunks), strings.Join(parts, " "), current[0].start, current[len(current)-1].end))
+		current = append([]sentenceSpan(nil), current[len(current)-c.overlap:]...)
+		fresh = 0
+	}
+
+	for _, s := range sentences {
+		current = append(current, s)
+		fresh++
+		if len(current) >= c.sentencesPerChunk {
+			flush()
+		}
+	}
+	if fresh > 0 {
+		flush()
+	}
+
+	return chunks
+}
+
+// fixedChunker cuts the text into windows of about size characters, moved back
+// to the nearest whitespace so words are not split, with overlap characters
+// shared between consecutive windows.
+type fixedChunker struct {
+	size, overlap int
+}
+
+func (c *fixedChunker) Chunk(docID, text string) []Chunk {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	layout := scanLayout(docID, text)
+
+	var chunks []Chunk
+	start := 0
+	for start < len(text) {
+		end := start + c.size
+		if end >= len(text) {
+			end = len(text)
+		} else if i := strings.LastIndexFunc(text[start:end], unicode.IsSpace); i > 0 {
+			end = start + i
+		} else {
+			for end < len(text) && !utf8.RuneStart(text[end]) {
+				end++
+			}
+		}
+
+		// trim surrounding whitespace so offsets point at the chunk's text
+		s, e := start, end
+		for s < e && isSpaceByte(text[s]) {
+			s++
+		}
+		for e > s && isSpaceByte(text[e-1]) {
+			e--
+		}
+		if s < e {
+			body := strings.Join(strings.Fields(text[s:e]), " ")
+			chunks = append(chunks, layout.chunk(docID, len(chunks), body, s, e))
+		}
+		if end == len(text) {
+			break
+		}
+
+		next := end - c.overlap
+		if next <= start {
+			next = end
+		}
+		// start the overlap on a word boundary
+		for next < end && !isSpaceByte(text[next-1]) {
+			next++
+		}
+		start = next
+	}
+	return chunks
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '\v'
+}
+
+// ChunkStats summarises the chunk lengths produced by one parameter set.
+type ChunkStats struct {
+	Count     int     `json:"count"`
+	MinTokens int     `json:"min_tokens"`
+	AvgTokens float64 `json:"avg_tokens"`
+	MaxTokens int     `json:"max_tokens"`
+}
+
+func chunkStats(chunks []Chunk) ChunkStats {
+	st := ChunkStats{Count: len(chunks)}
+	total := 0
+	for i, c := range chunks {
+		n := estimateTokens(c.Text)
+		total += n
+		if i == 0 || n < st.MinTokens {
+			st.MinTokens = n
+		}
+		if n > st.MaxTokens {
+			st.MaxTokens = n
+		}
+	}
+	if len(chunks) > 0 {
+		st.AvgTokens = float64(total) / float64(len(chunks))
+	}
+	return st
+}
+
+// estimateTokens approximates the token count of text as its number of
+// whitespace-separated words; good enough to compare chunkers, not to bill by.
+func estimateTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+// -------------------- Sentence segmentation --------------------
+
+// sentenceSpan is the byte range [start, end) of one sentence in the source text.
+type sentenceSpan struct {
+	start, end int
+}
+
+// abbreviations that end in a period without ending the sentence (lowercase,
+// without the trailing period).
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "sr": true, "jr": true,
+	"st": true, "vs": true, "etc": true, "e.g": true, "i.e": true, "cf": true, "al": true,
+	"inc": true, "ltd": true, "co": true, "corp": true, "dept": true, "fig": true, "figs": true,
+	"no": true, "nos": true, "vol": true, "approx": true, "est": true, "min": true, "max": true,
+	"jan": true, "feb": true, "mar": true, "apr": true, "jun": true, "jul": true, "aug": true,
+	"sep": true, "sept": true, "oct": true, "nov": true, "dec": true, "u.s": true, "a.m": true, "p.m": true,
+}
+
+// splitSentences segments text into sentences. A terminator (. ! ? …) only ends a
+// sentence when followed by whitespace and something that does not continue it,
+// so decimals ("3.14"), abbreviations ("Dr.", "e.g."), initials ("J. Smith") and
+// mid-sentence ellipses stay intact. Blank lines, page breaks and Markdown
+// heading lines also end a sentence.
+func splitSentences(text string) []sentenceSpan {
+	var spans []sentenceSpan
+	emit := func(start, end int) {
+		for start < end {
+			r, size := utf8.DecodeRuneInString(text[start:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			start += size
+		}
+		for end > start {
+			r, size := utf8.DecodeLastRuneInString(text[:end])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			end -= size
+		}
+		if start < end {
+			spans = append(spans, sentenceSpan{start: start, end: end})
+		}
+	}
+
+	sentStart, lineStart := 0, 0
+	for pos := 0; pos < len(text); {
+		r, size := utf8.DecodeRuneInString(text[pos:])
+		switch {
+		case r == '\f':
+			emit(sentStart, pos)
+			sentStart = pos + size
+		case r == '\n':
+			if isLineBreakBoundary(text, lineStart, pos) {
+				emit(sentStart, pos)
+				sentStart = pos + size
+			}
+			lineStart = pos + size
+		case isTerminator(r):
+			end := pos + size
+			run := 1
+			for end < len(text) {
+				r2, s2 := utf8.DecodeRuneInString(text[end:])
+				if !isTerminator(r2) {
+					break
+				}
+				end += s2
+				run++
+			}
+			for end < len(text) {
+				r2, s2 := utf8.DecodeRuneInString(text[end:])
+				if !strings.ContainsRune("\"')]}”’»", r2) {
+					break
+				}
+				end += s2
+			}
+			if isSentenceEnd(text, sentStart, pos, end, r == '.' && run == 1) {
+				emit(sentStart, end)
+				sentStart = end
+			}
+			pos = end
+			continue
+		}
+		pos += size
+	}
+	emit(sentStart, len(text))
+	return spans
+}
+
+func isTerminator(r rune) bool {
+	return r == '.' || r == '!' || r == '?' || r == '…'
+}
+
+// isSentenceEnd decides whether the terminator run text[pos:end] closes the
+// sentence that began at sentStart.
+func isSentenceEnd(text string, sentStart, pos, end int, singlePeriod bool) bool {
+	if end >= len(text) {
+		return true
+	}
+	if r, _ := utf8.DecodeRuneInString(text[end:]); !unicode.IsSpace(r) {
+		return false // "3.14", "example.com", "e.g.x"
+	}
+
+	if singlePeriod {
+		word := text[sentStart:pos]
+		if i := strings.LastIndexFunc(word, unicode.IsSpace); i >= 0 {
+			word = word[i+1:]
+		}
+		word = strings.TrimLeft(word, "\"'([{“‘«")
+		if abbreviations[strings.ToLower(word)] {
+			return false
+		}
+		if r, size := utf8.DecodeRuneInString(word); size == len(word) && unicode.IsUpper(r) {
+			return false // initial, e.g. "J. Smith"
+		}
+	}
+
+	// A lowercase continuation means the period was not a sentence end
+	// (e.g. an unknown abbreviation or "wait... what").
+	rest := strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+	if r, _ := utf8.DecodeRuneInString(rest); unicode.IsLower(r) {
+		return false
+	}
+	return true
+}
+
+// isLineBreakBoundary reports whether the newline at pos, ending the line that
+// starts at lineStart, also ends a sentence: after a heading, before a heading,
+// or at a blank line.
+func isLineBreakBoundary(text string, lineStart, pos int) bool {
+	line := strings.TrimSpace(text[lineStart:pos])
+	if line == "" || strings.HasPrefix(line, "#") {
+		return true
+	}
+	next := text[pos+1:]
+	if i := strings.IndexByte(next, '\n'); i >= 0 {
+		next = next[:i]
+	}
+	next = strings.TrimSpace(next)
+	return next == "" || strings.HasPrefix(next, "#")
+}
+
+// -------------------- Document layout --------------------
+
+// docLayout holds the structural landmarks of a document: its title, Markdown
+// headings and page breaks (form feeds), indexed by byte offset.
+type docLayout struct {
+	title      string
+	headings   []heading
+	pageBreaks []int
+}
+
+type heading struct {
+	offset, level int
+	text          string
+}
+
+func scanLayout(docID, text string) docLayout {
+	layout := docLayout{title: docID}
+	foundTitle := false
+
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			title := strings.TrimSpace(trimmed[level:])
+			if level <= 6 && title != "" {
+				layout.headings = append(layout.headings, heading{offset: offset, level: level, text: title})
+				if level == 1 && !foundTitle {
+					layout.title = title
+					foundTitle = true
+				}
+			}
+		}
+		offset += len(line)
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\f' {
+			layout.pageBreaks = append(layout.pageBreaks, i)
+		}
+	}
+	return layout
+}
+
+// chunk builds the index-th chunk of docID covering text[start:end].
+func (l docLayout) chunk(docID string, index int, body string, start, end int) Chunk {
+	return Chunk{
+		ID:       fmt.Sprintf("%s-%d", docID, index),
+		Text:     body,
+		Title:    l.title,
+		Headings: l.headingPath(start),
+		Page:     l.page(start),
+		Start:    start,
+		End:      end,
+	}
+}
+
+// headingPath returns the chain of headings in effect at offset, e.g. "Setup > Install".
+func (l docLayout) headingPath(offset int) string {
+	var path []heading
+	for _, h := range l.headings {
+		if h.offset > offset {
+			break
+		}
+		for len(path) > 0 && path[len(path)-1].level >= h.level {
+			path = path[:len(path)-1]
+		}
+		path = append(path, h)
+	}
+	names := make([]string, len(path))
+	for i, h := range path {
+		names[i] = h.text
+	}
+	return strings.Join(names, " > ")
+}
+
+// page returns the 1-based page number containing offset.
+func (l docLayout) page(offset int) int {
+	n := 1
+	for _, b := range l.pageBreaks {
+		if b >= offset {
+			break
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// classifySampleChars bounds how much of a document is sent to the LLM for
+// classification; the opening of a document is usually enough to tell its kind.
+const classifySampleChars = 4000
+
+// classifyDocument asks the LLM which of the configured categories apply to the
+// given text. Only names from categories are returned, in their configured spelling.
+func classifyDocument(ctx context.Context, llm LLM, categories []string, text string) ([]string, error) {
+	if len(categories) == 0 || llm == nil {
+		return nil, nil
+	}
+	if len(text) > classifySampleChars {
+		text = text[:classifySampleChars]
+	}
+
+	prompt := fmt.Sprintf(
+		"Categories:\n- %s\n\nDocument:\n%s\n\nWhich of the categories above describe this document? "+
+			"Reply with the matching category names separated by commas, or \"none\" if none apply.",
+		strings.Join(categories, "\n- "), text,
+	)
+
+	answer, err := llm.Generate(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+	return matchCategories(answer, categories), nil
+}
+
+// matchCategories maps a free-form LLM reply back onto the configured category names.
+func matchCategories(answer string, categories []string) []string {
+	byKey := make(map[string]string, len(categories))
+	for _, c := range categories {
+		byKey[strings.ToLower(strings.TrimSpace(c))] = c
+	}
+
+	var tags []string
+	seen := map[string]bool{}
+	for _, part := range strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == '\n' }) {
+		key := strings.ToLower(strings.Trim(strings.TrimSpace(part), "-*\"'."))
+		if c, ok := byKey[key]; ok && !seen[c] {
+			seen[c] = true
+			tags = append(tags, c)
+		}
+	}
+	return tags
+}
+
+// tagAttributeKey is the boolean metadata key marking a chunk with tag,
+// e.g. "HR policy" -> "tag_hr_policy". Chroma metadata cannot hold lists, so each
+// tag gets its own key that can be matched with an equality filter.
+func tagAttributeKey(tag string) string {
+	return attributeKey("tag_", tag)
+}
+
+// attributeKey turns name into a metadata key of lowercase letters, digits and
+// underscores after prefix.
+func attributeKey(prefix, name string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	lastUnderscore := true
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			lastUnderscore = false
+		} else if !lastUnderscore {
+			b.WriteByte('_')
+			lastUnderscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// tagAttributes returns the metadata attributes recording tags on a chunk.
+func tagAttributes(tags []string) []*chroma.MetaAttribute {
+	if len(tags) == 0 {
+		return nil
+	}
+	attrs := []*chroma.MetaAttribute{chroma.NewStringAttribute("tags", strings.Join(tags, ","))}
+	for _, t := range tags {
+		attrs = append(attrs, chroma.NewBoolAttribute(tagAttributeKey(t), true))
+	}
+	return attrs
+}
+
+// tagsWhere matches chunks carrying any of the given tags.
+func tagsWhere(tags []string) chroma.WhereClause {
+	var clauses []chroma.WhereClause
+	for _, t := range tags {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		clauses = append(clauses, chroma.EqBool(tagAttributeKey(t), true))
+	}
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		return clauses[0]
+	default:
+		return chroma.Or(clauses...)
+	}
+}
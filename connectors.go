@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncItem is one document a connector offers. Version, when the source
+// provides one (an S3 ETag), lets unchanged items be skipped without fetching
+// them; items without one are fetched and compared by content hash.
+type SyncItem struct {
+	Key     string // names the item within the source, e.g. an object key
+	Version string
+}
+
+// Connector lists and fetches the documents of an external source.
+type Connector interface {
+	List(ctx context.Context) ([]SyncItem, error)
+	Fetch(ctx context.Context, item SyncItem) (string, error)
+}
+
+// ConnectorFactory builds the Connector for a configured source; Deps can
+// register factories for further source types.
+type ConnectorFactory func(src SyncSource, cfg Config) (Connector, error)
+
+// errSkipItem marks an item a connector cannot ingest, such as a file type
+// the pipeline does not read; it is skipped rather than counted as failed.
+var errSkipItem = errors.New("unsupported content")
+
+// errItemGone marks a listed item whose content no longer exists, such as a
+// URL answering 404; its document is removed like that of an unlisted item.
+var errItemGone = errors.New("item no longer exists")
+
+// builtinConnectors are the source types available without registration.
+var builtinConnectors = map[string]ConnectorFactory{
+	"urls":  newURLConnector,
+	"s3":    newS3Connector,
+	"drive": newDriveConnector,
+}
+
+// connectorTimeout bounds one list or fetch call to a source.
+const connectorTimeout = 30 * time.Second
+
+var connectorHTTP = &http.Client{Timeout: connectorTimeout}
+
+// fetchText GETs url and returns the body if it is text the pipeline reads:
+// a .txt or .md path, or a text/plain or text/markdown response, whose content
+// is text (see decodeText).
+func fetchText(ctx context.Context, req *http.Request) (string, error) {
+	return fetchTextAs(ctx, req, req.URL.Path)
+}
+
+// fetchTextAs is fetchText for a download whose URL does not carry the file
+// name; name stands in for the path.
+func fetchTextAs(ctx context.Context, req *http.Request, name string) (string, error) {
+	setRequestIDHeader(ctx, req.Header)
+	resp, err := connectorHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return "", fmt.Errorf("%w: GET %s: %s", errItemGone, req.URL.Redacted(), resp.Status)
+	default:
+		return "", fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !isSupportedText(name) && mt != "text/plain" && mt != "text/markdown" {
+		return "", fmt.Errorf("%w: %s", errSkipItem, mt)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxUploadBytes {
+		return "", fmt.Errorf("%s is larger than %d bytes", req.URL.Redacted(), maxUploadBytes)
+	}
+	text, err := decodeText(b)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errSkipItem, err)
+	}
+	return text, nil
+}
+
+// -------------------- URL lists --------------------
+
+// urlConnector syncs a fixed list of URLs. The item key is the URL without
+// its scheme, so a document is named e.g. "handbook/example.com/docs/leave.md";
+// a path ending in "/" gets "index" appended.
+type urlConnector struct {
+	urls map[string]string // key -> URL
+}
+
+func newURLConnector(src SyncSource, _ Config) (Connector, error) {
+	if len(src.URLs) == 0 {
+		return nil, fmt.Errorf("urls is empty")
+	}
+	c := urlConnector{urls: map[string]string{}}
+	for _, raw := range src.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid url %q", raw)
+		}
+		key := u.Host + u.EscapedPath()
+		if strings.HasSuffix(key, "/") || u.Path == "" {
+			key = strings.TrimSuffix(key, "/") + "/index"
+		}
+		if u.RawQuery != "" {
+			key += "?" + u.RawQuery
+		}
+		c.urls[key] = u.String()
+	}
+	return c, nil
+}
+
+func (c urlConnector) List(context.Context) ([]SyncItem, error) {
+	items := make([]SyncItem, 0, len(c.urls))
+	for key := range c.urls {
+		items = append(items, SyncItem{Key: key})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, nil
+}
+
+func (c urlConnector) Fetch(ctx context.Context, item SyncItem) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.urls[item.Key], nil)
+	if err != nil {
+		return "", err
+	}
+	return fetchText(ctx, req)
+}
+
+// -------------------- S3 prefixes --------------------
+
+// s3Connector syncs the .txt and .md objects under a prefix of an S3 bucket,
+// or of an S3-compatible store at a custom endpoint (path-style). Requests
+// are signed with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY when set, and
+// anonymous otherwise (public buckets).
+type s3Connector struct {
+	base                       *url.URL // bucket URL, ending in "/"
+	region, prefix             string
+	accessKey, secret, session string
+}
+
+func newS3Connector(src SyncSource, cfg Config) (Connector, error) {
+	if src.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	region := src.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	raw := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", src.Bucket, region)
+	if src.Endpoint != "" {
+		raw = strings.TrimSuffix(src.Endpoint, "/") + "/" + url.PathEscape(src.Bucket) + "/"
+	}
+	base, err := url.Parse(raw)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", src.Endpoint)
+	}
+	return s3Connector{
+		base: base, region: region, prefix: src.Prefix,
+		accessKey: cfg.AWSAccessKeyID, secret: cfg.AWSSecretAccessKey, session: cfg.AWSSessionToken,
+	}, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (c s3Connector) List(ctx context.Context) ([]SyncItem, error) {
+	var items []SyncItem
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {c.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := *c.base
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		c.sign(req, time.Now())
+		setRequestIDHeader(ctx, req.Header)
+		resp, err := connectorHTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("listing %s: %s", u.Redacted(), resp.Status)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", u.Redacted(), err)
+		}
+		for _, o := range res.Contents {
+			if strings.HasSuffix(o.Key, "/") || !isSupportedText(o.Key) {
+				continue
+			}
+			items = append(items, SyncItem{Key: o.Key, Version: strings.Trim(o.ETag, `"`)})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return items, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c s3Connector) Fetch(ctx context.Context, item SyncItem) (string, error) {
+	u := c.base.JoinPath(strings.Split(item.Key, "/")...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	c.sign(req, time.Now())
+	return fetchText(ctx, req)
+}
+
+// sign adds an AWS Signature Version 4 to a GET request without a body. It
+// does nothing without credentials.
+func (c s3Connector) sign(req *http.Request, now time.Time) {
+	if c.accessKey == "" || c.secret == "" {
+		return
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	emptyHash := hex.EncodeToString(sha256.New().Sum(nil))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyHash)
+	if c.session != "" {
+		req.Header.Set("X-Amz-Security-Token", c.session)
+	}
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": emptyHash,
+		"x-amz-date":           amzDate,
+	}
+	if c.session != "" {
+		headers["x-amz-security-token"] = c.session
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		emptyHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secret), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signed, sig))
+}
+
+// canonicalQuery encodes q the way SigV4 expects: keys sorted, and every
+// character but A-Z a-z 0-9 - _ . ~ percent-encoded.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalPath encodes each segment of a path like canonicalQuery does.
+func canonicalPath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = awsEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// -------------------- Drive folders --------------------
+
+// driveAPI is the Google Drive v3 REST API.
+const driveAPI = "https://www.googleapis.com/drive/v3/"
+
+// driveScope is the OAuth scope a service account requests: read-only access
+// to the files shared with it.
+const driveScope = "https://www.googleapis.com/auth/drive.readonly"
+
+// driveFolderType and driveDocType are the MIME types Drive gives folders and
+// Google Docs, which are exported as plain text.
+const (
+	driveFolderType = "application/vnd.google-apps.folder"
+	driveDocType    = "application/vnd.google-apps.document"
+)
+
+// DriveCredentials is the part of a Google service account key file the
+// Drive connector uses.
+type DriveCredentials struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// loadDriveCredentials reads a service account key file; an empty path
+// configures none.
+func loadDriveCredentials(path string) (*DriveCredentials, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c DriveCredentials
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid key file: %w", err)
+	}
+	if c.ClientEmail == "" || c.PrivateKey == "" {
+		return nil, fmt.Errorf("key file lacks client_email or private_key")
+	}
+	if c.TokenURI == "" {
+		c.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("private_key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private_key: %w", err)
+	}
+	var ok bool
+	if c.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("private_key is not an RSA key")
+	}
+	return &c, nil
+}
+
+// driveConnector syncs the .txt and .md files and the Google Docs in a Drive
+// folder and its subfolders. It authenticates as the service account of
+// DRIVE_CREDENTIALS_FILE, which the folder must be shared with, or else with
+// DRIVE_API_KEY, which only reads folders shared with anyone who has the link.
+// Item keys are paths of file names below the folder.
+type driveConnector struct {
+	base   string // driveAPI, or a stand-in
+	folder string
+	creds  *DriveCredentials
+	apiKey string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	files   map[string]driveFile // by item key, as last listed
+}
+
+type driveFile struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	MD5Checksum  string `json:"md5Checksum"`
+	ModifiedTime string `json:"modifiedTime"`
+}
+
+func newDriveConnector(src SyncSource, cfg Config) (Connector, error) {
+	if src.Folder == "" {
+		return nil, fmt.Errorf("folder is required")
+	}
+	if cfg.DriveCredentials == nil && cfg.DriveAPIKey == "" {
+		return nil, fmt.Errorf("drive sources need DRIVE_CREDENTIALS_FILE or DRIVE_API_KEY")
+	}
+	return &driveConnector{
+		base:   driveAPI,
+		folder: src.Folder,
+		creds:  cfg.DriveCredentials,
+		apiKey: cfg.DriveAPIKey,
+	}, nil
+}
+
+func (c *driveConnector) List(ctx context.Context) ([]SyncItem, error) {
+	files := map[string]driveFile{}
+	if err := c.listFolder(ctx, c.folder, "", files); err != nil {
+		return nil, err
+	}
+	items := make([]SyncItem, 0, len(files))
+	for key, f := range files {
+		// Google Docs have no checksum; their modification time versions them
+		version := f.MD5Checksum
+		if version == "" {
+			version = f.ModifiedTime
+		}
+		items = append(items, SyncItem{Key: key, Version: version})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+
+	c.mu.Lock()
+	c.files = files
+	c.mu.Unlock()
+	return items, nil
+}
+
+// listFolder adds the files the connector reads in folder, and recursively in
+// its subfolders, to files under keys starting with path.
+func (c *driveConnector) listFolder(ctx context.Context, folder, path string, files map[string]driveFile) error {
+	token := ""
+	for {
+		q := url.Values{
+			"q":                         {fmt.Sprintf("'%s' in parents and trashed = false", strings.ReplaceAll(folder, "'", `\'`))},
+			"fields":                    {"nextPageToken, files(id, name, mimeType, md5Checksum, modifiedTime)"},
+			"pageSize":                  {"1000"},
+			"supportsAllDrives":         {"true"},
+			"includeItemsFromAllDrives": {"true"},
+		}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		var res struct {
+			Files         []driveFile `json:"files"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		if err := c.getJSON(ctx, "files?"+q.Encode(), &res); err != nil {
+			return fmt.Errorf("listing folder %s: %w", folder, err)
+		}
+		for _, f := range res.Files {
+			key := path + strings.ReplaceAll(f.Name, "/", "_")
+			switch {
+			case f.MimeType == driveFolderType:
+				if err := c.listFolder(ctx, f.ID, key+"/", files); err != nil {
+					return err
+				}
+				continue
+			case f.MimeType == driveDocType:
+			case isSupportedText(f.Name):
+			default:
+				continue
+			}
+			// Drive allows several files of the same name in a folder
+			if _, taken := files[key]; taken {
+				key += "~" + f.ID
+			}
+			files[key] = f
+		}
+		if res.NextPageToken == "" {
+			return nil
+		}
+		token = res.NextPageToken
+	}
+}
+
+func (c *driveConnector) Fetch(ctx context.Context, item SyncItem) (string, error) {
+	c.mu.Lock()
+	f, ok := c.files[item.Key]
+	c.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s was not listed", item.Key)
+	}
+	path := "files/" + url.PathEscape(f.ID) + "?alt=media&supportsAllDrives=true"
+	if f.MimeType == driveDocType {
+		path = "files/" + url.PathEscape(f.ID) + "/export?mimeType=text%2Fplain"
+	}
+	req, err := c.newRequest(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	// downloads come as application/octet-stream, so the name decides
+	name := f.Name
+	if f.MimeType == driveDocType {
+		name += ".txt"
+	}
+	return fetchTextAs(ctx, req, name)
+}
+
+func (c *driveConnector) getJSON(ctx context.Context, path string, v any) error {
+	req, err := c.newRequest(ctx, path)
+	if err != nil {
+		return err
+	}
+	setRequestIDHeader(ctx, req.Header)
+	resp, err := connectorHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// newRequest builds an authenticated GET of path below the API.
+func (c *driveConnector) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.creds == nil {
+		q := req.URL.Query()
+		q.Set("key", c.apiKey)
+		req.URL.RawQuery = q.Encode()
+		return req, nil
+	}
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+// accessToken returns an OAuth token of the service account, exchanging a
+// signed JWT for a new one when the last is about to expire.
+func (c *driveConnector) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.token != "" && now.Before(c.expires.Add(-time.Minute)) {
+		return c.token, nil
+	}
+
+	assertion, err := c.creds.signJWT(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := connectorHTTP.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("drive token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("drive token: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("drive token: %w", err)
+	}
+	c.token = tok.AccessToken
+	c.expires = now.Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// signJWT builds the RS256-signed assertion a service account trades for an
+// access token.
+func (c *DriveCredentials) signJWT(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   c.ClientEmail,
+		"scope": driveScope,
+		"aud":   c.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ChatDebug is what debug=true adds to a /chat response: the intermediate
+// result of each pipeline stage, so a bad answer can be traced to the stage
+// that went wrong.
+type ChatDebug struct {
+	Query       string          `json:"query"`           // the question as asked
+	SearchQuery string          `json:"search_query"`    // the text embedded for retrieval, after self_query rewrote it
+	Where       json.RawMessage `json:"where,omitempty"` // the metadata filter, before the caller's access is added
+
+	EmbedMS    float64 `json:"embed_ms"`
+	RetrieveMS float64 `json:"retrieve_ms"`
+	GenerateMS float64 `json:"generate_ms"`
+
+	Candidates []DebugChunk `json:"candidates"` // every hit fetched, by similarity, before re-ranking
+	Ranked     []DebugChunk `json:"ranked"`     // the hits kept after re-ranking, as they appear in the prompt
+
+	System string      `json:"system,omitempty"` // the profile's system instruction
+	Prompt string      `json:"prompt"`           // as sent to the LLM
+	Tokens DebugTokens `json:"tokens"`
+}
+
+// DebugChunk is a retrieved chunk with its text and scores.
+type DebugChunk struct {
+	Citation
+	Text string `json:"text"`
+}
+
+// DebugTokens counts the tokens of a chat answer: as reported by the LLM when
+// it streams, estimated otherwise.
+type DebugTokens struct {
+	Context    int `json:"context"`
+	Prompt     int `json:"prompt"`
+	Completion int `json:"completion"`
+}
+
+func debugChunks(hits []retrievedChunk) []DebugChunk {
+	out := make([]DebugChunk, 0, len(hits))
+	for _, h := range hits {
+		out = append(out, DebugChunk{Citation: h.citation(true), Text: h.Text})
+	}
+	return out
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// debugGeneration records the generation of answer, which took since start,
+// when the turn is being debugged.
+func (t *chatTurn) debugGeneration(start time.Time, answer string, usage *LLMUsage) {
+	d := t.resp.Debug
+	if d == nil {
+		return
+	}
+	d.GenerateMS = msSince(start)
+	d.Tokens.Context = estimateTokens(strings.Join(t.resp.Context, "\n"))
+	d.Tokens.Prompt = estimateTokens(t.prompt)
+	d.Tokens.Completion = estimateTokens(answer)
+	if usage != nil && usage.TotalTokens > 0 {
+		d.Tokens.Prompt, d.Tokens.Completion = usage.PromptTokens, usage.CompletionTokens
+	}
+}
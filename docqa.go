@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// maxWholeDocument bounds the text of a document put into the prompt whole
+// for whole_doc; larger documents are answered through retrieval as usual.
+const maxWholeDocument = 24 << 10
+
+// wholeDocument returns every chunk of document name in the default
+// collection, in document order, or ok=false when their text exceeds
+// maxWholeDocument. Excluded chunks are left out, and the caller's access
+// applies as for retrieval.
+func (s *Server) wholeDocument(ctx context.Context, name string) (hits []retrievedChunk, ok bool, err error) {
+	where := andWhere(notExcludedWhere(), documentsWhere([]string{name}))
+	size := 0
+	for offset := 0; ; offset += chromaPageSize {
+		var res chroma.GetResult
+		err := withRetry(ctx, "chroma get", func() (err error) {
+			res, err = s.store.Get(ctx,
+				chroma.WithWhereGet(where),
+				chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+				chroma.WithLimitGet(chromaPageSize),
+				chroma.WithOffsetGet(offset),
+			)
+			return err
+		})
+		if err != nil {
+			return nil, false, statusErrorf(http.StatusInternalServerError, "chroma get failed: %v", err)
+		}
+		docs, metas := res.GetDocuments(), res.GetMetadatas()
+		for i := range res.GetIDs() {
+			hit := retrievedChunk{Collection: s.store.Name(), Score: 1}
+			if i < len(docs) && docs[i] != nil {
+				hit.Text = docs[i].ContentString()
+			}
+			if i < len(metas) {
+				hit.Metadata = metas[i]
+			}
+			if size += len(hit.Text); size > maxWholeDocument {
+				return nil, false, nil
+			}
+			hits = append(hits, hit)
+		}
+		if len(res.GetIDs()) < chromaPageSize {
+			break
+		}
+	}
+	if len(hits) == 0 {
+		return nil, false, statusErrorf(http.StatusNotFound, "document not found: %s", name)
+	}
+
+	sort.SliceStable(hits, func(a, b int) bool {
+		return chunkStart(hits[a].Metadata) < chunkStart(hits[b].Metadata)
+	})
+	return hits, true, nil
+}
+
+func chunkStart(meta chroma.DocumentMetadata) int64 {
+	if meta == nil {
+		return 0
+	}
+	start, _ := meta.GetInt("start")
+	return start
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// StoredChunk is a chunk as stored in Chroma.
+type StoredChunk struct {
+	ID       string         `json:"id"`
+	Text     string         `json:"text"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type documentChunksResponse struct {
+	Document string        `json:"document"`
+	Total    int           `json:"total"` // chunks of the document across all pages
+	Limit    int           `json:"limit"`
+	Offset   int           `json:"offset"`
+	Chunks   []StoredChunk `json:"chunks"`
+}
+
+// DocumentSummary describes one stored document in the document listing.
+type DocumentSummary struct {
+	Document   string    `json:"document"`
+	Title      string    `json:"title,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Chunks     int       `json:"chunks"`
+	IngestedAt time.Time `json:"ingested_at,omitzero"` // latest ingestion of any of its chunks
+	Aliases    []string  `json:"aliases,omitempty"`    // other names it was uploaded as
+}
+
+type documentsResponse struct {
+	Total     int               `json:"total"` // documents across all pages
+	Limit     int               `json:"limit"`
+	Offset    int               `json:"offset"`
+	Documents []DocumentSummary `json:"documents"`
+}
+
+// documentsHandler serves GET (list) and POST (ingest JSON) on /documents.
+func (s *Server) documentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listDocumentsHandler(w, r)
+	case http.MethodPost:
+		s.requireQuota(budgetEmbed, s.createDocumentsHandler)(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listDocumentsHandler lists the stored documents by name, paginated with the
+// limit and offset query parameters. Chroma has no grouping, so every call
+// scans the chunk metadata of the whole collection.
+func (s *Server) listDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("List documents request received")
+
+	limit, offset, err := readPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	docs, err := summarizeDocuments(r.Context(), s.store)
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var latest time.Time
+	for _, d := range docs {
+		if d.IngestedAt.After(latest) {
+			latest = d.IngestedAt
+		}
+	}
+	page := docs[min(offset, len(docs)):min(offset+limit, len(docs))]
+	writeJSONWithETag(w, r, documentsResponse{
+		Total:     len(docs),
+		Limit:     limit,
+		Offset:    offset,
+		Documents: page,
+	}, latest)
+}
+
+// summarizeDocuments pages through the metadata of collection c and groups
+// the chunks by document, sorted by name.
+func summarizeDocuments(ctx context.Context, c VectorStore) ([]DocumentSummary, error) {
+	byName := map[string]*DocumentSummary{}
+	for offset := 0; ; offset += chromaPageSize {
+		res, err := c.Get(ctx,
+			chroma.WithIncludeGet(chroma.IncludeMetadatas),
+			chroma.WithLimitGet(chromaPageSize),
+			chroma.WithOffsetGet(offset),
+		)
+		if err != nil {
+			return nil, err
+		}
+		metas := res.GetMetadatas()
+		for _, m := range metas {
+			if m == nil {
+				continue
+			}
+			name, ok := m.GetString("context")
+			if !ok || name == "" {
+				continue
+			}
+			d := byName[name]
+			if d == nil {
+				d = &DocumentSummary{Document: name}
+				d.Title, _ = m.GetString("title")
+				d.Namespace, _ = m.GetString("namespace")
+				aliases, _ := m.GetString(metaAliases)
+				d.Aliases = parseAliases(aliases)
+				byName[name] = d
+			}
+			d.Chunks++
+			if at := lastIngested([]chroma.DocumentMetadata{m}); at.After(d.IngestedAt) {
+				d.IngestedAt = at
+			}
+		}
+		if len(res.GetIDs()) < chromaPageSize {
+			break
+		}
+	}
+
+	out := make([]DocumentSummary, 0, len(byName))
+	for _, d := range byName {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Document < out[j].Document })
+	return out, nil
+}
+
+// documentChunksHandler lists the stored chunks of one document, paginated with
+// the limit and offset query parameters.
+func (s *Server) documentChunksHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Document chunks request received")
+
+	ctx := r.Context()
+	name := r.PathValue("name")
+
+	limit, offset, err := readPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.store.Get(ctx,
+		chroma.WithWhereGet(chroma.EqString("context", name)),
+		chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+		chroma.WithLimitGet(limit),
+		chroma.WithOffsetGet(offset),
+	)
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chunks := storedChunks(res)
+	if len(chunks) == 0 && offset == 0 {
+		http.Error(w, "document not found: "+name, http.StatusNotFound)
+		return
+	}
+
+	// a short first page is the whole document; otherwise count the rest
+	total := len(chunks)
+	if offset > 0 || len(chunks) == limit {
+		ids, err := collectionIDs(ctx, s.store, chroma.EqString("context", name))
+		if err != nil {
+			http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total = len(ids)
+	}
+
+	writeJSONWithETag(w, r, documentChunksResponse{
+		Document: name,
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+		Chunks:   chunks,
+	}, lastIngested(res.GetMetadatas()))
+}
+
+// writeJSONWithETag writes v like writeJSON with status 200, plus an ETag
+// hashed from the encoded body and, unless modified is zero, Last-Modified. A
+// request whose If-None-Match already names the ETag gets 304 Not Modified and
+// no body, so polling clients skip unchanged data. The ETag is weak because
+// the body may be sent gzip-compressed.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v any, modified time.Time) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
+
+// etagMatches reports whether an If-None-Match header names etag, comparing
+// weakly as RFC 9110 prescribes for If-None-Match.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// lastIngested is the latest ingestion time among chunks, or zero if none
+// records one.
+func lastIngested(metas []chroma.DocumentMetadata) time.Time {
+	var latest int64
+	for _, m := range metas {
+		if m == nil {
+			continue
+		}
+		if v, ok := m.GetInt(metaIngestedAt); ok && v > latest {
+			latest = v
+		}
+	}
+	if latest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(latest, 0)
+}
+
+// readPage reads the limit and offset query parameters.
+func readPage(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// storedChunks converts a Chroma get result into StoredChunks.
+func storedChunks(res chroma.GetResult) []StoredChunk {
+	ids := res.GetIDs()
+	docs := res.GetDocuments()
+	metas := res.GetMetadatas()
+
+	out := make([]StoredChunk, 0, len(ids))
+	for i, id := range ids {
+		c := StoredChunk{ID: string(id)}
+		if i < len(docs) && docs[i] != nil {
+			c.Text = docs[i].ContentString()
+		}
+		if i < len(metas) {
+			c.Metadata = metadataMap(metas[i])
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// metadataMap flattens chunk metadata into a plain map for JSON responses.
+func metadataMap(meta chroma.DocumentMetadata) map[string]any {
+	out := map[string]any{}
+	if meta == nil {
+		return out
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return out
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	_ = dec.Decode(&out)
+	return out
+}
+
+// reservedMetadataKeys are written by the ingestion pipeline and cannot be
+// changed through PATCH /documents/{name}.
+var reservedMetadataKeys = map[string]bool{
+	"context": true, "doc_id": true, "len": true, "title": true, "headings": true,
+	"page": true, "start": true, "end": true,
+	"excluded": true, "excluded_reason": true, "excluded_at": true, "source_path": true,
+	metaQuantScale: true, metaIngestedAt: true, metaEmbedProvider: true,
+	metaArchive: true, metaArchivePath: true,
+	metaACLRestricted: true, metaACLOwner: true, metaACLGroups: true,
+	metaTenant: true, metaChunkTitle: true, metaChunkSummary: true, metaTable: true,
+	metaContentSHA256: true, metaAliases: true,
+}
+
+type patchDocumentRequest struct {
+	// Metadata holds the attributes to set on every chunk of the document.
+	// A null value removes the attribute. "tags" takes a list of strings and
+	// replaces the document's tags; "expires_at" and "doc_date" take a date
+	// (YYYY-MM-DD) or RFC 3339 timestamp and are stored as Unix seconds.
+	Metadata map[string]json.RawMessage `json:"metadata"`
+}
+
+type patchDocumentResponse struct {
+	Document string `json:"document"`
+	Updated  int    `json:"updated"`
+}
+
+// patchDocumentHandler sets or removes metadata attributes on all chunks of a
+// document in place, without re-ingesting it.
+func (s *Server) patchDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Patch document request received")
+
+	defer r.Body.Close()
+	ctx := r.Context()
+	name := r.PathValue("name")
+
+	var req patchDocumentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Metadata) == 0 {
+		http.Error(w, "expected {\"metadata\": {...}}", http.StatusBadRequest)
+		return
+	}
+
+	attrs, newTags, replaceTags, err := metadataUpdates(req.Metadata, s.defaultSchema())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chunks, err := getAllChunks(ctx, s.store, chroma.EqString("context", name))
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(chunks) == 0 {
+		http.Error(w, "document not found: "+name, http.StatusNotFound)
+		return
+	}
+	for _, c := range chunks {
+		if !mayModify(ctx, c.Metadata) {
+			http.Error(w, "you may not modify "+name, http.StatusForbidden)
+			return
+		}
+	}
+
+	ids := make([]chroma.DocumentID, 0, len(chunks))
+	metas := make([]chroma.DocumentMetadata, 0, len(chunks))
+	for _, c := range chunks {
+		chunkAttrs := append([]*chroma.MetaAttribute(nil), attrs...)
+		if replaceTags {
+			// drop the per-tag keys of the old tags before writing the new ones
+			if old, ok := c.Metadata["tags"].(string); ok && old != "" {
+				for _, t := range strings.Split(old, ",") {
+					chunkAttrs = append(chunkAttrs, chroma.RemoveAttribute(tagAttributeKey(t)))
+				}
+			}
+			if len(newTags) == 0 {
+				chunkAttrs = append(chunkAttrs, chroma.RemoveAttribute("tags"))
+			}
+			chunkAttrs = append(chunkAttrs, tagAttributes(newTags)...)
+		}
+		ids = append(ids, chroma.DocumentID(c.ID))
+		metas = append(metas, chroma.NewDocumentMetadata(chunkAttrs...))
+	}
+
+	for i := 0; i < len(ids); i += chromaPageSize {
+		j := min(i+chromaPageSize, len(ids))
+		err := s.store.Update(ctx,
+			chroma.WithIDsUpdate(ids[i:j]...),
+			chroma.WithMetadatasUpdate(metas[i:j]...),
+		)
+		if err != nil {
+			http.Error(w, "chroma update failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, patchDocumentResponse{Document: name, Updated: len(ids)})
+}
+
+// metadataUpdates converts a PATCH or upload metadata object into attributes,
+// checked against schema when the collection has one. Tags are returned
+// separately because replacing them depends on each chunk's old tags.
+func metadataUpdates(in map[string]json.RawMessage, schema *MetadataSchema) (attrs []*chroma.MetaAttribute, tags []string, replaceTags bool, err error) {
+	for key, raw := range in {
+		switch {
+		case reservedMetadataKeys[key] || strings.HasPrefix(key, aclGroupPrefix) || strings.HasPrefix(key, aliasKeyPrefix):
+			return nil, nil, false, fmt.Errorf("metadata key %q is managed by ingestion and cannot be changed", key)
+		case strings.HasPrefix(key, "tag_"):
+			return nil, nil, false, fmt.Errorf("set tags through the \"tags\" key, not %q", key)
+		case key == "tags":
+			replaceTags = true
+			if string(raw) != "null" {
+				if err := json.Unmarshal(raw, &tags); err != nil {
+					return nil, nil, false, fmt.Errorf("tags must be a list of strings")
+				}
+			}
+			continue
+		case key == "expires_at" || key == metaDocDate:
+			if string(raw) == "null" {
+				attrs = append(attrs, chroma.RemoveAttribute(key))
+				continue
+			}
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, nil, false, fmt.Errorf("%s must be a date string", key)
+			}
+			t, err := parseTimestamp(s)
+			if err != nil {
+				return nil, nil, false, fmt.Errorf("%s: %w", key, err)
+			}
+			attrs = append(attrs, chroma.NewIntAttribute(key, t.Unix()))
+			continue
+		}
+
+		attr, err := schema.attribute(key, raw)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, tags, replaceTags, nil
+}
+
+// metadataAttribute converts a JSON scalar into a Chroma attribute; null removes the key.
+func metadataAttribute(key string, raw json.RawMessage) (*chroma.MetaAttribute, error) {
+	v, err := decodeScalar(key, raw)
+	if err != nil {
+		return nil, err
+	}
+	switch val := v.(type) {
+	case nil:
+		return chroma.RemoveAttribute(key), nil
+	case string:
+		return chroma.NewStringAttribute(key, val), nil
+	case bool:
+		return chroma.NewBoolAttribute(key, val), nil
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return chroma.NewIntAttribute(key, n), nil
+		}
+		f, err := val.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q: %w", key, err)
+		}
+		return chroma.NewFloatAttribute(key, f), nil
+	default:
+		return nil, fmt.Errorf("metadata %q must be a string, number, boolean or null", key)
+	}
+}
+
+// parseTimestamp accepts a date (YYYY-MM-DD) or an RFC 3339 timestamp.
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: want YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// getAllChunks pages through collection c and returns every chunk matching where.
+func getAllChunks(ctx context.Context, c VectorStore, where chroma.WhereClause) ([]StoredChunk, error) {
+	var out []StoredChunk
+	for offset := 0; ; offset += chromaPageSize {
+		res, err := c.Get(ctx,
+			chroma.WithWhereGet(where),
+			chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+			chroma.WithLimitGet(chromaPageSize),
+			chroma.WithOffsetGet(offset),
+		)
+		if err != nil {
+			return nil, err
+		}
+		page := storedChunks(res)
+		out = append(out, page...)
+		if len(page) < chromaPageSize {
+			return out, nil
+		}
+	}
+}
+
+// -------------------- Chunk tombstones --------------------
+
+type excludeChunkRequest struct {
+	Reason string `json:"reason"`
+}
+
+type excludeChunkResponse struct {
+	ID       string `json:"id"`
+	Excluded bool   `json:"excluded"`
+}
+
+// excludeChunkHandler marks a single chunk as excluded. The chunk stays stored
+// (and visible in chunk listings) but retrieval no longer returns it.
+func (s *Server) excludeChunkHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Exclude chunk request received")
+
+	defer r.Body.Close()
+	var req excludeChunkRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "expected {reason}", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.setChunkTombstone(w, r, chroma.NewDocumentMetadata(
+		chroma.NewBoolAttribute("excluded", true),
+		chroma.NewStringAttribute("excluded_reason", req.Reason),
+		chroma.NewIntAttribute("excluded_at", time.Now().Unix()),
+	), true)
+}
+
+// restoreChunkHandler lifts the exclusion set by excludeChunkHandler.
+func (s *Server) restoreChunkHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Restore chunk request received")
+
+	s.setChunkTombstone(w, r, chroma.NewDocumentMetadata(
+		chroma.RemoveAttribute("excluded"),
+		chroma.RemoveAttribute("excluded_reason"),
+		chroma.RemoveAttribute("excluded_at"),
+	), false)
+}
+
+func (s *Server) setChunkTombstone(w http.ResponseWriter, r *http.Request, meta chroma.DocumentMetadata, excluded bool) {
+	ctx := r.Context()
+	id := chroma.DocumentID(r.PathValue("id"))
+
+	res, err := s.store.Get(ctx, chroma.WithIDsGet(id), chroma.WithIncludeGet(chroma.IncludeMetadatas))
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(res.GetIDs()) == 0 {
+		http.Error(w, "chunk not found: "+string(id), http.StatusNotFound)
+		return
+	}
+	if metas := res.GetMetadatas(); len(metas) == 0 || !mayModify(ctx, metadataMap(metas[0])) {
+		http.Error(w, "you may not modify chunk "+string(id), http.StatusForbidden)
+		return
+	}
+
+	err = s.store.Update(ctx, chroma.WithIDsUpdate(id), chroma.WithMetadatasUpdate(meta))
+	if err != nil {
+		http.Error(w, "chroma update failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, excludeChunkResponse{ID: string(id), Excluded: excluded})
+}
+
+// notExcludedWhere filters out tombstoned chunks. Chroma's $ne also matches
+// records that lack the key, so chunks that were never excluded still match.
+func notExcludedWhere() chroma.WhereClause {
+	return chroma.NotEqBool("excluded", true)
+}
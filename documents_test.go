@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// doAs sends a request to srv as the given user of tenant.
+func doAs(t *testing.T, srv *httptest.Server, user, tenant, method, path string, body any) int {
+	t.Helper()
+	var raw []byte
+	if body != nil {
+		raw, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", user)
+	req.Header.Set(headerTenant, tenant)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDocumentWritesNeedOwnership(t *testing.T) {
+	store := newFakeStore("test_writes")
+	srv := newTestServer(t, store, &fakeEmbedder{}, &fakeLLM{})
+
+	if code := doAs(t, srv, "alice", "acme", http.MethodPost, "/upload", map[string]string{"id": "otters.md", "text": testDocument}); code != http.StatusOK {
+		t.Fatalf("upload: status %d", code)
+	}
+	chunk := string(store.records[0].id)
+	patch := map[string]any{"metadata": map[string]string{"expires_at": "2020-01-01"}}
+
+	for _, tc := range []struct {
+		name, user, tenant, method, path string
+		body                             any
+		want                             int
+	}{
+		{"patch from another tenant", "mallory", "evil", http.MethodPatch, "/documents/otters.md", patch, http.StatusForbidden},
+		{"exclude from another tenant", "mallory", "evil", http.MethodPost, "/chunks/" + chunk + "/exclude", nil, http.StatusForbidden},
+		{"restore from another tenant", "mallory", "evil", http.MethodPost, "/chunks/" + chunk + "/restore", nil, http.StatusForbidden},
+		{"exclude from the same tenant", "bob", "acme", http.MethodPost, "/chunks/" + chunk + "/exclude", nil, http.StatusOK},
+		{"patch from the same tenant", "bob", "acme", http.MethodPatch, "/documents/otters.md", patch, http.StatusOK},
+	} {
+		if code := doAs(t, srv, tc.user, tc.tenant, tc.method, tc.path, tc.body); code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
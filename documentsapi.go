@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxIngestDocuments bounds how many documents one POST /documents call may carry.
+const maxIngestDocuments = 100
+
+// documentInput is one document pushed through POST /documents.
+type documentInput struct {
+	ID        string          `json:"id"`
+	Title     string          `json:"title,omitempty"`
+	Text      string          `json:"text"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	Groups    []string        `json:"groups,omitempty"`
+	Summarize *bool           `json:"summarize,omitempty"` // overrides CHUNK_SUMMARIES
+
+	OnDuplicate string `json:"on_duplicate,omitempty"` // reject, alias or allow
+}
+
+// documentOutcome reports how ingesting one document went.
+type documentOutcome struct {
+	ID      string      `json:"id"`
+	Chunks  int         `json:"chunks"`
+	Params  ChunkParams `json:"params,omitzero"`
+	Tokens  ChunkStats  `json:"tokens,omitzero"`
+	EmbedMS int64       `json:"embed_ms,omitempty"`
+
+	SkippedDuplicates int    `json:"skipped_duplicates,omitempty"` // chunks already stored unchanged
+	Error             string `json:"error,omitempty"`
+	Skipped           string `json:"skipped,omitempty"` // why a file of an archive was not ingested
+
+	DuplicateOf string `json:"duplicate_of,omitempty"` // recorded as an alias of this document instead
+}
+
+// outcome reports r as one document of a batch or archive response.
+func (r ingestResult) outcome() documentOutcome {
+	return documentOutcome{
+		ID:          r.Document,
+		Chunks:      r.Chunks,
+		Params:      r.Params,
+		Tokens:      r.Tokens,
+		EmbedMS:     r.EmbedMS,
+		DuplicateOf: r.DuplicateOf,
+
+		SkippedDuplicates: r.SkippedDuplicates,
+	}
+}
+
+// readDocumentInputs decodes a single document object or an array of them.
+func readDocumentInputs(body []byte) (docs []documentInput, batch bool, err error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &docs); err != nil {
+			return nil, true, err
+		}
+		return docs, true, nil
+	}
+	var doc documentInput
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false, err
+	}
+	return []documentInput{doc}, false, nil
+}
+
+// createDocumentsHandler ingests JSON documents through the same chunk, embed
+// and store pipeline as /upload, for services that push content rather than
+// upload files. Every document is validated before any is stored; then each
+// is ingested on its own, so a failure does not undo the ones before it.
+func (s *Server) createDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Create documents request received")
+
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if err != nil {
+		http.Error(w, "failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	docs, batch, err := readDocumentInputs(body)
+	if err != nil {
+		http.Error(w, `expected {"id", "text", ...} or an array of them`, http.StatusBadRequest)
+		return
+	}
+	if len(docs) == 0 || len(docs) > maxIngestDocuments {
+		http.Error(w, fmt.Sprintf("send between 1 and %d documents", maxIngestDocuments), http.StatusBadRequest)
+		return
+	}
+
+	schema := s.defaultSchema()
+	who := callerIdentity(r)
+	reqs := make([]ingestRequest, len(docs))
+	seen := map[string]bool{}
+	for i, d := range docs {
+		prefix := ""
+		if batch {
+			prefix = fmt.Sprintf("documents[%d]: ", i)
+		}
+		id := strings.TrimSpace(d.ID)
+		if err := validateDocumentID(id); err != nil {
+			http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if seen[id] {
+			http.Error(w, fmt.Sprintf("%sduplicate id %q", prefix, id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+		if strings.TrimSpace(d.Text) == "" {
+			http.Error(w, prefix+"text is empty", http.StatusBadRequest)
+			return
+		}
+
+		reqs[i] = ingestRequest{
+			FileName:  id,
+			Title:     strings.TrimSpace(d.Title),
+			Content:   d.Text,
+			Params:    s.cfg.chunkParams(),
+			Summarize: s.cfg.ChunkSummaries,
+			Who:       who,
+		}
+		if d.Summarize != nil {
+			reqs[i].Summarize = *d.Summarize
+		}
+		if reqs[i].OnDuplicate, err = parseDuplicateMode(strings.TrimSpace(d.OnDuplicate)); err != nil {
+			http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := readUploadMetadata(string(d.Metadata), schema, &reqs[i]); err != nil {
+			http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+			return
+		}
+		groups, err := cleanGroups(d.Groups)
+		if err != nil {
+			http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs[i].Access = Access{Owner: strings.TrimSpace(d.Owner), Groups: groups}
+	}
+
+	status := http.StatusOK
+	outcomes := make([]documentOutcome, len(reqs))
+	for i, req := range reqs {
+		res, err := s.ingest(r.Context(), req)
+		outcomes[i] = res.outcome()
+		if err != nil {
+			outcomes[i].Error = err.Error()
+			if status == http.StatusOK {
+				status = errorStatus(err)
+			}
+		}
+	}
+
+	if !batch {
+		if outcomes[0].Error != "" {
+			http.Error(w, outcomes[0].Error, status)
+			return
+		}
+		writeJSON(w, status, outcomes[0])
+		return
+	}
+	writeJSON(w, status, map[string][]documentOutcome{"documents": outcomes})
+}
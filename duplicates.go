@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// What an upload does when its content is already ingested under another
+// name (the on_duplicate field).
+const (
+	duplicateReject = "reject" // answer 409 naming the existing document
+	duplicateAlias  = "alias"  // record the name as an alias of the existing document
+	duplicateAllow  = "allow"  // ingest it again under its own name
+)
+
+const (
+	metaContentSHA256 = "content_sha256" // of the whole document, on every chunk
+	metaAliases       = "aliases"        // JSON list of the other names a document was uploaded as
+	aliasKeyPrefix    = "alias_"
+)
+
+func parseDuplicateMode(v string) (string, error) {
+	switch v {
+	case "":
+		return duplicateReject, nil
+	case duplicateReject, duplicateAlias, duplicateAllow:
+		return v, nil
+	}
+	return "", fmt.Errorf("on_duplicate must be reject, alias or allow")
+}
+
+// aliasKey is the metadata key set on the chunks of the document name is an
+// alias of, so filters on name find them. Names are hashed since they need
+// not make valid keys.
+func aliasKey(name string) string {
+	return aliasKeyPrefix + contentSHA256(name)[:16]
+}
+
+// findDuplicate returns the name of a document in c other than name whose
+// content hashes to sum, or "" when there is none. Only the documents of the
+// caller's tenant are considered, so an upload learns nothing of another's.
+func findDuplicate(ctx context.Context, c VectorStore, name, sum string) (string, error) {
+	where := []chroma.WhereClause{
+		chroma.EqString(metaContentSHA256, sum),
+		chroma.NotEqString("context", name),
+	}
+	if tenant, ok := tenantFrom(ctx); ok {
+		where = append(where, chroma.EqString(metaTenant, tenant))
+	}
+	var res chroma.GetResult
+	err := withRetry(ctx, "chroma get", func() (err error) {
+		res, err = c.Get(ctx,
+			chroma.WithWhereGet(andWhere(where...)),
+			chroma.WithIncludeGet(chroma.IncludeMetadatas),
+			chroma.WithLimitGet(1),
+		)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, m := range res.GetMetadatas() {
+		if m == nil {
+			continue
+		}
+		if doc, ok := m.GetString("context"); ok {
+			return doc, nil
+		}
+	}
+	return "", nil
+}
+
+// presentChunks returns the IDs of the chunks c already holds as they would
+// be stored now: the same text, cut from content hashing to sum, and with a
+// summary exactly when summarized.
+func presentChunks(ctx context.Context, c VectorStore, chunks []Chunk, sum string, summarized bool) (map[string]bool, error) {
+	want := make(map[string]string, len(chunks))
+	ids := make([]chroma.DocumentID, len(chunks))
+	for i, ch := range chunks {
+		want[ch.ID] = ch.Text
+		ids[i] = chroma.DocumentID(ch.ID)
+	}
+	present := map[string]bool{}
+	for i := 0; i < len(ids); i += chromaPageSize {
+		j := min(i+chromaPageSize, len(ids))
+		var res chroma.GetResult
+		err := withRetry(ctx, "chroma get", func() (err error) {
+			res, err = c.Get(ctx,
+				chroma.WithIDsGet(ids[i:j]...),
+				chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+			)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		docs, metas := res.GetDocuments(), res.GetMetadatas()
+		for k, id := range res.GetIDs() {
+			if k >= len(docs) || k >= len(metas) || metas[k] == nil || docs[k].ContentString() != want[string(id)] {
+				continue
+			}
+			stored, _ := metas[k].GetString(metaContentSHA256)
+			_, hasSummary := metas[k].GetString(metaChunkSummary)
+			if stored == sum && hasSummary == summarized {
+				present[string(id)] = true
+			}
+		}
+	}
+	return present, nil
+}
+
+// parseAliases reads the aliases attribute of a chunk.
+func parseAliases(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	var aliases []string
+	if err := json.Unmarshal([]byte(raw), &aliases); err != nil {
+		return nil
+	}
+	return aliases
+}
+
+// addDocumentAlias records alias as another name of doc on all its chunks.
+// The caller must be allowed to modify doc (see mayModify).
+func addDocumentAlias(ctx context.Context, c VectorStore, doc, alias string) error {
+	chunks, err := getAllChunks(ctx, c, chroma.EqString("context", doc))
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return fmt.Errorf("document not found: %s", doc)
+	}
+	for _, ch := range chunks {
+		if !mayModify(ctx, ch.Metadata) {
+			return statusErrorf(http.StatusForbidden,
+				"%s has the same content as %s, which you may not modify, so it cannot become its alias; upload with on_duplicate=allow to ingest it again",
+				alias, doc)
+		}
+	}
+	raw, _ := chunks[0].Metadata[metaAliases].(string)
+	aliases := parseAliases(raw)
+	if !slices.Contains(aliases, alias) {
+		aliases = append(aliases, alias)
+	}
+	list, _ := json.Marshal(aliases)
+	meta := chroma.NewDocumentMetadata(
+		chroma.NewStringAttribute(metaAliases, string(list)),
+		chroma.NewBoolAttribute(aliasKey(alias), true),
+	)
+
+	ids := make([]chroma.DocumentID, len(chunks))
+	for i, ch := range chunks {
+		ids[i] = chroma.DocumentID(ch.ID)
+	}
+	for i := 0; i < len(ids); i += chromaPageSize {
+		j := min(i+chromaPageSize, len(ids))
+		metas := make([]chroma.DocumentMetadata, j-i)
+		for k := range metas {
+			metas[k] = meta
+		}
+		err := withRetry(ctx, "chroma update", func() error {
+			return c.Update(ctx, chroma.WithIDsUpdate(ids[i:j]...), chroma.WithMetadatasUpdate(metas...))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicate looks for the content of req under another name in store
+// and handles a match as req.OnDuplicate says. It returns the name of the
+// existing document when req was recorded as its alias and needs no ingestion.
+func checkDuplicate(ctx context.Context, store VectorStore, req ingestRequest, sum string) (string, error) {
+	if req.OnDuplicate == duplicateAllow {
+		return "", nil
+	}
+	dup, err := findDuplicate(ctx, store, req.FileName, sum)
+	if err != nil {
+		return "", statusErrorf(http.StatusInternalServerError, "checking for duplicates failed: %v", err)
+	}
+	if dup == "" {
+		return "", nil
+	}
+	if req.OnDuplicate != duplicateAlias {
+		return "", statusErrorf(http.StatusConflict,
+			"%s has the same content as %s, which is already ingested; upload with on_duplicate=alias to record it as another name for %s, or on_duplicate=allow to ingest it again",
+			req.FileName, dup, dup)
+	}
+	if err := addDocumentAlias(ctx, store, dup, req.FileName); err != nil {
+		if errorStatus(err) == http.StatusForbidden {
+			return "", err
+		}
+		return "", statusErrorf(http.StatusInternalServerError, "recording alias of %s failed: %v", dup, err)
+	}
+	return dup, nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -30,6 +31,15 @@ import (
 
 type Chunk struct {
 	ID, Text string
+
+	// Provenance within the source document, used for citations.
+	Title      string // document title (first "# " heading, else the file name)
+	Headings   string // section heading path, e.g. "Setup > Install"
+	Page       int    // 1-based page number (pages are separated by form feeds)
+	Start, End int    // byte offsets of the chunk in the source text
+
+	// Table is the structure of a chunk that holds a whole table.
+	Table *Table `json:",omitempty"`
 }
 
 // Embedder is a minimal interface you can call from your upload flow.
@@ -37,18 +47,36 @@ type Embedder interface {
 	Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error)
 }
 
-func NewEmbedderFromEnv() (Embedder, error) {
-	if currentConfig.HFAPIKey == "" {
+// NewEmbedder builds the configured embedding providers (EMBED_PROVIDERS)
+// into one Embedder that fails over between them in order.
+func NewEmbedder(cfg Config) (Embedder, error) {
+	names := cfg.EmbedProviders
+	if len(names) == 0 {
+		names = []string{providerHF}
+	}
+	fe := &failoverEmbedder{slo: cfg.EmbedSLO}
+	for _, name := range names {
+		e, err := newEmbedProvider(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		fe.providers = append(fe.providers, embedProvider{name: name, Embedder: e})
+	}
+	return fe, nil
+}
+
+func newHFEmbedder(cfg Config) (Embedder, error) {
+	if cfg.HFAPIKey == "" {
 		return nil, fmt.Errorf("missing HF_API_KEY in config")
 	}
-	model := currentConfig.EmbedModelName
+	model := cfg.EmbedModelName
 	if model == "" {
 		model = "sentence-transformers/all-MiniLM-L6-v2"
 	}
 
 	return &hfEmbedder{
 		client:    &http.Client{Timeout: 60 * time.Second},
-		token:     currentConfig.HFAPIKey,
+		token:     cfg.HFAPIKey,
 		model:     model,
 		pooling:   "mean",
 		normalize: true,
@@ -57,6 +85,18 @@ func NewEmbedderFromEnv() (Embedder, error) {
 	}, nil
 }
 
+func newTEIEmbedder(cfg Config) (Embedder, error) {
+	if cfg.TEIURL == "" {
+		return nil, fmt.Errorf("missing TEI_URL in config")
+	}
+	return &teiEmbedder{
+		baseURL: strings.TrimRight(cfg.TEIURL, "/"),
+		token:   cfg.TEIToken,
+		client:  &http.Client{Timeout: 60 * time.Second},
+		batch:   32,
+	}, nil
+}
+
 // -------------------- Hugging Face Inference API --------------------
 
 type hfEmbedder struct {
@@ -105,6 +145,7 @@ func (h *hfEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]fl
 		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Authorization", "Bearer "+h.token)
+		setRequestIDHeader(ctx, req.Header)
 
 		fmt.Println("embed request", time.Now())
 
@@ -164,9 +205,6 @@ func (t *teiEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]f
 	url := t.baseURL + "/embed"
 
 	for i := 0; i < len(chunks); i += t.batch {
-		if i > 1 {
-			break
-		}
 		j := i + t.batch
 		if j > len(chunks) {
 			j = len(chunks)
@@ -184,6 +222,7 @@ func (t *teiEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]f
 		if t.token != "" {
 			req.Header.Set("Authorization", "Bearer "+t.token)
 		}
+		setRequestIDHeader(ctx, req.Header)
 
 		resp, err := t.client.Do(req)
 		if err != nil {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxEmbedTexts bounds how many texts one /embed call may carry.
+const maxEmbedTexts = 256
+
+type embedRequest struct {
+	Texts []string `json:"texts"`
+}
+
+type embedResponse struct {
+	Model      string      `json:"model"`
+	Provider   string      `json:"provider,omitempty"` // embedding provider that produced the vectors
+	Dimension  int         `json:"dimension"`
+	Embeddings [][]float32 `json:"embeddings"` // aligned with the request's texts
+}
+
+// embedHandler returns vectors for arbitrary texts from the configured
+// embedder, through the same on-disk cache uploads use, so other services get
+// vectors comparable with the stored ones without their own embedding setup.
+func (s *Server) embedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Embed request received")
+
+	defer r.Body.Close()
+
+	var req embedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "expected {texts: [...]}", http.StatusBadRequest)
+		return
+	}
+	if len(req.Texts) == 0 {
+		http.Error(w, "texts is empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Texts) > maxEmbedTexts {
+		http.Error(w, "too many texts (max "+strconv.Itoa(maxEmbedTexts)+")", http.StatusBadRequest)
+		return
+	}
+
+	chunks := make([]Chunk, len(req.Texts))
+	for i, t := range req.Texts {
+		if strings.TrimSpace(t) == "" {
+			http.Error(w, "texts["+strconv.Itoa(i)+"] is empty", http.StatusBadRequest)
+			return
+		}
+		chunks[i] = Chunk{ID: strconv.Itoa(i), Text: t}
+	}
+
+	modelName := s.cfg.EmbedModelName
+
+	// the texts themselves are the cache key's content; JSON keeps them unambiguous
+	content, err := json.Marshal(req.Texts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	embeds, provider, err := s.embedWithCache(r.Context(), s.embedder, chunks, "/embed", string(content), "", modelName, "")
+	if err != nil {
+		http.Error(w, "failed to embed texts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := embedResponse{Model: modelName, Provider: provider, Embeddings: make([][]float32, len(chunks))}
+	for i, c := range chunks {
+		vec, ok := embeds[c.ID]
+		if !ok {
+			http.Error(w, "missing embedding for texts["+c.ID+"]", http.StatusInternalServerError)
+			return
+		}
+		resp.Embeddings[i] = vec
+		resp.Dimension = len(vec)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// metaEmbedModel is the collection metadata key recording, at creation, which
+// embedding model the collection is built with. The vector dimension is taken
+// from Chroma, which fixes it on the first write, or from the first vector we store.
+const metaEmbedModel = "embed_model"
+
+// ErrEmbeddingMismatch is returned when vectors from the configured embedding
+// model cannot be stored in or compared against a collection.
+type ErrEmbeddingMismatch struct {
+	Collection string
+	Reason     string
+}
+
+func (e *ErrEmbeddingMismatch) Error() string {
+	return fmt.Sprintf("embedding mismatch for collection %s: %s; re-ingest into a new collection or restore the original EMBED_MODEL_NAME", e.Collection, e.Reason)
+}
+
+// dimensionCache remembers the vector dimension of each collection once learned.
+type dimensionCache struct {
+	sync.Mutex
+	m map[string]int
+}
+
+// collectionDim returns the dimension recorded for c, or 0 if none is known yet.
+func (s *Server) collectionDim(c VectorStore) int {
+	s.state.knownDims.Lock()
+	defer s.state.knownDims.Unlock()
+	if d, ok := s.state.knownDims.m[c.Name()]; ok {
+		return d
+	}
+	d := c.Dimension()
+	if d > 0 {
+		s.state.knownDims.m[c.Name()] = d
+	}
+	return d
+}
+
+// checkEmbeddings validates that vectors of length dim produced by the named
+// model fit collection c. When adding to a collection with no known dimension,
+// dim becomes its dimension.
+func (s *Server) checkEmbeddings(c VectorStore, modelName string, dim int, adding bool) error {
+	if md := c.Metadata(); md != nil {
+		if model, ok := md.GetString(metaEmbedModel); ok && model != "" && model != modelName {
+			return &ErrEmbeddingMismatch{
+				Collection: c.Name(),
+				Reason:     fmt.Sprintf("it was built with model %q but EMBED_MODEL_NAME is %q", model, modelName),
+			}
+		}
+	}
+
+	want := s.collectionDim(c)
+	if want == 0 {
+		if adding {
+			s.state.knownDims.Lock()
+			s.state.knownDims.m[c.Name()] = dim
+			s.state.knownDims.Unlock()
+		}
+		return nil
+	}
+	if dim != want {
+		return &ErrEmbeddingMismatch{
+			Collection: c.Name(),
+			Reason:     fmt.Sprintf("it stores %d-dimensional vectors but %q produced %d dimensions", want, modelName, dim),
+		}
+	}
+	return nil
+}
+
+// retrievalErrorStatus maps retrieval errors to HTTP status codes: embedding
+// mismatches are configuration conflicts, anything else is a server error.
+func retrievalErrorStatus(err error) int {
+	var mismatch *ErrEmbeddingMismatch
+	if errors.As(err, &mismatch) {
+		return http.StatusConflict
+	}
+	return errorStatus(err)
+}
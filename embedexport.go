@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// Limits of an embeddings export. The TensorFlow Projector slows down well
+// before the maximum; UMAP copes with more.
+const (
+	defaultExportChunks = 10000
+	maxExportChunks     = 100000
+)
+
+// Parts of an embeddings export. The TensorFlow Projector loads the vectors
+// and their labels as two files, one row per chunk in the same order.
+const (
+	exportVectors  = "vectors"
+	exportMetadata = "metadata"
+)
+
+// exportColumns are the label columns of the metadata part.
+var exportColumns = []string{"chunk_id", "document", "title", "headings", "tags", "excluded"}
+
+// exportEmbeddingsHandler implements GET /admin/embeddings/export: the stored
+// chunk vectors (part=vectors, the default) or their labels (part=metadata) as
+// TSV, for inspecting in the TensorFlow Projector or with UMAP whether the
+// corpus clusters sensibly under the embedding model. Vectors stored
+// quantized are exported dequantized.
+func (s *Server) exportEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Embeddings export request received")
+
+	q := r.URL.Query()
+	if f := q.Get("format"); f != "" && f != "tsv" {
+		http.Error(w, "format must be tsv", http.StatusBadRequest)
+		return
+	}
+	part := q.Get("part")
+	switch part {
+	case "":
+		part = exportVectors
+	case exportVectors, exportMetadata:
+	default:
+		http.Error(w, "part must be vectors or metadata", http.StatusBadRequest)
+		return
+	}
+	limit := defaultExportChunks
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxExportChunks {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxExportChunks), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	c := s.store
+	if name := q.Get("collection"); name != "" {
+		cs, err := s.resolveCollections(r.Context(), []string{name})
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		c = cs[0]
+	}
+	var where chroma.WhereClause
+	if doc := q.Get("document"); doc != "" {
+		where = chroma.EqString("context", doc)
+	}
+
+	// the first page is fetched before anything is written, so a failing
+	// Chroma is still answered with an error status
+	fetch := func(ctx context.Context, offset, n int) (chroma.GetResult, error) {
+		include := []chroma.Include{chroma.IncludeMetadatas}
+		if part == exportVectors {
+			include = append(include, chroma.IncludeEmbeddings)
+		}
+		opts := []chroma.CollectionGetOption{
+			chroma.WithIncludeGet(include...),
+			chroma.WithLimitGet(n),
+			chroma.WithOffsetGet(offset),
+		}
+		if where != nil {
+			opts = append(opts, chroma.WithWhereGet(where))
+		}
+		return c.Get(ctx, opts...)
+	}
+	res, err := fetch(r.Context(), 0, min(chromaPageSize, limit))
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+part+`.tsv"`)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	if part == exportMetadata {
+		bw.WriteString(strings.Join(exportColumns, "\t") + "\n")
+	}
+
+	written := 0
+	for {
+		ids := res.GetIDs()
+		metas := res.GetMetadatas()
+		vecs := res.GetEmbeddings()
+		for i, id := range ids {
+			var meta chroma.DocumentMetadata
+			if i < len(metas) {
+				meta = metas[i]
+			}
+			if part == exportVectors {
+				var vec []float32
+				if i < len(vecs) && vecs[i] != nil {
+					vec = loadedEmbedding(vecs[i].ContentAsFloat32(), meta)
+				}
+				bw.WriteString(vectorRow(vec) + "\n")
+			} else {
+				bw.WriteString(labelRow(string(id), meta) + "\n")
+			}
+		}
+		written += len(ids)
+		if len(ids) < chromaPageSize || written >= limit {
+			return
+		}
+		if res, err = fetch(r.Context(), written, min(chromaPageSize, limit-written)); err != nil {
+			// too late for a status; the export ends short
+			logf(r.Context(), "embeddings export stopped after %d chunks: %v", written, err)
+			return
+		}
+	}
+}
+
+func vectorRow(vec []float32) string {
+	cells := make([]string, len(vec))
+	for i, x := range vec {
+		cells[i] = strconv.FormatFloat(float64(x), 'g', -1, 32)
+	}
+	return strings.Join(cells, "\t")
+}
+
+// labelRow is one row of the metadata part, in exportColumns order.
+func labelRow(id string, meta chroma.DocumentMetadata) string {
+	cells := []string{id, "", "", "", "", "false"}
+	if meta != nil {
+		for i, key := range []string{"context", "title", "headings", "tags"} {
+			cells[i+1], _ = meta.GetString(key)
+		}
+		if excluded, ok := meta.GetBool("excluded"); ok && excluded {
+			cells[5] = "true"
+		}
+	}
+	for i, c := range cells {
+		cells[i] = tsvField(c)
+	}
+	return strings.Join(cells, "\t")
+}
+
+// tsvField keeps a label on one cell: tabs and line breaks become spaces.
+func tsvField(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\t' || r == '\n' || r == '\r'
+	}), " ")
+}
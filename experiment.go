@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// chatTopK is how many chunks /chat retrieves unless an experiment variant
+// says otherwise.
+const chatTopK = 5
+
+// maxExperimentTopK bounds the top_k a variant may ask for.
+const maxExperimentTopK = 50
+
+// Variant names in the experiment log.
+const (
+	variantControl   = "control"
+	variantTreatment = "treatment"
+)
+
+// Experiment routes a share of /chat traffic through an alternative pipeline
+// configuration, so the two can be compared on latency and feedback. It is read
+// from the JSON file EXPERIMENT_FILE names.
+type Experiment struct {
+	Name    string            `json:"name"`
+	Percent float64           `json:"percent"` // share of /chat requests given the treatment, 0..100
+	Variant ExperimentVariant `json:"variant"`
+}
+
+// ExperimentVariant is the treatment: each field that is set replaces what
+// the request would otherwise use. Collections can point at a copy of the
+// corpus ingested with another chunker; the recency boost is the pipeline's
+// re-ranking stage.
+type ExperimentVariant struct {
+	Collections     []string `json:"collections,omitempty"`
+	TopK            int      `json:"top_k,omitempty"`
+	Template        string   `json:"template,omitempty"`
+	RecencyHalfLife string   `json:"recency_half_life,omitempty"`
+	Pipeline        string   `json:"pipeline,omitempty"` // from PIPELINE_FILE; the fields above still take precedence
+}
+
+// loadExperiment reads and checks the experiment in path; an empty path runs none.
+func loadExperiment(path string) (*Experiment, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var e Experiment
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return nil, fmt.Errorf("invalid experiment: %w", err)
+	}
+	e.Name = strings.TrimSpace(e.Name)
+	v := e.Variant
+	switch {
+	case e.Name == "":
+		return nil, fmt.Errorf("experiment name is required")
+	case e.Percent < 0 || e.Percent > 100:
+		return nil, fmt.Errorf("experiment percent must be 0..100")
+	case v.TopK < 0 || v.TopK > maxExperimentTopK:
+		return nil, fmt.Errorf("variant top_k must be 1..%d", maxExperimentTopK)
+	case len(v.Collections) > maxFederatedCollections:
+		return nil, fmt.Errorf("variant names more than %d collections", maxFederatedCollections)
+	case len(v.Collections) == 0 && v.TopK == 0 && v.Template == "" && v.RecencyHalfLife == "" && v.Pipeline == "":
+		return nil, fmt.Errorf("variant changes nothing")
+	}
+	if v.RecencyHalfLife != "" {
+		if d, err := time.ParseDuration(v.RecencyHalfLife); err != nil || d < 0 {
+			return nil, fmt.Errorf("variant recency_half_life %q: want a duration such as 720h, or 0", v.RecencyHalfLife)
+		}
+	}
+	return &e, nil
+}
+
+// assign picks the variant for a request. Callers identified by X-User-ID keep
+// their variant across requests; anonymous requests are assigned one by one.
+func (e *Experiment) assign(r *http.Request) string {
+	unit := strings.TrimSpace(r.Header.Get("X-User-ID"))
+	if unit == "" {
+		unit = requestID(r.Context())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "\x00" + unit))
+	if float64(h.Sum32()%10000) < e.Percent*100 {
+		return variantTreatment
+	}
+	return variantControl
+}
+
+// apply changes req into the treatment.
+func (v ExperimentVariant) apply(req *ChatRequest) {
+	if len(v.Collections) > 0 {
+		req.Collections = slices.Clone(v.Collections)
+	}
+	if v.TopK > 0 {
+		req.topK = v.TopK
+	}
+	if v.Template != "" {
+		req.Template, req.TemplateText = v.Template, ""
+	}
+	if v.RecencyHalfLife != "" {
+		req.RecencyHalfLife = v.RecencyHalfLife
+	}
+	if v.Pipeline != "" {
+		req.Pipeline = v.Pipeline
+	}
+}
+
+// ExperimentEvent is a line of the experiment log: a /chat request served
+// during an experiment ("chat"), or feedback on one ("feedback").
+type ExperimentEvent struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	RequestID  string    `json:"request_id"`
+	Experiment string    `json:"experiment,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
+	Who        string    `json:"who,omitempty"`
+	LatencyMS  int64     `json:"latency_ms,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Helpful    *bool     `json:"helpful,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+}
+
+// The experiment log is an append-only JSON Lines file under RAG_DATA_DIR,
+// like the audit log.
+
+func (s *Server) experimentLogPath() string {
+	return filepath.Join(s.cfg.RAGDataDir, "experiments.jsonl")
+}
+
+// appendExperimentEvent writes e to the experiment log; failures are logged,
+// not returned, so the log never fails the request it describes.
+func (s *Server) appendExperimentEvent(e ExperimentEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("experiments: marshal failed: %v", err)
+		return
+	}
+
+	s.state.experimentMu.Lock()
+	defer s.state.experimentMu.Unlock()
+
+	path := s.experimentLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("experiments: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("experiments: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("experiments: %v", err)
+	}
+}
+
+// readExperimentEvents returns the experiment log in the order it was written.
+func (s *Server) readExperimentEvents() ([]ExperimentEvent, error) {
+	s.state.experimentMu.Lock()
+	defer s.state.experimentMu.Unlock()
+
+	f, err := os.Open(s.experimentLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []ExperimentEvent
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e ExperimentEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // skip a torn last line
+		}
+		out = append(out, e)
+	}
+	return out, sc.Err()
+}
+
+// maxFeedbackComment bounds the comment stored with feedback.
+const maxFeedbackComment = 2000
+
+type feedbackRequest struct {
+	RequestID string `json:"request_id"`
+	Helpful   *bool  `json:"helpful"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+// feedbackHandler records whether the answer to a /chat request served during
+// an experiment helped, keyed by the request's X-Request-ID.
+func (s *Server) feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Feedback request received")
+
+	defer r.Body.Close()
+	var req feedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" || req.Helpful == nil {
+		http.Error(w, "expected {request_id, helpful, comment}", http.StatusBadRequest)
+		return
+	}
+	if len(req.Comment) > maxFeedbackComment {
+		http.Error(w, fmt.Sprintf("comment is too long (max %d bytes)", maxFeedbackComment), http.StatusBadRequest)
+		return
+	}
+
+	events, err := s.readExperimentEvents()
+	if err != nil {
+		http.Error(w, "failed to read experiment log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(events, func(e ExperimentEvent) bool {
+		return e.Kind == "chat" && e.RequestID == req.RequestID
+	})
+	if i < 0 {
+		http.Error(w, "no experiment request with id "+req.RequestID, http.StatusNotFound)
+		return
+	}
+
+	s.appendExperimentEvent(ExperimentEvent{
+		Time:       time.Now().UTC(),
+		Kind:       "feedback",
+		RequestID:  req.RequestID,
+		Experiment: events[i].Experiment,
+		Variant:    events[i].Variant,
+		Who:        callerIdentity(r),
+		Helpful:    req.Helpful,
+		Comment:    req.Comment,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VariantStats summarizes one variant of an experiment.
+type VariantStats struct {
+	Experiment   string  `json:"experiment"`
+	Variant      string  `json:"variant"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"` // responses with a status of 400 or above
+	AvgLatencyMS int64   `json:"avg_latency_ms"`
+	P50LatencyMS int64   `json:"p50_latency_ms"`
+	P95LatencyMS int64   `json:"p95_latency_ms"`
+	Feedback     int     `json:"feedback"`
+	HelpfulRate  float64 `json:"helpful_rate,omitempty"` // share of feedback marked helpful
+}
+
+type experimentsResponse struct {
+	Running *Experiment    `json:"running,omitempty"`
+	Results []VariantStats `json:"results"`
+}
+
+// experimentsHandler reports the running experiment and, for every experiment
+// in the log, per-variant request counts, latency and feedback.
+func (s *Server) experimentsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Experiments request received")
+
+	events, err := s.readExperimentEvents()
+	if err != nil {
+		http.Error(w, "failed to read experiment log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, experimentsResponse{Running: s.cfg.Experiment, Results: experimentStats(events)})
+}
+
+func experimentStats(events []ExperimentEvent) []VariantStats {
+	type acc struct {
+		VariantStats
+		latencies []int64
+		helpful   int
+	}
+	byKey := map[string]*acc{}
+	get := func(e ExperimentEvent) *acc {
+		k := e.Experiment + "\x00" + e.Variant
+		a := byKey[k]
+		if a == nil {
+			a = &acc{VariantStats: VariantStats{Experiment: e.Experiment, Variant: e.Variant}}
+			byKey[k] = a
+		}
+		return a
+	}
+	for _, e := range events {
+		a := get(e)
+		switch e.Kind {
+		case "chat":
+			a.Requests++
+			if e.Status >= http.StatusBadRequest {
+				a.Errors++
+			}
+			a.latencies = append(a.latencies, e.LatencyMS)
+		case "feedback":
+			a.Feedback++
+			if e.Helpful != nil && *e.Helpful {
+				a.helpful++
+			}
+		}
+	}
+
+	out := make([]VariantStats, 0, len(byKey))
+	for _, a := range byKey {
+		if n := len(a.latencies); n > 0 {
+			slices.Sort(a.latencies)
+			var sum int64
+			for _, l := range a.latencies {
+				sum += l
+			}
+			a.AvgLatencyMS = sum / int64(n)
+			a.P50LatencyMS = a.latencies[(n-1)/2]
+			a.P95LatencyMS = a.latencies[(n-1)*95/100]
+		}
+		if a.Feedback > 0 {
+			a.HelpfulRate = float64(a.helpful) / float64(a.Feedback)
+		}
+		out = append(out, a.VariantStats)
+	}
+	slices.SortFunc(out, func(a, b VariantStats) int {
+		if c := strings.Compare(a.Experiment, b.Experiment); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Variant, b.Variant)
+	})
+	return out
+}
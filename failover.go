@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Embedding providers that can be listed in EMBED_PROVIDERS.
+const (
+	providerHF   = "hf"   // Hugging Face Inference API (HF_API_KEY)
+	providerTEI  = "tei"  // Text Embeddings Inference or a compatible /embed service (TEI_URL)
+	providerONNX = "onnx" // all-MiniLM-L6-v2 run locally through ONNX Runtime
+	providerMock = "mock" // deterministic hash-based vectors (EMBED_MODE=mock)
+)
+
+// metaEmbedProvider records on each chunk which provider produced its vector.
+const metaEmbedProvider = "embed_provider"
+
+// newEmbedProvider builds the named provider from the config.
+func newEmbedProvider(cfg Config, name string) (Embedder, error) {
+	switch name {
+	case providerHF:
+		return newHFEmbedder(cfg)
+	case providerTEI:
+		return newTEIEmbedder(cfg)
+	case providerONNX:
+		return newONNXEmbedder(cfg)
+	case providerMock:
+		return mockEmbedder{dim: mockEmbedDim}, nil
+	}
+	return nil, fmt.Errorf("unknown embedding provider %q", name)
+}
+
+type embedProvider struct {
+	name string
+	Embedder
+}
+
+// failoverEmbedder tries its providers in order: when one errors, or takes
+// longer than the SLO, the next one is asked. The last provider gets no SLO,
+// since there is nothing left to fall back to.
+//
+// Every provider must serve the same model (EMBED_MODEL_NAME); vectors from
+// different models are not comparable even when their dimensions agree. A
+// fallback whose vectors have a different dimension than the primary's is
+// treated as failed.
+type failoverEmbedder struct {
+	providers []embedProvider
+	slo       time.Duration
+
+	mu         sync.Mutex
+	primaryDim int // dimension of the first provider's vectors, once seen
+}
+
+func (f *failoverEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error) {
+	out, _, err := f.EmbedProvider(ctx, chunks)
+	return out, err
+}
+
+// EmbedProvider embeds chunks and reports which provider produced the vectors.
+func (f *failoverEmbedder) EmbedProvider(ctx context.Context, chunks []Chunk) (map[string][]float32, string, error) {
+	var errs []error
+	for i, p := range f.providers {
+		last := i == len(f.providers)-1
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if f.slo > 0 && !last {
+			attemptCtx, cancel = context.WithTimeout(ctx, f.slo)
+		}
+		out, err := p.Embed(attemptCtx, chunks)
+		cancel()
+
+		if err == nil && i > 0 {
+			err = f.checkFallbackDim(out)
+		}
+		if err == nil {
+			if i == 0 {
+				f.recordPrimaryDim(out)
+			}
+			return out, p.name, nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up; that is not the provider's fault
+			return nil, "", ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("exceeded EMBED_SLO of %s", f.slo)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+		if !last {
+			logf(ctx, "embedding provider %s failed, falling back to %s: %v", p.name, f.providers[i+1].name, err)
+		}
+	}
+	return nil, "", fmt.Errorf("all embedding providers failed: %w", errors.Join(errs...))
+}
+
+// vectorDim is the dimension of any vector in m, or 0 if it is empty.
+func vectorDim(m map[string][]float32) int {
+	for _, v := range m {
+		return len(v)
+	}
+	return 0
+}
+
+func (f *failoverEmbedder) recordPrimaryDim(out map[string][]float32) {
+	if d := vectorDim(out); d > 0 {
+		f.mu.Lock()
+		f.primaryDim = d
+		f.mu.Unlock()
+	}
+}
+
+// checkFallbackDim rejects a fallback's vectors when their dimension differs
+// from the primary's. Vectors that don't fit the collection are rejected
+// when they are stored or queried, like any others.
+func (f *failoverEmbedder) checkFallbackDim(out map[string][]float32) error {
+	f.mu.Lock()
+	want := f.primaryDim
+	f.mu.Unlock()
+	if have := vectorDim(out); want > 0 && have != want {
+		return fmt.Errorf("produced %d-dimensional vectors, want %d", have, want)
+	}
+	return nil
+}
+
+// providerEmbedder is an Embedder that knows which provider embedded.
+type providerEmbedder interface {
+	EmbedProvider(ctx context.Context, chunks []Chunk) (map[string][]float32, string, error)
+}
+
+// embedChunks embeds chunks with e, reporting the provider when e knows it.
+func embedChunks(ctx context.Context, e Embedder, chunks []Chunk) (map[string][]float32, string, error) {
+	if p, ok := e.(providerEmbedder); ok {
+		return p.EmbedProvider(ctx, chunks)
+	}
+	out, err := e.Embed(ctx, chunks)
+	return out, "", err
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// fakeStore is an in-memory VectorStore. It evaluates metadata filters by
+// their JSON form, which covers the operators the server uses, and ranks
+// queries by cosine distance.
+type fakeStore struct {
+	name string
+
+	mu      sync.Mutex
+	records []fakeRecord
+}
+
+type fakeRecord struct {
+	id   chroma.DocumentID
+	text string
+	meta chroma.DocumentMetadata
+	vec  []float32
+}
+
+func newFakeStore(name string) *fakeStore { return &fakeStore{name: name} }
+
+func (f *fakeStore) Name() string                        { return f.name }
+func (f *fakeStore) Metadata() chroma.CollectionMetadata { return nil }
+
+func (f *fakeStore) Dimension() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.records) == 0 {
+		return 0
+	}
+	return len(f.records[0].vec)
+}
+
+func (f *fakeStore) Add(ctx context.Context, opts ...chroma.CollectionAddOption) error {
+	op, err := chroma.NewCollectionAddOp(opts...)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, id := range op.Ids {
+		r := fakeRecord{id: id}
+		if i < len(op.Documents) {
+			r.text = op.Documents[i].ContentString()
+		}
+		if i < len(op.Metadatas) {
+			r.meta = op.Metadatas[i]
+		}
+		if i < len(op.Embeddings) {
+			if e, ok := op.Embeddings[i].(embeddings.Embedding); ok {
+				r.vec = e.ContentAsFloat32()
+			}
+		}
+		// like Chroma, adding an existing ID leaves the record as it is
+		if !slices.ContainsFunc(f.records, func(old fakeRecord) bool { return old.id == id }) {
+			f.records = append(f.records, r)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) Update(ctx context.Context, opts ...chroma.CollectionUpdateOption) error {
+	op, err := chroma.NewCollectionUpdateOp(opts...)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, id := range op.Ids {
+		for k := range f.records {
+			if f.records[k].id != id || i >= len(op.Metadatas) {
+				continue
+			}
+			merged := metadataMap(f.records[k].meta)
+			for key, v := range metadataMap(op.Metadatas[i]) {
+				if v == nil {
+					delete(merged, key)
+				} else {
+					merged[key] = v
+				}
+			}
+			meta, err := chroma.NewDocumentMetadataFromMap(merged)
+			if err != nil {
+				return err
+			}
+			f.records[k].meta = meta
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) Delete(ctx context.Context, opts ...chroma.CollectionDeleteOption) error {
+	op, err := chroma.NewCollectionDeleteOp(opts...)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = slices.DeleteFunc(f.records, func(r fakeRecord) bool {
+		return matchRecord(r, op.Ids, op.Where)
+	})
+	return nil
+}
+
+func (f *fakeStore) Count(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.records), nil
+}
+
+func (f *fakeStore) Get(ctx context.Context, opts ...chroma.CollectionGetOption) (chroma.GetResult, error) {
+	op, err := chroma.NewCollectionGetOp(opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := &chroma.GetResultImpl{}
+	skipped := 0
+	for _, r := range f.records {
+		if !matchRecord(r, op.Ids, op.Where) {
+			continue
+		}
+		if skipped < op.Offset {
+			skipped++
+			continue
+		}
+		if op.Limit > 0 && len(res.Ids) == op.Limit {
+			break
+		}
+		res.Ids = append(res.Ids, r.id)
+		res.Documents = append(res.Documents, chroma.NewTextDocument(r.text))
+		res.Metadatas = append(res.Metadatas, r.meta)
+	}
+	return res, nil
+}
+
+func (f *fakeStore) Query(ctx context.Context, opts ...chroma.CollectionQueryOption) (chroma.QueryResult, error) {
+	op, err := chroma.NewCollectionQueryOp(opts...)
+	if err != nil {
+		return nil, err
+	}
+	q := op.QueryEmbeddings[0].ContentAsFloat32()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	type hit struct {
+		r    fakeRecord
+		dist float32
+	}
+	var hits []hit
+	for _, r := range f.records {
+		if len(r.vec) == len(q) && matchRecord(r, op.Ids, op.Where) {
+			hits = append(hits, hit{r, cosineDistance(q, r.vec)})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].dist < hits[j].dist })
+	if op.NResults > 0 && len(hits) > op.NResults {
+		hits = hits[:op.NResults]
+	}
+
+	var ids chroma.DocumentIDs
+	var docs chroma.Documents
+	var metas chroma.DocumentMetadatas
+	var dists embeddings.Distances
+	for _, h := range hits {
+		ids = append(ids, h.r.id)
+		docs = append(docs, chroma.NewTextDocument(h.r.text))
+		metas = append(metas, h.r.meta)
+		dists = append(dists, embeddings.Distance(h.dist))
+	}
+	return &chroma.QueryResultImpl{
+		IDLists:        []chroma.DocumentIDs{ids},
+		DocumentsLists: []chroma.Documents{docs},
+		MetadatasLists: []chroma.DocumentMetadatas{metas},
+		DistancesLists: []embeddings.Distances{dists},
+	}, nil
+}
+
+func cosineDistance(a, b []float32) float32 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i] * b[i])
+		na += float64(a[i] * a[i])
+		nb += float64(b[i] * b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return float32(1 - dot/math.Sqrt(na*nb))
+}
+
+func matchRecord(r fakeRecord, ids []chroma.DocumentID, where chroma.WhereFilter) bool {
+	if len(ids) > 0 && !slices.Contains(ids, r.id) {
+		return false
+	}
+	if where == nil {
+		return true
+	}
+	raw, err := json.Marshal(where)
+	if err != nil {
+		panic(err)
+	}
+	var clause map[string]any
+	if err := json.Unmarshal(raw, &clause); err != nil {
+		panic(err)
+	}
+	return matchWhere(clause, metadataMap(r.meta))
+}
+
+// matchWhere evaluates a Chroma where clause against a record's metadata.
+func matchWhere(clause map[string]any, meta map[string]any) bool {
+	for key, v := range clause {
+		switch key {
+		case "$and":
+			for _, c := range v.([]any) {
+				if !matchWhere(c.(map[string]any), meta) {
+					return false
+				}
+			}
+		case "$or":
+			if !slices.ContainsFunc(v.([]any), func(c any) bool { return matchWhere(c.(map[string]any), meta) }) {
+				return false
+			}
+		default:
+			cond, ok := v.(map[string]any)
+			if !ok {
+				cond = map[string]any{"$eq": v}
+			}
+			have, present := meta[key]
+			for op, want := range cond {
+				if !matchOperator(op, have, present, want) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func matchOperator(op string, have any, present bool, want any) bool {
+	same := func(w any) bool { return present && fmt.Sprint(have) == fmt.Sprint(w) }
+	switch op {
+	case "$eq":
+		return same(want)
+	case "$ne":
+		return !same(want)
+	case "$in":
+		return slices.ContainsFunc(want.([]any), same)
+	case "$nin":
+		return !slices.ContainsFunc(want.([]any), same)
+	case "$gt", "$gte", "$lt", "$lte":
+		if !present {
+			return false
+		}
+		var h, w float64
+		fmt.Sscan(fmt.Sprint(have), &h)
+		fmt.Sscan(fmt.Sprint(want), &w)
+		switch op {
+		case "$gt":
+			return h > w
+		case "$gte":
+			return h >= w
+		case "$lt":
+			return h < w
+		default:
+			return h <= w
+		}
+	}
+	panic("fakeStore: unsupported where operator " + op)
+}
+
+// fakeEmbedder embeds texts as hashed bags of words, so texts sharing words
+// are close, and counts the texts it was asked to embed.
+type fakeEmbedder struct {
+	mu       sync.Mutex
+	embedded int
+}
+
+const fakeEmbedDim = 64
+
+func (e *fakeEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error) {
+	e.mu.Lock()
+	e.embedded += len(chunks)
+	e.mu.Unlock()
+	out := make(map[string][]float32, len(chunks))
+	for _, c := range chunks {
+		vec := make([]float32, fakeEmbedDim)
+		for _, w := range strings.Fields(strings.ToLower(c.Text)) {
+			h := fnv.New32a()
+			h.Write([]byte(strings.Trim(w, ".,;:!?")))
+			vec[h.Sum32()%fakeEmbedDim]++
+		}
+		out[c.ID] = vec
+	}
+	return out, nil
+}
+
+// fakeLLM answers every prompt with answer and keeps the prompts it was sent.
+type fakeLLM struct {
+	answer string
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (l *fakeLLM) Generate(ctx context.Context, prompt string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prompts = append(l.prompts, prompt)
+	return l.answer, nil
+}
+
+func (l *fakeLLM) GenerateStream(ctx context.Context, prompt string, onDelta func(string) error) (string, *LLMUsage, error) {
+	answer, err := l.Generate(ctx, prompt)
+	if err != nil {
+		return "", nil, err
+	}
+	return answer, nil, onDelta(answer)
+}
+
+func (l *fakeLLM) lastPrompt() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.prompts) == 0 {
+		return ""
+	}
+	return l.prompts[len(l.prompts)-1]
+}
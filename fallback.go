@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// What a chat answers with when generation fails (LLM_FALLBACK).
+const (
+	fallbackContext    = "context"    // the retrieved context and citations, without an answer
+	fallbackExtractive = "extractive" // as context, with the context sentences that best match the question as the answer
+	fallbackOff        = "off"        // an error, as before
+)
+
+// maxExtractiveSentences bounds an extractive answer.
+const maxExtractiveSentences = 3
+
+// degrade answers t without the LLM after generation failed with err: the
+// response keeps the retrieved context and citations, flagged
+// answer_unavailable, so clients can still show sources during a provider
+// outage. With LLM_FALLBACK=off, or once the client has gone, err is
+// returned as before.
+func (t *chatTurn) degrade(ctx context.Context, err error) (ChatResponse, error) {
+	if t.srv.cfg.LLMFallback == fallbackOff || ctx.Err() != nil {
+		return ChatResponse{}, statusErrorf(http.StatusInternalServerError, "gemini failed: %v", err)
+	}
+	logf(ctx, "generation failed, answering with the retrieved context only: %v", err)
+
+	resp := t.resp
+	resp.AnswerUnavailable = true
+	if t.srv.cfg.LLMFallback == fallbackExtractive {
+		resp.Answer = extractiveAnswer(t.req.Query, resp.Context)
+	}
+	return resp, nil
+}
+
+// extractiveAnswer picks the sentences of chunks that share the most words
+// with query, at most maxExtractiveSentences of them, in the order they
+// appear in the context. It is empty when no sentence shares a word.
+func extractiveAnswer(query string, chunks []string) string {
+	terms := map[string]bool{}
+	for _, w := range extractiveWords(query) {
+		terms[w] = true
+	}
+
+	type candidate struct {
+		text  string
+		pos   int
+		score int
+	}
+	var cands []candidate
+	seen := map[string]bool{}
+	for _, chunk := range chunks {
+		for _, span := range splitSentences(chunk) {
+			text := strings.TrimSpace(chunk[span.start:span.end])
+			if text == "" || seen[text] {
+				continue
+			}
+			seen[text] = true
+			score := 0
+			for _, w := range extractiveWords(text) {
+				if terms[w] {
+					score++
+				}
+			}
+			if score > 0 {
+				cands = append(cands, candidate{text: text, pos: len(cands), score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(cands, func(a, b int) bool { return cands[a].score > cands[b].score })
+	if len(cands) > maxExtractiveSentences {
+		cands = cands[:maxExtractiveSentences]
+	}
+	sort.Slice(cands, func(a, b int) bool { return cands[a].pos < cands[b].pos })
+	parts := make([]string, len(cands))
+	for i, c := range cands {
+		parts[i] = c.text
+	}
+	return strings.Join(parts, " ")
+}
+
+// extractiveWords lowercases text into its words, leaving out the short ones
+// ("a", "is", "of"), which match nearly every sentence.
+func extractiveWords(text string) []string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(w)) > 2 {
+			words = append(words, w)
+		}
+	}
+	return words
+}
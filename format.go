@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Answer formats a chat request can ask for.
+const (
+	formatMarkdown = "markdown"
+	formatText     = "text"
+	formatBullets  = "bullets"
+	formatJSON     = "json"
+)
+
+// answerFormat is a validated format request.
+type answerFormat struct {
+	Name   string
+	Schema map[string]any // optional JSON schema for formatJSON
+}
+
+// requestFormat validates the format fields of a chat request. An empty format
+// leaves the prompt and the answer untouched.
+func requestFormat(req ChatRequest) (answerFormat, error) {
+	f := answerFormat{Name: req.Format}
+	switch req.Format {
+	case "", formatMarkdown, formatText, formatBullets:
+		if len(req.JSONSchema) > 0 {
+			return f, fmt.Errorf("json_schema requires format %q", formatJSON)
+		}
+	case formatJSON:
+		if len(req.JSONSchema) > 0 {
+			if err := json.Unmarshal(req.JSONSchema, &f.Schema); err != nil {
+				return f, fmt.Errorf("json_schema must be a JSON object")
+			}
+		}
+	default:
+		return f, fmt.Errorf("invalid format %q: want markdown, text, bullets or json", req.Format)
+	}
+	return f, nil
+}
+
+// instruction is appended to the prompt to ask for the format.
+func (f answerFormat) instruction() string {
+	switch f.Name {
+	case formatMarkdown:
+		return "Format the answer as Markdown."
+	case formatText:
+		return "Reply in plain text without any Markdown formatting."
+	case formatBullets:
+		return "Reply with a bulleted list of 3 to 5 short points, one per line, each starting with \"- \", and nothing else."
+	case formatJSON:
+		if f.Schema != nil {
+			schema, _ := json.Marshal(f.Schema)
+			return "Reply with a single JSON value matching this JSON schema, and nothing else:\n" + string(schema)
+		}
+		return "Reply with a single JSON value and nothing else."
+	}
+	return ""
+}
+
+var (
+	markdownEmphasis = regexp.MustCompile(`(\*\*|__|\*|` + "`" + `)`)
+	markdownHeading  = regexp.MustCompile(`(?m)^#{1,6}\s+`)
+	listMarker       = regexp.MustCompile(`^\s*(?:[-*•+]|\d+[.)])\s+`)
+)
+
+// apply post-processes the LLM's answer for the format. For JSON it returns
+// the parsed value, or an error when the answer is not valid JSON or does not
+// match the schema.
+func (f answerFormat) apply(answer string) (string, json.RawMessage, error) {
+	switch f.Name {
+	case formatText:
+		answer = markdownHeading.ReplaceAllString(answer, "")
+		answer = markdownEmphasis.ReplaceAllString(answer, "")
+		return strings.TrimSpace(answer), nil, nil
+
+	case formatBullets:
+		// keep only the list items when there are any, dropping intros such as
+		// "Here is a summary:"; otherwise make every line an item
+		var items, lines []string
+		for _, line := range strings.Split(answer, "\n") {
+			if listMarker.MatchString(line) {
+				items = append(items, "- "+strings.TrimSpace(listMarker.ReplaceAllString(line, "")))
+			} else if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, "- "+line)
+			}
+		}
+		if len(items) == 0 {
+			items = lines
+		}
+		return strings.Join(items, "\n"), nil, nil
+
+	case formatJSON:
+		raw := strings.TrimSpace(answer)
+		// models like to wrap JSON in a code fence
+		raw = strings.TrimPrefix(raw, "```json")
+		raw = strings.TrimPrefix(raw, "```")
+		raw = strings.TrimSuffix(raw, "```")
+		raw = strings.TrimSpace(raw)
+
+		var v any
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			return answer, nil, fmt.Errorf("answer is not valid JSON: %v", err)
+		}
+		if f.Schema != nil {
+			if err := validateJSONSchema(f.Schema, v, "$"); err != nil {
+				return answer, nil, fmt.Errorf("answer does not match json_schema: %v", err)
+			}
+		}
+		return raw, json.RawMessage(raw), nil
+	}
+	return answer, nil, nil
+}
+
+// validateJSONSchema checks v against the commonly used subset of JSON
+// Schema: type, enum, properties, required and items.
+func validateJSONSchema(schema map[string]any, v any, path string) error {
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+
+	if typ, ok := schema["type"].(string); ok && !jsonTypeMatches(typ, v) {
+		return fmt.Errorf("%s: want %s", path, typ)
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, present := val[name]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, name)
+					}
+				}
+			}
+		}
+		if props, ok := schema["properties"].(map[string]any); ok {
+			for name, sub := range props {
+				subSchema, ok := sub.(map[string]any)
+				pv, present := val[name]
+				if !ok || !present {
+					continue
+				}
+				if err := validateJSONSchema(subSchema, pv, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := validateJSONSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonTypeMatches(typ string, v any) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return true
+}
@@ -2,10 +2,21 @@ package main
 
 import (
 	"context"
+	"net/http"
+	"strings"
 
 	"google.golang.org/genai"
 )
 
+// LLM generates text from a prompt.
+type LLM interface {
+	Generate(ctx context.Context, prompt string) (string, error)
+	// GenerateStream hands each text delta to onDelta as it arrives; an error
+	// from onDelta stops generation. It returns the whole text and, when
+	// known, the token usage.
+	GenerateStream(ctx context.Context, prompt string, onDelta func(string) error) (string, *LLMUsage, error)
+}
+
 type GeminiLLM struct {
 	client *genai.Client
 	model  string
@@ -24,9 +35,84 @@ func NewGeminiLLMFromEnv(ctx context.Context, apiKey, model string) (*GeminiLLM,
 }
 
 func (g *GeminiLLM) Generate(ctx context.Context, prompt string) (string, error) {
-	res, err := g.client.Models.GenerateContent(ctx, g.model, genai.Text(prompt), nil)
+	res, err := g.client.Models.GenerateContent(ctx, g.model, genai.Text(prompt), generateConfig(ctx))
 	if err != nil {
 		return "", err
 	}
+	reportTruncation(ctx, res)
 	return res.Text(), nil
 }
+
+// generateConfig forwards the request ID, the output limits and the answer
+// profile ctx carries to the Gemini API; it is nil, the default config,
+// without any of them.
+func generateConfig(ctx context.Context) *genai.GenerateContentConfig {
+	id, guard, profile := requestID(ctx), outputGuardFrom(ctx), profileFrom(ctx)
+	if id == "" && guard == nil && profile == nil {
+		return nil
+	}
+	cfg := &genai.GenerateContentConfig{}
+	if id != "" {
+		cfg.HTTPOptions = &genai.HTTPOptions{Headers: http.Header{headerRequestID: []string{id}}}
+	}
+	if guard != nil {
+		cfg.StopSequences = guard.stop
+		cfg.MaxOutputTokens = int32(guard.maxTokens)
+	}
+	if profile != nil {
+		if si := profile.systemInstruction(); si != "" {
+			cfg.SystemInstruction = genai.NewContentFromText(si, genai.RoleUser)
+		}
+		cfg.Temperature = profile.Temperature
+	}
+	return cfg
+}
+
+// reportTruncation flags the output guard ctx carries when the model stopped
+// at its output token limit.
+func reportTruncation(ctx context.Context, res *genai.GenerateContentResponse) {
+	guard := outputGuardFrom(ctx)
+	if guard == nil || res == nil {
+		return
+	}
+	for _, c := range res.Candidates {
+		if c != nil && c.FinishReason == genai.FinishReasonMaxTokens {
+			guard.truncated = true
+		}
+	}
+}
+
+// LLMUsage is the token usage of one generation.
+type LLMUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// GenerateStream generates like Generate but hands each text delta to onDelta
+// as it arrives; an error from onDelta stops generation. It returns the whole
+// text and, when the API reports it, the token usage.
+func (g *GeminiLLM) GenerateStream(ctx context.Context, prompt string, onDelta func(string) error) (string, *LLMUsage, error) {
+	var text strings.Builder
+	var usage *LLMUsage
+	for res, err := range g.client.Models.GenerateContentStream(ctx, g.model, genai.Text(prompt), generateConfig(ctx)) {
+		if err != nil {
+			return text.String(), usage, err
+		}
+		reportTruncation(ctx, res)
+		if delta := res.Text(); delta != "" {
+			text.WriteString(delta)
+			if err := onDelta(delta); err != nil {
+				return text.String(), usage, err
+			}
+		}
+		if u := res.UsageMetadata; u != nil {
+			usage = &LLMUsage{
+				PromptTokens:     int(u.PromptTokenCount),
+				CompletionTokens: int(u.CandidatesTokenCount),
+				TotalTokens:      int(u.TotalTokenCount),
+			}
+		}
+	}
+	return text.String(), usage, nil
+}
@@ -2,7 +2,12 @@ module semanticRAG
 
 go 1.25.1
 
-require github.com/amikos-tech/chroma-go v0.2.5
+require (
+	github.com/amikos-tech/chroma-go v0.2.5
+	github.com/pkg/errors v0.9.1
+	golang.org/x/sync v0.13.0
+	google.golang.org/genai v1.40.0
+)
 
 require (
 	cloud.google.com/go v0.116.0 // indirect
@@ -16,14 +21,12 @@ require (
 	github.com/googleapis/enterprise-certificate-proxy v0.3.4 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/oklog/ulid v1.3.1 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/yalue/onnxruntime_go v1.19.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/crypto v0.37.0 // indirect
 	golang.org/x/net v0.39.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
-	google.golang.org/genai v1.40.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241021214115-324edc3d5d38 // indirect
 	google.golang.org/grpc v1.68.1 // indirect
 	google.golang.org/protobuf v1.35.2 // indirect
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Grounding verification methods.
+const (
+	verifyEmbedding = "embedding"
+	verifyLLM       = "llm"
+)
+
+// minClaimChars skips fragments too short to be claims, such as list markers.
+const minClaimChars = 12
+
+// ClaimSupport is how well one sentence of the answer is backed by the
+// retrieved chunks.
+type ClaimSupport struct {
+	Text      string  `json:"text"`
+	Score     float64 `json:"score"`            // 0..1
+	Supported bool    `json:"supported"`        // score >= GROUNDING_THRESHOLD
+	Source    int     `json:"source,omitempty"` // 1-based index into context/citations of the best match, 0 if none
+}
+
+// Grounding is the result of verifying an answer against its context.
+type Grounding struct {
+	Method      string         `json:"method"`
+	Score       float64        `json:"score"` // mean claim score
+	Unsupported int            `json:"unsupported"`
+	Claims      []ClaimSupport `json:"claims"`
+}
+
+// answerClaims splits an answer into its sentences.
+func answerClaims(answer string) []string {
+	var claims []string
+	for _, s := range splitSentences(answer) {
+		text := strings.TrimSpace(strings.TrimLeft(answer[s.start:s.end], "-*• \t"))
+		if len(text) >= minClaimChars {
+			claims = append(claims, text)
+		}
+	}
+	return claims
+}
+
+// verifyGrounding scores each sentence of answer against the retrieved chunks
+// with the given method.
+func (s *Server) verifyGrounding(ctx context.Context, method, answer string, chunks []string) (*Grounding, error) {
+	claims := answerClaims(answer)
+	g := &Grounding{Method: method, Claims: make([]ClaimSupport, len(claims))}
+	if len(claims) == 0 {
+		return g, nil
+	}
+	for i, c := range claims {
+		g.Claims[i].Text = c
+	}
+
+	if len(chunks) > 0 {
+		var err error
+		switch method {
+		case verifyEmbedding:
+			err = scoreClaimsByEmbedding(ctx, s.embedder, g.Claims, chunks)
+		case verifyLLM:
+			err = scoreClaimsByLLM(ctx, s.llm, g.Claims, chunks)
+		default:
+			err = fmt.Errorf("unknown verification method %q", method)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var total float64
+	for i := range g.Claims {
+		c := &g.Claims[i]
+		c.Supported = c.Score >= s.cfg.GroundingThreshold
+		if !c.Supported {
+			g.Unsupported++
+		}
+		total += c.Score
+	}
+	g.Score = total / float64(len(g.Claims))
+	return g, nil
+}
+
+// scoreClaimsByEmbedding scores each claim by its highest cosine similarity
+// to a chunk, embedding claims and chunks in one call.
+func scoreClaimsByEmbedding(ctx context.Context, embedder Embedder, claims []ClaimSupport, chunks []string) error {
+	batch := make([]Chunk, 0, len(claims)+len(chunks))
+	for i, c := range claims {
+		batch = append(batch, Chunk{ID: "claim-" + strconv.Itoa(i), Text: c.Text})
+	}
+	for i, t := range chunks {
+		batch = append(batch, Chunk{ID: "chunk-" + strconv.Itoa(i), Text: t})
+	}
+	vecs, err := embedder.Embed(ctx, batch)
+	if err != nil {
+		return err
+	}
+
+	for i := range claims {
+		cv := vecs["claim-"+strconv.Itoa(i)]
+		for j := range chunks {
+			sim := cosineSimilarity(cv, vecs["chunk-"+strconv.Itoa(j)])
+			if sim > claims[i].Score {
+				claims[i].Score = sim
+				claims[i].Source = j + 1
+			}
+		}
+	}
+	return nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return math.Max(0, dot/(math.Sqrt(na)*math.Sqrt(nb)))
+}
+
+// scoreClaimsByLLM asks the LLM, in one call, whether the numbered sources
+// entail each numbered claim.
+func scoreClaimsByLLM(ctx context.Context, llm LLM, claims []ClaimSupport, chunks []string) error {
+	if llm == nil {
+		return fmt.Errorf("no LLM configured")
+	}
+
+	var b strings.Builder
+	b.WriteString("Sources:\n")
+	for i, c := range chunks {
+		fmt.Fprintf(&b, "[%d] %s\n", i+1, c)
+	}
+	b.WriteString("\nClaims:\n")
+	for i, c := range claims {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, c.Text)
+	}
+	b.WriteString("\nFor each claim, judge how well the sources support it, from 0 (not at all or contradicted) " +
+		"to 1 (stated or directly implied). Reply with JSON only: " +
+		`[{"claim": <claim number>, "score": <0..1>, "source": <best source number or 0>}, ...]`)
+
+	answer, err := llm.Generate(ctx, b.String())
+	if err != nil {
+		return err
+	}
+	start, end := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if start < 0 || end < start {
+		return fmt.Errorf("no JSON array in verification reply")
+	}
+	var verdicts []struct {
+		Claim  int     `json:"claim"`
+		Score  float64 `json:"score"`
+		Source int     `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &verdicts); err != nil {
+		return fmt.Errorf("bad verification reply: %w", err)
+	}
+	for _, v := range verdicts {
+		if v.Claim < 1 || v.Claim > len(claims) {
+			continue
+		}
+		c := &claims[v.Claim-1]
+		c.Score = math.Min(math.Max(v.Score, 0), 1)
+		if v.Source >= 1 && v.Source <= len(chunks) {
+			c.Source = v.Source
+		}
+	}
+	return nil
+}
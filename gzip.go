@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// minGzipSize is the smallest response body worth compressing; below it the
+// gzip framing costs about as much as it saves.
+const minGzipSize = 1 << 10
+
+// maxInflatedBody bounds a gzip-compressed request body once decompressed, so
+// a small upload cannot expand without limit.
+const maxInflatedBody = 64 << 20
+
+// withGzip decompresses request bodies sent with Content-Encoding: gzip and
+// compresses JSON responses of at least minGzipSize bytes for clients that
+// accept gzip. Other responses, notably event streams, pass through as is.
+func withGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r.Body = http.MaxBytesReader(w, zr, maxInflatedBody)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(q), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers a JSON response until it reaches minGzipSize and
+// then switches to gzip; a response that stays smaller, or is not JSON, is
+// written unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool // the handler called WriteHeader or Write
+	buffering   bool // JSON not yet known to reach minGzipSize
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.status = status
+
+	h := g.Header()
+	compressible := strings.HasPrefix(h.Get("Content-Type"), "application/json") &&
+		h.Get("Content-Encoding") == "" &&
+		status != http.StatusNoContent && status != http.StatusNotModified
+	if compressible {
+		h.Add("Vary", "Accept-Encoding")
+		g.buffering = true
+		return
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.buffering:
+		g.buf = append(g.buf, p...)
+		if len(g.buf) >= minGzipSize {
+			if err := g.startGzip(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *gzipResponseWriter) startGzip() error {
+	h := g.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	g.buffering = false
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// writeBuffered sends a buffered response that stayed below minGzipSize as is.
+func (g *gzipResponseWriter) writeBuffered() {
+	g.buffering = false
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+// Flush sends what has been written so far; a response still being buffered
+// goes out uncompressed.
+func (g *gzipResponseWriter) Flush() {
+	if g.buffering {
+		g.writeBuffered()
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// finish completes the response once the handler has returned.
+func (g *gzipResponseWriter) finish() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case g.buffering:
+		g.writeBuffered()
+	}
+}
@@ -1,125 +1,454 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
-	"github.com/amikos-tech/chroma-go/pkg/embeddings"
 )
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Upload request received")
 
-	contentStr, fileName := getFileContents(w, r)
-	if contentStr == "" {
+	field, err := readUploadFields(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// chunk the content of the file
-	chunks := simpleChunkDocument(fileName, contentStr, 2)
+	// a text field is ingested as is under the caller's document ID; otherwise
+	// the document is the uploaded file
+	var contentStr, fileName string
+	archive := uploadedArchive(r)
+	if text := field("text"); text != "" {
+		if r.MultipartForm != nil && len(r.MultipartForm.File["files"]) > 0 {
+			http.Error(w, "send either a file or text, not both", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			http.Error(w, "text is empty", http.StatusBadRequest)
+			return
+		}
+		fileName = strings.TrimSpace(field("id"))
+		if err := validateDocumentID(fileName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contentStr = text
+	} else if isJSONRequest(r) {
+		http.Error(w, "expected {\"text\": ..., \"id\": ...}", http.StatusBadRequest)
+		return
+	} else if r.MultipartForm == nil {
+		http.Error(w, "expected a file in 'files' or a text field", http.StatusBadRequest)
+		return
+	} else if archive != nil {
+		fileName = archive.Filename
+	} else {
+		contentStr, fileName = getFileContents(w, r)
+		if contentStr == "" {
+			return
+		}
+	}
 
-	// embed
-	ctx := r.Context()
-	embedder, err := NewEmbedderFromEnv()
+	params, err := readChunkParams(field, s.cfg.chunkParams())
 	if err != nil {
-		http.Error(w, "failed to NewEmbedderFromEnv", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Determine model name if available from embedder implementation
-	modelName := ""
-	if h, ok := embedder.(*hfEmbedder); ok {
-		modelName = h.model
+	req := ingestRequest{
+		FileName:  fileName,
+		Content:   contentStr,
+		Params:    params,
+		Namespace: strings.TrimSpace(field("namespace")),
+		Summarize: s.cfg.ChunkSummaries,
+		Who:       callerIdentity(r),
 	}
-
-	embeds, err := embedWithCache(ctx, embedder, chunks, fileName, contentStr, 2, modelName)
-	if err != nil {
-		// Map cache errors to appropriate HTTP codes
-		msg := err.Error()
-		if strings.HasPrefix(msg, "failed to load embeddings cache") {
-			http.Error(w, msg, http.StatusInternalServerError)
+	if v := strings.TrimSpace(field("summarize")); v != "" {
+		if req.Summarize, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "summarize: want true or false", http.StatusBadRequest)
 			return
 		}
-		if strings.HasPrefix(msg, "no matching cached embeddings found") {
-			http.Error(w, msg, http.StatusBadRequest)
+	}
+	if req.OnDuplicate, err = parseDuplicateMode(strings.TrimSpace(field("on_duplicate"))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.CacheMode, err = parseCacheMode(strings.TrimSpace(field("cache_mode"))); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := strings.TrimSpace(field("doc_date")); v != "" {
+		if req.DocDate, err = parseTimestamp(v); err != nil {
+			http.Error(w, "doc_date: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if strings.Contains(msg, "cache") {
-			http.Error(w, "embedding/cache failed: "+msg, http.StatusInternalServerError)
+	}
+	if err := readUploadMetadata(field("metadata"), s.defaultSchema(), &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Access, err = readAccess(field); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an archive is ingested file by file, each as its own document
+	if archive != nil {
+		if async, _ := strconv.ParseBool(field("async")); async {
+			http.Error(w, "async is not supported for archives", http.StatusBadRequest)
 			return
 		}
-		http.Error(w, "failed to Embed chunks", http.StatusInternalServerError)
+		s.ingestArchive(w, r, archive, req)
 		return
 	}
 
-	// 2) Build aligned slices: ids and embeddings
-	ids := make([]chroma.DocumentID, 0, len(chunks))
-	embs := make([]embeddings.Embedding, 0, len(chunks))
-	texts := make([]string, 0, len(chunks))
-	metas := make([]chroma.DocumentMetadata, 0, len(chunks))
-
-	for _, c := range chunks {
-		vec, ok := embeds[c.ID]
-		if !ok {
-			http.Error(w, "missing embedding for chunk "+c.ID, http.StatusBadRequest)
-			return
+	// async=true runs the ingestion as a background job and answers right away
+	if async, _ := strconv.ParseBool(field("async")); async {
+		callbackURL := strings.TrimSpace(field("callback_url"))
+		if callbackURL == "" {
+			callbackURL = s.cfg.WebhookURL
+		} else if callbackURL != s.cfg.WebhookURL {
+			// unlike WEBHOOK_URL, a caller's endpoint must be public
+			err := validateCallbackURL(callbackURL)
+			if err == nil {
+				err = checkCallbackHost(r.Context(), callbackURL)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 
-		ids = append(ids, chroma.DocumentID(c.ID))
-		embs = append(embs, embeddings.NewEmbeddingFromFloat32(vec))
-		texts = append(texts, c.Text)
+		job := s.createJob(fileName, callbackURL, requestID(r.Context()))
+		go s.runIngestJob(context.WithoutCancel(r.Context()), job.ID, req)
 
-		metas = append(metas, chroma.NewDocumentMetadata(
-			chroma.NewStringAttribute("context", fileName), // or whatever “context” means to you
-			chroma.NewStringAttribute("doc_id", c.ID),
-			chroma.NewIntAttribute("len", int64(len(c.Text))),
-		))
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
 	}
 
-	// 3) Add to Chroma using IDs + Embeddings
-	//    All slice lengths must match; otherwise the client will return a validation error.
-
-	err = collection.Add(ctx,
-		chroma.WithIDs(ids...),
-		chroma.WithEmbeddings(embs...),
-		chroma.WithTexts(texts...),
-		chroma.WithMetadatas(metas...),
-	)
+	res, err := s.ingest(r.Context(), req)
 	if err != nil {
-		http.Error(w, "failed to add to chroma: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
-	count, err := collection.Count(ctx)
+	writeJSON(w, http.StatusOK, res)
+}
+
+// maxUploadBytes bounds an upload's form or JSON body.
+const maxUploadBytes = 32 << 20
+
+// maxDocumentID bounds the length of a caller-provided document ID.
+const maxDocumentID = 255
+
+// requestFields looks up a field of a request by name, "" when it is not set.
+type requestFields func(name string) string
+
+func isJSONRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Content-Type"), "application/json")
+}
+
+// readUploadFields parses the fields of an upload: a multipart or urlencoded
+// form, or a JSON object. JSON strings are taken as is and other values as
+// their JSON text, so "metadata" may be an object and "async" a boolean.
+func readUploadFields(w http.ResponseWriter, r *http.Request) (requestFields, error) {
+	if isJSONRequest(r) {
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUploadBytes)).Decode(&body); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
+		return func(name string) string {
+			raw, ok := body[name]
+			if !ok || string(raw) == "null" {
+				return ""
+			}
+			var s string
+			if json.Unmarshal(raw, &s) == nil {
+				return s
+			}
+			return string(raw)
+		}, nil
+	}
+
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, fmt.Errorf("failed to parse multipart form")
+	}
+	return r.FormValue, nil
+}
+
+// validateDocumentID checks a caller-provided document ID. It names the
+// document like an uploaded file's name does, so it must be usable as one.
+func validateDocumentID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("id is required")
+	case len(id) > maxDocumentID:
+		return fmt.Errorf("id is too long (max %d bytes)", maxDocumentID)
+	case id == "." || id == ".." || strings.ContainsAny(id, "/\\"):
+		return fmt.Errorf("id %q must not be a path", id)
+	case strings.IndexFunc(id, unicode.IsControl) >= 0:
+		return fmt.Errorf("id must not contain control characters")
+	}
+	return nil
+}
+
+// statusError is a failure together with the HTTP status a caller should
+// answer with, for pipelines that run outside a single handler.
+type statusError struct {
+	Status int
+	Msg    string
+}
+
+func (e *statusError) Error() string { return e.Msg }
+
+func statusErrorf(status int, format string, args ...any) error {
+	return &statusError{Status: status, Msg: fmt.Sprintf(format, args...)}
+}
+
+// errorStatus maps an error to an HTTP status, 500 unless it is a statusError.
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// readUploadMetadata reads v, the optional "metadata" field, a JSON object of
+// custom attributes for every chunk, checked against the collection's schema.
+// "tags" in it replaces automatic classification.
+func readUploadMetadata(v string, schema *MetadataSchema, req *ingestRequest) error {
+	var custom map[string]json.RawMessage
+	if v != "" {
+		if err := json.Unmarshal([]byte(v), &custom); err != nil {
+			return fmt.Errorf("metadata must be a JSON object")
+		}
+	}
+	if err := schema.checkRequired(custom); err != nil {
+		return err
+	}
+	for k, raw := range custom {
+		if string(raw) == "null" {
+			return fmt.Errorf("metadata %q: null is only meaningful in PATCH", k)
+		}
+	}
+
+	attrs, tags, setTags, err := metadataUpdates(custom, schema)
 	if err != nil {
-		log.Fatalf("Error counting collection: %s \n", err)
-		return
+		return err
+	}
+	req.Attributes = attrs
+	if setTags {
+		req.Tags, req.TagsSet = tags, true
 	}
-	fmt.Printf("Count collection: %d\n", count)
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK: upserted " + strconv.Itoa(len(ids)) + " chunks"))
+// readChunkParams reads the strategy, chunk_size and overlap fields, falling
+// back to def for any that are not set. Choosing another strategy than def's
+// also drops def's size and overlap, which are in that strategy's units.
+func readChunkParams(field requestFields, def ChunkParams) (ChunkParams, error) {
+	params := def
+	if v := field("strategy"); v != "" && v != def.Strategy {
+		params = ChunkParams{Strategy: v, Size: defaultChunkSize(v)}
+	}
+	if v := field("chunk_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid chunk_size %q", v)
+		}
+		params.Size = n
+	}
+	if v := field("overlap"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid overlap %q", v)
+		}
+		params.Overlap = n
+	}
+	return params, params.Validate()
 }
 
 type ChatRequest struct {
-	Query string `json:"query"`
+	Query       string                     `json:"query"`
+	Messages    []ChatMessage              `json:"messages,omitempty"`    // prior turns plus the new question, instead of query
+	Tags        []string                   `json:"tags,omitempty"`        // restrict retrieval to chunks carrying any of these tags
+	Documents   []string                   `json:"documents,omitempty"`   // restrict retrieval to these documents
+	Filters     map[string]json.RawMessage `json:"filters,omitempty"`     // equality filters on custom metadata
+	Collections []string                   `json:"collections,omitempty"` // query these collections instead of the default one
+	SelfQuery   bool                       `json:"self_query,omitempty"`  // let the LLM derive documents/tags filters from the query
+
+	Doc      string `json:"doc,omitempty"`       // answer about this one document only
+	WholeDoc bool   `json:"whole_doc,omitempty"` // put all of doc in the prompt when it is small enough
+
+	RecencyHalfLife string `json:"recency_half_life,omitempty"` // overrides RECENCY_HALF_LIFE; "0" disables the boost
+
+	// restrict retrieval to chunks ingested in this window: a date, an RFC 3339
+	// time, or a duration back from now such as "168h"
+	IngestedAfter  string `json:"ingested_after,omitempty"`
+	IngestedBefore string `json:"ingested_before,omitempty"`
+
+	Pipeline string `json:"pipeline,omitempty"` // a pipeline from PIPELINE_FILE, supplying what the request leaves unset
+	Profile  string `json:"profile,omitempty"`  // an answer style from PROFILE_FILE
+
+	Neighbors *int `json:"neighbors,omitempty"` // adjacent chunks to add on each side of a hit; overrides NEIGHBOR_CHUNKS
+
+	Template     string `json:"template,omitempty"`      // name of a registered prompt template
+	TemplateText string `json:"template_text,omitempty"` // inline prompt template
+
+	Format     string          `json:"format,omitempty"`      // markdown | text | bullets | json
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"` // schema the answer must match, for format json
+
+	MaxTokens int      `json:"max_tokens,omitempty"` // cut the answer after this many tokens; at most LLM_MAX_OUTPUT_TOKENS
+	Stop      []string `json:"stop,omitempty"`       // end the answer at any of these; replaces LLM_STOP_SEQUENCES
+
+	Verify string `json:"verify,omitempty"` // check the answer against the context: "embedding" | "llm"
+	Stream bool   `json:"stream,omitempty"` // answer as Server-Sent Events
+	Debug  bool   `json:"debug,omitempty"`  // add the intermediate results of each stage to the response
+
+	topK int // chunks to retrieve, set by an experiment variant; 0 means chatTopK
+}
+
+// ChatMessage is one turn of a conversation.
+type ChatMessage struct {
+	Role    string `json:"role"` // "user" | "assistant"
+	Content string `json:"content"`
+}
+
+// maxHistoryMessages bounds how many prior turns are fed into the prompt; older
+// turns are dropped.
+const maxHistoryMessages = 20
+
+// normalize validates the request and, for a messages request, moves the
+// final user turn into Query, leaving the earlier turns as history.
+func (req *ChatRequest) normalize() error {
+	req.Doc = strings.TrimSpace(req.Doc)
+	if req.Doc != "" {
+		if len(req.Documents) > 0 {
+			return fmt.Errorf("send either doc or documents, not both")
+		}
+		req.Documents = []string{req.Doc}
+	} else if req.WholeDoc {
+		return fmt.Errorf("whole_doc needs doc")
+	}
+
+	if len(req.Messages) == 0 {
+		if strings.TrimSpace(req.Query) == "" {
+			return fmt.Errorf("expected query or messages")
+		}
+		return nil
+	}
+	if req.Query != "" {
+		return fmt.Errorf("send either query or messages, not both")
+	}
+	for i, m := range req.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return fmt.Errorf("messages[%d]: role must be user or assistant, got %q", i, m.Role)
+		}
+		if strings.TrimSpace(m.Content) == "" {
+			return fmt.Errorf("messages[%d]: content is empty", i)
+		}
+	}
+	last := req.Messages[len(req.Messages)-1]
+	if last.Role != "user" {
+		return fmt.Errorf("the last message must be from the user")
+	}
+	req.Query = last.Content
+	req.Messages = req.Messages[:len(req.Messages)-1]
+	if len(req.Messages) > maxHistoryMessages {
+		req.Messages = req.Messages[len(req.Messages)-maxHistoryMessages:]
+	}
+	return nil
 }
 
 type ChatResponse struct {
-	Answer  string   `json:"answer"`
-	Context []string `json:"context"`
+	Answer string `json:"answer"`
+	// AnswerUnavailable is set when generation failed and the response only
+	// carries the context (and, with LLM_FALLBACK=extractive, an extract of it)
+	AnswerUnavailable bool `json:"answer_unavailable,omitempty"`
+	// Truncated is set when the answer was cut at the output token limit
+	// (LLM_MAX_OUTPUT_TOKENS or max_tokens) rather than finished
+	Truncated bool `json:"truncated,omitempty"`
+
+	Data      json.RawMessage  `json:"data,omitempty"` // the parsed answer, for format json
+	Context   []string         `json:"context"`
+	Citations []Citation       `json:"citations"`
+	Filter    *SelfQueryFilter `json:"filter,omitempty"`    // what self_query derived
+	WholeDoc  bool             `json:"whole_doc,omitempty"` // the whole of doc was the context, instead of retrieved chunks
+	Pipeline  string           `json:"pipeline,omitempty"`  // the pipeline that answered, when not the built-in one
+	Profile   string           `json:"profile,omitempty"`   // the answer style, when one applied
+	Grounding *Grounding       `json:"grounding,omitempty"`
+	Debug     *ChatDebug       `json:"debug,omitempty"` // with debug=true
 }
 
-var (
-	geminiLLM *GeminiLLM
-)
+// Citation locates a retrieved chunk in its source document.
+type Citation struct {
+	ChunkID    string `json:"chunk_id"`
+	Document   string `json:"document"`
+	Collection string `json:"collection,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Headings   string `json:"headings,omitempty"`
+	Page       int    `json:"page,omitempty"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+
+	// The generated title and summary of the chunk, when uploaded with summarize.
+	ChunkTitle string `json:"chunk_title,omitempty"`
+	Summary    string `json:"summary,omitempty"`
+
+	// The rows and columns of a chunk holding a whole table.
+	Table *Table `json:"table,omitempty"`
+
+	// Retrieval confidence: the raw Chroma distance (lower is closer) and a
+	// similarity score in (0, 1] derived from it (higher is closer).
+	Distance float64 `json:"distance"`
+	Score    float64 `json:"score"`
+
+	// The adjacent chunks added to the context with neighbors; start and end
+	// then cover them too.
+	Neighbors []string `json:"neighbors,omitempty"`
+}
+
+// citationFromMetadata reads the provenance attributes stored with a chunk at upload.
+func citationFromMetadata(meta chroma.DocumentMetadata) Citation {
+	var c Citation
+	if meta == nil {
+		return c
+	}
+	c.ChunkID, _ = meta.GetString("doc_id")
+	c.Document, _ = meta.GetString("context")
+	c.Title, _ = meta.GetString("title")
+	c.Headings, _ = meta.GetString("headings")
+	c.ChunkTitle, _ = meta.GetString(metaChunkTitle)
+	c.Summary, _ = meta.GetString(metaChunkSummary)
+	if v, ok := meta.GetString(metaTable); ok {
+		var t Table
+		if json.Unmarshal([]byte(v), &t) == nil {
+			c.Table = &t
+		}
+	}
+	if v, ok := meta.GetInt("page"); ok {
+		c.Page = int(v)
+	}
+	if v, ok := meta.GetInt("start"); ok {
+		c.Start = int(v)
+	}
+	if v, ok := meta.GetInt("end"); ok {
+		c.End = int(v)
+	}
+	return c
+}
 
 func readChatRequest(r *http.Request) (ChatRequest, error) {
 	ct := r.Header.Get("Content-Type")
@@ -141,87 +470,194 @@ func readChatRequest(r *http.Request) (ChatRequest, error) {
 	_ = r.ParseMultipartForm(10 << 20)
 	_ = r.ParseForm()
 
+	var tags, documents, collections []string
+	if v := r.FormValue("tags"); v != "" {
+		tags = strings.Split(v, ",")
+	}
+	if v := r.FormValue("documents"); v != "" {
+		documents = strings.Split(v, ",")
+	}
+	if v := r.FormValue("collections"); v != "" {
+		collections = strings.Split(v, ",")
+	}
+	selfQuery, _ := strconv.ParseBool(r.FormValue("self_query"))
+	wholeDoc, _ := strconv.ParseBool(r.FormValue("whole_doc"))
+	stream, _ := strconv.ParseBool(r.FormValue("stream"))
+	debug, _ := strconv.ParseBool(r.FormValue("debug"))
+	var neighbors *int
+	if v := r.FormValue("neighbors"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return ChatRequest{}, fmt.Errorf("neighbors must be an integer")
+		}
+		neighbors = &n
+	}
+	var maxTokens int
+	if v := r.FormValue("max_tokens"); v != "" {
+		var err error
+		if maxTokens, err = strconv.Atoi(v); err != nil {
+			return ChatRequest{}, fmt.Errorf("max_tokens must be an integer")
+		}
+	}
+	var filters map[string]json.RawMessage
+	if v := r.FormValue("filters"); v != "" {
+		if err := json.Unmarshal([]byte(v), &filters); err != nil {
+			return ChatRequest{}, fmt.Errorf("filters must be a JSON object")
+		}
+	}
+
 	return ChatRequest{
-		Query: r.FormValue("query"),
+		Query:       r.FormValue("query"),
+		Tags:        tags,
+		Documents:   documents,
+		Collections: collections,
+		SelfQuery:   selfQuery,
+		Filters:     filters,
+		Doc:         r.FormValue("doc"),
+		WholeDoc:    wholeDoc,
+
+		RecencyHalfLife: r.FormValue("recency_half_life"),
+		IngestedAfter:   r.FormValue("ingested_after"),
+		IngestedBefore:  r.FormValue("ingested_before"),
+		Neighbors:       neighbors,
+		Pipeline:        r.FormValue("pipeline"),
+		Profile:         r.FormValue("profile"),
+		Template:        r.FormValue("template"),
+		TemplateText:    r.FormValue("template_text"),
+		Format:          r.FormValue("format"),
+		JSONSchema:      json.RawMessage(r.FormValue("json_schema")),
+		MaxTokens:       maxTokens,
+		Verify:          r.FormValue("verify"),
+		Stream:          stream,
+		Debug:           debug,
 	}, nil
 }
 
-func promptHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Prompt request received")
-
-	defer r.Body.Close()
-	ctx := r.Context()
-
-	req, err := readChatRequest(r)
-	if err != nil || req.Query == "" {
-		http.Error(w, "expected {context, query}", http.StatusBadRequest)
-		return
+// chatWhere builds the Chroma metadata filter for a chat request, or nil if the
+// request does not restrict retrieval. Custom filters are checked against the
+// metadata schema of the collections searched.
+func (s *Server) chatWhere(req ChatRequest) (chroma.WhereClause, error) {
+	filters, err := s.filtersWhereFor(req.Filters, req.Collections)
+	if err != nil {
+		return nil, err
 	}
-
-	// 1) Embed query (adapt this to your embedder API)
-	embedder, err := NewEmbedderFromEnv()
+	ingested, err := ingestedWhere(req.IngestedAfter, req.IngestedBefore, time.Now())
 	if err != nil {
-		http.Error(w, "failed to NewEmbedderFromEnv", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	return andWhere(
+		notExcludedWhere(),
+		tagsWhere(req.Tags),
+		documentsWhere(req.Documents),
+		filters,
+		ingested,
+	), nil
+}
 
-	// create a single “chunk” to embed (adjust to your chunk type)
-	qChunk := Chunk{ID: "q", Text: req.Query}
-	m, err := embedder.Embed(ctx, []Chunk{qChunk})
+// embedQuery embeds a single query string with the configured embedder.
+func (s *Server) embedQuery(ctx context.Context, query string) ([]float32, error) {
+	// create a single “chunk” to embed
+	m, err := s.embedder.Embed(ctx, []Chunk{{ID: "q", Text: query}})
 	if err != nil {
-		http.Error(w, "failed to embed query", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to embed query")
 	}
-
 	qVec, ok := m["q"]
 	if !ok {
-		http.Error(w, "missing query embedding", http.StatusInternalServerError)
+		return nil, fmt.Errorf("missing query embedding")
+	}
+	return qVec, nil
+}
+
+// warmEmbedder embeds a throwaway query, so that the first chat does not pay
+// for setting up the provider's connection or loading a cold model. A failure
+// is only logged; the first request that needs the embedder will try again.
+func (s *Server) warmEmbedder(ctx context.Context) {
+	start := time.Now()
+	if _, err := s.embedQuery(ctx, "warm-up"); err != nil {
+		log.Printf("warning: warming up the embedder failed: %v", err)
 		return
 	}
+	log.Printf("embedder warmed up in %s", time.Since(start).Round(time.Millisecond))
+}
 
-	// 2) Query Chroma with metadata filter: context == req.Context
-	qr, err := collection.Query(ctx,
-		chroma.WithQueryEmbeddings(embeddings.NewEmbeddingFromFloat32(qVec)),
-		chroma.WithNResults(5),
-		chroma.WithIncludeQuery(chroma.IncludeDocuments, chroma.IncludeMetadatas),
-	)
+func (s *Server) promptHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Prompt request received")
+
+	defer r.Body.Close()
+
+	req, err := readChatRequest(r)
 	if err != nil {
-		http.Error(w, "chroma query failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "expected {query} or {messages}", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if debug, _ := strconv.ParseBool(r.URL.Query().Get("debug")); debug {
+		req.Debug = true
+	}
 
-	// 3) Pull retrieved texts (documents)
-	retrieved := make([]string, 0, 5)
-	docsGroups := qr.GetDocumentsGroups()
-	if len(docsGroups) > 0 {
-		for _, d := range docsGroups[0] {
-			if d == nil {
-				continue
-			}
-			retrieved = append(retrieved, d.ContentString())
+	// during an experiment, a share of requests run with the variant and every
+	// request is logged with its variant, latency and status
+	if e := s.cfg.Experiment; e != nil {
+		variant := e.assign(r)
+		if variant == variantTreatment {
+			e.Variant.apply(&req)
 		}
+		w.Header().Set("X-Experiment", e.Name)
+		w.Header().Set("X-Experiment-Variant", variant)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+		start := time.Now()
+		defer func() {
+			s.appendExperimentEvent(ExperimentEvent{
+				Time:       start.UTC(),
+				Kind:       "chat",
+				RequestID:  requestID(r.Context()),
+				Experiment: e.Name,
+				Variant:    variant,
+				Who:        callerIdentity(r),
+				LatencyMS:  time.Since(start).Milliseconds(),
+				Status:     rec.status,
+			})
+		}()
 	}
 
-	contextBlock := strings.Join(retrieved, "\n")
-
-	// 4) Prompt Gemini
-	prompt := fmt.Sprintf(
-		"Context:\n%s\n\nQuestion: %s\n\nBased on the context above, generate a succinct answer.",
-		contextBlock, req.Query,
-	)
+	if req.Stream {
+		s.streamChat(w, r, req)
+		return
+	}
 
-	answer, err := geminiLLM.Generate(ctx, prompt)
+	resp, err := s.answerChat(r.Context(), req)
 	if err != nil {
-		http.Error(w, "gemini failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
-	// 5) Return JSON
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(ChatResponse{
-		Answer:  answer,
-		Context: retrieved,
-	})
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// buildPrompt assembles the LLM prompt from the retrieved context, any prior
+// conversation turns and the question.
+func buildPrompt(contextBlock string, history []ChatMessage, query string) string {
+	var conv strings.Builder
+	if len(history) > 0 {
+		conv.WriteString("Conversation so far:\n")
+		for _, m := range history {
+			role := "User"
+			if m.Role == "assistant" {
+				role = "Assistant"
+			}
+			fmt.Fprintf(&conv, "%s: %s\n", role, m.Content)
+		}
+		conv.WriteString("\n")
+	}
+	return fmt.Sprintf(
+		"Context:\n%s\n\n%sQuestion: %s\n\nBased on the context above, generate a succinct answer.",
+		contextBlock, conv.String(), query,
+	)
 }
 
 func getFileContents(w http.ResponseWriter, r *http.Request) (string, string) {
@@ -263,20 +699,31 @@ func getFileContents(w http.ResponseWriter, r *http.Request) (string, string) {
 		return "", ""
 	}
 
-	var text string
-	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
-	switch ext {
-	case ".txt", ".md":
-		text = string(contentBytes)
-	default:
-		http.Error(w, "unsupported file type for now; please upload .txt or .md", http.StatusBadRequest)
+	// the content is checked first: it tells what a misnamed file really is
+	content, err := decodeText(contentBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %v. Supported are %s", fileHeader.Filename, err, supportedUploads), http.StatusUnsupportedMediaType)
+		return "", ""
+	}
+	if !isSupportedText(fileHeader.Filename) {
+		http.Error(w, "unsupported file type for now; please upload .txt, .md or a .zip/.tar.gz of them", http.StatusBadRequest)
 		return "", ""
 	}
 
-	return text, fileHeader.Filename
+	return content, fileHeader.Filename
 }
 
-func rechunkHandler(w http.ResponseWriter, r *http.Request) {
+// maxRechunkVariants bounds how many parameter sets one /rechunk call may compare.
+const maxRechunkVariants = 10
+
+// rechunkResult is the outcome of chunking a file with one parameter set.
+type rechunkResult struct {
+	Params ChunkParams
+	Stats  ChunkStats
+	Chunks []Chunk
+}
+
+func (s *Server) rechunkHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Rechunk request received")
 
 	contentStr, fileName := getFileContents(w, r)
@@ -284,13 +731,52 @@ func rechunkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// chunk the content of the file
-	chunks := simpleChunkDocument(fileName, contentStr, 2)
+	// A "variants" field holds a JSON array of parameter sets to compare side by
+	// side; without it the single strategy/chunk_size/overlap fields are used.
+	var variants []ChunkParams
+	if v := r.FormValue("variants"); v != "" {
+		if err := json.Unmarshal([]byte(v), &variants); err != nil {
+			http.Error(w, "invalid variants: expected a JSON array of {strategy, chunk_size, overlap}", http.StatusBadRequest)
+			return
+		}
+		if len(variants) == 0 || len(variants) > maxRechunkVariants {
+			http.Error(w, fmt.Sprintf("variants must contain between 1 and %d parameter sets", maxRechunkVariants), http.StatusBadRequest)
+			return
+		}
+	} else {
+		params, err := readChunkParams(r.FormValue, s.cfg.chunkParams())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		variants = []ChunkParams{params}
+	}
+
+	results := make([]rechunkResult, 0, len(variants))
+	for i, params := range variants {
+		params = params.withDefaults(s.cfg.chunkParams())
+		chunker, err := s.newChunker(params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("variant %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
 
-	result := struct {
-		Chunks []Chunk
-	}{
-		chunks,
+		// chunk the content of the file
+		chunks := chunker.Chunk(fileName, contentStr)
+		results = append(results, rechunkResult{
+			Params: params,
+			Stats:  chunkStats(chunks),
+			Chunks: chunks,
+		})
+	}
+
+	var result any = results[0]
+	if r.FormValue("variants") != "" {
+		result = struct {
+			Variants []rechunkResult
+		}{
+			results,
+		}
 	}
 
 	resStr, err := json.Marshal(result)
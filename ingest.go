@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// ingestRequest is one document to chunk, embed and store.
+type ingestRequest struct {
+	FileName  string
+	Title     string // replaces the title the chunker derives, when set
+	Content   string
+	Params    ChunkParams
+	Namespace string    // optional grouping of documents, e.g. per team or environment
+	DocDate   time.Time // optional date of the document itself, for recency boosting
+
+	Attributes []*chroma.MetaAttribute // custom metadata for every chunk
+	Tags       []string                // used instead of classification when TagsSet
+	TagsSet    bool
+	Summarize  bool        // generate a title and summary for every chunk (CHUNK_SUMMARIES)
+	CacheMode  string      // embedding cache mode; "" uses EMBED_CACHE_MODE
+	Access     Access      // who may read the document; the zero Access lets everyone
+	Who        string      // caller identity, for the audit log
+	Store      VectorStore // collection written to; nil writes to the default one
+
+	// OnDuplicate says what to do when the content is already ingested under
+	// another name: reject (also when empty), alias or allow.
+	OnDuplicate string
+
+	// Progress, when set, is told about each stage and how far it has got.
+	Progress func(stage string, done, total int)
+}
+
+func (r ingestRequest) progress(stage string, done, total int) {
+	if r.Progress != nil {
+		r.Progress(stage, done, total)
+	}
+}
+
+// ingestResult describes a stored document.
+type ingestResult struct {
+	Document string      `json:"document"`
+	Chunks   int         `json:"chunks"`
+	Params   ChunkParams `json:"params"`
+	Tokens   ChunkStats  `json:"tokens,omitzero"` // estimated tokens per chunk
+	EmbedMS  int64       `json:"embed_ms"`        // embedding time, cache lookups included
+	Provider string      `json:"embed_provider,omitempty"`
+
+	// SkippedDuplicates counts the chunks already stored unchanged, which
+	// were neither embedded nor stored again.
+	SkippedDuplicates int `json:"skipped_duplicates"`
+
+	// DuplicateOf names the document the upload was recorded as an alias of,
+	// in which case nothing was stored.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// ingest runs the upload pipeline for req and records the outcome in the
+// audit log, whether it succeeds or not.
+func (s *Server) ingest(ctx context.Context, req ingestRequest) (ingestResult, error) {
+	start := time.Now()
+	res, err := s.runIngest(ctx, req)
+
+	audit := AuditEntry{
+		Time:       start.UTC(),
+		Who:        req.Who,
+		Action:     "upload",
+		Document:   req.FileName,
+		SHA256:     contentSHA256(req.Content),
+		Chunks:     res.Chunks,
+		Chunking:   req.Params.String(),
+		Model:      s.cfg.EmbedModelName,
+		DurationMS: time.Since(start).Milliseconds(),
+		Outcome:    "ok",
+		Status:     http.StatusOK,
+		RequestID:  requestID(ctx),
+	}
+	if err != nil {
+		audit.Outcome = "error"
+		audit.Status = errorStatus(err)
+		audit.Error = err.Error()
+	} else if res.DuplicateOf != "" {
+		audit.Action = "alias"
+	}
+	s.appendAudit(audit)
+
+	return res, err
+}
+
+func (s *Server) runIngest(ctx context.Context, req ingestRequest) (ingestResult, error) {
+	res := ingestResult{Document: req.FileName, Params: req.Params}
+	store := s.store
+	if req.Store != nil {
+		store = req.Store
+	}
+
+	chunker, err := s.newChunker(req.Params)
+	if err != nil {
+		return res, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+
+	// the same content under another name would only crowd retrieval results
+	sum := contentSHA256(req.Content)
+	if res.DuplicateOf, err = checkDuplicate(ctx, store, req, sum); err != nil || res.DuplicateOf != "" {
+		return res, err
+	}
+
+	// chunk the content of the file
+	req.progress("chunking", 0, 0)
+	chunks := chunker.Chunk(req.FileName, req.Content)
+	if req.Title != "" {
+		for i := range chunks {
+			chunks[i].Title = req.Title
+		}
+	}
+	res.Chunks = len(chunks)
+	res.Tokens = chunkStats(chunks)
+
+	// chunks an earlier upload of the same content stored need neither
+	// embedding nor storing again
+	present, err := presentChunks(ctx, store, chunks, sum, req.Summarize)
+	if err != nil {
+		return res, statusErrorf(http.StatusInternalServerError, "checking for stored chunks failed: %v", err)
+	}
+	if len(present) > 0 {
+		res.SkippedDuplicates = len(present)
+		chunks = slices.DeleteFunc(chunks, func(c Chunk) bool { return present[c.ID] })
+		if len(chunks) == 0 {
+			return res, nil
+		}
+	}
+	if err := s.checkChunkQuota(ctx, len(chunks)); err != nil {
+		return res, err
+	}
+
+	// optionally title and summarize each chunk, and embed those along with
+	// its text; like classification, a failure only costs the summaries
+	var summaries map[string]chunkSummary
+	chunking := req.Params.String()
+	if req.Summarize {
+		req.progress("summarizing", 0, len(chunks))
+		summaries = summarizeChunks(ctx, s.llm, chunks, func(done int) { req.progress("summarizing", done, len(chunks)) })
+		// the cached vectors of the plain chunks do not fit summarized ones
+		chunking += " summaries"
+	}
+	// the cached vectors of all chunks do not fit some of them
+	if len(present) > 0 {
+		ids := make([]string, len(chunks))
+		for i, c := range chunks {
+			ids[i] = c.ID
+		}
+		chunking += " only " + contentSHA256(strings.Join(ids, "\n"))[:16]
+	}
+	// tables are embedded by their description rather than their cells
+	toEmbed := chunks
+	if hasTables(chunks) {
+		chunking += " tables"
+	}
+	if req.Summarize || hasTables(chunks) {
+		toEmbed = make([]Chunk, len(chunks))
+		for i, c := range chunks {
+			toEmbed[i] = c
+			toEmbed[i].Text = summarizedText(c, summaries[c.ID])
+		}
+	}
+	req.progress("embedding", 0, len(chunks))
+
+	// embed
+	modelName := s.cfg.EmbedModelName
+	embedStart := time.Now()
+	embeds, provider, err := s.embedWithCache(ctx, s.embedder, toEmbed, req.FileName, req.Content, chunking, modelName, req.CacheMode)
+	res.EmbedMS = time.Since(embedStart).Milliseconds()
+	res.Provider = provider
+	if err != nil {
+		// Map cache errors to appropriate HTTP codes
+		msg := err.Error()
+		if strings.HasPrefix(msg, "failed to load embeddings cache") {
+			return res, statusErrorf(http.StatusInternalServerError, "%s", msg)
+		}
+		if strings.HasPrefix(msg, "no matching cached embeddings found") {
+			return res, statusErrorf(http.StatusBadRequest, "%s", msg)
+		}
+		if strings.Contains(msg, "cache") {
+			return res, statusErrorf(http.StatusInternalServerError, "embedding/cache failed: %s", msg)
+		}
+		return res, statusErrorf(http.StatusInternalServerError, "failed to Embed chunks")
+	}
+	req.progress("embedding", len(chunks), len(chunks))
+
+	// classify the document into the configured categories unless the caller
+	// set tags; a failure here only costs us the tags, so it should not fail the upload
+	tags := req.Tags
+	if !req.TagsSet {
+		tags, err = classifyDocument(ctx, s.llm, s.cfg.Categories, req.Content)
+		if err != nil {
+			logf(ctx, "classification failed for %s: %v", req.FileName, err)
+		}
+	}
+
+	// keep the source so maintenance can drop the chunks once the file is removed
+	sourcePath, err := s.saveSource(req.FileName, req.Content)
+	if err != nil {
+		logf(ctx, "failed to save source for %s: %v", req.FileName, err)
+	}
+
+	ingestedAt := time.Now().Unix()
+
+	// 2) Build aligned slices: ids and embeddings
+	ids := make([]chroma.DocumentID, 0, len(chunks))
+	embs := make([]embeddings.Embedding, 0, len(chunks))
+	texts := make([]string, 0, len(chunks))
+	metas := make([]chroma.DocumentMetadata, 0, len(chunks))
+
+	for _, c := range chunks {
+		vec, ok := embeds[c.ID]
+		if !ok {
+			return res, statusErrorf(http.StatusBadRequest, "missing embedding for chunk %s", c.ID)
+		}
+
+		emb, quantAttrs := storedEmbedding(vec, s.cfg.EmbedQuantize)
+		ids = append(ids, chroma.DocumentID(c.ID))
+		embs = append(embs, emb)
+		texts = append(texts, c.Text)
+
+		attrs := []*chroma.MetaAttribute{
+			chroma.NewStringAttribute("context", req.FileName), // or whatever “context” means to you
+			chroma.NewStringAttribute("doc_id", c.ID),
+			chroma.NewIntAttribute("len", int64(len(c.Text))),
+			chroma.NewStringAttribute("title", c.Title),
+			chroma.NewStringAttribute("headings", c.Headings),
+			chroma.NewIntAttribute("page", int64(c.Page)),
+			chroma.NewIntAttribute("start", int64(c.Start)),
+			chroma.NewIntAttribute("end", int64(c.End)),
+			chroma.NewIntAttribute(metaIngestedAt, ingestedAt),
+			chroma.NewStringAttribute(metaContentSHA256, sum),
+		}
+		if !req.DocDate.IsZero() {
+			attrs = append(attrs, chroma.NewIntAttribute(metaDocDate, req.DocDate.Unix()))
+		}
+		if req.Namespace != "" {
+			attrs = append(attrs, chroma.NewStringAttribute("namespace", req.Namespace))
+		}
+		if sourcePath != "" {
+			attrs = append(attrs, chroma.NewStringAttribute("source_path", sourcePath))
+		}
+		if provider != "" {
+			attrs = append(attrs, chroma.NewStringAttribute(metaEmbedProvider, provider))
+		}
+		if c.Table != nil {
+			table, _ := json.Marshal(c.Table)
+			attrs = append(attrs, chroma.NewStringAttribute(metaTable, string(table)))
+		}
+		if sum, ok := summaries[c.ID]; ok {
+			attrs = append(attrs,
+				chroma.NewStringAttribute(metaChunkTitle, sum.Title),
+				chroma.NewStringAttribute(metaChunkSummary, sum.Summary))
+		}
+		if tenant, ok := tenantFrom(ctx); ok {
+			attrs = append(attrs, chroma.NewStringAttribute(metaTenant, tenant))
+		}
+		attrs = append(attrs, req.Access.attributes()...)
+		attrs = append(attrs, req.Attributes...)
+		attrs = append(attrs, tagAttributes(tags)...)
+		attrs = append(attrs, quantAttrs...)
+		metas = append(metas, chroma.NewDocumentMetadata(attrs...))
+	}
+
+	// 3) Add to Chroma using IDs + Embeddings
+	//    All slice lengths must match; otherwise the client will return a validation error.
+	for _, e := range embs {
+		if err := s.checkEmbeddings(store, modelName, e.Len(), true); err != nil {
+			return res, statusErrorf(http.StatusConflict, "%v", err)
+		}
+	}
+
+	req.progress("storing", 0, len(ids))
+	written, err := addInBatches(ctx, store, s.cfg.ChromaBatchSize, ids, embs, texts, metas,
+		func(written int) { req.progress("storing", written, len(ids)) })
+	if err != nil {
+		return res, statusErrorf(http.StatusInternalServerError, "failed to add to chroma after %d of %d chunks: %v", written, len(ids), err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// jobRetention is how long finished jobs stay queryable.
+const jobRetention = 24 * time.Hour
+
+// jobKeepAlive is how often an idle event stream sends a comment line, so
+// proxies do not close it.
+const jobKeepAlive = 15 * time.Second
+
+// JobProgress is how far a running job has got within its current stage.
+type JobProgress struct {
+	Stage string `json:"stage"` // "chunking" | "embedding" | "storing"; "building" | "catching_up" | "checking" for a reindex
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
+// Job is an asynchronous ingestion started with `async=true` on /upload, or
+// a reindex started with /admin/reindex.
+type Job struct {
+	ID        string         `json:"id"`
+	Status    string         `json:"status"`
+	Document  string         `json:"document,omitempty"`   // empty for a reindex
+	RequestID string         `json:"request_id,omitempty"` // of the request that started the job
+	Progress  *JobProgress   `json:"progress,omitempty"`
+	Result    *ingestResult  `json:"result,omitempty"`
+	Reindex   *ReindexReport `json:"reindex,omitempty"` // the report of a finished reindex
+	Error     string         `json:"error,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+
+	callbackURL string
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// jobEvent is one state transition or progress update of a job.
+type jobEvent struct {
+	Type string // "status" | "progress"
+	Job  Job
+}
+
+// jobRegistry holds a server's jobs in memory; jobs do not survive a restart
+// (the audit log does). subs holds the event streams watching each job.
+type jobRegistry struct {
+	sync.Mutex
+	m    map[string]*Job
+	subs map[string][]chan jobEvent
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// createJob registers a queued job and drops finished jobs past retention.
+func (s *Server) createJob(document, callbackURL, requestID string) Job {
+	now := time.Now().UTC()
+	j := &Job{
+		ID:          newJobID(),
+		Status:      JobQueued,
+		Document:    document,
+		RequestID:   requestID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		callbackURL: callbackURL,
+	}
+
+	s.state.jobs.Lock()
+	defer s.state.jobs.Unlock()
+	for id, old := range s.state.jobs.m {
+		if old.finished() && now.Sub(old.UpdatedAt) > jobRetention {
+			delete(s.state.jobs.m, id)
+		}
+	}
+	s.state.jobs.m[j.ID] = j
+	return *j
+}
+
+// getJob returns a snapshot of the job with the given id.
+func (s *Server) getJob(id string) (Job, bool) {
+	s.state.jobs.Lock()
+	defer s.state.jobs.Unlock()
+	j, ok := s.state.jobs.m[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// updateJob applies fn to the job under the lock, publishes the change to the
+// job's subscribers and returns a snapshot. Subscribers that fall behind miss
+// intermediate events; their channel is closed once the job finishes, so they
+// can still read the final state.
+func (s *Server) updateJob(id string, fn func(*Job)) Job {
+	s.state.jobs.Lock()
+	defer s.state.jobs.Unlock()
+	j := s.state.jobs.m[id]
+	status := j.Status
+	fn(j)
+	j.UpdatedAt = time.Now().UTC()
+
+	ev := jobEvent{Type: "progress", Job: *j}
+	if j.Status != status {
+		ev.Type = "status"
+	}
+	for _, ch := range s.state.jobs.subs[id] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	if j.finished() {
+		for _, ch := range s.state.jobs.subs[id] {
+			close(ch)
+		}
+		delete(s.state.jobs.subs, id)
+	}
+	return *j
+}
+
+// subscribeJob returns a snapshot of the job and a channel of its later
+// events, plus a func to stop listening. The channel is nil when the job has
+// already finished.
+func (s *Server) subscribeJob(id string) (Job, <-chan jobEvent, func(), bool) {
+	s.state.jobs.Lock()
+	defer s.state.jobs.Unlock()
+	j, ok := s.state.jobs.m[id]
+	if !ok {
+		return Job{}, nil, nil, false
+	}
+	if j.finished() {
+		return *j, nil, func() {}, true
+	}
+
+	ch := make(chan jobEvent, 16)
+	s.state.jobs.subs[id] = append(s.state.jobs.subs[id], ch)
+	unsubscribe := func() {
+		s.state.jobs.Lock()
+		defer s.state.jobs.Unlock()
+		subs := s.state.jobs.subs[id]
+		for i, c := range subs {
+			if c == ch {
+				s.state.jobs.subs[id] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+	return *j, ch, unsubscribe, true
+}
+
+// runIngestJob runs req in the background and notifies the job's webhook once
+// it finishes. ctx should be detached from the request that started the job
+// (context.WithoutCancel) but keeps its values, such as the request ID.
+func (s *Server) runIngestJob(ctx context.Context, id string, req ingestRequest) {
+	s.updateJob(id, func(j *Job) { j.Status = JobRunning })
+
+	req.Progress = func(stage string, done, total int) {
+		s.updateJob(id, func(j *Job) {
+			j.Progress = &JobProgress{Stage: stage, Done: done, Total: total}
+		})
+	}
+	res, err := s.ingest(ctx, req)
+
+	job := s.updateJob(id, func(j *Job) {
+		if err != nil {
+			j.Status = JobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = JobSucceeded
+		j.Result = &res
+	})
+	if err != nil {
+		logf(ctx, "job %s (%s) failed: %v", id, req.FileName, err)
+	}
+
+	if url := job.callbackURL; url != "" {
+		client := callbackClient
+		if url == s.cfg.WebhookURL {
+			client = webhookClient
+		}
+		if err := notifyWebhook(ctx, client, url, s.cfg.WebhookSecret, job); err != nil {
+			logf(ctx, "job %s: webhook %s failed: %v", id, url, err)
+		}
+	}
+}
+
+// runReindexJob runs a reindex in the background, like runIngestJob. The
+// caller holds reindexRunning; it is released once the run finishes.
+func (s *Server) runReindexJob(ctx context.Context, id string, req ReindexRequest, who string) {
+	defer s.state.reindexRunning.Unlock()
+	s.updateJob(id, func(j *Job) { j.Status = JobRunning })
+
+	req.Progress = func(stage string, done, total int) {
+		s.updateJob(id, func(j *Job) {
+			j.Progress = &JobProgress{Stage: stage, Done: done, Total: total}
+		})
+	}
+	rep, err := s.reindex(ctx, req, who)
+
+	s.updateJob(id, func(j *Job) {
+		if err != nil {
+			j.Status = JobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = JobSucceeded
+		j.Reindex = &rep
+	})
+	if err != nil {
+		logf(ctx, "job %s (reindex) failed: %v", id, err)
+	}
+}
+
+// jobHandler reports the state of an ingestion or reindex job.
+func (s *Server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// jobEventsHandler streams a job's state transitions and progress as
+// Server-Sent Events. The current state is sent first; the stream ends after
+// the event for the finished job.
+func (s *Server) jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id := r.PathValue("id")
+	job, events, unsubscribe, ok := s.subscribeJob(id)
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev jobEvent) bool {
+		b, err := json.Marshal(ev.Job)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !send(jobEvent{Type: "status", Job: job}) || events == nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(jobKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				// finished; the final event may have been dropped if we fell behind
+				if final, found := s.getJob(id); found {
+					send(jobEvent{Type: "status", Job: final})
+				}
+				return
+			}
+			if !send(ev) || ev.Job.finished() {
+				return
+			}
+		}
+	}
+}
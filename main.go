@@ -7,47 +7,48 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
 )
 
-var chromaClient chroma.Client
-
-func initChroma(baseURL string) error {
+func initChroma(baseURL string) (chroma.Client, error) {
 	c, err := chroma.NewHTTPClient(
 		chroma.WithBaseURL(baseURL),
 	)
 	if err != nil {
-		return fmt.Errorf("creating Chroma client: %w", err)
+		return nil, fmt.Errorf("creating Chroma client: %w", err)
 	}
-	chromaClient = c
-	return nil
+	return c, nil
 }
 
-func initGeminiLLM(ctx context.Context, apiKey, model string) error {
-	gem, err := NewGeminiLLMFromEnv(ctx, apiKey, model)
-	if err != nil {
-		return fmt.Errorf("creating Gemini LLM: %w", err)
+func initLLM(ctx context.Context, cfg Config) (LLM, error) {
+	if cfg.LLMMode == modeMock {
+		return mockLLM{}, nil
 	}
 
-	geminiLLM = gem
-	return nil
+	gem, err := NewGeminiLLMFromEnv(ctx, cfg.GeminiAPIKey, cfg.LLMModelName)
+	if err != nil {
+		return nil, fmt.Errorf("creating Gemini LLM: %w", err)
+	}
+	return gem, nil
 }
 
 // source ./chroma/bin/activate
 // chroma run --path ./chroma-data --host 0.0.0.0 --port 8000
 func main() {
-	var err error
-	currentConfig, err = Load()
+	cfg, err := Load()
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 		return
 	}
 
-	err = initChroma(currentConfig.ChromaDBHost)
+	chromaClient, err := initChroma(cfg.ChromaDBHost)
 	if err != nil {
 		log.Fatalf("failed to init chroma: %v", err)
 		return
@@ -61,34 +62,99 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err = initChromaCollection(ctx)
+	// reads and writes go to the collection the alias names, the default one
+	// until a reindex flips it
+	alias, err := loadAlias(cfg.RAGDataDir)
+	if err != nil {
+		log.Fatalf("failed to read collection alias: %v", err)
+		return
+	}
+
+	// the collection is looked up again whenever its handle goes stale, so a
+	// Chroma that is down now is only tried again on first use
+	resolve := collectionResolver(chromaClient, cfg, alias.Collection)
+	collection, err := resolve(ctx)
+	if err != nil {
+		log.Printf("warning: chroma collection unavailable, retrying on first use: %v", err)
+	}
+	store := newReconnectingStore(defaultCollection, collection, resolve)
+
+	llm, err := initLLM(ctx, cfg)
+	if err != nil {
+		log.Fatalf("failed to init LLM: %v", err)
+		return
+	}
+
+	embedder, err := NewEmbedder(cfg)
 	if err != nil {
-		log.Fatalf("failed to init chroma collection: %v", err)
+		log.Fatalf("failed to init embedder: %v", err)
 		return
 	}
 
-	err = initGeminiLLM(ctx, currentConfig.GeminiAPIKey, currentConfig.LLMModelName)
+	templates, err := loadPromptTemplates(cfg.PromptTemplatesDir)
 	if err != nil {
-		log.Fatalf("failed to init gemini LLM: %v", err)
+		log.Fatalf("failed to load prompt templates: %v", err)
 		return
 	}
+	if e := cfg.Experiment; e != nil && e.Variant.Template != "" && templates[e.Variant.Template] == nil {
+		log.Fatalf("experiment %s uses unknown template %q", e.Name, e.Variant.Template)
+		return
+	}
+	for _, name := range cfg.Pipelines.templates() {
+		if templates[name] == nil {
+			log.Fatalf("a pipeline uses unknown template %q", name)
+			return
+		}
+	}
+
+	// start ONNX Runtime (downloading the model on first run) before the
+	// first request needs it; a failure is left to the failover to handle
+	if slices.Contains(cfg.EmbedProviders, providerONNX) {
+		if _, err := loadONNX(); err != nil {
+			log.Printf("warning: onnx embedding provider unavailable: %v", err)
+		}
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Health check request received")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	srv := NewServer(cfg, Deps{
+		Chroma:    chromaClient,
+		Store:     store,
+		Embedder:  embedder,
+		LLM:       llm,
+		Templates: templates,
 	})
-	mux.HandleFunc("/upload", requirePost(uploadHandler))   // POST
-	mux.HandleFunc("/chat", requirePost(promptHandler))     // POST
-	mux.HandleFunc("/rechunk", requirePost(rechunkHandler)) // POST
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", currentConfig.Port), mux))
+	go srv.warmEmbedder(context.Background())
+	if cfg.ChromaHealthInterval > 0 {
+		go srv.watchChroma(context.Background(), cfg.ChromaHealthInterval)
+	}
+	if cfg.MaintenanceInterval > 0 {
+		go srv.runMaintenance(context.Background(), cfg.MaintenanceInterval)
+	}
+	for _, src := range cfg.SyncSources {
+		if _, err := srv.connector(src); err != nil {
+			log.Fatalf("sync source %s: %v", src.Name, err)
+			return
+		}
+	}
+	if len(cfg.SyncSources) > 0 {
+		go srv.runSyncLoop(context.Background())
+	}
+
+	logBanner(cfg)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), srv))
 }
 
 func requirePost(h http.HandlerFunc) http.HandlerFunc {
+	return requireMethod(http.MethodPost, h)
+}
+
+func requireGet(h http.HandlerFunc) http.HandlerFunc {
+	return requireMethod(http.MethodGet, h)
+}
+
+func requireMethod(method string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+		if r.Method != method {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
@@ -96,75 +162,126 @@ func requirePost(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// simpleChunkDocument splits the text into sentences and groups them into chunks
-// of up to sentencesPerChunk sentences each.
-func simpleChunkDocument(docID, text string, sentencesPerChunk int) []Chunk {
-	text = strings.TrimSpace(text)
-	if text == "" {
-		return nil
-	}
+type Config struct {
+	HFAPIKey       string   // HF_API_KEY (required by the hf embedding provider)
+	EmbedModelName string   // EMBED_MODEL_NAME
+	GeminiAPIKey   string   // GEMINI_API_KEY
+	LLMModelName   string   // LLM_MODEL_NAME
+	LLMMode        string   // LLM_MODE ("" or mock)
+	EmbedMode      string   // EMBED_MODE ("" or mock; mock replaces EMBED_PROVIDERS and EMBED_MODEL_NAME)
+	ChromaDBHost   string   // CHROMA_DB_HOST
+	RAGDataDir     string   // RAG_DATA_DIR
+	ChunkStrategy  string   // CHUNK_STRATEGY (sentence|fixed)
+	ChunkLength    int      // CHUNK_LENGTH (0: the strategy's default size)
+	ChunkOverlap   int      // CHUNK_OVERLAP
+	Port           int      // PORT
+	Categories     []string // DOC_CATEGORIES (comma-separated; empty disables classification)
+	AdminToken     string   // ADMIN_TOKEN (empty disables /admin endpoints)
+	ChunkSummaries bool     // CHUNK_SUMMARIES (title and summarize every chunk with the LLM at upload)
 
-	text = strings.ReplaceAll(text, "\n", " ")
-	text = strings.ReplaceAll(text, "\r", " ")
+	ChromaDistance     string // CHROMA_DISTANCE (cosine|l2|ip; empty keeps Chroma's default)
+	HNSWM              int    // HNSW_M
+	HNSWConstructionEF int    // HNSW_CONSTRUCTION_EF
+	HNSWSearchEF       int    // HNSW_SEARCH_EF
+	EmbedQuantize      string // EMBED_QUANTIZE ("" or int8)
+	ChromaBatchSize    int    // CHROMA_BATCH_SIZE (records per Add call)
 
-	// Naive sentence split on "."
-	rawSentences := strings.Split(text, ".")
-	var sentences []string
-	for _, s := range rawSentences {
-		s = strings.TrimSpace(s)
-		if s != "" {
-			sentences = append(sentences, s+".")
-		}
-	}
+	ChromaHealthInterval time.Duration // CHROMA_HEALTH_INTERVAL (between heartbeats to Chroma; 0 disables them)
 
-	var chunks []Chunk
-	var current []string
-	index := 0
+	EmbedProviders []string      // EMBED_PROVIDERS (comma-separated, in failover order: hf, tei, onnx)
+	EmbedSLO       time.Duration // EMBED_SLO (latency after which the next provider is tried; 0 waits)
+	TEIURL         string        // TEI_URL (base URL of the tei provider)
+	TEIToken       string        // TEI_API_TOKEN (optional bearer token for the tei provider)
 
-	for _, s := range sentences {
-		current = append(current, s)
-		if len(current) >= sentencesPerChunk {
-			chunkText := strings.Join(current, " ")
-			chunks = append(chunks, Chunk{
-				ID:   fmt.Sprintf("%s-%d", docID, index),
-				Text: chunkText,
-			})
-			index++
-			current = nil
-		}
-	}
-	if len(current) > 0 {
-		chunkText := strings.Join(current, " ")
-		chunks = append(chunks, Chunk{
-			ID:   fmt.Sprintf("%s-%d", docID, index),
-			Text: chunkText,
-		})
-	}
+	MaintenanceInterval time.Duration // MAINTENANCE_INTERVAL (0 disables the maintenance loop)
+	EmbedCacheMaxAge    time.Duration // EMBED_CACHE_MAX_AGE (0 keeps cache files forever)
+	OrphanCleanup       bool          // ORPHAN_CLEANUP (delete chunks whose saved source was removed)
 
-	return chunks
-}
+	RecencyHalfLife time.Duration // RECENCY_HALF_LIFE (0 disables the recency boost)
+	RecencyWeight   float64       // RECENCY_WEIGHT (share of the score subject to decay, 0..1)
 
-type Config struct {
-	HFAPIKey       string // HF_API_KEY (required)
-	EmbedModelName string // EMBED_MODEL_NAME
-	GeminiAPIKey   string // GEMINI_API_KEY
-	LLMModelName   string // LLM_MODEL_NAME
-	ChromaDBHost   string // CHROMA_DB_HOST
-	RAGDataDir     string // RAG_DATA_DIR
-	ChunkLength    int    // CHUNK_LENGTH
-	Port           int    // PORT
+	NeighborChunks int // NEIGHBOR_CHUNKS (adjacent chunks added on each side of a chat hit, 0..3)
+
+	PromptTemplatesDir string  // PROMPT_TEMPLATES_DIR (named prompt templates, <name>.tmpl)
+	GroundingThreshold float64 // GROUNDING_THRESHOLD (claim score counted as supported)
+	LLMFallback        string  // LLM_FALLBACK (context|extractive|off: what /chat answers when generation fails)
+
+	StopSequences   []string // LLM_STOP_SEQUENCES (comma-separated, at most 5; \n for a newline)
+	MaxOutputTokens int      // LLM_MAX_OUTPUT_TOKENS (answers are cut, and flagged truncated, beyond this; 0: the model's limit)
+
+	QueryLog          string        // QUERY_LOG (off|redacted|full: what the query log keeps of each chat)
+	QueryLogRetention time.Duration // QUERY_LOG_RETENTION (age at which maintenance drops entries; 0 keeps them)
+
+	WebhookURL    string // WEBHOOK_URL (default callback for async upload jobs)
+	WebhookSecret string // WEBHOOK_SECRET (signs webhook payloads when set)
+
+	Experiment *Experiment // read from EXPERIMENT_FILE (nil runs no experiment)
+
+	Pipelines *Pipelines // read from PIPELINE_FILE (nil: only the built-in pipeline)
+
+	Profiles *Profiles // read from PROFILE_FILE (nil: no answer profiles)
+
+	Quotas *Quotas // read from QUOTA_FILE (nil: usage is counted but not limited)
+
+	SyncSources        []SyncSource // read from SYNC_FILE (none: no scheduled sync)
+	AWSAccessKeyID     string       // AWS_ACCESS_KEY_ID (signs s3 sync requests; empty: anonymous)
+	AWSSecretAccessKey string       // AWS_SECRET_ACCESS_KEY
+	AWSSessionToken    string       // AWS_SESSION_TOKEN (temporary credentials)
+
+	DriveCredentials *DriveCredentials // read from DRIVE_CREDENTIALS_FILE (a service account key for drive sync)
+	DriveAPIKey      string            // DRIVE_API_KEY (reads publicly shared folders when there is no key file)
 }
 
-var currentConfig Config
-var collection chroma.Collection
+// defaultCollection is the collection uploads go to, and after a reindex
+// the alias of the collection that replaced it.
+const defaultCollection = "rag_demo"
 
-func initChromaCollection(ctx context.Context) error {
-	c, err := chromaClient.GetOrCreateCollection(ctx, "rag_demo")
+func initChromaCollection(ctx context.Context, client chroma.Client, cfg Config, name string) (chroma.Collection, error) {
+	c, err := client.GetOrCreateCollection(ctx, name, collectionCreateOptions(cfg)...)
 	if err != nil {
-		return fmt.Errorf("GetOrCreateCollection failed: %w", err)
+		return nil, fmt.Errorf("GetOrCreateCollection failed: %w", err)
+	}
+
+	// Index settings only apply when the collection is first created.
+	if want := cfg.ChromaDistance; want != "" && c.Metadata() != nil {
+		if have, ok := c.Metadata().GetString(chroma.HNSWSpace); ok && have != want {
+			log.Printf("warning: collection %s uses distance %q, not the configured %q; recreate it to change", c.Name(), have, want)
+		}
+	}
+	return c, nil
+}
+
+// collectionResolver looks up the named collection for the default one,
+// creating it if Chroma does not have it.
+func collectionResolver(client chroma.Client, cfg Config, name string) func(ctx context.Context) (VectorStore, error) {
+	return func(ctx context.Context) (VectorStore, error) {
+		return initChromaCollection(ctx, client, cfg, name)
 	}
-	collection = c
-	return nil
+}
+
+// collectionCreateOptions records the embedding model and maps the configured
+// distance metric and HNSW parameters onto collection creation options; zero
+// values keep Chroma's defaults.
+func collectionCreateOptions(cfg Config) []chroma.CreateCollectionOption {
+	// must come first: it replaces the metadata the HNSW options add to
+	opts := []chroma.CreateCollectionOption{
+		chroma.WithCollectionMetadataCreate(chroma.NewMetadata(
+			chroma.NewStringAttribute(metaEmbedModel, cfg.EmbedModelName),
+		)),
+	}
+	if cfg.ChromaDistance != "" {
+		opts = append(opts, chroma.WithHNSWSpaceCreate(embeddings.DistanceMetric(cfg.ChromaDistance)))
+	}
+	if cfg.HNSWM > 0 {
+		opts = append(opts, chroma.WithHNSWMCreate(cfg.HNSWM))
+	}
+	if cfg.HNSWConstructionEF > 0 {
+		opts = append(opts, chroma.WithHNSWConstructionEfCreate(cfg.HNSWConstructionEF))
+	}
+	if cfg.HNSWSearchEF > 0 {
+		opts = append(opts, chroma.WithHNSWSearchEfCreate(cfg.HNSWSearchEF))
+	}
+	return opts
 }
 
 // Load loads .env-style files then reads process env.
@@ -179,14 +296,168 @@ func Load() (Config, error) {
 		EmbedModelName: getEnvOr("EMBED_MODEL_NAME", "sentence-transformers/all-MiniLM-L6-v2"),
 		GeminiAPIKey:   os.Getenv("GEMINI_API_KEY"),
 		LLMModelName:   getEnvOr("LLM_MODEL_NAME", "gemini-2.5-flash"),
+		LLMMode:        strings.ToLower(os.Getenv("LLM_MODE")),
+		EmbedMode:      strings.ToLower(os.Getenv("EMBED_MODE")),
 		ChromaDBHost:   getEnvOr("CHROMA_DB_HOST", "http://localhost:8000"),
 		RAGDataDir:     getEnvOr("RAG_DATA_DIR", "./data"),
-		ChunkLength:    getIntOr("CHUNK_LENGTH", 800),
+		ChunkStrategy:  strings.ToLower(getEnvOr("CHUNK_STRATEGY", "sentence")),
+		ChunkLength:    getIntOr("CHUNK_LENGTH", 0),
+		ChunkOverlap:   getIntOr("CHUNK_OVERLAP", 0),
 		Port:           getIntOr("PORT", 8080),
+		Categories:     getListOr("DOC_CATEGORIES", nil),
+		AdminToken:     os.Getenv("ADMIN_TOKEN"),
+		ChunkSummaries: getBoolOr("CHUNK_SUMMARIES", false),
+
+		ChromaDistance:     strings.ToLower(os.Getenv("CHROMA_DISTANCE")),
+		HNSWM:              getIntOr("HNSW_M", 0),
+		HNSWConstructionEF: getIntOr("HNSW_CONSTRUCTION_EF", 0),
+		HNSWSearchEF:       getIntOr("HNSW_SEARCH_EF", 0),
+		EmbedQuantize:      strings.ToLower(os.Getenv("EMBED_QUANTIZE")),
+		ChromaBatchSize:    getIntOr("CHROMA_BATCH_SIZE", 500),
+
+		ChromaHealthInterval: getDurationOr("CHROMA_HEALTH_INTERVAL", 30*time.Second),
+
+		EmbedProviders: getListOr("EMBED_PROVIDERS", []string{providerHF}),
+		EmbedSLO:       getDurationOr("EMBED_SLO", 0),
+		TEIURL:         os.Getenv("TEI_URL"),
+		TEIToken:       os.Getenv("TEI_API_TOKEN"),
+
+		MaintenanceInterval: getDurationOr("MAINTENANCE_INTERVAL", time.Hour),
+		EmbedCacheMaxAge:    getDurationOr("EMBED_CACHE_MAX_AGE", 0),
+		OrphanCleanup:       getBoolOr("ORPHAN_CLEANUP", false),
+
+		RecencyHalfLife: getDurationOr("RECENCY_HALF_LIFE", 0),
+		RecencyWeight:   getFloatOr("RECENCY_WEIGHT", 0.3),
+
+		NeighborChunks: getIntOr("NEIGHBOR_CHUNKS", 0),
+
+		PromptTemplatesDir: os.Getenv("PROMPT_TEMPLATES_DIR"),
+		GroundingThreshold: getFloatOr("GROUNDING_THRESHOLD", 0.6),
+		LLMFallback:        strings.ToLower(getEnvOr("LLM_FALLBACK", fallbackContext)),
+
+		StopSequences:   getListOr("LLM_STOP_SEQUENCES", nil),
+		MaxOutputTokens: getIntOr("LLM_MAX_OUTPUT_TOKENS", 0),
+
+		QueryLog:          strings.ToLower(getEnvOr("QUERY_LOG", queryLogOff)),
+		QueryLogRetention: getDurationOr("QUERY_LOG_RETENTION", 30*24*time.Hour),
+
+		WebhookURL:    os.Getenv("WEBHOOK_URL"),
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+	}
+	switch cfg.LLMMode {
+	case "", modeMock:
+	default:
+		return cfg, fmt.Errorf("invalid LLM_MODE %q: want mock or empty", cfg.LLMMode)
+	}
+	switch cfg.EmbedMode {
+	case "":
+	case modeMock:
+		// a distinct model name keeps mock vectors out of real collections
+		cfg.EmbedProviders = []string{providerMock}
+		cfg.EmbedModelName = mockEmbedModel
+	default:
+		return cfg, fmt.Errorf("invalid EMBED_MODE %q: want mock or empty", cfg.EmbedMode)
+	}
+	for _, p := range cfg.EmbedProviders {
+		switch p {
+		case providerHF:
+			if cfg.HFAPIKey == "" {
+				return cfg, fmt.Errorf("missing required env: HF_API_KEY")
+			}
+		case providerTEI:
+			if cfg.TEIURL == "" {
+				return cfg, fmt.Errorf("missing required env: TEI_URL (EMBED_PROVIDERS includes tei)")
+			}
+		case providerMock:
+		case providerONNX:
+			if cfg.EmbedModelName != onnxModelName {
+				return cfg, fmt.Errorf("EMBED_PROVIDERS includes onnx, which only runs %s; set EMBED_MODEL_NAME to it", onnxModelName)
+			}
+		default:
+			return cfg, fmt.Errorf("invalid EMBED_PROVIDERS entry %q: want hf, tei or onnx", p)
+		}
+	}
+	if err := cfg.chunkParams().Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid CHUNK_STRATEGY, CHUNK_LENGTH or CHUNK_OVERLAP: %w", err)
+	}
+	switch embeddings.DistanceMetric(cfg.ChromaDistance) {
+	case "", embeddings.COSINE, embeddings.L2, embeddings.IP:
+	default:
+		return cfg, fmt.Errorf("invalid CHROMA_DISTANCE %q: want cosine, l2 or ip", cfg.ChromaDistance)
+	}
+	switch cfg.EmbedQuantize {
+	case "":
+	case quantInt8:
+		if embeddings.DistanceMetric(cfg.ChromaDistance) != embeddings.COSINE {
+			return cfg, fmt.Errorf("EMBED_QUANTIZE=int8 requires CHROMA_DISTANCE=cosine")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid EMBED_QUANTIZE %q: want int8 or empty", cfg.EmbedQuantize)
+	}
+	if cfg.PromptTemplatesDir == "" {
+		cfg.PromptTemplatesDir = filepath.Join(cfg.RAGDataDir, "templates")
+	}
+	if cfg.RecencyWeight < 0 || cfg.RecencyWeight > 1 {
+		return cfg, fmt.Errorf("invalid RECENCY_WEIGHT %v: want 0..1", cfg.RecencyWeight)
+	}
+	if cfg.NeighborChunks < 0 || cfg.NeighborChunks > maxNeighborChunks {
+		return cfg, fmt.Errorf("invalid NEIGHBOR_CHUNKS %d: want 0..%d", cfg.NeighborChunks, maxNeighborChunks)
 	}
-	if cfg.HFAPIKey == "" {
-		return cfg, fmt.Errorf("missing required env: HF_API_KEY")
+	if cfg.GroundingThreshold < 0 || cfg.GroundingThreshold > 1 {
+		return cfg, fmt.Errorf("invalid GROUNDING_THRESHOLD %v: want 0..1", cfg.GroundingThreshold)
 	}
+	switch cfg.LLMFallback {
+	case fallbackContext, fallbackExtractive, fallbackOff:
+	default:
+		return cfg, fmt.Errorf("invalid LLM_FALLBACK %q: want context, extractive or off", cfg.LLMFallback)
+	}
+	if len(cfg.StopSequences) > maxStopSequences {
+		return cfg, fmt.Errorf("invalid LLM_STOP_SEQUENCES: at most %d sequences", maxStopSequences)
+	}
+	for i, seq := range cfg.StopSequences {
+		cfg.StopSequences[i] = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(seq)
+	}
+	if cfg.MaxOutputTokens < 0 {
+		return cfg, fmt.Errorf("invalid LLM_MAX_OUTPUT_TOKENS %d: want 0 or more", cfg.MaxOutputTokens)
+	}
+	switch cfg.QueryLog {
+	case queryLogOff, queryLogRedacted, queryLogFull:
+	default:
+		return cfg, fmt.Errorf("invalid QUERY_LOG %q: want off, redacted or full", cfg.QueryLog)
+	}
+	if cfg.WebhookURL != "" {
+		if err := validateCallbackURL(cfg.WebhookURL); err != nil {
+			return cfg, fmt.Errorf("WEBHOOK_URL: %w", err)
+		}
+	}
+	var err error
+	if cfg.Pipelines, err = loadPipelines(os.Getenv("PIPELINE_FILE")); err != nil {
+		return cfg, fmt.Errorf("PIPELINE_FILE: %w", err)
+	}
+	if cfg.Profiles, err = loadProfiles(os.Getenv("PROFILE_FILE")); err != nil {
+		return cfg, fmt.Errorf("PROFILE_FILE: %w", err)
+	}
+	if cfg.Experiment, err = loadExperiment(os.Getenv("EXPERIMENT_FILE")); err != nil {
+		return cfg, fmt.Errorf("EXPERIMENT_FILE: %w", err)
+	}
+	if e := cfg.Experiment; e != nil && e.Variant.Pipeline != "" {
+		if _, ok := cfg.Pipelines.lookup(e.Variant.Pipeline); !ok {
+			return cfg, fmt.Errorf("EXPERIMENT_FILE: variant uses unknown pipeline %q", e.Variant.Pipeline)
+		}
+	}
+	if cfg.Quotas, err = loadQuotas(os.Getenv("QUOTA_FILE")); err != nil {
+		return cfg, fmt.Errorf("QUOTA_FILE: %w", err)
+	}
+	if cfg.SyncSources, err = loadSyncSources(os.Getenv("SYNC_FILE")); err != nil {
+		return cfg, fmt.Errorf("SYNC_FILE: %w", err)
+	}
+	cfg.AWSAccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	cfg.AWSSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	cfg.AWSSessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if cfg.DriveCredentials, err = loadDriveCredentials(os.Getenv("DRIVE_CREDENTIALS_FILE")); err != nil {
+		return cfg, fmt.Errorf("DRIVE_CREDENTIALS_FILE: %w", err)
+	}
+	cfg.DriveAPIKey = os.Getenv("DRIVE_API_KEY")
 	return cfg, nil
 }
 
@@ -248,3 +519,44 @@ func getIntOr(key string, def int) int {
 	}
 	return def
 }
+
+func getFloatOr(key string, def float64) float64 {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func getBoolOr(key string, def bool) bool {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func getDurationOr(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func getListOr(key string, def []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// runMaintenance periodically removes expired and orphaned chunks and compacts
+// the embedding cache directory. It returns when ctx is done.
+func (s *Server) runMaintenance(ctx context.Context, interval time.Duration) {
+	log.Printf("Maintenance scheduled every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.maintain(ctx)
+		}
+	}
+}
+
+// maintain runs one maintenance pass; each step logs and carries on after errors
+// so one failing step does not block the others.
+func (s *Server) maintain(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	if n, err := s.deleteExpiredChunks(ctx, time.Now()); err != nil {
+		log.Printf("maintenance: expiry failed: %v", err)
+	} else if n > 0 {
+		log.Printf("maintenance: deleted %d expired chunks", n)
+	}
+
+	if s.cfg.OrphanCleanup {
+		if n, err := s.deleteOrphanedChunks(ctx); err != nil {
+			log.Printf("maintenance: orphan cleanup failed: %v", err)
+		} else if n > 0 {
+			log.Printf("maintenance: deleted %d orphaned chunks", n)
+		}
+	}
+
+	if s.cfg.QueryLogRetention > 0 {
+		if n, err := s.pruneQueryLog(time.Now().Add(-s.cfg.QueryLogRetention)); err != nil {
+			log.Printf("maintenance: query log pruning failed: %v", err)
+		} else if n > 0 {
+			log.Printf("maintenance: dropped %d query log entries", n)
+		}
+	}
+
+	if n, err := compactEmbedCache(s.embedCacheDir(), s.cfg.EmbedCacheMaxAge, time.Now()); err != nil {
+		log.Printf("maintenance: cache compaction failed: %v", err)
+	} else if n > 0 {
+		log.Printf("maintenance: removed %d cache files", n)
+	}
+}
+
+// deleteExpiredChunks removes chunks whose expires_at (Unix seconds) is in the past.
+func (s *Server) deleteExpiredChunks(ctx context.Context, now time.Time) (int, error) {
+	ids, err := collectionIDs(ctx, s.store, chroma.LtInt("expires_at", int(now.Unix())))
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), deleteIDs(ctx, s.store, ids)
+}
+
+// maxOrphanShare is the largest share of the chunks with a source that orphan
+// cleanup deletes in one pass. More than that looks like a moved or missing
+// data directory rather than retired documents.
+const maxOrphanShare = 0.5
+
+// deleteOrphanedChunks removes chunks whose source file (metadata "source_path",
+// written at upload) no longer exists in the data directory. Chunks without a
+// source path, or with one that does not resolve inside the data directory,
+// are left alone.
+func (s *Server) deleteOrphanedChunks(ctx context.Context) (int, error) {
+	bySource := map[string][]chroma.DocumentID{}
+	withSource := 0
+	for offset := 0; ; offset += chromaPageSize {
+		res, err := s.store.Get(ctx,
+			chroma.WithIncludeGet(chroma.IncludeMetadatas),
+			chroma.WithLimitGet(chromaPageSize),
+			chroma.WithOffsetGet(offset),
+		)
+		if err != nil {
+			return 0, err
+		}
+		ids, metas := res.GetIDs(), res.GetMetadatas()
+		for i, id := range ids {
+			if i >= len(metas) || metas[i] == nil {
+				continue
+			}
+			src, ok := metas[i].GetString("source_path")
+			if !ok {
+				continue
+			}
+			if path, ok := s.sourceFilePath(src); ok {
+				bySource[path] = append(bySource[path], id)
+				withSource++
+			}
+		}
+		if len(ids) < chromaPageSize {
+			break
+		}
+	}
+
+	var orphans []chroma.DocumentID
+	for src, ids := range bySource {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			orphans = append(orphans, ids...)
+		}
+	}
+	if len(orphans) > 0 && float64(len(orphans)) > maxOrphanShare*float64(withSource) {
+		return 0, fmt.Errorf("refusing to delete %d of %d chunks as orphaned; check RAG_DATA_DIR (%s)",
+			len(orphans), withSource, s.cfg.RAGDataDir)
+	}
+	return len(orphans), deleteIDs(ctx, s.store, orphans)
+}
+
+// compactEmbedCache removes temp files left behind by interrupted cache writes
+// and, when maxAge is positive, cache files not written for longer than maxAge.
+func compactEmbedCache(dir string, maxAge time.Duration, now time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		age := now.Sub(info.ModTime())
+		stale := strings.HasSuffix(e.Name(), ".tmp") && age > time.Hour
+		expired := maxAge > 0 && age > maxAge
+		if stale || expired {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// saveSource keeps a copy of an uploaded document in the data directory, so
+// chunks can be traced back to (and cleaned up with) their source file.
+// Documents from archives keep their directories, so equal file names in
+// different folders do not overwrite each other. It returns the path to
+// record on the chunks, relative to the data directory so it still resolves
+// after the directory moves or the server starts from elsewhere.
+func (s *Server) saveSource(fileName, content string) (string, error) {
+	rel := filepath.FromSlash(fileName)
+	if !filepath.IsLocal(rel) {
+		rel = filepath.Base(rel)
+	}
+	rel = filepath.Join("sources", rel)
+	path := filepath.Join(s.cfg.RAGDataDir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), os.WriteFile(path, []byte(content), 0o600)
+}
+
+// sourceFilePath resolves a recorded source_path to the file, reporting false
+// when it cannot tell where the file is. Chunks stored before paths were
+// recorded relative to the data directory hold the data directory they were
+// saved under; those resolve only while RAG_DATA_DIR still names it.
+func (s *Server) sourceFilePath(src string) (string, bool) {
+	if src == "" {
+		return "", false
+	}
+	if filepath.IsAbs(src) {
+		return src, true
+	}
+	rel := filepath.FromSlash(src)
+	if strings.HasPrefix(src, "sources/") && filepath.IsLocal(rel) {
+		return filepath.Join(s.cfg.RAGDataDir, rel), true
+	}
+	legacy := filepath.Join(s.cfg.RAGDataDir, "sources") + string(filepath.Separator)
+	if rest, ok := strings.CutPrefix(filepath.Clean(rel), legacy); ok && filepath.IsLocal(rest) {
+		return filepath.Join(s.cfg.RAGDataDir, "sources", rest), true
+	}
+	return "", false
+}
+
+// removeSource deletes the copy saveSource kept of doc. Names saveSource had
+// to flatten are left alone, since another document may share the file.
+func (s *Server) removeSource(doc string) {
+	rel := filepath.FromSlash(doc)
+	if filepath.IsLocal(rel) {
+		_ = os.Remove(filepath.Join(s.cfg.RAGDataDir, "sources", rel))
+	}
+}
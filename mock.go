@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// modeMock is the LLM_MODE and EMBED_MODE value that swaps the external APIs
+// for deterministic local stand-ins, so the whole HTTP flow can run in CI and
+// demos without API keys. Like the embedding cache, it trades fidelity for
+// repeatability.
+const modeMock = "mock"
+
+// -------------------- Mock embedder --------------------
+
+// Mock vectors have the dimension of all-MiniLM-L6-v2 but their own model
+// name, so a collection built with them is never queried with real vectors.
+const (
+	mockEmbedDim   = 384
+	mockEmbedModel = "mock/hashed-bag-of-words-384"
+)
+
+// mockEmbedder hashes each lowercased word into one of dim buckets with a
+// hash-derived sign and normalizes the result. Texts sharing words get similar
+// vectors, so retrieval still returns plausible chunks.
+type mockEmbedder struct {
+	dim int
+}
+
+func (m mockEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error) {
+	out := make(map[string][]float32, len(chunks))
+	for _, c := range chunks {
+		out[c.ID] = m.vector(c.Text)
+	}
+	return out, nil
+}
+
+func (m mockEmbedder) vector(text string) []float32 {
+	vec := make([]float32, m.dim)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		sum := sha256.Sum256([]byte(w))
+		h := binary.BigEndian.Uint64(sum[:8])
+		sign := float32(1)
+		if h&1 == 1 {
+			sign = -1
+		}
+		vec[(h>>1)%uint64(m.dim)] += sign
+	}
+
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		// empty or symbol-only text: any fixed unit vector will do
+		vec[0] = 1
+		return vec
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range vec {
+		vec[i] *= scale
+	}
+	return vec
+}
+
+// -------------------- Mock LLM --------------------
+
+// mockLLM answers every prompt with a fixed sentence tagged with a hash of the
+// prompt, so identical requests get identical answers and different ones
+// differ. Features that parse the reply (classification, self-query, JSON
+// answers, LLM grounding) see an unusable reply and take their fallback paths.
+type mockLLM struct{}
+
+func (mockLLM) answer(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return fmt.Sprintf("This is a mock answer (%s) based on the retrieved context.", hex.EncodeToString(sum[:4]))
+}
+
+func (m mockLLM) Generate(ctx context.Context, prompt string) (string, error) {
+	return m.answer(prompt), nil
+}
+
+// GenerateStream sends the answer a word at a time.
+func (m mockLLM) GenerateStream(ctx context.Context, prompt string, onDelta func(string) error) (string, *LLMUsage, error) {
+	answer := m.answer(prompt)
+	words := strings.SplitAfter(answer, " ")
+	for _, w := range words {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+		if err := onDelta(w); err != nil {
+			return answer, nil, err
+		}
+	}
+	usage := &LLMUsage{PromptTokens: estimateTokens(prompt), CompletionTokens: estimateTokens(answer)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return answer, usage, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMockModes boots the server as LLM_MODE=mock and EMBED_MODE=mock
+// configure it, with only the vector store faked, and runs an upload and a
+// chat through it.
+func TestMockModes(t *testing.T) {
+	t.Setenv("LLM_MODE", "mock")
+	t.Setenv("EMBED_MODE", "mock")
+	t.Setenv("EMBED_CACHE_MODE", "off")
+	t.Setenv("RAG_DATA_DIR", t.TempDir())
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llm, err := initLLM(t.Context(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder, err := NewEmbedder(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewServer(cfg, Deps{
+		Store:    newFakeStore("test_mock"),
+		Embedder: embedder,
+		LLM:      llm,
+	}))
+	defer srv.Close()
+
+	if res := uploadFile(t, srv, "otters.txt", testDocument); res.Chunks == 0 {
+		t.Fatal("no chunks reported")
+	}
+	res := chat(t, srv, ChatRequest{Query: "What is a group of resting otters called?"})
+	if !strings.HasPrefix(res.Answer, "This is a mock answer") {
+		t.Errorf("answer = %q, want the mock LLM's", res.Answer)
+	}
+	if len(res.Citations) == 0 || res.Citations[0].Document != "otters.txt" {
+		t.Errorf("citations = %+v, want otters.txt", res.Citations)
+	}
+}
@@ -1,32 +1,90 @@
 package main
 
 import (
-    "context"
-    "crypto/sha256"
-    "encoding/hex"
-    "encoding/json"
-    "fmt"
-    "os"
-    "path/filepath"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 )
 
 type EmbeddingMap map[string][]float32
 
+// embedCacheDir holds the on-disk embedding cache under RAG_DATA_DIR, one JSON
+// file per cache key; it is also compacted by the maintenance loop. Cache file
+// reads and writes are serialized by the state's embedCacheMu, which is never
+// held while embedding, so concurrent uploads still run in parallel.
+func (s *Server) embedCacheDir() string {
+	return filepath.Join(s.cfg.RAGDataDir, "embeddings_cache")
+}
+
+// Embedding cache modes, set by EMBED_CACHE_MODE or per upload by cache_mode.
+const (
+	cacheAuto = "auto"
+	cacheLoad = "load"
+	cacheOff  = "off"
+)
+
+// parseCacheMode checks a cache_mode field; "" leaves EMBED_CACHE_MODE in charge.
+func parseCacheMode(v string) (string, error) {
+	switch v {
+	case "", cacheAuto, cacheLoad, cacheOff:
+		return v, nil
+	}
+	return "", fmt.Errorf("cache_mode must be auto, load or off")
+}
+
+// embedCacheCounters count a server's cache lookups (see statsHandler).
+type embedCacheCounters struct {
+	hits     atomic.Int64 // lookups answered from a cache file
+	misses   atomic.Int64 // no matching cache file
+	saves    atomic.Int64 // cache files written after a miss
+	bypassed atomic.Int64 // embedded with the cache off
+}
+
+// errCacheCorrupt is returned when a cache file cannot be parsed or fails its checksum.
+var errCacheCorrupt = errors.New("embeddings cache file is corrupt")
+
 type embedCacheFile struct {
 	Version    int                  `json:"version"`
-	Key        string               `json:"key"`   // identifies doc+chunking
-	Model      string               `json:"model"` // embed model name (optional)
+	Key        string               `json:"key"`                // identifies doc+chunking
+	Model      string               `json:"model"`              // embed model name (optional)
+	Provider   string               `json:"provider,omitempty"` // embedding provider that produced the vectors
+	Checksum   string               `json:"checksum"`           // sha256 of the embeddings JSON
 	Embeddings map[string][]float32 `json:"embeddings"`
 }
 
 // stable cache key: fileName + content hash + chunking params (and optionally model)
-func makeEmbedCacheKey(fileName string, content string, chunkSize int, model string) string {
+func makeEmbedCacheKey(fileName string, content string, chunking string, model string) string {
 	sum := sha256.Sum256([]byte(content))
-	return fmt.Sprintf("%s|sha256:%s|chunk:%d|model:%s", fileName, hex.EncodeToString(sum[:]), chunkSize, model)
+	return fmt.Sprintf("%s|sha256:%s|chunk:%s|model:%s", fileName, hex.EncodeToString(sum[:]), chunking, model)
+}
+
+// embedCachePath is the cache file for a cache key.
+func (s *Server) embedCachePath(cacheKey string) string {
+	sum := sha256.Sum256([]byte(cacheKey))
+	return filepath.Join(s.embedCacheDir(), hex.EncodeToString(sum[:16])+".json")
 }
 
-func loadEmbeddingsFromFile(path string) (EmbeddingMap, *embedCacheFile, bool, error) {
+// embeddingsChecksum hashes the embeddings' JSON encoding (map keys are sorted,
+// so it is deterministic).
+func embeddingsChecksum(emb map[string][]float32) (string, error) {
+	b, err := json.Marshal(emb)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *Server) loadEmbeddingsFromFile(path string) (EmbeddingMap, *embedCacheFile, bool, error) {
+	s.state.embedCacheMu.Lock()
 	b, err := os.ReadFile(path)
+	s.state.embedCacheMu.Unlock()
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil, false, nil
@@ -36,106 +94,160 @@ func loadEmbeddingsFromFile(path string) (EmbeddingMap, *embedCacheFile, bool, e
 
 	var cf embedCacheFile
 	if err := json.Unmarshal(b, &cf); err != nil {
-		return nil, nil, false, err
+		return nil, nil, false, fmt.Errorf("%w: %v", errCacheCorrupt, err)
 	}
 	if cf.Embeddings == nil {
 		return nil, &cf, false, nil
 	}
+	sum, err := embeddingsChecksum(cf.Embeddings)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if cf.Checksum != sum {
+		return nil, &cf, false, fmt.Errorf("%w: checksum mismatch", errCacheCorrupt)
+	}
 	return EmbeddingMap(cf.Embeddings), &cf, true, nil
 }
 
-func saveEmbeddingsToFileAtomic(path string, cf embedCacheFile) error {
+// saveEmbeddingsToFileAtomic writes through a uniquely named temp file and
+// renames it into place, so concurrent writers never share a temp file and
+// readers never see a partial file.
+func (s *Server) saveEmbeddingsToFileAtomic(path string, cf embedCacheFile) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
 	}
-	tmp := path + ".tmp"
+
+	sum, err := embeddingsChecksum(cf.Embeddings)
+	if err != nil {
+		return err
+	}
+	cf.Checksum = sum
 
 	b, err := json.MarshalIndent(cf, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	return os.Rename(tmp, path)
+
+	s.state.embedCacheMu.Lock()
+	defer s.state.embedCacheMu.Unlock()
+	return os.Rename(tmp.Name(), path)
 }
 
 // Main helper: load if possible, else compute via embedFn and save.
-func getEmbeddingsCached(
-    ctx context.Context,
-    cachePath string,
-    cacheKey string,
-    model string,
-    embedFn func(context.Context) (map[string][]float32, error),
-) (map[string][]float32, error) {
-
-	emb, cf, ok, err := loadEmbeddingsFromFile(cachePath)
-	if err != nil {
-		return nil, err
+func (s *Server) getEmbeddingsCached(
+	ctx context.Context,
+	cachePath string,
+	cacheKey string,
+	model string,
+	embedFn func(context.Context) (map[string][]float32, string, error),
+) (map[string][]float32, string, error) {
+
+	emb, cf, ok, err := s.loadEmbeddingsFromFile(cachePath)
+	if errors.Is(err, errCacheCorrupt) {
+		// a corrupt entry is just a miss; it is overwritten below
+		logf(ctx, "ignoring embeddings cache %s: %v", cachePath, err)
+	} else if err != nil {
+		return nil, "", err
 	}
 	if ok && cf != nil && cf.Key == cacheKey {
 		// Cache hit
-		return map[string][]float32(emb), nil
+		s.state.embedCache.hits.Add(1)
+		return map[string][]float32(emb), cf.Provider, nil
 	}
 
 	// Cache miss → run real embedding
-	out, err := embedFn(ctx)
+	s.state.embedCache.misses.Add(1)
+	out, provider, err := embedFn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Save
-	_ = saveEmbeddingsToFileAtomic(cachePath, embedCacheFile{
-		Version:    1,
+	if err := s.saveEmbeddingsToFileAtomic(cachePath, embedCacheFile{
+		Version:    2,
 		Key:        cacheKey,
 		Model:      model,
+		Provider:   provider,
 		Embeddings: out,
-	})
-    return out, nil
+	}); err != nil {
+		logf(ctx, "failed to save embeddings cache %s: %v", cachePath, err)
+	} else {
+		s.state.embedCache.saves.Add(1)
+	}
+	return out, provider, nil
 }
 
 // embedWithCache wraps Embedder.Embed with a tiny on-disk JSON cache.
-// Behavior is controlled by ENV var EMBED_CACHE_MODE:
+// Behavior is controlled by mode, or when it is empty by ENV var
+// EMBED_CACHE_MODE:
 //   - "off":  always call API (never load/save cache)
 //   - "load": only load from cache; error if not found or key mismatch
 //   - "auto" (default): load if key matches, else call API and save
+//
 // The cache key is derived from fileName, content hash, chunking, and model name.
-func embedWithCache(
-    ctx context.Context,
-    embedder Embedder,
-    chunks []Chunk,
-    fileName string,
-    contentStr string,
-    chunkSize int,
-    modelName string,
-) (map[string][]float32, error) {
-    mode := os.Getenv("EMBED_CACHE_MODE") // "auto" | "load" | "off"
-    if mode == "" {
-        mode = "auto"
-    }
-    cachePath := "tmp/embeddings_cache.json"
-
-    cacheKey := makeEmbedCacheKey(fileName, contentStr, chunkSize, modelName)
-
-    switch mode {
-    case "off":
-        // Always call API
-        return embedder.Embed(ctx, chunks)
-
-    case "load":
-        // Never call API, only load
-        loaded, cf, ok, err := loadEmbeddingsFromFile(cachePath)
-        if err != nil {
-            return nil, fmt.Errorf("failed to load embeddings cache: %w", err)
-        }
-        if !ok || cf == nil || cf.Key != cacheKey {
-            return nil, fmt.Errorf("no matching cached embeddings found (set EMBED_CACHE_MODE=auto to generate once)")
-        }
-        return map[string][]float32(loaded), nil
-
-    default: // "auto"
-        return getEmbeddingsCached(ctx, cachePath, cacheKey, modelName, func(ctx context.Context) (map[string][]float32, error) {
-            return embedder.Embed(ctx, chunks)
-        })
-    }
+// It also returns the name of the provider that produced the vectors, if known.
+func (s *Server) embedWithCache(
+	ctx context.Context,
+	embedder Embedder,
+	chunks []Chunk,
+	fileName string,
+	contentStr string,
+	chunking string,
+	modelName string,
+	mode string,
+) (map[string][]float32, string, error) {
+	if mode == "" {
+		mode = embedCacheMode()
+	}
+
+	cacheKey := makeEmbedCacheKey(fileName, contentStr, chunking, modelName)
+	cachePath := s.embedCachePath(cacheKey)
+
+	switch mode {
+	case cacheOff:
+		// Always call API
+		s.state.embedCache.bypassed.Add(1)
+		return embedChunks(ctx, embedder, chunks)
+
+	case cacheLoad:
+		// Never call API, only load
+		loaded, cf, ok, err := s.loadEmbeddingsFromFile(cachePath)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load embeddings cache: %w", err)
+		}
+		if !ok || cf == nil || cf.Key != cacheKey {
+			s.state.embedCache.misses.Add(1)
+			return nil, "", fmt.Errorf("no matching cached embeddings found (set EMBED_CACHE_MODE=auto or cache_mode=auto to generate once)")
+		}
+		s.state.embedCache.hits.Add(1)
+		return map[string][]float32(loaded), cf.Provider, nil
+
+	default: // "auto"
+		return s.getEmbeddingsCached(ctx, cachePath, cacheKey, modelName, func(ctx context.Context) (map[string][]float32, string, error) {
+			return embedChunks(ctx, embedder, chunks)
+		})
+	}
+}
+
+// embedCacheMode is the configured EMBED_CACHE_MODE, auto by default.
+func embedCacheMode() string {
+	switch mode := os.Getenv("EMBED_CACHE_MODE"); mode {
+	case cacheLoad, cacheOff:
+		return mode
+	}
+	return cacheAuto
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// maxNeighborChunks bounds how many chunks on each side of a hit neighborhood
+// expansion adds.
+const maxNeighborChunks = 3
+
+// neighborWindow records the chunks neighborhood expansion added around a
+// hit, and the span of the document the expanded text covers.
+type neighborWindow struct {
+	IDs        []string
+	Start, End int
+}
+
+// requestNeighbors returns how many neighbors on each side req asks for,
+// NEIGHBOR_CHUNKS when it does not say.
+func (s *Server) requestNeighbors(req ChatRequest) (int, error) {
+	if req.Neighbors == nil {
+		return s.cfg.NeighborChunks, nil
+	}
+	if n := *req.Neighbors; n < 0 || n > maxNeighborChunks {
+		return 0, fmt.Errorf("neighbors must be 0..%d", maxNeighborChunks)
+	}
+	return *req.Neighbors, nil
+}
+
+// chunkIndex splits a chunk ID ("<document>-<index>") into its document and
+// its position in it.
+func chunkIndex(id string) (doc string, index int, ok bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(id[i+1:])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return id[:i], index, true
+}
+
+// expandNeighbors adds to each hit the n chunks before and after it in its
+// document, so the prompt sees the text around a short chunk. A neighbor is
+// added once, to the best-ranked hit next to it, and never when it is a hit
+// itself; excluded chunks and chunks the caller may not read are left out.
+// The hits keep their order and scores.
+func (s *Server) expandNeighbors(ctx context.Context, hits []retrievedChunk, n int) ([]retrievedChunk, error) {
+	if n <= 0 || len(hits) == 0 {
+		return hits, nil
+	}
+
+	// which neighbor IDs each hit wants, claimed in rank order
+	claimed := map[string]bool{}
+	for _, h := range hits {
+		claimed[h.Collection+"\x00"+metaChunkID(h.Metadata)] = true
+	}
+	wants := make([][]string, len(hits))
+	byCollection := map[string][]string{}
+	for i, h := range hits {
+		doc, index, ok := chunkIndex(metaChunkID(h.Metadata))
+		if !ok {
+			continue
+		}
+		for j := max(0, index-n); j <= index+n; j++ {
+			nid := doc + "-" + strconv.Itoa(j)
+			key := h.Collection + "\x00" + nid
+			if claimed[key] {
+				continue
+			}
+			claimed[key] = true
+			wants[i] = append(wants[i], nid)
+			byCollection[h.Collection] = append(byCollection[h.Collection], nid)
+		}
+	}
+	if len(byCollection) == 0 {
+		return hits, nil
+	}
+
+	// fetch them, one Get per collection
+	found := map[string]retrievedChunk{}
+	for name, ids := range byCollection {
+		cs, err := s.resolveCollections(ctx, []string{name})
+		if err != nil {
+			return hits, err
+		}
+		var res chroma.GetResult
+		err = withRetry(ctx, "chroma get", func() (err error) {
+			res, err = cs[0].Get(ctx,
+				chroma.WithIDsGet(toDocumentIDs(ids)...),
+				chroma.WithWhereGet(notExcludedWhere()),
+				chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+			)
+			return err
+		})
+		if err != nil {
+			return hits, fmt.Errorf("fetching neighbors in %s: %w", name, err)
+		}
+		docs, metas := res.GetDocuments(), res.GetMetadatas()
+		for i, id := range res.GetIDs() {
+			var c retrievedChunk
+			if i < len(docs) && docs[i] != nil {
+				c.Text = docs[i].ContentString()
+			}
+			if i < len(metas) {
+				c.Metadata = metas[i]
+			}
+			found[name+"\x00"+string(id)] = c
+		}
+	}
+
+	// stitch each hit's window together in document order
+	for i := range hits {
+		h := &hits[i]
+		_, hitIndex, _ := chunkIndex(metaChunkID(h.Metadata))
+		type part struct {
+			id    string
+			index int
+			text  string
+			meta  chroma.DocumentMetadata
+		}
+		parts := []part{{index: hitIndex, text: h.Text, meta: h.Metadata}}
+		for _, nid := range wants[i] {
+			c, ok := found[h.Collection+"\x00"+nid]
+			if !ok {
+				continue
+			}
+			_, index, _ := chunkIndex(nid)
+			parts = append(parts, part{id: nid, index: index, text: c.Text, meta: c.Metadata})
+		}
+		if len(parts) == 1 {
+			continue
+		}
+		sort.Slice(parts, func(a, b int) bool { return parts[a].index < parts[b].index })
+		w := &neighborWindow{Start: int(chunkStart(parts[0].meta)), End: chunkEnd(parts[len(parts)-1].meta)}
+		texts := make([]string, len(parts))
+		for j, p := range parts {
+			texts[j] = p.text
+			if p.id != "" {
+				w.IDs = append(w.IDs, p.id)
+			}
+		}
+		h.Text = strings.Join(texts, "\n")
+		h.Neighbors = w
+	}
+	return hits, nil
+}
+
+// metaChunkID is the chunk ID recorded in meta.
+func metaChunkID(meta chroma.DocumentMetadata) string {
+	if meta == nil {
+		return ""
+	}
+	id, _ := meta.GetString("doc_id")
+	return id
+}
+
+func chunkEnd(meta chroma.DocumentMetadata) int {
+	if meta == nil {
+		return 0
+	}
+	end, _ := meta.GetInt("end")
+	return int(end)
+}
+
+func toDocumentIDs(ids []string) []chroma.DocumentID {
+	out := make([]chroma.DocumentID, len(ids))
+	for i, id := range ids {
+		out[i] = chroma.DocumentID(id)
+	}
+	return out
+}
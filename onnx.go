@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	defaultef "github.com/amikos-tech/chroma-go/pkg/embeddings/default_ef"
+)
+
+// onnxModelName is the only model the onnx provider runs: Chroma's bundled
+// all-MiniLM-L6-v2 export.
+const onnxModelName = "sentence-transformers/all-MiniLM-L6-v2"
+
+// onnxBatchSize bounds the texts per inference call; inputs are padded to 256
+// tokens, so memory grows linearly with it.
+const onnxBatchSize = 32
+
+// The ONNX Runtime environment is process-wide and expensive to start, so the
+// embedding function is created on first use and kept for the life of the
+// process. A failed start is retried on the next call.
+var onnxEF struct {
+	sync.Mutex
+	ef *defaultef.DefaultEmbeddingFunction
+}
+
+// onnxEmbedder runs all-MiniLM-L6-v2 in-process through ONNX Runtime, using
+// chroma-go's default embedding function. The runtime library, tokenizer and
+// model are downloaded to ~/.cache/chroma on first use; for air-gapped hosts,
+// copy that directory from a machine that has run it once.
+type onnxEmbedder struct{}
+
+func newONNXEmbedder(cfg Config) (Embedder, error) {
+	if cfg.EmbedModelName != onnxModelName {
+		return nil, fmt.Errorf("the onnx provider only runs %s, but EMBED_MODEL_NAME is %q", onnxModelName, cfg.EmbedModelName)
+	}
+	return onnxEmbedder{}, nil
+}
+
+func loadONNX() (*defaultef.DefaultEmbeddingFunction, error) {
+	onnxEF.Lock()
+	defer onnxEF.Unlock()
+	if onnxEF.ef == nil {
+		ef, _, err := defaultef.NewDefaultEmbeddingFunction()
+		if err != nil {
+			return nil, fmt.Errorf("starting ONNX runtime: %w", err)
+		}
+		onnxEF.ef = ef
+	}
+	return onnxEF.ef, nil
+}
+
+func (onnxEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error) {
+	out := make(map[string][]float32, len(chunks))
+	if len(chunks) == 0 {
+		return out, nil
+	}
+	ef, err := loadONNX()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(chunks); i += onnxBatchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch := chunks[i:min(i+onnxBatchSize, len(chunks))]
+		texts := make([]string, len(batch))
+		for k, c := range batch {
+			texts[k] = c.Text
+		}
+		embs, err := ef.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return nil, err
+		}
+		if len(embs) != len(batch) {
+			return nil, fmt.Errorf("ONNX embeddings count mismatch: have %d want %d", len(embs), len(batch))
+		}
+		for k, c := range batch {
+			out[c.ID] = embs[k].ContentAsFloat32()
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAI-compatible chat completions, backed by the same pipeline as /chat, so
+// OpenAI SDKs and tools work against this service with only a base-URL
+// change. Only the fields that make sense for RAG are honoured; sampling
+// parameters such as temperature are accepted and ignored (a profile sets
+// the temperature instead).
+
+// openAIModelID is reported by /v1/models and used when a request names no model.
+const openAIModelID = "semantic-rag"
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // a string or an array of content parts
+}
+
+type openAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+
+	MaxTokens           int             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int             `json:"max_completion_tokens,omitempty"` // the newer name of max_tokens
+	Stop                json.RawMessage `json:"stop,omitempty"`                  // a string or an array of strings
+
+	// extensions, same meaning as on /chat
+	Tags        []string                   `json:"tags,omitempty"`
+	Documents   []string                   `json:"documents,omitempty"`
+	Filters     map[string]json.RawMessage `json:"filters,omitempty"`
+	Collections []string                   `json:"collections,omitempty"`
+	SelfQuery   bool                       `json:"self_query,omitempty"`
+	Template    string                     `json:"template,omitempty"`
+	Verify      string                     `json:"verify,omitempty"`
+	Pipeline    string                     `json:"pipeline,omitempty"`
+	Profile     string                     `json:"profile,omitempty"`
+	Neighbors   *int                       `json:"neighbors,omitempty"`
+
+	IngestedAfter  string `json:"ingested_after,omitempty"`
+	IngestedBefore string `json:"ingested_before,omitempty"`
+}
+
+type openAIChoiceMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int                  `json:"index"`
+	Message      *openAIChoiceMessage `json:"message,omitempty"`
+	Delta        *openAIChoiceMessage `json:"delta,omitempty"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type openAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"` // "chat.completion" | "chat.completion.chunk"
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *LLMUsage      `json:"usage,omitempty"`
+
+	Citations []Citation `json:"citations,omitempty"` // extension: where the answer came from
+	Grounding *Grounding `json:"grounding,omitempty"` // extension: with verify
+
+	AnswerUnavailable bool `json:"answer_unavailable,omitempty"` // extension: generation failed (see LLM_FALLBACK)
+}
+
+// openAIText flattens message content, which is either a plain string or an
+// array of parts of which only the text parts are kept.
+func openAIText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("content must be a string or an array of parts")
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// chatRequest maps the OpenAI request onto a normalized ChatRequest. System
+// messages are dropped: the RAG prompt supplies its own instructions.
+func (o openAIChatRequest) chatRequest() (ChatRequest, error) {
+	req := ChatRequest{
+		Tags:        o.Tags,
+		Documents:   o.Documents,
+		Filters:     o.Filters,
+		Collections: o.Collections,
+		SelfQuery:   o.SelfQuery,
+		Template:    o.Template,
+		Verify:      o.Verify,
+		Pipeline:    o.Pipeline,
+		Profile:     o.Profile,
+		Neighbors:   o.Neighbors,
+		MaxTokens:   o.MaxTokens,
+
+		IngestedAfter:  o.IngestedAfter,
+		IngestedBefore: o.IngestedBefore,
+	}
+	if o.MaxCompletionTokens > 0 {
+		req.MaxTokens = o.MaxCompletionTokens
+	}
+	if len(o.Stop) > 0 && string(o.Stop) != "null" {
+		var one string
+		if err := json.Unmarshal(o.Stop, &one); err == nil {
+			req.Stop = []string{one}
+		} else if err := json.Unmarshal(o.Stop, &req.Stop); err != nil {
+			return req, fmt.Errorf("stop must be a string or an array of strings")
+		}
+	}
+	for i, m := range o.Messages {
+		if m.Role == "system" || m.Role == "developer" {
+			continue
+		}
+		text, err := openAIText(m.Content)
+		if err != nil {
+			return req, fmt.Errorf("messages[%d]: %v", i, err)
+		}
+		req.Messages = append(req.Messages, ChatMessage{Role: m.Role, Content: text})
+	}
+	if len(req.Messages) == 0 {
+		return req, fmt.Errorf("messages must contain a user message")
+	}
+	return req, req.normalize()
+}
+
+// writeOpenAIError answers in the OpenAI error format, which SDKs parse.
+func writeOpenAIError(w http.ResponseWriter, status int, msg string) {
+	typ := "invalid_request_error"
+	if status >= 500 {
+		typ = "server_error"
+	}
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{"message": msg, "type": typ, "code": nil, "request_id": w.Header().Get(headerRequestID)},
+	})
+}
+
+// chatCompletionsHandler implements POST /v1/chat/completions.
+func (s *Server) chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Chat completions request received")
+
+	defer r.Body.Close()
+
+	var oreq openAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&oreq); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	req, err := oreq.chatRequest()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	model := oreq.Model
+	if model == "" {
+		model = openAIModelID
+	}
+	id := "chatcmpl-" + newJobID()
+	created := time.Now().Unix()
+
+	if oreq.Stream {
+		s.streamChatCompletion(w, r, openAIChatResponse{
+			ID: id, Object: "chat.completion.chunk", Created: created, Model: model,
+		}, req)
+		return
+	}
+
+	resp, err := s.answerChat(r.Context(), req)
+	if err != nil {
+		writeOpenAIError(w, errorStatus(err), err.Error())
+		return
+	}
+
+	prompt := estimateTokens(req.Query) + estimateTokens(strings.Join(resp.Context, "\n"))
+	for _, m := range req.Messages {
+		prompt += estimateTokens(m.Content)
+	}
+	completion := estimateTokens(resp.Answer)
+	finish := finishReason(resp)
+
+	writeJSON(w, http.StatusOK, openAIChatResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+		Choices: []openAIChoice{{
+			Message:      &openAIChoiceMessage{Role: "assistant", Content: resp.Answer},
+			FinishReason: &finish,
+		}},
+		Usage: &LLMUsage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		},
+		Citations: resp.Citations,
+		Grounding: resp.Grounding,
+
+		AnswerUnavailable: resp.AnswerUnavailable,
+	})
+}
+
+// streamChatCompletion writes the answer in the chat.completion.chunk SSE
+// format: a role delta, content deltas as the LLM produces them, a final chunk
+// with the finish reason, usage, citations and grounding, then the [DONE]
+// sentinel. An error after the stream has started is sent as an error object.
+func (s *Server) streamChatCompletion(w http.ResponseWriter, r *http.Request, base openAIChatResponse, req ChatRequest) {
+	ctx := r.Context()
+	start := time.Now()
+	var (
+		t    *chatTurn
+		resp ChatResponse
+		err  error
+	)
+	defer func() { s.logQuery(ctx, start, req, t, resp, err) }()
+
+	if t, err = s.prepareChat(ctx, req); err != nil {
+		writeOpenAIError(w, errorStatus(err), err.Error())
+		return
+	}
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		err = statusErrorf(http.StatusInternalServerError, "streaming unsupported")
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fail := func(err error) {
+		_ = sse.send("", map[string]any{"error": map[string]string{"message": err.Error(), "type": "server_error", "request_id": requestID(ctx)}})
+	}
+
+	chunk := base
+	chunk.Choices = []openAIChoice{{Delta: &openAIChoiceMessage{Role: "assistant"}}}
+	if err := sse.send("", chunk); err != nil {
+		return
+	}
+
+	answer, usage, sent, err := t.generateStream(ctx, func(delta string) error {
+		chunk.Choices = []openAIChoice{{Delta: &openAIChoiceMessage{Content: delta}}}
+		return sse.send("", chunk)
+	})
+	switch {
+	case err != nil && !sent:
+		if resp, err = t.degrade(ctx, err); err != nil {
+			fail(err)
+			return
+		}
+		if resp.Answer != "" {
+			chunk.Choices = []openAIChoice{{Delta: &openAIChoiceMessage{Content: resp.Answer}}}
+			if err := sse.send("", chunk); err != nil {
+				return
+			}
+		}
+		chunk.AnswerUnavailable = true
+	case err != nil:
+		err = fmt.Errorf("gemini failed: %w", err)
+		fail(err)
+		return
+	default:
+		if resp, err = t.finish(ctx, answer, false); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	finish := finishReason(resp)
+	chunk.Choices = []openAIChoice{{Delta: &openAIChoiceMessage{}, FinishReason: &finish}}
+	chunk.Usage = usage
+	chunk.Citations = resp.Citations
+	chunk.Grounding = resp.Grounding
+	_ = sse.send("", chunk)
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	sse.f.Flush()
+}
+
+// finishReason is "length" for an answer cut at the output token limit, as
+// OpenAI reports it, and "stop" otherwise.
+func finishReason(resp ChatResponse) string {
+	if resp.Truncated {
+		return "length"
+	}
+	return "stop"
+}
+
+// modelsHandler implements GET /v1/models, which many clients call first.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data": []map[string]any{{
+			"id":       openAIModelID,
+			"object":   "model",
+			"created":  0,
+			"owned_by": "semantic-rag",
+		}},
+	})
+}
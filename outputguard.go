@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxStopSequences is how many stop sequences the Gemini API accepts.
+const maxStopSequences = 5
+
+// errOutputComplete stops a stream once the guard has cut the answer.
+var errOutputComplete = errors.New("output complete")
+
+// outputGuard bounds one answer: generation ends at the first stop sequence,
+// and an answer longer than maxTokens is cut there and flagged as truncated.
+// The LLM is asked to apply the same limits (see generateConfig); the guard
+// enforces them on whatever comes back, for LLMs that ignore them.
+type outputGuard struct {
+	stop      []string
+	maxTokens int // 0: the model's own limit
+
+	text      string // the answer so far, as cut
+	truncated bool   // cut at maxTokens, here or by the LLM
+}
+
+// requestGuard builds the guard for a chat request: its stop and max_tokens
+// override LLM_STOP_SEQUENCES and LLM_MAX_OUTPUT_TOKENS, but max_tokens cannot
+// raise the configured limit.
+func (s *Server) requestGuard(req ChatRequest) (*outputGuard, error) {
+	g := &outputGuard{stop: s.cfg.StopSequences, maxTokens: s.cfg.MaxOutputTokens}
+	if req.Stop != nil {
+		if len(req.Stop) > maxStopSequences {
+			return nil, fmt.Errorf("stop: at most %d sequences", maxStopSequences)
+		}
+		for i, seq := range req.Stop {
+			if seq == "" {
+				return nil, fmt.Errorf("stop[%d] is empty", i)
+			}
+		}
+		g.stop = req.Stop
+	}
+	switch {
+	case req.MaxTokens < 0:
+		return nil, fmt.Errorf("max_tokens must not be negative")
+	case req.MaxTokens > 0 && g.maxTokens > 0 && req.MaxTokens > g.maxTokens:
+		return nil, fmt.Errorf("max_tokens must be at most %d", g.maxTokens)
+	case req.MaxTokens > 0:
+		g.maxTokens = req.MaxTokens
+	}
+	return g, nil
+}
+
+type outputGuardKey struct{}
+
+// context returns ctx carrying g, for the LLM to read its limits from and
+// report truncation to. Only the answer's own generation carries it, not the
+// other LLM calls a chat makes.
+func (g *outputGuard) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, outputGuardKey{}, g)
+}
+
+// outputGuardFrom returns the guard ctx carries, or nil.
+func outputGuardFrom(ctx context.Context) *outputGuard {
+	g, _ := ctx.Value(outputGuardKey{}).(*outputGuard)
+	return g
+}
+
+// reset readies g for another attempt at generation.
+func (g *outputGuard) reset() {
+	g.text, g.truncated = "", false
+}
+
+// accept appends the next delta of a streamed answer and returns the part of
+// it to pass on; done reports that the answer ended here, at a stop sequence
+// or at maxTokens. Text of a stop sequence split across deltas may already
+// have been passed on; the final answer (g.text) never includes it.
+func (g *outputGuard) accept(delta string) (keep string, done bool) {
+	prev := g.text
+	full := prev + delta
+	end := len(full)
+	for _, seq := range g.stop {
+		// a match that started in prev can only end in delta, or it would
+		// have been found with prev
+		from := max(0, len(prev)-len(seq)+1)
+		if i := strings.Index(full[from:], seq); i >= 0 && from+i < end {
+			end, done = from+i, true
+		}
+	}
+	if g.maxTokens > 0 {
+		if cut, ok := cutTokens(full[:end], g.maxTokens); ok {
+			end, done = cut, true
+			g.truncated = true
+		}
+	}
+	g.text = full[:end]
+	if end > len(prev) {
+		keep = full[len(prev):end]
+	}
+	return keep, done
+}
+
+// apply guards a whole answer, keeping any truncation the LLM reported.
+func (g *outputGuard) apply(answer string) string {
+	g.text = ""
+	g.accept(answer)
+	return g.text
+}
+
+// cutTokens returns the end of the first n tokens of text, counted like
+// estimateTokens, and whether text has more than that.
+func cutTokens(text string, n int) (int, bool) {
+	tokens, inToken := 0, false
+	for i, r := range text {
+		switch space := unicode.IsSpace(r); {
+		case space && inToken:
+			inToken = false
+		case !space && !inToken:
+			if tokens == n {
+				return len(strings.TrimRightFunc(text[:i], unicode.IsSpace)), true
+			}
+			tokens++
+			inToken = true
+		}
+	}
+	return len(text), false
+}
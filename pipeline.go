@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pipelines are named configurations of the chat pipeline (rewrite, embed,
+// retrieve, rerank, compress, prompt), read from the JSON file PIPELINE_FILE
+// names. A request selects one with "pipeline"; without one it runs Default,
+// or the built-in pipeline when that is empty.
+type Pipelines struct {
+	Default   string              `json:"default,omitempty"`
+	Pipelines map[string]Pipeline `json:"pipelines"`
+}
+
+// Pipeline holds the parameters of each stage. A parameter supplies the value
+// a request does not set itself; the zero value keeps the built-in behavior.
+type Pipeline struct {
+	Rewrite  PipelineRewrite  `json:"rewrite"`
+	Embed    PipelineEmbed    `json:"embed"`
+	Retrieve PipelineRetrieve `json:"retrieve"`
+	Rerank   PipelineRerank   `json:"rerank"`
+	Compress PipelineCompress `json:"compress"`
+	Prompt   PipelinePrompt   `json:"prompt"`
+}
+
+// PipelineRewrite turns the question into the search text.
+type PipelineRewrite struct {
+	SelfQuery bool `json:"self_query,omitempty"` // derive documents/tags filters with the LLM
+}
+
+// PipelineEmbed embeds the search text.
+type PipelineEmbed struct {
+	// Prefix is prepended to the search text, for models that embed queries
+	// with an instruction, such as BGE's "Represent this sentence for
+	// searching relevant passages: ".
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// PipelineRetrieve fetches candidates from Chroma.
+type PipelineRetrieve struct {
+	TopK        int                        `json:"top_k,omitempty"`
+	Collections []string                   `json:"collections,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Filters     map[string]json.RawMessage `json:"filters,omitempty"`
+	Neighbors   int                        `json:"neighbors,omitempty"` // adjacent chunks added on each side of a hit
+}
+
+// PipelineRerank orders the candidates and keeps the best.
+type PipelineRerank struct {
+	RecencyHalfLife string  `json:"recency_half_life,omitempty"`
+	MinScore        float64 `json:"min_score,omitempty"` // drop hits scoring below this
+}
+
+// PipelineCompress shrinks the retrieved context before it is prompted.
+type PipelineCompress struct {
+	// MaxSentences keeps, of each chunk, the sentences that share the most
+	// words with the question, in their order; a chunk sharing none is kept
+	// whole.
+	MaxSentences int `json:"max_sentences,omitempty"`
+	// MaxContextTokens drops the lowest-ranked hits once the context is this
+	// long; the best hit is always kept.
+	MaxContextTokens int `json:"max_context_tokens,omitempty"`
+}
+
+// PipelinePrompt renders the prompt and bounds the answer.
+type PipelinePrompt struct {
+	Template  string   `json:"template,omitempty"`
+	Format    string   `json:"format,omitempty"`
+	MaxTokens int      `json:"max_tokens,omitempty"`
+	Stop      []string `json:"stop,omitempty"`
+}
+
+// loadPipelines reads and checks the pipelines in path; an empty path
+// declares none.
+func loadPipelines(path string) (*Pipelines, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Pipelines
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid pipelines: %w", err)
+	}
+	if len(p.Pipelines) == 0 {
+		return nil, fmt.Errorf("no pipelines declared")
+	}
+	if _, ok := p.Pipelines[p.Default]; p.Default != "" && !ok {
+		return nil, fmt.Errorf("default pipeline %q is not declared", p.Default)
+	}
+	for name, pl := range p.Pipelines {
+		if err := pl.validate(); err != nil {
+			return nil, fmt.Errorf("pipeline %q: %w", name, err)
+		}
+	}
+	return &p, nil
+}
+
+func (p Pipeline) validate() error {
+	switch {
+	case p.Retrieve.TopK < 0 || p.Retrieve.TopK > maxExperimentTopK:
+		return fmt.Errorf("retrieve.top_k must be 1..%d", maxExperimentTopK)
+	case len(p.Retrieve.Collections) > maxFederatedCollections:
+		return fmt.Errorf("retrieve.collections names more than %d collections", maxFederatedCollections)
+	case p.Retrieve.Neighbors < 0 || p.Retrieve.Neighbors > maxNeighborChunks:
+		return fmt.Errorf("retrieve.neighbors must be 0..%d", maxNeighborChunks)
+	case p.Rerank.MinScore < 0:
+		return fmt.Errorf("rerank.min_score must not be negative")
+	case p.Compress.MaxSentences < 0 || p.Compress.MaxContextTokens < 0:
+		return fmt.Errorf("compress limits must not be negative")
+	case p.Prompt.MaxTokens < 0:
+		return fmt.Errorf("prompt.max_tokens must not be negative")
+	case len(p.Prompt.Stop) > maxStopSequences:
+		return fmt.Errorf("prompt.stop: at most %d sequences", maxStopSequences)
+	}
+	if h := p.Rerank.RecencyHalfLife; h != "" {
+		if d, err := time.ParseDuration(h); err != nil || d < 0 {
+			return fmt.Errorf("rerank.recency_half_life %q: want a duration such as 720h, or 0", h)
+		}
+	}
+	if _, err := requestFormat(ChatRequest{Format: p.Prompt.Format}); err != nil {
+		return fmt.Errorf("prompt.format: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the pipeline called name.
+func (p *Pipelines) lookup(name string) (Pipeline, bool) {
+	if p == nil {
+		return Pipeline{}, false
+	}
+	pl, ok := p.Pipelines[name]
+	return pl, ok
+}
+
+// templates lists the prompt templates the pipelines name.
+func (p *Pipelines) templates() []string {
+	if p == nil {
+		return nil
+	}
+	var names []string
+	for _, pl := range p.Pipelines {
+		if pl.Prompt.Template != "" {
+			names = append(names, pl.Prompt.Template)
+		}
+	}
+	return names
+}
+
+// requestPipeline resolves the pipeline req names, or the default one, and
+// fills in the parameters req leaves unset. It returns the pipeline's name,
+// "" for the built-in one.
+func (s *Server) requestPipeline(req *ChatRequest) (string, Pipeline, error) {
+	ps := s.cfg.Pipelines
+	name := req.Pipeline
+	if name == "" && ps != nil {
+		name = ps.Default
+	}
+	if name == "" {
+		return "", Pipeline{}, nil
+	}
+	p, ok := ps.lookup(name)
+	if !ok {
+		return "", Pipeline{}, fmt.Errorf("unknown pipeline %q", name)
+	}
+
+	if p.Rewrite.SelfQuery {
+		req.SelfQuery = true
+	}
+	if req.topK == 0 {
+		req.topK = p.Retrieve.TopK
+	}
+	// a whole document is the context; there is nothing to search
+	if len(req.Collections) == 0 && !req.WholeDoc {
+		req.Collections = slices.Clone(p.Retrieve.Collections)
+	}
+	if len(req.Tags) == 0 {
+		req.Tags = slices.Clone(p.Retrieve.Tags)
+	}
+	if len(req.Filters) == 0 && len(p.Retrieve.Filters) > 0 {
+		req.Filters = maps.Clone(p.Retrieve.Filters)
+	}
+	if req.Neighbors == nil && p.Retrieve.Neighbors > 0 {
+		n := p.Retrieve.Neighbors
+		req.Neighbors = &n
+	}
+	if req.RecencyHalfLife == "" {
+		req.RecencyHalfLife = p.Rerank.RecencyHalfLife
+	}
+	if req.Template == "" && req.TemplateText == "" {
+		req.Template = p.Prompt.Template
+	}
+	if req.Format == "" && len(req.JSONSchema) == 0 {
+		req.Format = p.Prompt.Format
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = p.Prompt.MaxTokens
+	}
+	if req.Stop == nil {
+		req.Stop = slices.Clone(p.Prompt.Stop)
+	}
+	return name, p, nil
+}
+
+// rerank drops the ranked hits scoring below the pipeline's minimum.
+func (p Pipeline) rerank(hits []retrievedChunk) []retrievedChunk {
+	if p.Rerank.MinScore <= 0 {
+		return hits
+	}
+	kept := hits[:0]
+	for _, h := range hits {
+		if h.Score >= p.Rerank.MinScore {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// compress shrinks the texts of hits for query, and drops the hits beyond the
+// context budget, as the pipeline's compress stage says.
+func (p Pipeline) compress(query string, hits []retrievedChunk) []retrievedChunk {
+	c := p.Compress
+	if c.MaxSentences > 0 {
+		for i := range hits {
+			hits[i].Text = compressChunk(query, hits[i].Text, c.MaxSentences)
+		}
+	}
+	if c.MaxContextTokens > 0 {
+		tokens := 0
+		for i, h := range hits {
+			tokens += estimateTokens(h.Text)
+			if i > 0 && tokens > c.MaxContextTokens {
+				return hits[:i]
+			}
+		}
+	}
+	return hits
+}
+
+// compressChunk keeps the n sentences of text that share the most words with
+// query, in their order, scored like an extractive answer. Text sharing no
+// word with query is returned whole: it ranked for its meaning, not its words.
+func compressChunk(query, text string, n int) string {
+	terms := map[string]bool{}
+	for _, w := range extractiveWords(query) {
+		terms[w] = true
+	}
+	type sentence struct {
+		text  string
+		pos   int
+		score int
+	}
+	var sents []sentence
+	matched := false
+	for i, span := range splitSentences(text) {
+		t := strings.TrimSpace(text[span.start:span.end])
+		if t == "" {
+			continue
+		}
+		score := 0
+		for _, w := range extractiveWords(t) {
+			if terms[w] {
+				score++
+			}
+		}
+		matched = matched || score > 0
+		sents = append(sents, sentence{text: t, pos: i, score: score})
+	}
+	if !matched || len(sents) <= n {
+		return text
+	}
+	sort.SliceStable(sents, func(a, b int) bool { return sents[a].score > sents[b].score })
+	sents = sents[:n]
+	sort.Slice(sents, func(a, b int) bool { return sents[a].pos < sents[b].pos })
+	parts := make([]string, len(sents))
+	for i, s := range sents {
+		parts[i] = s.text
+	}
+	return strings.Join(parts, " ")
+}
+
+// pipelinesHandler implements GET /pipelines: the declared pipelines and the
+// default one.
+func (s *Server) pipelinesHandler(w http.ResponseWriter, r *http.Request) {
+	p := s.cfg.Pipelines
+	if p == nil {
+		p = &Pipelines{Pipelines: map[string]Pipeline{}}
+	}
+	writeJSON(w, http.StatusOK, p)
+}
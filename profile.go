@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Profiles are named answer styles, such as "concise-technical" or
+// "legal-formal", read from the JSON file PROFILE_FILE names. A request
+// selects one with "profile"; without one it gets Default, if set.
+type Profiles struct {
+	Default  string             `json:"default,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Profile bundles the language and tone of an answer. The system prompt,
+// language and temperature go to the LLM along with the prompt (see
+// generateConfig); the format supplies the request's when it sets none.
+type Profile struct {
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Language     string   `json:"language,omitempty"`    // e.g. "German"; the answer is asked for in it
+	Temperature  *float32 `json:"temperature,omitempty"` // 0..2; unset keeps the model's default
+	Format       string   `json:"format,omitempty"`      // markdown | text | bullets | json
+}
+
+// maxTemperature is the highest temperature Gemini accepts.
+const maxTemperature = 2
+
+// loadProfiles reads and checks the profiles in path; an empty path declares
+// none.
+func loadProfiles(path string) (*Profiles, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Profiles
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid profiles: %w", err)
+	}
+	if len(p.Profiles) == 0 {
+		return nil, fmt.Errorf("no profiles declared")
+	}
+	if _, ok := p.Profiles[p.Default]; p.Default != "" && !ok {
+		return nil, fmt.Errorf("default profile %q is not declared", p.Default)
+	}
+	for name, pr := range p.Profiles {
+		if t := pr.Temperature; t != nil && (*t < 0 || *t > maxTemperature) {
+			return nil, fmt.Errorf("profile %q: temperature must be between 0 and %d", name, maxTemperature)
+		}
+		if _, err := requestFormat(ChatRequest{Format: pr.Format}); err != nil {
+			return nil, fmt.Errorf("profile %q: format: %w", name, err)
+		}
+	}
+	return &p, nil
+}
+
+// requestProfile resolves the profile req names, or the default one, and
+// fills in the format if req sets none. It returns nil without a profile.
+func (s *Server) requestProfile(req *ChatRequest) (*Profile, error) {
+	ps := s.cfg.Profiles
+	name := req.Profile
+	if name == "" && ps != nil {
+		name = ps.Default
+	}
+	if name == "" {
+		return nil, nil
+	}
+	var (
+		p  Profile
+		ok bool
+	)
+	if ps != nil {
+		p, ok = ps.Profiles[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	req.Profile = name
+	if req.Format == "" && len(req.JSONSchema) == 0 {
+		req.Format = p.Format
+	}
+	return &p, nil
+}
+
+// systemInstruction is what the LLM is told before the prompt.
+func (p *Profile) systemInstruction() string {
+	parts := []string{}
+	if sp := strings.TrimSpace(p.SystemPrompt); sp != "" {
+		parts = append(parts, sp)
+	}
+	if p.Language != "" {
+		parts = append(parts, "Answer in "+p.Language+", whatever the language of the context.")
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+type profileKey struct{}
+
+// context returns ctx carrying p, for the LLM to read it from. Like the output
+// guard, only the answer's own generation carries it.
+func (p *Profile) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, profileKey{}, p)
+}
+
+// profileFrom returns the profile ctx carries, or nil.
+func profileFrom(ctx context.Context) *Profile {
+	p, _ := ctx.Value(profileKey{}).(*Profile)
+	return p
+}
+
+// profilesHandler implements GET /profiles: the declared profiles and the
+// default one.
+func (s *Server) profilesHandler(w http.ResponseWriter, r *http.Request) {
+	p := s.cfg.Profiles
+	if p == nil {
+		p = &Profiles{Profiles: map[string]Profile{}}
+	}
+	writeJSON(w, http.StatusOK, p)
+}
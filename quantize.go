@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// Quantization (EMBED_QUANTIZE=int8) stores each vector as integer codes in
+// [-127, 127] plus a per-vector scale kept in chunk metadata. Because every
+// vector gets its own scale, distances are only meaningful under a
+// scale-invariant metric, so quantization requires CHROMA_DISTANCE=cosine; the
+// float query vector can then be compared against the codes directly.
+const (
+	quantInt8        = "int8"
+	metaQuantScale   = "quant_scale"
+	int8MaxMagnitude = 127
+)
+
+// quantizeInt8 maps v onto int8 codes; v ≈ codes * scale.
+func quantizeInt8(v []float32) (codes []int32, scale float32) {
+	var maxAbs float64
+	for _, x := range v {
+		maxAbs = math.Max(maxAbs, math.Abs(float64(x)))
+	}
+	codes = make([]int32, len(v))
+	if maxAbs == 0 {
+		return codes, 0
+	}
+	scale = float32(maxAbs / int8MaxMagnitude)
+	for i, x := range v {
+		codes[i] = int32(math.Round(float64(x) / float64(scale)))
+	}
+	return codes, scale
+}
+
+// dequantizeInt8 restores approximate float values from int8 codes.
+func dequantizeInt8(codes []float32, scale float32) []float32 {
+	out := make([]float32, len(codes))
+	for i, c := range codes {
+		out[i] = c * scale
+	}
+	return out
+}
+
+// storedEmbedding converts an embedding into what is written to Chroma under
+// the EMBED_QUANTIZE mode quant, plus the metadata attributes needed to read it
+// back.
+func storedEmbedding(vec []float32, quant string) (embeddings.Embedding, []*chroma.MetaAttribute) {
+	if quant != quantInt8 {
+		return embeddings.NewEmbeddingFromFloat32(vec), nil
+	}
+	codes, scale := quantizeInt8(vec)
+	return embeddings.NewEmbeddingFromInt32(codes), []*chroma.MetaAttribute{
+		chroma.NewFloatAttribute(metaQuantScale, float64(scale)),
+	}
+}
+
+// loadedEmbedding reverses storedEmbedding for a vector read back from Chroma.
+func loadedEmbedding(stored []float32, meta chroma.DocumentMetadata) []float32 {
+	if meta == nil {
+		return stored
+	}
+	scale, ok := meta.GetFloat(metaQuantScale)
+	if !ok {
+		return stored
+	}
+	return dequantizeInt8(stored, float32(scale))
+}
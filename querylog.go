@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// What the query log keeps of each chat (QUERY_LOG).
+const (
+	queryLogOff      = "off"      // nothing
+	queryLogRedacted = "redacted" // everything, with personal data masked in the texts
+	queryLogFull     = "full"     // everything, as sent and generated
+)
+
+// QueryLogEntry records one chat answered through /chat or
+// /v1/chat/completions: the request, what was retrieved for it, the prompt
+// and the answer. It holds enough to run the request again (see
+// replayHandler).
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+
+	// The caller, whose access the request was answered with.
+	User   string   `json:"user,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Admin  bool     `json:"admin,omitempty"`
+
+	Request   ChatRequest   `json:"request"`         // as normalized: query is the question, messages the history
+	TopK      int           `json:"top_k,omitempty"` // set by an experiment variant
+	Retrieved []QueryLogHit `json:"retrieved"`
+	Prompt    string        `json:"prompt,omitempty"`
+
+	Answer            string `json:"answer"`
+	AnswerUnavailable bool   `json:"answer_unavailable,omitempty"`
+	Truncated         bool   `json:"truncated,omitempty"`
+	Status            int    `json:"status"`
+	Error             string `json:"error,omitempty"`
+	LatencyMS         int64  `json:"latency_ms"`
+	Redacted          bool   `json:"redacted,omitempty"`
+}
+
+// QueryLogHit is a chunk retrieved for a logged chat.
+type QueryLogHit struct {
+	ChunkID  string  `json:"chunk_id"`
+	Document string  `json:"document"`
+	Score    float64 `json:"score"`
+}
+
+// The query log is an append-only JSON Lines file under RAG_DATA_DIR, like
+// the audit log; maintenance drops entries older than QUERY_LOG_RETENTION.
+
+func (s *Server) queryLogPath() string {
+	return filepath.Join(s.cfg.RAGDataDir, "queries.jsonl")
+}
+
+// Personal data masked in redacted query logs.
+var redactions = []struct {
+	re          *regexp.Regexp
+	placeholder string
+}{
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+	{regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), "[number]"}, // card and account numbers
+	{regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?\(?\d{2,4}\)?[ .-]\d{3,4}[ .-]\d{3,4}\b`), "[phone]"},
+	{regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`), "[ip]"},
+}
+
+// redact masks e-mail addresses, card and account numbers, phone numbers and
+// IP addresses in text.
+func redact(text string) string {
+	for _, r := range redactions {
+		text = r.re.ReplaceAllString(text, r.placeholder)
+	}
+	return text
+}
+
+// logQuery records a chat in the query log, unless QUERY_LOG is off. t is
+// nil when the request failed before retrieval. Failures are logged, not
+// returned: logging must never fail the chat it describes.
+func (s *Server) logQuery(ctx context.Context, start time.Time, req ChatRequest, t *chatTurn, resp ChatResponse, err error) {
+	mode := s.cfg.QueryLog
+	if mode == "" || mode == queryLogOff {
+		return
+	}
+
+	e := QueryLogEntry{
+		Time:              start.UTC(),
+		RequestID:         requestID(ctx),
+		Request:           req,
+		TopK:              req.topK,
+		Retrieved:         []QueryLogHit{},
+		Answer:            resp.Answer,
+		AnswerUnavailable: resp.AnswerUnavailable,
+		Truncated:         resp.Truncated,
+		Status:            http.StatusOK,
+		LatencyMS:         time.Since(start).Milliseconds(),
+	}
+	if c, ok := callerFrom(ctx); ok {
+		e.User, e.Groups, e.Admin = c.ID, c.Groups, c.Admin
+	}
+	if t != nil {
+		e.Prompt = t.prompt
+		for _, c := range t.resp.Citations {
+			e.Retrieved = append(e.Retrieved, QueryLogHit{ChunkID: c.ChunkID, Document: c.Document, Score: c.Score})
+		}
+	}
+	if err != nil {
+		e.Status = errorStatus(err)
+		e.Error = err.Error()
+	}
+	// the log is for replaying the question, not for repeating how it was
+	// delivered
+	e.Request.Stream, e.Request.Debug = false, false
+
+	if mode == queryLogRedacted {
+		e.Redacted = true
+		e.Request.Query = redact(e.Request.Query)
+		e.Request.Messages = make([]ChatMessage, len(req.Messages))
+		for i, m := range req.Messages {
+			e.Request.Messages[i] = ChatMessage{Role: m.Role, Content: redact(m.Content)}
+		}
+		e.Prompt = redact(e.Prompt)
+		e.Answer = redact(e.Answer)
+		e.Error = redact(e.Error)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("query log: marshal failed: %v", err)
+		return
+	}
+
+	s.state.queryLogMu.Lock()
+	defer s.state.queryLogMu.Unlock()
+
+	path := s.queryLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("query log: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("query log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("query log: %v", err)
+	}
+}
+
+// readQueryLog returns the entries matching keep, newest first.
+func (s *Server) readQueryLog(keep func(QueryLogEntry) bool) ([]QueryLogEntry, error) {
+	s.state.queryLogMu.Lock()
+	defer s.state.queryLogMu.Unlock()
+
+	f, err := os.Open(s.queryLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []QueryLogEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20) // prompts carry the whole context
+	for sc.Scan() {
+		var e QueryLogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // skip a torn last line rather than hide the whole log
+		}
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, sc.Err()
+}
+
+// pruneQueryLog drops the entries logged before cutoff, rewriting the log
+// atomically, and returns how many were dropped.
+func (s *Server) pruneQueryLog(cutoff time.Time) (int, error) {
+	s.state.queryLogMu.Lock()
+	defer s.state.queryLogMu.Unlock()
+
+	path := s.queryLogPath()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var kept [][]byte
+	dropped := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		var e struct {
+			Time time.Time `json:"time"`
+		}
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Time.Before(cutoff) {
+			dropped++
+			continue
+		}
+		kept = append(kept, append(append([]byte(nil), sc.Bytes()...), '\n'))
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range kept {
+		if _, err := out.Write(line); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return dropped, os.Rename(tmp, path)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// metaTenant records on each chunk the tenant that uploaded it, so stored
+// chunks can be counted against the tenant's quota.
+const metaTenant = "tenant"
+
+// headerTenant names the tenant a request is billed to, set like X-User-ID by
+// the authenticating proxy; without it the tenant is the X-User-ID.
+const headerTenant = "X-Tenant-ID"
+
+// anonymousTenant is the tenant of requests that carry no identity.
+const anonymousTenant = "anonymous"
+
+// Quota periods: token usage is counted per calendar day or month, in UTC.
+const (
+	periodDay   = "day"
+	periodMonth = "month"
+)
+
+// QuotaLimits caps a tenant's usage. A zero limit is no limit.
+type QuotaLimits struct {
+	EmbedTokens int64 `json:"embed_tokens,omitempty"` // per period
+	LLMTokens   int64 `json:"llm_tokens,omitempty"`   // per period
+	Chunks      int64 `json:"chunks,omitempty"`       // stored in the default collection
+}
+
+// Quotas are the limits read from the JSON file QUOTA_FILE names. A tenant
+// listed in Tenants gets its own limits instead of Default.
+type Quotas struct {
+	Period  string                 `json:"period,omitempty"` // day | month (default)
+	Default QuotaLimits            `json:"default"`
+	Tenants map[string]QuotaLimits `json:"tenants,omitempty"`
+}
+
+// loadQuotas reads and checks the quotas in path; an empty path sets none.
+func loadQuotas(path string) (*Quotas, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var q Quotas
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&q); err != nil {
+		return nil, fmt.Errorf("invalid quotas: %w", err)
+	}
+	switch q.Period {
+	case "":
+		q.Period = periodMonth
+	case periodDay, periodMonth:
+	default:
+		return nil, fmt.Errorf("invalid period %q: want day or month", q.Period)
+	}
+	for name, l := range q.Tenants {
+		if l.EmbedTokens < 0 || l.LLMTokens < 0 || l.Chunks < 0 {
+			return nil, fmt.Errorf("tenant %s: limits must not be negative", name)
+		}
+	}
+	if l := q.Default; l.EmbedTokens < 0 || l.LLMTokens < 0 || l.Chunks < 0 {
+		return nil, fmt.Errorf("default: limits must not be negative")
+	}
+	return &q, nil
+}
+
+// limits returns the limits of tenant; none without quotas.
+func (q *Quotas) limits(tenant string) QuotaLimits {
+	if q == nil {
+		return QuotaLimits{}
+	}
+	if l, ok := q.Tenants[tenant]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// period returns the bounds of the period t falls in.
+func (q *Quotas) period(t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	if q != nil && q.Period == periodDay {
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// tenantFrom returns the tenant ctx's caller is billed as. ok is false for
+// work the server does on its own, which is not metered.
+func tenantFrom(ctx context.Context) (string, bool) {
+	c, ok := callerFrom(ctx)
+	if !ok {
+		return "", false
+	}
+	if c.Tenant == "" {
+		return anonymousTenant, true
+	}
+	return c.Tenant, true
+}
+
+// -------------------- Usage --------------------
+
+// TenantUsage is what a tenant has used in the current period.
+type TenantUsage struct {
+	EmbedTokens int64 `json:"embed_tokens"`
+	LLMTokens   int64 `json:"llm_tokens"`
+}
+
+// usageLog holds the token usage of the current period, per tenant. It is
+// kept in RAG_DATA_DIR/usage.json, so usage survives restarts and is shared
+// by every server (and selection) on the same data directory.
+type usageLog struct {
+	Period  time.Time               `json:"period"` // start of the period
+	Tenants map[string]*TenantUsage `json:"tenants"`
+}
+
+func (s *Server) usagePath() string {
+	return filepath.Join(s.cfg.RAGDataDir, "usage.json")
+}
+
+// loadUsage returns the usage of the current period; usage recorded in an
+// earlier period is dropped. The caller holds s.state.usageMu.
+func (s *Server) loadUsage() (usageLog, error) {
+	start, _ := s.cfg.Quotas.period(time.Now())
+	u := usageLog{Period: start, Tenants: map[string]*TenantUsage{}}
+	b, err := os.ReadFile(s.usagePath())
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return u, err
+	}
+	var stored usageLog
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return u, err
+	}
+	if stored.Period.Equal(start) && stored.Tenants != nil {
+		u.Tenants = stored.Tenants
+	}
+	return u, nil
+}
+
+// recordUsage adds tokens used for ctx's caller to the usage log. Failures
+// are logged, not returned: the tokens are spent either way.
+func (s *Server) recordUsage(ctx context.Context, embedTokens, llmTokens int64) {
+	tenant, ok := tenantFrom(ctx)
+	if !ok || (embedTokens == 0 && llmTokens == 0) {
+		return
+	}
+
+	s.state.usageMu.Lock()
+	defer s.state.usageMu.Unlock()
+
+	u, err := s.loadUsage()
+	if err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	t := u.Tenants[tenant]
+	if t == nil {
+		t = &TenantUsage{}
+		u.Tenants[tenant] = t
+	}
+	t.EmbedTokens += embedTokens
+	t.LLMTokens += llmTokens
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		log.Printf("usage: marshal failed: %v", err)
+		return
+	}
+	path := s.usagePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("usage: %v", err)
+	}
+}
+
+// tenantUsage returns what tenant has used in the current period.
+func (s *Server) tenantUsage(tenant string) (TenantUsage, error) {
+	s.state.usageMu.Lock()
+	defer s.state.usageMu.Unlock()
+	u, err := s.loadUsage()
+	if err != nil {
+		return TenantUsage{}, err
+	}
+	if t := u.Tenants[tenant]; t != nil {
+		return *t, nil
+	}
+	return TenantUsage{}, nil
+}
+
+// storedChunks counts the chunks tenant has stored in the default collection,
+// whoever may read them.
+func (s *Server) storedChunks(ctx context.Context, tenant string) (int64, error) {
+	ids, err := collectionIDs(ctx, s.deps.Store, chroma.EqString(metaTenant, tenant))
+	return int64(len(ids)), err
+}
+
+// meteredEmbedder counts the tokens of the texts it embeds against the caller.
+type meteredEmbedder struct {
+	Embedder
+	srv *Server
+}
+
+func (m meteredEmbedder) Embed(ctx context.Context, chunks []Chunk) (map[string][]float32, error) {
+	out, _, err := m.EmbedProvider(ctx, chunks)
+	return out, err
+}
+
+// EmbedProvider embeds like embedChunks, so the provider is still reported.
+func (m meteredEmbedder) EmbedProvider(ctx context.Context, chunks []Chunk) (map[string][]float32, string, error) {
+	out, provider, err := embedChunks(ctx, m.Embedder, chunks)
+	if err == nil {
+		var tokens int64
+		for _, c := range chunks {
+			tokens += int64(estimateTokens(c.Text))
+		}
+		m.srv.recordUsage(ctx, tokens, 0)
+	}
+	return out, provider, err
+}
+
+// meteredLLM counts the tokens of each generation against the caller: the
+// usage the API reports when it does, an estimate otherwise.
+type meteredLLM struct {
+	LLM
+	srv *Server
+}
+
+func (m meteredLLM) Generate(ctx context.Context, prompt string) (string, error) {
+	answer, err := m.LLM.Generate(ctx, prompt)
+	if err == nil {
+		m.srv.recordUsage(ctx, 0, int64(estimateTokens(prompt)+estimateTokens(answer)))
+	}
+	return answer, err
+}
+
+func (m meteredLLM) GenerateStream(ctx context.Context, prompt string, onDelta func(string) error) (string, *LLMUsage, error) {
+	answer, usage, err := m.LLM.GenerateStream(ctx, prompt, onDelta)
+	tokens := estimateTokens(prompt) + estimateTokens(answer)
+	if usage != nil && usage.TotalTokens > 0 {
+		tokens = usage.TotalTokens
+	}
+	// a stream cut short has still been paid for up to where it stopped
+	if err == nil || answer != "" {
+		m.srv.recordUsage(ctx, 0, int64(tokens))
+	}
+	return answer, usage, err
+}
+
+// -------------------- Enforcement --------------------
+
+// quotaBudget selects the token budgets a route spends.
+type quotaBudget uint8
+
+const (
+	budgetEmbed quotaBudget = 1 << iota
+	budgetLLM
+)
+
+// requireQuota answers 429 Too Many Requests, with a Retry-After until the
+// period ends, when the caller has used up a budget h spends. A request that
+// starts within budget runs to completion, so usage can end up slightly over
+// a limit. Admin callers are not limited.
+func (s *Server) requireQuota(budgets quotaBudget, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, _ := callerFrom(r.Context())
+		tenant, ok := tenantFrom(r.Context())
+		if s.cfg.Quotas == nil || !ok || c.Admin {
+			h(w, r)
+			return
+		}
+		limits := s.cfg.Quotas.limits(tenant)
+		used, err := s.tenantUsage(tenant)
+		if err != nil {
+			http.Error(w, "failed to read usage: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var exceeded string
+		switch {
+		case budgets&budgetEmbed != 0 && limits.EmbedTokens > 0 && used.EmbedTokens >= limits.EmbedTokens:
+			exceeded = fmt.Sprintf("embedding token quota of %d", limits.EmbedTokens)
+		case budgets&budgetLLM != 0 && limits.LLMTokens > 0 && used.LLMTokens >= limits.LLMTokens:
+			exceeded = fmt.Sprintf("LLM token quota of %d", limits.LLMTokens)
+		}
+		if exceeded != "" {
+			_, end := s.cfg.Quotas.period(time.Now())
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(end).Seconds())+1))
+			http.Error(w, fmt.Sprintf("tenant %s has used its %s; it resets at %s", tenant, exceeded, end.Format(time.RFC3339)), http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// checkChunkQuota fails with 402 Payment Required when storing n more chunks
+// would take ctx's caller over its chunk quota.
+func (s *Server) checkChunkQuota(ctx context.Context, n int) error {
+	c, _ := callerFrom(ctx)
+	tenant, ok := tenantFrom(ctx)
+	if !ok || c.Admin {
+		return nil
+	}
+	limit := s.cfg.Quotas.limits(tenant).Chunks
+	if limit == 0 {
+		return nil
+	}
+	stored, err := s.storedChunks(ctx, tenant)
+	if err != nil {
+		return statusErrorf(http.StatusInternalServerError, "failed to count stored chunks: %v", err)
+	}
+	if stored+int64(n) > limit {
+		return statusErrorf(http.StatusPaymentRequired, "tenant %s stores %d of its %d chunks; this document needs %d more", tenant, stored, limit, n)
+	}
+	return nil
+}
+
+// -------------------- GET /usage --------------------
+
+// UsageAmount is how much of one quota a tenant has used; Limit is 0 when
+// there is none.
+type UsageAmount struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// UsageReport is a tenant's usage in the current period.
+type UsageReport struct {
+	Tenant      string      `json:"tenant"`
+	Period      time.Time   `json:"period"`
+	ResetsAt    time.Time   `json:"resets_at"`
+	EmbedTokens UsageAmount `json:"embed_tokens"`
+	LLMTokens   UsageAmount `json:"llm_tokens"`
+	Chunks      UsageAmount `json:"chunks"`
+}
+
+func (s *Server) usageReport(ctx context.Context, tenant string) (UsageReport, error) {
+	used, err := s.tenantUsage(tenant)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	chunks, err := s.storedChunks(ctx, tenant)
+	if err != nil {
+		return UsageReport{}, fmt.Errorf("counting stored chunks: %w", err)
+	}
+	limits := s.cfg.Quotas.limits(tenant)
+	start, end := s.cfg.Quotas.period(time.Now())
+	return UsageReport{
+		Tenant:      tenant,
+		Period:      start,
+		ResetsAt:    end,
+		EmbedTokens: UsageAmount{Used: used.EmbedTokens, Limit: limits.EmbedTokens},
+		LLMTokens:   UsageAmount{Used: used.LLMTokens, Limit: limits.LLMTokens},
+		Chunks:      UsageAmount{Used: chunks, Limit: limits.Chunks},
+	}, nil
+}
+
+// usageHandler reports the caller's usage and quotas. With the admin token,
+// ?tenant= reports another tenant's, and no tenant reports every tenant that
+// has used tokens this period or has quotas of its own.
+func (s *Server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Usage request received")
+
+	c, _ := callerFrom(r.Context())
+	tenant, _ := tenantFrom(r.Context())
+	if q := r.URL.Query().Get("tenant"); q != "" && q != tenant {
+		if !c.Admin {
+			http.Error(w, "only the admin token can read another tenant's usage", http.StatusForbidden)
+			return
+		}
+		tenant = q
+	} else if c.Admin && q == "" {
+		s.allUsageHandler(w, r)
+		return
+	}
+
+	report, err := s.usageReport(r.Context(), tenant)
+	if err != nil {
+		http.Error(w, "failed to read usage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+type usageListResponse struct {
+	Tenants []UsageReport `json:"tenants"`
+}
+
+func (s *Server) allUsageHandler(w http.ResponseWriter, r *http.Request) {
+	s.state.usageMu.Lock()
+	u, err := s.loadUsage()
+	s.state.usageMu.Unlock()
+	if err != nil {
+		http.Error(w, "failed to read usage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tenants []string
+	for t := range u.Tenants {
+		tenants = append(tenants, t)
+	}
+	if s.cfg.Quotas != nil {
+		for t := range s.cfg.Quotas.Tenants {
+			if u.Tenants[t] == nil {
+				tenants = append(tenants, t)
+			}
+		}
+	}
+	slices.Sort(tenants)
+
+	reports := []UsageReport{}
+	for _, t := range tenants {
+		report, err := s.usageReport(r.Context(), t)
+		if err != nil {
+			http.Error(w, "failed to read usage: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, report)
+	}
+	writeJSON(w, http.StatusOK, usageListResponse{Tenants: reports})
+}
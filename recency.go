@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// Chunk timestamps, in Unix seconds: when the chunk was ingested, and the
+// optional date of the document itself (set on upload or via PATCH).
+const (
+	metaIngestedAt = "ingested_at"
+	metaDocDate    = "doc_date"
+)
+
+// recencyOverfetch is how many times the requested number of hits is fetched
+// when boosting, so newer chunks just outside the plain top n can move up.
+const recencyOverfetch = 3
+
+// recencyBoost blends similarity with age: a chunk's score is multiplied by
+// (1 - Weight) + Weight * 0.5^(age / HalfLife). A zero HalfLife or Weight
+// disables it.
+type recencyBoost struct {
+	HalfLife time.Duration
+	Weight   float64
+}
+
+func (b recencyBoost) enabled() bool {
+	return b.HalfLife > 0 && b.Weight > 0
+}
+
+// factor is the multiplier for a chunk with the given metadata. Age is taken
+// from doc_date, else ingested_at; chunks with neither count as infinitely old.
+func (b recencyBoost) factor(meta chroma.DocumentMetadata, now time.Time) float64 {
+	decay := 0.0
+	if meta != nil {
+		ts, ok := meta.GetInt(metaDocDate)
+		if !ok {
+			ts, ok = meta.GetInt(metaIngestedAt)
+		}
+		if ok {
+			age := max(now.Sub(time.Unix(ts, 0)), 0)
+			decay = math.Pow(0.5, float64(age)/float64(b.HalfLife))
+		}
+	}
+	return (1 - b.Weight) + b.Weight*decay
+}
+
+// apply rescales the hits' scores, re-sorts them and keeps the best n.
+// Distances are left as Chroma returned them.
+func (b recencyBoost) apply(hits []retrievedChunk, n int, now time.Time) []retrievedChunk {
+	for i := range hits {
+		hits[i].Score *= b.factor(hits[i].Metadata, now)
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	return hits
+}
+
+// requestRecency is the configured boost, with the half-life overridden by the
+// request's recency_half_life ("0" disables boosting for the request).
+func (s *Server) requestRecency(req ChatRequest) (recencyBoost, error) {
+	b := recencyBoost{HalfLife: s.cfg.RecencyHalfLife, Weight: s.cfg.RecencyWeight}
+	if req.RecencyHalfLife != "" {
+		d, err := time.ParseDuration(req.RecencyHalfLife)
+		if err != nil || d < 0 {
+			return b, fmt.Errorf("invalid recency_half_life %q: want a duration such as 720h, or 0", req.RecencyHalfLife)
+		}
+		b.HalfLife = d
+	}
+	return b, nil
+}
+
+// ingestedWhere restricts retrieval to chunks ingested at or after after and
+// before before. Each is a date or RFC 3339 time, or a duration such as 168h
+// meaning that long before now; an empty one leaves that side open.
+func ingestedWhere(after, before string, now time.Time) (chroma.WhereClause, error) {
+	var clauses []chroma.WhereClause
+	for _, bound := range []struct {
+		name, v string
+		clause  func(field string, value int) chroma.WhereClause
+	}{
+		{"ingested_after", after, chroma.GteInt},
+		{"ingested_before", before, chroma.LtInt},
+	} {
+		if bound.v == "" {
+			continue
+		}
+		t, err := parseTimestamp(bound.v)
+		if err != nil {
+			d, derr := time.ParseDuration(bound.v)
+			if derr != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s %q: want YYYY-MM-DD, RFC 3339 or a duration such as 168h", bound.name, bound.v)
+			}
+			t = now.Add(-d)
+		}
+		clauses = append(clauses, bound.clause(metaIngestedAt, int(t.Unix())))
+	}
+	return andWhere(clauses...), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	chhttp "github.com/amikos-tech/chroma-go/pkg/commons/http"
+)
+
+// reconnectingStore is a collection handle that looks its collection up again
+// when the one it holds goes stale: when Chroma answers that the collection
+// does not exist, as after a restart that lost or recreated it, and after
+// Chroma was unreachable. Until the first lookup succeeds, e.g. when Chroma is
+// down at startup, every call tries it first.
+type reconnectingStore struct {
+	name    string
+	resolve func(ctx context.Context) (VectorStore, error)
+
+	mu    sync.RWMutex
+	cur   VectorStore // nil until resolved
+	stale bool        // look the collection up before the next call
+}
+
+func newReconnectingStore(name string, cur VectorStore, resolve func(ctx context.Context) (VectorStore, error)) *reconnectingStore {
+	return &reconnectingStore{name: name, resolve: resolve, cur: cur}
+}
+
+// handle returns the current handle, looking the collection up first when
+// there is none or it was marked stale.
+func (r *reconnectingStore) handle(ctx context.Context) (VectorStore, error) {
+	r.mu.RLock()
+	c, stale := r.cur, r.stale
+	r.mu.RUnlock()
+	if c != nil && !stale {
+		return c, nil
+	}
+	return r.refresh(ctx, c)
+}
+
+// refresh replaces the handle old with a fresh one. When another call has
+// already replaced old, its handle is used instead.
+func (r *reconnectingStore) refresh(ctx context.Context, old VectorStore) (VectorStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur != old && !r.stale {
+		return r.cur, nil
+	}
+	c, err := r.resolve(ctx)
+	if err != nil {
+		if r.cur != nil {
+			return r.cur, err
+		}
+		return nil, err
+	}
+	if old != nil {
+		log.Printf("chroma: collection %s looked up again", r.name)
+	}
+	r.cur, r.stale = c, false
+	return c, nil
+}
+
+// markStale has the next call look the collection up again.
+func (r *reconnectingStore) markStale() {
+	r.mu.Lock()
+	r.stale = r.cur != nil
+	r.mu.Unlock()
+}
+
+// retarget points r at another collection, cur, which resolve looks up from
+// now on. Calls already holding the old handle finish on it.
+func (r *reconnectingStore) retarget(cur VectorStore, resolve func(ctx context.Context) (VectorStore, error)) {
+	r.mu.Lock()
+	r.cur, r.resolve, r.stale = cur, resolve, false
+	r.mu.Unlock()
+}
+
+// do runs fn on the handle. A handle Chroma no longer knows is replaced and fn
+// run once more; a connection failure marks it stale for the next call.
+func (r *reconnectingStore) do(ctx context.Context, fn func(VectorStore) error) error {
+	c, err := r.handle(ctx)
+	if c == nil {
+		return err
+	}
+	err = fn(c)
+	switch {
+	case err == nil:
+	case collectionGone(err):
+		if c, rerr := r.refresh(ctx, c); rerr == nil {
+			return fn(c)
+		}
+	case chromaUnreachable(err):
+		r.markStale()
+	}
+	return err
+}
+
+func (r *reconnectingStore) Name() string { return r.name }
+
+func (r *reconnectingStore) Metadata() chroma.CollectionMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Metadata()
+}
+
+func (r *reconnectingStore) Dimension() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cur == nil {
+		return 0
+	}
+	return r.cur.Dimension()
+}
+
+func (r *reconnectingStore) Add(ctx context.Context, opts ...chroma.CollectionAddOption) error {
+	return r.do(ctx, func(c VectorStore) error { return c.Add(ctx, opts...) })
+}
+
+func (r *reconnectingStore) Update(ctx context.Context, opts ...chroma.CollectionUpdateOption) error {
+	return r.do(ctx, func(c VectorStore) error { return c.Update(ctx, opts...) })
+}
+
+func (r *reconnectingStore) Delete(ctx context.Context, opts ...chroma.CollectionDeleteOption) error {
+	return r.do(ctx, func(c VectorStore) error { return c.Delete(ctx, opts...) })
+}
+
+func (r *reconnectingStore) Count(ctx context.Context) (n int, err error) {
+	err = r.do(ctx, func(c VectorStore) (err error) {
+		n, err = c.Count(ctx)
+		return err
+	})
+	return n, err
+}
+
+func (r *reconnectingStore) Get(ctx context.Context, opts ...chroma.CollectionGetOption) (res chroma.GetResult, err error) {
+	err = r.do(ctx, func(c VectorStore) (err error) {
+		res, err = c.Get(ctx, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (r *reconnectingStore) Query(ctx context.Context, opts ...chroma.CollectionQueryOption) (res chroma.QueryResult, err error) {
+	err = r.do(ctx, func(c VectorStore) (err error) {
+		res, err = c.Query(ctx, opts...)
+		return err
+	})
+	return res, err
+}
+
+// collectionGone reports whether Chroma answered that a collection does not
+// exist.
+func collectionGone(err error) bool {
+	var ce *chhttp.ChromaError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	msg := strings.ToLower(ce.Message)
+	return ce.ErrorCode == http.StatusNotFound || strings.Contains(msg, "does not exist") || strings.Contains(msg, "not found")
+}
+
+// chromaUnreachable reports whether a Chroma call failed without a response.
+func chromaUnreachable(err error) bool {
+	var ce *chhttp.ChromaError
+	return errors.As(err, &ce) && ce.ErrorCode == 0
+}
+
+// -------------------- Health checks --------------------
+
+// chromaHealthTimeout bounds one heartbeat.
+const chromaHealthTimeout = 5 * time.Second
+
+// checkChroma sends Chroma a heartbeat.
+func (s *Server) checkChroma(ctx context.Context) error {
+	if s.chroma == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, chromaHealthTimeout)
+	defer cancel()
+	return s.chroma.Heartbeat(ctx)
+}
+
+// watchChroma sends Chroma a heartbeat every interval and logs when it stops
+// and starts answering. When it answers again, every collection handle is
+// looked up again before its next use, in case Chroma came back without the
+// collections it had. It returns when ctx is done.
+func (s *Server) watchChroma(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := s.checkChroma(ctx)
+		switch {
+		case err != nil && healthy:
+			log.Printf("chroma: heartbeat failed: %v", err)
+			healthy = false
+		case err == nil && !healthy:
+			log.Printf("chroma: reachable again")
+			healthy = true
+			s.markCollectionsStale()
+		}
+	}
+}
+
+// markCollectionsStale has every collection handle of the server looked up
+// again before its next use.
+func (s *Server) markCollectionsStale() {
+	if r, ok := s.deps.Store.(*reconnectingStore); ok {
+		r.markStale()
+	}
+	s.others.Lock()
+	defer s.others.Unlock()
+	for _, c := range s.others.m {
+		if a, ok := c.(accessStore); ok {
+			if r, ok := a.VectorStore.(*reconnectingStore); ok {
+				r.markStale()
+			}
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// Alias records which Chroma collection serves as the default one. A reindex
+// builds a shadow collection next to the one serving reads and, once it
+// checks out, points the alias at it. The alias is kept in RAG_DATA_DIR so it
+// survives restarts.
+type Alias struct {
+	Collection string    `json:"collection"`
+	Previous   string    `json:"previous,omitempty"` // what it pointed at before the last flip
+	FlippedAt  time.Time `json:"flipped_at,omitzero"`
+}
+
+func aliasPath(dataDir string) string {
+	return filepath.Join(dataDir, "alias.json")
+}
+
+// loadAlias reads the alias in dataDir. Without one the default collection
+// serves itself.
+func loadAlias(dataDir string) (Alias, error) {
+	a := Alias{Collection: defaultCollection}
+	b, err := os.ReadFile(aliasPath(dataDir))
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return a, fmt.Errorf("invalid alias: %w", err)
+	}
+	if a.Collection == "" {
+		a.Collection = defaultCollection
+	}
+	return a, nil
+}
+
+// saveAlias writes a through a temp file and a rename, so a crash cannot
+// leave a torn alias behind.
+func saveAlias(dataDir string, a Alias) error {
+	path := aliasPath(dataDir)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// aliasedStores returns the handles of the default collection that an alias
+// can re-target: the one main opens in Chroma, as the server and each of its
+// selections hold it.
+func (s *Server) aliasedStores() ([]*reconnectingStore, error) {
+	var out []*reconnectingStore
+	for _, srv := range s.state.servers.all() {
+		r, ok := srv.deps.Store.(*reconnectingStore)
+		if ok && r.Name() == defaultCollection && !slices.Contains(out, r) {
+			out = append(out, r)
+		}
+	}
+	if len(out) == 0 || s.chroma == nil {
+		return nil, statusErrorf(http.StatusNotImplemented, "the default collection is not a Chroma collection this server can re-target")
+	}
+	return out, nil
+}
+
+// aliasTarget returns the Chroma collection the alias points the default
+// collection at.
+func (s *Server) aliasTarget() (string, error) {
+	s.state.aliasMu.Lock()
+	defer s.state.aliasMu.Unlock()
+	if s.state.aliasTarget == "" {
+		a, err := loadAlias(s.cfg.RAGDataDir)
+		if err != nil {
+			return "", err
+		}
+		s.state.aliasTarget = a.Collection
+	}
+	return s.state.aliasTarget, nil
+}
+
+// flipAlias points the default collection at the Chroma collection name.
+// Reads and writes that start after it returns go to the new collection;
+// the old one is kept, so flipping back undoes it.
+func (s *Server) flipAlias(ctx context.Context, name string) (Alias, error) {
+	stores, err := s.aliasedStores()
+	if err != nil {
+		return Alias{}, err
+	}
+	c, err := s.chroma.GetCollection(ctx, name)
+	if err != nil {
+		return Alias{}, statusErrorf(http.StatusNotFound, "collection %q: %v", name, err)
+	}
+	if md := c.Metadata(); md != nil {
+		if model, ok := md.GetString(metaEmbedModel); ok && model != "" && model != s.cfg.EmbedModelName {
+			return Alias{}, statusErrorf(http.StatusConflict, "collection %s was built with model %q but EMBED_MODEL_NAME is %q", name, model, s.cfg.EmbedModelName)
+		}
+	}
+
+	s.state.aliasMu.Lock()
+	defer s.state.aliasMu.Unlock()
+	cur, err := loadAlias(s.cfg.RAGDataDir)
+	if err != nil {
+		return Alias{}, err
+	}
+	next := Alias{Collection: name, Previous: cur.Collection, FlippedAt: time.Now().UTC()}
+	if err := saveAlias(s.cfg.RAGDataDir, next); err != nil {
+		return Alias{}, fmt.Errorf("saving alias: %w", err)
+	}
+	for _, r := range stores {
+		r.retarget(c, collectionResolver(s.chroma, s.cfg, name))
+	}
+	s.state.aliasTarget = name
+	// the dimension is learned again from the new collection
+	s.state.knownDims.Lock()
+	delete(s.state.knownDims.m, defaultCollection)
+	s.state.knownDims.Unlock()
+	log.Printf("collection %s now serves %s (was %s)", name, defaultCollection, cur.Collection)
+	return next, nil
+}
+
+// aliasHandler implements GET /admin/alias, which names the collection
+// serving as the default one, and POST /admin/alias, which points it at
+// another existing collection, e.g. back at the previous one.
+func (s *Server) aliasHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Alias request received")
+
+	switch r.Method {
+	case http.MethodGet:
+		a, err := loadAlias(s.cfg.RAGDataDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	case http.MethodPost:
+		defer r.Body.Close()
+		var req struct {
+			Collection string `json:"collection"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Collection == "" {
+			http.Error(w, `expected {"collection": "<name>"}`, http.StatusBadRequest)
+			return
+		}
+		a, err := s.flipAlias(r.Context(), req.Collection)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// -------------------- Reindexing --------------------
+
+// ReindexRequest is the body of POST /admin/reindex. The chunking fields
+// default to the configured ones; the embedding model is always
+// EMBED_MODEL_NAME.
+type ReindexRequest struct {
+	ChunkParams
+	Checks []ReindexCheck `json:"checks,omitempty"` // spot checks; sampled from the documents when empty
+	Flip   *bool          `json:"flip,omitempty"`   // point the alias at the new collection once verified (default true)
+
+	// Progress, when set, is told about each stage and how far it has got.
+	Progress func(stage string, done, total int) `json:"-"`
+}
+
+func (r ReindexRequest) progress(stage string, done, total int) {
+	if r.Progress != nil {
+		r.Progress(stage, done, total)
+	}
+}
+
+// ReindexCheck is a query the new collection must answer well: with Document
+// among its top hits, or when Document is empty, the document the old
+// collection ranks first.
+type ReindexCheck struct {
+	Query    string `json:"query"`
+	Document string `json:"document,omitempty"`
+}
+
+// ReindexCheckResult is how the new collection did on a check.
+type ReindexCheckResult struct {
+	ReindexCheck
+	Found  []string `json:"found"` // documents of the new collection's top hits
+	Passed bool     `json:"passed"`
+}
+
+// ReindexReport describes a reindex run.
+type ReindexReport struct {
+	From         string               `json:"from"`   // the collection serving reads during the run
+	Shadow       string               `json:"shadow"` // the collection built
+	Params       ChunkParams          `json:"params"`
+	Model        string               `json:"model"`
+	Documents    int                  `json:"documents"`
+	Copied       []string             `json:"copied,omitempty"` // without a saved source; chunks kept, re-embedded
+	CaughtUp     int                  `json:"caught_up"`        // documents uploaded or deleted while building
+	Failed       []string             `json:"failed,omitempty"`
+	Missing      []string             `json:"missing,omitempty"` // in the old collection but not the new one
+	LiveChunks   int                  `json:"live_chunks"`
+	ShadowChunks int                  `json:"shadow_chunks"`
+	Checks       []ReindexCheckResult `json:"checks"`
+	Verified     bool                 `json:"verified"`
+	Flipped      bool                 `json:"flipped"`
+}
+
+const (
+	reindexCheckHits    = 5   // a check passes when its document is among this many hits
+	reindexSampleChecks = 5   // checks sampled when the request gives none
+	reindexSampleQuery  = 300 // bytes of a chunk a sampled check queries with
+)
+
+var errReindexRunning = errors.New("reindex already running")
+
+// shadowPrefix starts the name of every collection a reindex builds.
+const shadowPrefix = defaultCollection + "_"
+
+// isShadowCollection reports whether name is one a reindex built.
+func isShadowCollection(name string) bool {
+	return strings.HasPrefix(name, shadowPrefix)
+}
+
+// startReindex starts a reindex as a job, or fails with errReindexRunning
+// while another one runs. ctx should outlive the request that starts it.
+func (s *Server) startReindex(ctx context.Context, req ReindexRequest, who string) (Job, error) {
+	if !s.state.reindexRunning.TryLock() {
+		return Job{}, errReindexRunning
+	}
+	job := s.createJob("", "", requestID(ctx))
+	go s.runReindexJob(ctx, job.ID, req, who)
+	return job, nil
+}
+
+// reindex rebuilds the default collection into a shadow collection and, if
+// it verifies, flips the alias to it. The run is audited as a "reindex"
+// entry. The caller holds reindexRunning.
+func (s *Server) reindex(ctx context.Context, req ReindexRequest, who string) (ReindexReport, error) {
+	start := time.Now()
+	rep, err := s.runReindex(ctx, req)
+	audit := AuditEntry{
+		Time:       start.UTC(),
+		Who:        who,
+		Action:     "reindex",
+		Document:   rep.Shadow,
+		Chunks:     rep.ShadowChunks,
+		Chunking:   rep.Params.String(),
+		Model:      rep.Model,
+		DurationMS: time.Since(start).Milliseconds(),
+		Outcome:    "ok",
+		Status:     http.StatusOK,
+		RequestID:  requestID(ctx),
+	}
+	if err == nil && !rep.Verified {
+		audit.Outcome, audit.Error = "error", "verification failed"
+	}
+	if err != nil {
+		audit.Outcome = "error"
+		audit.Status = errorStatus(err)
+		audit.Error = err.Error()
+	}
+	s.appendAudit(audit)
+	return rep, err
+}
+
+func (s *Server) runReindex(ctx context.Context, req ReindexRequest) (ReindexReport, error) {
+	rep := ReindexReport{Model: s.cfg.EmbedModelName, Checks: []ReindexCheckResult{}}
+	if _, err := s.aliasedStores(); err != nil {
+		return rep, err
+	}
+	rep.Params = req.ChunkParams.withDefaults(s.cfg.chunkParams())
+	if _, err := s.newChunker(rep.Params); err != nil {
+		return rep, statusErrorf(http.StatusBadRequest, "%v", err)
+	}
+	alias, err := loadAlias(s.cfg.RAGDataDir)
+	if err != nil {
+		return rep, err
+	}
+	rep.From = alias.Collection
+
+	rep.Shadow = shadowPrefix + time.Now().UTC().Format("20060102T150405") + "_" + newJobID()[:4]
+	var shadow VectorStore
+	err = withRetry(ctx, "chroma create collection", func() (err error) {
+		shadow, err = s.chroma.CreateCollection(ctx, rep.Shadow, collectionCreateOptions(s.cfg)...)
+		return err
+	})
+	if err != nil {
+		return rep, fmt.Errorf("creating %s: %w", rep.Shadow, err)
+	}
+	// a shadow that is not flipped to is dropped, unless the caller asked to
+	// keep it for a later flip
+	keep := false
+	defer func() {
+		if keep {
+			return
+		}
+		if err := s.chroma.DeleteCollection(context.WithoutCancel(ctx), rep.Shadow); err != nil {
+			logf(ctx, "reindex: dropping %s failed: %v", rep.Shadow, err)
+		}
+	}()
+
+	// the default collection unfiltered, whatever the caller may read
+	live := s.deps.Store
+	docs, err := summarizeDocuments(ctx, live)
+	if err != nil {
+		return rep, fmt.Errorf("listing documents: %w", err)
+	}
+	built := map[string]time.Time{}
+	samples := map[string]string{}
+	for i, d := range docs {
+		s.reindexDocument(ctx, live, shadow, d.Document, &rep, samples)
+		built[d.Document] = d.IngestedAt
+		req.progress("building", i+1, len(docs))
+	}
+	req.progress("catching_up", 0, 0)
+
+	// catch up with documents uploaded, replaced or deleted meanwhile; those
+	// changed after this pass and before the flip are not carried over
+	docs, err = summarizeDocuments(ctx, live)
+	if err != nil {
+		return rep, fmt.Errorf("listing documents: %w", err)
+	}
+	current := map[string]bool{}
+	for _, d := range docs {
+		current[d.Document] = true
+		at, ok := built[d.Document]
+		if ok && !d.IngestedAt.After(at) {
+			continue
+		}
+		if ok {
+			if err := deleteDocumentFrom(ctx, shadow, d.Document); err != nil {
+				rep.Failed = append(rep.Failed, d.Document)
+				logf(ctx, "reindex: replacing %s failed: %v", d.Document, err)
+				continue
+			}
+		}
+		s.reindexDocument(ctx, live, shadow, d.Document, &rep, samples)
+		rep.CaughtUp++
+	}
+	for name := range built {
+		if current[name] {
+			continue
+		}
+		if err := deleteDocumentFrom(ctx, shadow, name); err != nil {
+			logf(ctx, "reindex: removing %s failed: %v", name, err)
+		}
+		delete(samples, name)
+		rep.CaughtUp++
+	}
+	rep.Documents = len(docs)
+
+	if err := s.verifyShadow(ctx, live, shadow, docs, req, samples, &rep); err != nil {
+		return rep, err
+	}
+	if !rep.Verified {
+		logf(ctx, "reindex: %s did not verify; dropping it", rep.Shadow)
+		return rep, nil
+	}
+	if req.Flip != nil && !*req.Flip {
+		keep = true
+		return rep, nil
+	}
+	if _, err := s.flipAlias(ctx, rep.Shadow); err != nil {
+		return rep, err
+	}
+	keep, rep.Flipped = true, true
+	return rep, nil
+}
+
+// chunkLevelKeys are metadata keys that describe one chunk rather than its
+// document, so they are not carried over when a document is chunked anew.
+var chunkLevelKeys = map[string]bool{
+	"context": true, "doc_id": true, "len": true, "title": true, "headings": true,
+	"page": true, "start": true, "end": true, "source_path": true,
+	"excluded": true, "excluded_reason": true, "excluded_at": true,
+	metaQuantScale: true, metaEmbedProvider: true,
+	metaChunkTitle: true, metaChunkSummary: true, metaTable: true,
+}
+
+// reindexDocument writes a document of live into shadow: chunked anew from
+// its saved source, or, without one, copied chunk by chunk. Either way its
+// metadata, including when it was ingested, is kept. A failure is recorded
+// in rep rather than returned, so one document does not stop the run.
+func (s *Server) reindexDocument(ctx context.Context, live, shadow VectorStore, doc string, rep *ReindexReport, samples map[string]string) {
+	ids, texts, metas, err := documentRecords(ctx, live, doc)
+	if err == nil && len(ids) == 0 {
+		return
+	}
+	if err == nil {
+		samples[doc] = texts[0]
+		first := metas[0]
+		var content []byte
+		src, _ := first.GetString("source_path")
+		if path, ok := s.sourceFilePath(src); ok {
+			content, err = os.ReadFile(path)
+		}
+		switch {
+		case content != nil:
+			req := ingestRequest{
+				FileName:   doc,
+				Content:    string(content),
+				Params:     rep.Params,
+				Attributes: metaAttributes(first, chunkLevelKeys),
+				TagsSet:    true,
+				Who:        "reindex",
+				Store:      shadow,
+				// duplicates were let in or aliased when first uploaded
+				OnDuplicate: duplicateAllow,
+			}
+			req.Title, _ = first.GetString("title")
+			_, req.Summarize = first.GetString(metaChunkSummary)
+			_, err = s.runIngest(ctx, req)
+		default:
+			err = s.copyDocument(ctx, shadow, doc, ids, texts, metas)
+			if err == nil {
+				rep.Copied = append(rep.Copied, doc)
+			}
+		}
+	}
+	if err != nil {
+		rep.Failed = append(rep.Failed, doc)
+		logf(ctx, "reindex: %s failed: %v", doc, err)
+	}
+}
+
+// copyDocument writes the stored chunks of a document to c as they are,
+// embedded again with the configured model.
+func (s *Server) copyDocument(ctx context.Context, c VectorStore, doc string, ids []chroma.DocumentID, texts []string, metas []chroma.DocumentMetadata) error {
+	// embed the text the chunks were embedded by at upload
+	chunks := make([]Chunk, len(ids))
+	for i, id := range ids {
+		chunks[i] = Chunk{ID: string(id), Text: texts[i]}
+		var sum chunkSummary
+		sum.Title, _ = metas[i].GetString(metaChunkTitle)
+		sum.Summary, _ = metas[i].GetString(metaChunkSummary)
+		if table, ok := metas[i].GetString(metaTable); ok {
+			_ = json.Unmarshal([]byte(table), &chunks[i].Table)
+		}
+		chunks[i].Text = summarizedText(chunks[i], sum)
+	}
+	embeds, provider, err := s.embedWithCache(ctx, s.embedder, chunks, doc, strings.Join(texts, "\n"), "reindex copy", s.cfg.EmbedModelName, "")
+	if err != nil {
+		return err
+	}
+
+	embs := make([]embeddings.Embedding, len(ids))
+	out := make([]chroma.DocumentMetadata, len(ids))
+	skip := map[string]bool{metaQuantScale: true, metaEmbedProvider: true}
+	for i, id := range ids {
+		vec, ok := embeds[string(id)]
+		if !ok {
+			return fmt.Errorf("missing embedding for chunk %s", id)
+		}
+		if err := s.checkEmbeddings(c, s.cfg.EmbedModelName, len(vec), true); err != nil {
+			return err
+		}
+		emb, quantAttrs := storedEmbedding(vec, s.cfg.EmbedQuantize)
+		embs[i] = emb
+		attrs := append(metaAttributes(metas[i], skip), quantAttrs...)
+		if provider != "" {
+			attrs = append(attrs, chroma.NewStringAttribute(metaEmbedProvider, provider))
+		}
+		out[i] = chroma.NewDocumentMetadata(attrs...)
+	}
+	_, err = addInBatches(ctx, c, s.cfg.ChromaBatchSize, ids, embs, texts, out, nil)
+	return err
+}
+
+// verifyShadow checks that shadow holds every document of docs and answers
+// the spot checks, and records the outcome in rep.
+func (s *Server) verifyShadow(ctx context.Context, live, shadow VectorStore, docs []DocumentSummary, req ReindexRequest, samples map[string]string, rep *ReindexReport) error {
+	got, err := summarizeDocuments(ctx, shadow)
+	if err != nil {
+		return fmt.Errorf("listing documents of %s: %w", rep.Shadow, err)
+	}
+	have := map[string]bool{}
+	for _, d := range got {
+		have[d.Document] = true
+		rep.ShadowChunks += d.Chunks
+	}
+	for _, d := range docs {
+		rep.LiveChunks += d.Chunks
+		if !have[d.Document] {
+			rep.Missing = append(rep.Missing, d.Document)
+		}
+	}
+
+	checks := req.Checks
+	if len(checks) == 0 {
+		checks = sampleChecks(docs, samples)
+	}
+	passed := true
+	for i, c := range checks {
+		res, err := s.runCheck(ctx, live, shadow, c)
+		if err != nil {
+			return fmt.Errorf("check %q: %w", c.Query, err)
+		}
+		passed = passed && res.Passed
+		rep.Checks = append(rep.Checks, res)
+		req.progress("checking", i+1, len(checks))
+	}
+	rep.Verified = passed && len(rep.Missing) == 0 && len(rep.Failed) == 0
+	return nil
+}
+
+// sampleChecks queries for documents spread over docs with the start of
+// their first chunk, expecting each to find its own document.
+func sampleChecks(docs []DocumentSummary, samples map[string]string) []ReindexCheck {
+	var names []string
+	for _, d := range docs {
+		if samples[d.Document] != "" {
+			names = append(names, d.Document)
+		}
+	}
+	n := min(reindexSampleChecks, len(names))
+	checks := make([]ReindexCheck, 0, n)
+	for i := range n {
+		name := names[i*len(names)/n]
+		query := samples[name]
+		if len(query) > reindexSampleQuery {
+			end := reindexSampleQuery
+			for end > 0 && !utf8.RuneStart(query[end]) {
+				end--
+			}
+			query = query[:end]
+		}
+		checks = append(checks, ReindexCheck{Query: query, Document: name})
+	}
+	return checks
+}
+
+// runCheck queries shadow for c. Without an expected document it takes the
+// one the live collection ranks first; when the live collection cannot be
+// queried, e.g. because it was built with another model, any hit passes.
+func (s *Server) runCheck(ctx context.Context, live, shadow VectorStore, c ReindexCheck) (ReindexCheckResult, error) {
+	res := ReindexCheckResult{ReindexCheck: c, Found: []string{}}
+	qVec, err := s.embedQuery(ctx, c.Query)
+	if err != nil {
+		return res, err
+	}
+	if res.Document == "" {
+		if hits, err := s.queryCollection(ctx, live, qVec, nil, 1); err == nil && len(hits) > 0 {
+			res.Document = metaDocument(hits[0].Metadata)
+		}
+	}
+	hits, err := s.queryCollection(ctx, shadow, qVec, nil, reindexCheckHits)
+	if err != nil {
+		return res, err
+	}
+	for _, h := range hits {
+		doc := metaDocument(h.Metadata)
+		res.Found = append(res.Found, doc)
+		if doc == res.Document {
+			res.Passed = true
+		}
+	}
+	if res.Document == "" {
+		res.Passed = len(hits) > 0
+	}
+	return res, nil
+}
+
+// documentRecords returns the stored chunks of doc in c, in document order.
+func documentRecords(ctx context.Context, c VectorStore, doc string) ([]chroma.DocumentID, []string, []chroma.DocumentMetadata, error) {
+	type record struct {
+		id   chroma.DocumentID
+		text string
+		meta chroma.DocumentMetadata
+	}
+	var recs []record
+	for offset := 0; ; offset += chromaPageSize {
+		var res chroma.GetResult
+		err := withRetry(ctx, "chroma get", func() (err error) {
+			res, err = c.Get(ctx,
+				chroma.WithWhereGet(chroma.EqString("context", doc)),
+				chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+				chroma.WithLimitGet(chromaPageSize),
+				chroma.WithOffsetGet(offset),
+			)
+			return err
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ids, texts, metas := res.GetIDs(), res.GetDocuments(), res.GetMetadatas()
+		for i, id := range ids {
+			r := record{id: id, meta: chroma.NewDocumentMetadata()}
+			if i < len(texts) && texts[i] != nil {
+				r.text = texts[i].ContentString()
+			}
+			if i < len(metas) && metas[i] != nil {
+				r.meta = metas[i]
+			}
+			recs = append(recs, r)
+		}
+		if len(ids) < chromaPageSize {
+			break
+		}
+	}
+	sort.SliceStable(recs, func(a, b int) bool {
+		_, i, _ := chunkIndex(string(recs[a].id))
+		_, j, _ := chunkIndex(string(recs[b].id))
+		return i < j
+	})
+	ids := make([]chroma.DocumentID, len(recs))
+	texts := make([]string, len(recs))
+	metas := make([]chroma.DocumentMetadata, len(recs))
+	for i, r := range recs {
+		ids[i], texts[i], metas[i] = r.id, r.text, r.meta
+	}
+	return ids, texts, metas, nil
+}
+
+// deleteDocumentFrom removes every chunk of doc from c.
+func deleteDocumentFrom(ctx context.Context, c VectorStore, doc string) error {
+	ids, err := collectionIDs(ctx, c, chroma.EqString("context", doc))
+	if err != nil {
+		return err
+	}
+	return deleteIDs(ctx, c, ids)
+}
+
+// metaAttributes turns meta back into attributes, leaving out the keys in
+// skip, so they can be written again with their types.
+func metaAttributes(meta chroma.DocumentMetadata, skip map[string]bool) []*chroma.MetaAttribute {
+	var attrs []*chroma.MetaAttribute
+	for key := range metadataMap(meta) {
+		if skip[key] {
+			continue
+		}
+		if v, ok := meta.GetString(key); ok {
+			attrs = append(attrs, chroma.NewStringAttribute(key, v))
+		} else if v, ok := meta.GetBool(key); ok {
+			attrs = append(attrs, chroma.NewBoolAttribute(key, v))
+		} else if v, ok := meta.GetInt(key); ok {
+			attrs = append(attrs, chroma.NewIntAttribute(key, v))
+		} else if v, ok := meta.GetFloat(key); ok {
+			attrs = append(attrs, chroma.NewFloatAttribute(key, v))
+		}
+	}
+	return attrs
+}
+
+// metaDocument is the document a chunk belongs to.
+func metaDocument(meta chroma.DocumentMetadata) string {
+	if meta == nil {
+		return ""
+	}
+	doc, _ := meta.GetString("context")
+	return doc
+}
+
+// reindexHandler implements POST /admin/reindex: it starts rebuilding the
+// default collection as a job and answers 202 with it; the job's result is
+// the report. A reindex already in progress answers 409.
+func (s *Server) reindexHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Reindex request received")
+
+	defer r.Body.Close()
+	var req ReindexRequest
+	if r.ContentLength != 0 {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "invalid reindex request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for i, c := range req.Checks {
+		if strings.TrimSpace(c.Query) == "" {
+			http.Error(w, fmt.Sprintf("checks[%d]: query is required", i), http.StatusBadRequest)
+			return
+		}
+	}
+	// refuse what would fail right away here rather than in the job
+	if _, err := s.aliasedStores(); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if _, err := s.newChunker(req.ChunkParams.withDefaults(s.cfg.chunkParams())); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the run outlives the request, and reads every document
+	ctx := withRequestIDContext(context.WithoutCancel(context.Background()), requestID(r.Context()))
+	job, err := s.startReindex(ctx, req, callerIdentity(r))
+	if errors.Is(err, errReindexRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
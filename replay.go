@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Replay limits: every replayed query costs an embedding and an LLM call.
+const (
+	defaultReplayQueries = 20
+	maxReplayQueries     = 500
+)
+
+// replayDriftThreshold is the answer similarity below which a replayed answer
+// counts as drifted from the logged one.
+const replayDriftThreshold = 0.9
+
+// ReplayRequest picks logged chats to run again. Without request_ids, the
+// newest successful chats in [since, until) are replayed, up to limit.
+type ReplayRequest struct {
+	RequestIDs []string           `json:"request_ids,omitempty"`
+	Since      string             `json:"since,omitempty"` // YYYY-MM-DD or RFC 3339
+	Until      string             `json:"until,omitempty"`
+	Limit      int                `json:"limit,omitempty"`   // default 20
+	Variant    *ExperimentVariant `json:"variant,omitempty"` // changes applied to every replayed request
+}
+
+// ReplayResult compares a logged answer with the one the current
+// configuration gives.
+type ReplayResult struct {
+	RequestID        string  `json:"request_id"`
+	Query            string  `json:"query"`
+	LoggedAnswer     string  `json:"logged_answer"`
+	Answer           string  `json:"answer"`
+	AnswerSimilarity float64 `json:"answer_similarity"` // cosine similarity of the two answers' embeddings
+	RetrievalOverlap float64 `json:"retrieval_overlap"` // shared retrieved chunks over all retrieved chunks
+	Drifted          bool    `json:"drifted"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// ReplayReport summarizes a replay.
+type ReplayReport struct {
+	Replayed             int            `json:"replayed"`
+	Failed               int            `json:"failed"`
+	Drifted              int            `json:"drifted"`
+	MeanAnswerSimilarity float64        `json:"mean_answer_similarity"`
+	MeanRetrievalOverlap float64        `json:"mean_retrieval_overlap"`
+	Results              []ReplayResult `json:"results"`
+}
+
+// replayHandler runs logged chats again with the current configuration, and
+// optionally a variant on top of it, and reports how far the answers and the
+// retrieved chunks have moved. Run against a staging server that shares the
+// data directory, it measures the drift a change would cause before it is
+// rolled out.
+func (s *Server) replayHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Replay request received")
+
+	defer r.Body.Close()
+
+	var req ReplayRequest
+	if r.ContentLength != 0 {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "expected {request_ids, since, until, limit, variant}", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultReplayQueries
+	}
+	if req.Limit < 1 || req.Limit > maxReplayQueries {
+		http.Error(w, fmt.Sprintf("limit must be 1..%d", maxReplayQueries), http.StatusBadRequest)
+		return
+	}
+	if v := req.Variant; v != nil && (v.TopK < 0 || v.TopK > maxExperimentTopK || len(v.Collections) > maxFederatedCollections) {
+		http.Error(w, fmt.Sprintf("variant top_k must be 1..%d and name at most %d collections", maxExperimentTopK, maxFederatedCollections), http.StatusBadRequest)
+		return
+	}
+	var since, until time.Time
+	var err error
+	if req.Since != "" {
+		if since, err = parseTimestamp(req.Since); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Until != "" {
+		if until, err = parseTimestamp(req.Until); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.readQueryLog(func(e QueryLogEntry) bool {
+		if len(req.RequestIDs) > 0 {
+			return slices.Contains(req.RequestIDs, e.RequestID)
+		}
+		return e.Status == http.StatusOK && !e.AnswerUnavailable &&
+			!e.Time.Before(since) && (until.IsZero() || e.Time.Before(until))
+	})
+	if err != nil {
+		http.Error(w, "failed to read query log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > req.Limit {
+		entries = entries[:req.Limit]
+	}
+
+	writeJSON(w, http.StatusOK, s.replay(r.Context(), entries, req.Variant))
+}
+
+// replay runs each entry again, as the caller who asked it but billed to the
+// caller replaying it. Replayed chats are not logged themselves.
+func (s *Server) replay(ctx context.Context, entries []QueryLogEntry, variant *ExperimentVariant) ReplayReport {
+	report := ReplayReport{Results: []ReplayResult{}}
+	replayer, _ := callerFrom(ctx)
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		req := e.Request
+		req.topK = e.TopK
+		if variant != nil {
+			variant.apply(&req)
+		}
+		res := ReplayResult{RequestID: e.RequestID, Query: req.Query, LoggedAnswer: e.Answer}
+
+		asker := withCaller(ctx, Caller{ID: e.User, Groups: e.Groups, Admin: e.Admin, Tenant: replayer.Tenant})
+		t, resp, err := s.generateChat(asker, req)
+		if err != nil {
+			res.Error = err.Error()
+			report.Failed++
+			report.Results = append(report.Results, res)
+			continue
+		}
+		res.Answer = resp.Answer
+		if resp.AnswerUnavailable {
+			res.Error = "answer unavailable: generation failed"
+			report.Failed++
+			report.Results = append(report.Results, res)
+			continue
+		}
+
+		var ids []string
+		if t != nil {
+			for _, c := range t.resp.Citations {
+				ids = append(ids, c.ChunkID)
+			}
+		}
+		logged := make([]string, len(e.Retrieved))
+		for i, h := range e.Retrieved {
+			logged[i] = h.ChunkID
+		}
+		res.RetrievalOverlap = overlap(logged, ids)
+
+		if res.AnswerSimilarity, err = s.answerSimilarity(ctx, e.Answer, resp.Answer); err != nil {
+			res.Error = "comparing answers: " + err.Error()
+			report.Failed++
+			report.Results = append(report.Results, res)
+			continue
+		}
+		res.Drifted = res.AnswerSimilarity < replayDriftThreshold
+
+		report.Replayed++
+		report.MeanAnswerSimilarity += res.AnswerSimilarity
+		report.MeanRetrievalOverlap += res.RetrievalOverlap
+		if res.Drifted {
+			report.Drifted++
+		}
+		report.Results = append(report.Results, res)
+	}
+	if report.Replayed > 0 {
+		report.MeanAnswerSimilarity /= float64(report.Replayed)
+		report.MeanRetrievalOverlap /= float64(report.Replayed)
+	}
+	return report
+}
+
+// answerSimilarity embeds two answers and returns their cosine similarity;
+// two empty answers are the same.
+func (s *Server) answerSimilarity(ctx context.Context, a, b string) (float64, error) {
+	switch {
+	case a == b:
+		return 1, nil
+	case a == "" || b == "":
+		return 0, nil
+	}
+	vecs, err := s.embedder.Embed(ctx, []Chunk{{ID: "a", Text: a}, {ID: "b", Text: b}})
+	if err != nil {
+		return 0, err
+	}
+	return cosineSimilarity(vecs["a"], vecs["b"]), nil
+}
+
+// overlap is the Jaccard similarity of two sets of chunk IDs; two empty sets
+// are the same.
+func overlap(a, b []string) float64 {
+	set := map[string]bool{}
+	for _, id := range a {
+		set[id] = true
+	}
+	shared, union := 0, len(set)
+	for _, id := range b {
+		switch v, ok := set[id]; {
+		case !ok:
+			set[id] = false
+			union++
+		case v:
+			set[id] = false // count a repeated ID once
+			shared++
+		}
+	}
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+	"github.com/amikos-tech/chroma-go/pkg/embeddings"
+)
+
+// maxFederatedCollections bounds how many collections one request may query.
+const maxFederatedCollections = 10
+
+// includeDistances asks Chroma to return query distances; chroma-go has no
+// constant for it, but the API accepts it alongside the others.
+const includeDistances chroma.Include = "distances"
+
+// retrievedChunk is one query hit together with where it came from.
+type retrievedChunk struct {
+	Text       string
+	Metadata   chroma.DocumentMetadata
+	Collection string
+	Distance   float64
+	Score      float64         // similarity in (0, 1], comparable across collections
+	Neighbors  *neighborWindow // the chunks added around the hit, if any
+}
+
+// citation describes the hit for API responses; the collection is only named
+// when the request searched more than one.
+func (h retrievedChunk) citation(withCollection bool) Citation {
+	c := citationFromMetadata(h.Metadata)
+	if withCollection {
+		c.Collection = h.Collection
+	}
+	c.Distance = h.Distance
+	c.Score = h.Score
+	if w := h.Neighbors; w != nil {
+		c.Neighbors = w.IDs
+		c.Start, c.End = w.Start, w.End
+	}
+	return c
+}
+
+// retrieve runs the vector query against the requested collections (the
+// default collection when none are named) concurrently and merges the hits
+// by score, returning at most n of them. An enabled boost re-ranks the hits
+// by recency.
+func (s *Server) retrieve(ctx context.Context, qVec []float32, where chroma.WhereClause, collectionNames []string, n int, boost recencyBoost) ([]retrievedChunk, error) {
+	candidates, err := s.retrieveCandidates(ctx, qVec, where, collectionNames, n, boost)
+	if err != nil {
+		return nil, err
+	}
+	return rankHits(candidates, n, boost), nil
+}
+
+// retrieveCandidates returns every hit retrieve ranks: the top n of each
+// collection, or more of them when boosting so the boost has room to work.
+func (s *Server) retrieveCandidates(ctx context.Context, qVec []float32, where chroma.WhereClause, collectionNames []string, n int, boost recencyBoost) ([]retrievedChunk, error) {
+	targets, err := s.resolveCollections(ctx, collectionNames)
+	if err != nil {
+		return nil, err
+	}
+
+	fetch := n
+	if boost.enabled() {
+		fetch = n * recencyOverfetch
+	}
+
+	results := make([][]retrievedChunk, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, c := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = s.queryCollection(ctx, c, qVec, where, fetch)
+		}()
+	}
+	wg.Wait()
+
+	var merged []retrievedChunk
+	for i, res := range results {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("querying collection %s: %w", targets[i].Name(), errs[i])
+		}
+		merged = append(merged, res...)
+	}
+	return merged, nil
+}
+
+// rankHits orders candidates by score, boosted when the boost is enabled, and
+// keeps the best n. Hits from one collection arrive in order already.
+func rankHits(hits []retrievedChunk, n int, boost recencyBoost) []retrievedChunk {
+	if boost.enabled() {
+		return boost.apply(hits, n, time.Now())
+	}
+	sort.SliceStable(hits, func(a, b int) bool { return hits[a].Score > hits[b].Score })
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	return hits
+}
+
+func (s *Server) queryCollection(ctx context.Context, c VectorStore, qVec []float32, where chroma.WhereClause, n int) ([]retrievedChunk, error) {
+	if err := s.checkEmbeddings(c, s.cfg.EmbedModelName, len(qVec), false); err != nil {
+		return nil, err
+	}
+
+	opts := []chroma.CollectionQueryOption{
+		chroma.WithQueryEmbeddings(embeddings.NewEmbeddingFromFloat32(qVec)),
+		chroma.WithNResults(n),
+		chroma.WithIncludeQuery(chroma.IncludeDocuments, chroma.IncludeMetadatas, includeDistances),
+	}
+	if where != nil {
+		opts = append(opts, chroma.WithWhereQuery(where))
+	}
+	var qr chroma.QueryResult
+	err := withRetry(ctx, "chroma query", func() (err error) {
+		qr, err = c.Query(ctx, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	docsGroups := qr.GetDocumentsGroups()
+	metasGroups := qr.GetMetadatasGroups()
+	distGroups := qr.GetDistancesGroups()
+	if len(docsGroups) == 0 {
+		return nil, nil
+	}
+
+	out := make([]retrievedChunk, 0, len(docsGroups[0]))
+	for i, d := range docsGroups[0] {
+		if d == nil {
+			continue
+		}
+		hit := retrievedChunk{Text: d.ContentString(), Collection: c.Name()}
+		if len(metasGroups) > 0 && i < len(metasGroups[0]) {
+			hit.Metadata = metasGroups[0][i]
+		}
+		if len(distGroups) > 0 && i < len(distGroups[0]) {
+			hit.Distance = float64(distGroups[0][i])
+		}
+		hit.Score = distanceToScore(hit.Distance)
+		out = append(out, hit)
+	}
+	return out, nil
+}
+
+// distanceToScore maps a distance onto (0, 1], higher meaning more similar.
+// The mapping is monotonic, so ranking within a collection is unchanged, and
+// does not depend on the other hits, so scores from different collections
+// (embedded with the same model) can be merged directly.
+func distanceToScore(d float64) float64 {
+	if d < 0 {
+		d = 0
+	}
+	return 1 / (1 + d)
+}
+
+// collectionCache holds a server's handles for collections other than the
+// default one.
+type collectionCache struct {
+	sync.Mutex
+	m map[string]VectorStore
+}
+
+// resolveCollections returns the collection handles for names, defaulting to
+// the main collection. Collections are looked up in Chroma without holding
+// the cache lock, so a slow lookup only delays the requests naming it.
+func (s *Server) resolveCollections(ctx context.Context, names []string) ([]VectorStore, error) {
+	if len(names) == 0 {
+		return []VectorStore{s.store}, nil
+	}
+	if len(names) > maxFederatedCollections {
+		return nil, statusErrorf(http.StatusBadRequest, "at most %d collections can be queried at once", maxFederatedCollections)
+	}
+
+	// the default collection's alias names the collection it points at, so
+	// both names are one collection
+	target, err := s.aliasTarget()
+	if err != nil {
+		return nil, err
+	}
+	canonical := func(name string) string {
+		if name == defaultCollection {
+			return target
+		}
+		return name
+	}
+	own := canonical(s.store.Name())
+
+	out := make([]VectorStore, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = canonical(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if name == own {
+			out = append(out, s.store)
+			continue
+		}
+		// a reindex builds its shadow next to the live collection; until the
+		// alias points at it, it is not one to answer from
+		if isShadowCollection(name) && name != target {
+			return nil, statusErrorf(http.StatusBadRequest, "collection %q is a reindex shadow, not a live collection", name)
+		}
+		c, err := s.otherCollection(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// otherCollection returns the cached handle of the named collection, looking
+// it up in Chroma on first use.
+func (s *Server) otherCollection(ctx context.Context, name string) (VectorStore, error) {
+	s.others.Lock()
+	c, ok := s.others.m[name]
+	s.others.Unlock()
+	if ok {
+		return c, nil
+	}
+	if s.chroma == nil {
+		return nil, statusErrorf(http.StatusNotImplemented, "collection %q: this server has no Chroma client to open other collections", name)
+	}
+
+	resolve := func(ctx context.Context) (VectorStore, error) {
+		return s.chroma.GetCollection(ctx, name)
+	}
+	first, err := resolve(ctx)
+	if err != nil {
+		return nil, statusErrorf(http.StatusNotFound, "collection %q: %v", name, err)
+	}
+
+	s.others.Lock()
+	defer s.others.Unlock()
+	// a concurrent lookup may have got there first
+	if c, ok := s.others.m[name]; ok {
+		return c, nil
+	}
+	c = accessStore{newReconnectingStore(name, first, resolve)}
+	s.others.m[name] = c
+	return c, nil
+}
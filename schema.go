@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// Schema field types, matching the scalar types Chroma metadata can hold.
+const (
+	fieldString = "string"
+	fieldInt    = "int"
+	fieldFloat  = "float"
+	fieldBool   = "bool"
+)
+
+// SchemaField describes one custom metadata attribute.
+type SchemaField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // "string" | "int" | "float" | "bool"
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// MetadataSchema lists the custom metadata attributes a collection accepts.
+// Once a collection has a schema, uploads and PATCH requests may only set the
+// declared attributes, with values of the declared type, and query filters are
+// checked and typed against it. Without a schema, attributes are free-form.
+type MetadataSchema struct {
+	Fields []SchemaField `json:"fields"`
+}
+
+// schemaKeys are handled specially by ingestion and PATCH and so cannot be
+// declared in a schema.
+var schemaKeys = map[string]bool{
+	"tags": true, "namespace": true, "expires_at": true, metaDocDate: true,
+}
+
+func (s *MetadataSchema) field(name string) (SchemaField, bool) {
+	if s == nil {
+		return SchemaField{}, false
+	}
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return SchemaField{}, false
+}
+
+// Validate checks field names and types.
+func (s *MetadataSchema) Validate() error {
+	seen := map[string]bool{}
+	for i, f := range s.Fields {
+		switch {
+		case f.Name == "":
+			return fmt.Errorf("fields[%d]: name is empty", i)
+		case reservedMetadataKeys[f.Name] || schemaKeys[f.Name] || strings.HasPrefix(f.Name, "tag_") || strings.HasPrefix(f.Name, aclGroupPrefix):
+			return fmt.Errorf("fields[%d]: %q is a built-in attribute", i, f.Name)
+		case seen[f.Name]:
+			return fmt.Errorf("fields[%d]: duplicate field %q", i, f.Name)
+		}
+		switch f.Type {
+		case fieldString, fieldInt, fieldFloat, fieldBool:
+		default:
+			return fmt.Errorf("fields[%d]: invalid type %q: want string, int, float or bool", i, f.Type)
+		}
+		seen[f.Name] = true
+	}
+	return nil
+}
+
+// decodeScalar decodes a JSON value keeping numbers as json.Number.
+func decodeScalar(key string, raw json.RawMessage) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("metadata %q: %w", key, err)
+	}
+	return v, nil
+}
+
+// typedValue converts v to the Go type of field f (string, int64, float64 or bool).
+func (f SchemaField) typedValue(v any) (any, error) {
+	switch f.Type {
+	case fieldString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case fieldBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case fieldInt:
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+		}
+	case fieldFloat:
+		if n, ok := v.(json.Number); ok {
+			if fl, err := n.Float64(); err == nil {
+				return fl, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("metadata %q must be of type %s", f.Name, f.Type)
+}
+
+// attribute converts a JSON value into a Chroma attribute. With a schema the
+// key must be declared and the value is stored as the declared type (so 3 is
+// stored as a float for a float field); without one any scalar is accepted.
+// null removes the key, unless the field is required.
+func (s *MetadataSchema) attribute(key string, raw json.RawMessage) (*chroma.MetaAttribute, error) {
+	if s == nil || len(s.Fields) == 0 {
+		return metadataAttribute(key, raw)
+	}
+	f, ok := s.field(key)
+	if !ok {
+		return nil, fmt.Errorf("metadata %q is not in the collection's schema", key)
+	}
+	v, err := decodeScalar(key, raw)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		if f.Required {
+			return nil, fmt.Errorf("metadata %q is required and cannot be removed", key)
+		}
+		return chroma.RemoveAttribute(key), nil
+	}
+	tv, err := f.typedValue(v)
+	if err != nil {
+		return nil, err
+	}
+	switch tv := tv.(type) {
+	case string:
+		return chroma.NewStringAttribute(key, tv), nil
+	case int64:
+		return chroma.NewIntAttribute(key, tv), nil
+	case float64:
+		return chroma.NewFloatAttribute(key, tv), nil
+	default:
+		return chroma.NewBoolAttribute(key, tv.(bool)), nil
+	}
+}
+
+// checkRequired reports the first required field missing from keys.
+func (s *MetadataSchema) checkRequired(keys map[string]json.RawMessage) error {
+	if s == nil {
+		return nil
+	}
+	for _, f := range s.Fields {
+		if _, ok := keys[f.Name]; f.Required && !ok {
+			return fmt.Errorf("metadata %q is required by the collection's schema", f.Name)
+		}
+	}
+	return nil
+}
+
+// filtersWhere turns equality filters into a Where clause. With a schema,
+// filters on undeclared keys or with values of the wrong type are rejected
+// instead of silently matching nothing, and numbers are typed as declared.
+func (s *MetadataSchema) filtersWhere(filters map[string]json.RawMessage) (chroma.WhereClause, error) {
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var clauses []chroma.WhereClause
+	for _, key := range keys {
+		v, err := decodeScalar(key, filters[key])
+		if err != nil {
+			return nil, err
+		}
+		if s != nil && len(s.Fields) > 0 {
+			f, ok := s.field(key)
+			if !ok {
+				return nil, fmt.Errorf("filter %q is not in the collection's schema", key)
+			}
+			if v, err = f.typedValue(v); err != nil {
+				return nil, fmt.Errorf("filter %q must be of type %s", key, f.Type)
+			}
+		}
+		switch val := v.(type) {
+		case string:
+			clauses = append(clauses, chroma.EqString(key, val))
+		case bool:
+			clauses = append(clauses, chroma.EqBool(key, val))
+		case int64:
+			clauses = append(clauses, chroma.EqInt(key, int(val)))
+		case float64:
+			clauses = append(clauses, chroma.EqFloat(key, float32(val)))
+		case json.Number:
+			if i, err := val.Int64(); err == nil {
+				clauses = append(clauses, chroma.EqInt(key, int(i)))
+			} else if fl, err := val.Float64(); err == nil {
+				clauses = append(clauses, chroma.EqFloat(key, float32(fl)))
+			} else {
+				return nil, fmt.Errorf("filter %q: %w", key, err)
+			}
+		default:
+			return nil, fmt.Errorf("filter %q must be a string, number or boolean", key)
+		}
+	}
+	return andWhere(clauses...), nil
+}
+
+// filtersWhereFor builds the filters' Where clause for a query against the
+// named collections (the default one when none are named), checking them
+// against every collection's schema.
+func (s *Server) filtersWhereFor(filters map[string]json.RawMessage, collectionNames []string) (chroma.WhereClause, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	if len(collectionNames) == 0 {
+		collectionNames = []string{s.store.Name()}
+	}
+	var where chroma.WhereClause
+	typed := false
+	for _, name := range collectionNames {
+		schema, err := s.collectionSchema(name)
+		if err != nil {
+			return nil, err
+		}
+		if schema == nil && where != nil {
+			continue
+		}
+		w, err := schema.filtersWhere(filters)
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %w", name, err)
+		}
+		if !typed {
+			where, typed = w, schema != nil
+		}
+	}
+	return where, nil
+}
+
+// Schemas are kept as JSON files under RAG_DATA_DIR/schemas, one per
+// collection, and cached by the server after the first read.
+type schemaCache struct {
+	sync.Mutex
+	m map[string]*MetadataSchema
+}
+
+func (s *Server) schemaPath(collectionName string) string {
+	return filepath.Join(s.cfg.RAGDataDir, "schemas", filepath.Base(collectionName)+".json")
+}
+
+// collectionSchema returns the schema of the named collection, or nil if it
+// has none.
+func (s *Server) collectionSchema(collectionName string) (*MetadataSchema, error) {
+	s.schemas.Lock()
+	defer s.schemas.Unlock()
+	if schema, ok := s.schemas.m[collectionName]; ok {
+		return schema, nil
+	}
+
+	var schema *MetadataSchema
+	b, err := os.ReadFile(s.schemaPath(collectionName))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		schema = &MetadataSchema{}
+		if err := json.Unmarshal(b, schema); err != nil {
+			return nil, fmt.Errorf("schema for %s: %w", collectionName, err)
+		}
+	}
+	s.schemas.m[collectionName] = schema
+	return schema, nil
+}
+
+func (s *Server) saveSchema(collectionName string, schema *MetadataSchema) error {
+	path := s.schemaPath(collectionName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+
+	s.schemas.Lock()
+	s.schemas.m[collectionName] = schema
+	s.schemas.Unlock()
+	return nil
+}
+
+// defaultSchema is the schema of the collection uploads write to. An
+// unreadable schema is logged and treated as none.
+func (s *Server) defaultSchema() *MetadataSchema {
+	schema, err := s.collectionSchema(s.store.Name())
+	if err != nil {
+		log.Printf("failed to load metadata schema: %v", err)
+	}
+	return schema
+}
+
+// schemaHandler serves GET (anyone) and PUT (admin) on
+// /collections/{name}/schema. PUT replaces the schema; it does not rewrite
+// chunks already stored.
+func (s *Server) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		schema, err := s.collectionSchema(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if schema == nil {
+			schema = &MetadataSchema{Fields: []SchemaField{}}
+		}
+		writeJSON(w, http.StatusOK, schema)
+
+	case http.MethodPut:
+		s.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			var schema MetadataSchema
+			if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+				http.Error(w, "expected {\"fields\": [...]}", http.StatusBadRequest)
+				return
+			}
+			if err := schema.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.saveSchema(name, &schema); err != nil {
+				http.Error(w, "failed to save schema: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, schema)
+		})(w, r)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
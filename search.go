@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// SearchHit is a retrieved chunk with its location and retrieval scores.
+type SearchHit struct {
+	Text string `json:"text"`
+	Citation
+}
+
+type SearchResponse struct {
+	Results []SearchHit      `json:"results"`
+	Filter  *SelfQueryFilter `json:"filter,omitempty"` // what self_query derived
+}
+
+// searchHandler runs retrieval only: it accepts the same body as /chat and
+// returns the matching chunks with their scores, without calling the LLM.
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Search request received")
+
+	defer r.Body.Close()
+	ctx := r.Context()
+
+	req, err := readChatRequest(r)
+	if err != nil {
+		http.Error(w, "expected {query} or {messages}", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	boost, err := s.requestRecency(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	searchText, filter := s.prepareRetrieval(ctx, &req)
+	where, err := s.chatWhere(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qVec, err := s.embedQuery(ctx, searchText)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hits, err := s.retrieve(ctx, qVec, where, req.Collections, 5, boost)
+	if err != nil {
+		http.Error(w, "chroma query failed: "+err.Error(), retrievalErrorStatus(err))
+		return
+	}
+
+	results := make([]SearchHit, 0, len(hits))
+	for _, h := range hits {
+		results = append(results, SearchHit{Text: h.Text, Citation: h.citation(len(req.Collections) > 0)})
+	}
+	writeJSON(w, http.StatusOK, SearchResponse{Results: results, Filter: filter})
+}
+
+// Keyword search modes.
+const (
+	keywordContains = "contains"
+	keywordRegex    = "regex"
+)
+
+// KeywordSearchRequest asks for chunks whose text contains a literal string or
+// matches a regular expression.
+type KeywordSearchRequest struct {
+	Query    string   `json:"query"`
+	Mode     string   `json:"mode,omitempty"`     // "contains" (default) | "regex"
+	Document string   `json:"document,omitempty"` // restrict to one document
+	Tags     []string `json:"tags,omitempty"`
+	Limit    int      `json:"limit,omitempty"`
+	Offset   int      `json:"offset,omitempty"`
+}
+
+type KeywordSearchResponse struct {
+	Limit   int         `json:"limit"`
+	Offset  int         `json:"offset"`
+	Results []SearchHit `json:"results"`
+}
+
+// keywordSearchHandler finds chunks by exact text using Chroma's document
+// filters, for lookups such as error codes and IDs that embeddings handle
+// poorly. Hits are unranked, so their distance and score are zero.
+func (s *Server) keywordSearchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Keyword search request received")
+
+	defer r.Body.Close()
+	ctx := r.Context()
+
+	var req KeywordSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
+		http.Error(w, "expected {query}", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultPageLimit
+	}
+	if req.Limit > maxPageLimit || req.Offset < 0 {
+		http.Error(w, fmt.Sprintf("limit must be at most %d and offset non-negative", maxPageLimit), http.StatusBadRequest)
+		return
+	}
+
+	var docFilter chroma.WhereDocumentFilter
+	switch req.Mode {
+	case "", keywordContains:
+		docFilter = chroma.Contains(req.Query)
+	case keywordRegex:
+		// Chroma's regex dialect is close to Go's; catch obvious mistakes early
+		if _, err := regexp.Compile(req.Query); err != nil {
+			http.Error(w, "invalid regex: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		docFilter = chroma.Regex(req.Query)
+	default:
+		http.Error(w, fmt.Sprintf("invalid mode %q: want contains or regex", req.Mode), http.StatusBadRequest)
+		return
+	}
+
+	var docWhere chroma.WhereClause
+	if req.Document != "" {
+		docWhere = documentsWhere([]string{req.Document})
+	}
+	opts := []chroma.CollectionGetOption{
+		chroma.WithWhereDocumentGet(docFilter),
+		chroma.WithIncludeGet(chroma.IncludeDocuments, chroma.IncludeMetadatas),
+		chroma.WithLimitGet(req.Limit),
+		chroma.WithOffsetGet(req.Offset),
+	}
+	if where := andWhere(notExcludedWhere(), tagsWhere(req.Tags), docWhere); where != nil {
+		opts = append(opts, chroma.WithWhereGet(where))
+	}
+
+	var res chroma.GetResult
+	err := withRetry(ctx, "chroma get", func() (err error) {
+		res, err = s.store.Get(ctx, opts...)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "chroma get failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	docs := res.GetDocuments()
+	metas := res.GetMetadatas()
+	results := make([]SearchHit, 0, len(docs))
+	for i := range res.GetIDs() {
+		var hit SearchHit
+		if i < len(docs) && docs[i] != nil {
+			hit.Text = docs[i].ContentString()
+		}
+		if i < len(metas) {
+			hit.Citation = citationFromMetadata(metas[i])
+		}
+		results = append(results, hit)
+	}
+	writeJSON(w, http.StatusOK, KeywordSearchResponse{Limit: req.Limit, Offset: req.Offset, Results: results})
+}
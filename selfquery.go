@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// maxSelfQueryDocuments bounds how many document names are offered to the LLM
+// when deriving a filter.
+const maxSelfQueryDocuments = 200
+
+// SelfQueryFilter is what the LLM made of a question: the metadata filter it
+// implies and the semantic part to embed.
+type SelfQueryFilter struct {
+	Query     string   `json:"query"`
+	Documents []string `json:"documents,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// knownDocuments lists the names of stored documents from the saved sources,
+// which is far cheaper than scanning chunk metadata, leaving out those ctx's
+// caller may not read. Only the chunks hidden from the caller are scanned to
+// find those; if that fails, no names are offered at all.
+func (s *Server) knownDocuments(ctx context.Context) []string {
+	hidden := map[string]bool{}
+	if where := hiddenWhere(ctx); where != nil {
+		_, docs, err := collectionDocuments(ctx, s.deps.Store, where)
+		if err != nil {
+			logf(ctx, "self-query: listing documents hidden from the caller failed: %v", err)
+			return nil
+		}
+		for _, d := range docs {
+			hidden[d] = true
+		}
+	}
+
+	dir := filepath.Join(s.cfg.RAGDataDir, "sources")
+	var names []string
+	// documents from archives are kept in subdirectories, named by their path
+	filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && !hidden[filepath.ToSlash(rel)] {
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	if len(names) > maxSelfQueryDocuments {
+		names = names[:maxSelfQueryDocuments]
+	}
+	return names
+}
+
+// deriveSelfQuery asks the LLM to split a question into a metadata filter,
+// limited to the given documents and categories, and a search query. Names the
+// LLM invents are dropped, so the filter only ever uses real values.
+func deriveSelfQuery(ctx context.Context, llm LLM, query string, documents, categories []string) (SelfQueryFilter, error) {
+	sq := SelfQueryFilter{Query: query}
+	if llm == nil || (len(documents) == 0 && len(categories) == 0) {
+		return sq, nil
+	}
+
+	prompt := fmt.Sprintf(
+		"Documents:\n- %s\n\nCategories:\n- %s\n\nQuestion: %s\n\n"+
+			"Does the question explicitly restrict itself to some of the documents or categories above? "+
+			"Reply with JSON only, in the form "+
+			`{"query": "<the question without the restriction>", "documents": [...], "tags": [...]}`+
+			", using names exactly as listed, and empty lists when the question is not restricted.",
+		strings.Join(documents, "\n- "), strings.Join(categories, "\n- "), query,
+	)
+
+	answer, err := llm.Generate(ctx, prompt)
+	if err != nil {
+		return sq, err
+	}
+
+	// tolerate prose or code fences around the object
+	start, end := strings.Index(answer, "{"), strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return sq, fmt.Errorf("no JSON object in reply %q", answer)
+	}
+	var parsed SelfQueryFilter
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &parsed); err != nil {
+		return sq, fmt.Errorf("bad JSON in reply: %w", err)
+	}
+
+	if q := strings.TrimSpace(parsed.Query); q != "" {
+		sq.Query = q
+	}
+	known := make(map[string]bool, len(documents))
+	for _, d := range documents {
+		known[d] = true
+	}
+	for _, d := range parsed.Documents {
+		if known[d] {
+			sq.Documents = append(sq.Documents, d)
+		}
+	}
+	sq.Tags = matchCategories(strings.Join(parsed.Tags, ","), categories)
+	return sq, nil
+}
+
+// prepareRetrieval returns the text to embed for req. With self_query set it
+// also narrows req's documents and tags by the filter the LLM derived, which is
+// returned for the response; a failure falls back to plain retrieval.
+func (s *Server) prepareRetrieval(ctx context.Context, req *ChatRequest) (string, *SelfQueryFilter) {
+	if !req.SelfQuery {
+		return req.Query, nil
+	}
+	sq, err := deriveSelfQuery(ctx, s.llm, req.Query, s.knownDocuments(ctx), s.cfg.Categories)
+	if err != nil {
+		logf(ctx, "self-query failed, retrieving without a derived filter: %v", err)
+		return req.Query, nil
+	}
+	// explicit filters on the request win over derived ones
+	if len(req.Documents) == 0 {
+		req.Documents = sq.Documents
+	}
+	if len(req.Tags) == 0 {
+		req.Tags = sq.Tags
+	}
+	return sq.Query, &sq
+}
+
+// documentsWhere matches chunks of any of the given documents, by name or by
+// an alias recorded for them.
+func documentsWhere(docs []string) chroma.WhereClause {
+	if len(docs) == 0 {
+		return nil
+	}
+	clauses := []chroma.WhereClause{chroma.InString("context", docs...)}
+	if len(docs) == 1 {
+		clauses[0] = chroma.EqString("context", docs[0])
+	}
+	for _, d := range docs {
+		clauses = append(clauses, chroma.EqBool(aliasKey(d), true))
+	}
+	return chroma.Or(clauses...)
+}
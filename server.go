@@ -0,0 +1,266 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// ChunkerFactory builds the Chunker for validated chunking parameters.
+type ChunkerFactory func(ChunkParams) (Chunker, error)
+
+// Deps are the components a Server works with. main builds the real ones from
+// the config; tests can pass fakes. Store, Embedder and LLM are required;
+// Chroma is only needed for requests naming other collections and for
+// benchmarks.
+type Deps struct {
+	Chroma   chroma.Client // opens the other collections a request names
+	Store    VectorStore   // the default collection uploads go to
+	Embedder Embedder
+	LLM      LLM
+	Chunkers ChunkerFactory // defaults to the built-in sentence and fixed chunkers
+
+	// Templates are the named prompt templates (see loadPromptTemplates).
+	Templates map[string]*template.Template
+
+	// Selector, when set, lets requests use other components, e.g. per tenant.
+	Selector Selector
+
+	// Connectors add sync source types, e.g. a wiki, to the built-in urls,
+	// s3 and drive ones, by the name SYNC_FILE gives as a source's type.
+	Connectors map[string]ConnectorFactory
+}
+
+// Selector picks the components a request is served with. Key names the
+// selection for r, "" meaning the server's own components; Deps builds the
+// components for a key, starting from the server's own. Each key is built
+// once and reused, so keys should name tenants or configurations rather than
+// individual requests.
+type Selector interface {
+	Key(r *http.Request) string
+	Deps(key string, base Deps) (Deps, error)
+}
+
+// Server is the HTTP API together with everything its handlers need, so
+// several can run in one process, e.g. against httptest.
+type Server struct {
+	cfg       Config
+	chroma    chroma.Client
+	store     VectorStore // deps.Store behind the caller's access filter
+	embedder  Embedder    // deps.Embedder, counting usage per tenant
+	llm       LLM         // deps.LLM, counting usage per tenant
+	chunkers  ChunkerFactory
+	templates map[string]*template.Template
+
+	schemas schemaCache
+	others  collectionCache
+	mux     *http.ServeMux
+	handler http.Handler // mux behind the selection, gzip and request ID layers
+
+	deps     Deps         // as passed to NewServer, the base for selections
+	state    *serverState // shared with the selections
+	selected struct {
+		sync.Mutex
+		m map[string]*Server
+	}
+}
+
+// serverState is what a Server's handlers keep between requests: jobs,
+// pending confirmations, locks and counters. A Server shares it with its
+// selections; every NewServer starts with its own.
+type serverState struct {
+	started       time.Time // when the /stats counters started
+	jobs          jobRegistry
+	pendingPurges purgeTokens
+	knownDims     dimensionCache
+	syncRunning   runningSources
+	embedCache    embedCacheCounters
+
+	servers serverList // the Server and its selections
+
+	reindexRunning sync.Mutex // keeps reindex runs from overlapping
+	aliasMu        sync.Mutex // serializes alias flips and guards aliasTarget
+	aliasTarget    string     // the collection the alias names, once read
+
+	// serialize access to the logs, the usage file and the embedding cache
+	// under RAG_DATA_DIR
+	auditMu      sync.Mutex
+	experimentMu sync.Mutex
+	queryLogMu   sync.Mutex
+	usageMu      sync.Mutex
+	embedCacheMu sync.Mutex
+}
+
+// serverList holds the servers sharing a serverState.
+type serverList struct {
+	sync.Mutex
+	list []*Server
+}
+
+func (l *serverList) add(s *Server) {
+	l.Lock()
+	l.list = append(l.list, s)
+	l.Unlock()
+}
+
+func (l *serverList) all() []*Server {
+	l.Lock()
+	defer l.Unlock()
+	return slices.Clone(l.list)
+}
+
+func newServerState() *serverState {
+	return &serverState{
+		started:       time.Now(),
+		jobs:          jobRegistry{m: map[string]*Job{}, subs: map[string][]chan jobEvent{}},
+		pendingPurges: purgeTokens{m: map[string]pendingPurge{}},
+		knownDims:     dimensionCache{m: map[string]int{}},
+		syncRunning:   runningSources{m: map[string]bool{}},
+	}
+}
+
+// NewServer builds the API handler for cfg on top of deps.
+func NewServer(cfg Config, deps Deps) *Server {
+	return newServer(cfg, deps, newServerState())
+}
+
+func newServer(cfg Config, deps Deps, state *serverState) *Server {
+	if deps.Chunkers == nil {
+		deps.Chunkers = newChunker
+	}
+	if deps.Templates == nil {
+		deps.Templates = map[string]*template.Template{}
+	}
+	s := &Server{
+		cfg:       cfg,
+		chroma:    deps.Chroma,
+		store:     accessStore{deps.Store},
+		chunkers:  deps.Chunkers,
+		templates: deps.Templates,
+		schemas:   schemaCache{m: map[string]*MetadataSchema{}},
+		others:    collectionCache{m: map[string]VectorStore{}},
+		mux:       http.NewServeMux(),
+		deps:      deps,
+		state:     state,
+	}
+	s.embedder = meteredEmbedder{deps.Embedder, s}
+	s.llm = meteredLLM{deps.LLM, s}
+	s.selected.m = map[string]*Server{}
+	s.handler = withRequestID(withGzip(http.HandlerFunc(s.dispatch)))
+	s.routes()
+	state.servers.add(s)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// dispatch serves r with the components its Selector key picks, or the
+// server's own, for the caller r identifies.
+func (s *Server) dispatch(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(withCaller(r.Context(), s.caller(r)))
+	if s.deps.Selector != nil {
+		if key := s.deps.Selector.Key(r); key != "" {
+			sel, err := s.selection(key)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			sel.mux.ServeHTTP(w, r)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// selection returns the server for a Selector key, building it on first use.
+// A selection serves requests only; maintenance runs on the base server.
+func (s *Server) selection(key string) (*Server, error) {
+	s.selected.Lock()
+	defer s.selected.Unlock()
+	if sel, ok := s.selected.m[key]; ok {
+		return sel, nil
+	}
+	deps, err := s.deps.Selector.Deps(key, s.deps)
+	if err != nil {
+		return nil, err
+	}
+	deps.Selector = nil
+	sel := newServer(s.cfg, deps, s.state)
+	s.selected.m[key] = sel
+	return sel, nil
+}
+
+// newChunker builds the Chunker for params with the server's ChunkerFactory,
+// after validating them.
+func (s *Server) newChunker(params ChunkParams) (Chunker, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	return s.chunkers(params)
+}
+
+func (s *Server) routes() {
+	mux := s.mux
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Health check request received")
+		// ?chroma=true also checks Chroma, for readiness probes; the plain
+		// check stays a liveness probe, which a Chroma outage must not fail
+		if check, _ := strconv.ParseBool(r.URL.Query().Get("chroma")); check {
+			if err := s.checkChroma(r.Context()); err != nil {
+				http.Error(w, "chroma unreachable: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/upload", requirePost(s.requireQuota(budgetEmbed, s.uploadHandler)))         // POST
+	mux.HandleFunc("/chat", requirePost(s.requireQuota(budgetEmbed|budgetLLM, s.promptHandler))) // POST
+	mux.HandleFunc("/rechunk", requirePost(s.rechunkHandler))                                    // POST
+	mux.HandleFunc("/search", requirePost(s.requireQuota(budgetEmbed, s.searchHandler)))         // POST
+	mux.HandleFunc("/search/keyword", requirePost(s.keywordSearchHandler))                       // POST
+	mux.HandleFunc("/feedback", requirePost(s.feedbackHandler))                                  // POST
+
+	mux.HandleFunc("/documents", s.documentsHandler)                                             // GET, POST
+	mux.HandleFunc("/documents/{name}", requireMethod(http.MethodPatch, s.patchDocumentHandler)) // PATCH
+	mux.HandleFunc("/documents/{name}/chunks", requireGet(s.documentChunksHandler))              // GET
+
+	mux.HandleFunc("/chunks/{id}/exclude", requirePost(s.excludeChunkHandler)) // POST
+	mux.HandleFunc("/chunks/{id}/restore", requirePost(s.restoreChunkHandler)) // POST
+
+	mux.HandleFunc("/collections/{name}/schema", s.schemaHandler) // GET, PUT (admin)
+	mux.HandleFunc("/templates", requireGet(s.templatesHandler))  // GET
+	mux.HandleFunc("/pipelines", requireGet(s.pipelinesHandler))  // GET
+	mux.HandleFunc("/profiles", requireGet(s.profilesHandler))    // GET
+
+	mux.HandleFunc("/embed", requirePost(s.requireQuota(budgetEmbed, s.embedHandler))) // POST
+	mux.HandleFunc("/usage", requireGet(s.usageHandler))                               // GET
+	mux.HandleFunc("/stats", requireGet(s.statsHandler))                               // GET
+	mux.HandleFunc("/version", requireGet(s.versionHandler))                           // GET
+
+	mux.HandleFunc("/v1/chat/completions", requirePost(s.requireQuota(budgetEmbed|budgetLLM, s.chatCompletionsHandler))) // POST
+	mux.HandleFunc("/v1/models", requireGet(modelsHandler))                                                              // GET
+
+	mux.HandleFunc("/jobs/{id}", requireGet(s.jobHandler))              // GET
+	mux.HandleFunc("/jobs/{id}/events", requireGet(s.jobEventsHandler)) // GET (SSE)
+
+	mux.HandleFunc("/audit", requireGet(s.requireAdmin(s.auditHandler)))             // GET
+	mux.HandleFunc("/experiments", requireGet(s.requireAdmin(s.experimentsHandler))) // GET
+
+	mux.HandleFunc("/admin/purge", requirePost(s.requireAdmin(s.purgeHandler)))                       // POST
+	mux.HandleFunc("/admin/cache", s.requireAdmin(s.cacheHandler))                                    // GET, DELETE
+	mux.HandleFunc("/admin/benchmark", requirePost(s.requireAdmin(s.benchmarkHandler)))               // POST
+	mux.HandleFunc("/admin/sync/{name}", requirePost(s.requireAdmin(s.syncHandler)))                  // POST
+	mux.HandleFunc("/admin/replay", requirePost(s.requireAdmin(s.replayHandler)))                     // POST
+	mux.HandleFunc("/admin/embeddings/export", requireGet(s.requireAdmin(s.exportEmbeddingsHandler))) // GET
+	mux.HandleFunc("/admin/reindex", requirePost(s.requireAdmin(s.reindexHandler)))                   // POST
+	mux.HandleFunc("/admin/alias", s.requireAdmin(s.aliasHandler))                                    // GET, POST
+}
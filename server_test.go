@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDocument = "Otters hold hands while they sleep so they do not drift apart. " +
+	"A group of otters resting in the water is called a raft. " +
+	"Sea otters use rocks as tools to open shellfish."
+
+func newTestServer(t *testing.T, store VectorStore, embedder Embedder, llm LLM) *httptest.Server {
+	t.Helper()
+	t.Setenv("EMBED_CACHE_MODE", "off")
+	cfg := Config{
+		RAGDataDir:     t.TempDir(),
+		EmbedModelName: "fake",
+		LLMFallback:    fallbackContext,
+	}
+	srv := httptest.NewServer(NewServer(cfg, Deps{Store: store, Embedder: embedder, LLM: llm}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// uploadFile posts content as the file name to /upload and decodes the report.
+func uploadFile(t *testing.T, srv *httptest.Server, name, content string) ingestResult {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("files", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	resp, err := http.Post(srv.URL+"/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	var res ingestResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("upload: decoding report: %v", err)
+	}
+	return res
+}
+
+func chat(t *testing.T, srv *httptest.Server, req ChatRequest) ChatResponse {
+	t.Helper()
+	raw, _ := json.Marshal(req)
+	resp, err := http.Post(srv.URL+"/chat", "application/json", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat: status %d", resp.StatusCode)
+	}
+	var res ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("chat: decoding response: %v", err)
+	}
+	return res
+}
+
+func TestUploadStoresChunks(t *testing.T) {
+	store := newFakeStore("test_upload")
+	embedder := &fakeEmbedder{}
+	srv := newTestServer(t, store, embedder, &fakeLLM{})
+
+	res := uploadFile(t, srv, "otters.txt", testDocument)
+	if res.Document != "otters.txt" {
+		t.Errorf("document = %q, want otters.txt", res.Document)
+	}
+	if res.Chunks == 0 {
+		t.Fatal("no chunks reported")
+	}
+	if n, _ := store.Count(t.Context()); n != res.Chunks {
+		t.Errorf("store holds %d chunks, report says %d", n, res.Chunks)
+	}
+	if embedder.embedded != res.Chunks {
+		t.Errorf("embedded %d chunks, want %d", embedder.embedded, res.Chunks)
+	}
+}
+
+func TestChatAnswersFromUpload(t *testing.T) {
+	llm := &fakeLLM{answer: "They hold hands."}
+	srv := newTestServer(t, newFakeStore("test_chat"), &fakeEmbedder{}, llm)
+	uploadFile(t, srv, "otters.txt", testDocument)
+
+	res := chat(t, srv, ChatRequest{Query: "Why do otters hold hands while they sleep?"})
+	if res.Answer != llm.answer {
+		t.Errorf("answer = %q, want %q", res.Answer, llm.answer)
+	}
+	if len(res.Citations) == 0 {
+		t.Fatal("no citations")
+	}
+	for _, c := range res.Citations {
+		if c.Document != "otters.txt" {
+			t.Errorf("citation of %q, want otters.txt", c.Document)
+		}
+	}
+	if !strings.Contains(llm.lastPrompt(), "hold hands while they sleep") {
+		t.Errorf("prompt lacks the retrieved chunk:\n%s", llm.lastPrompt())
+	}
+}
+
+func TestChatWithoutDocuments(t *testing.T) {
+	llm := &fakeLLM{answer: "unused"}
+	srv := newTestServer(t, newFakeStore("test_empty"), &fakeEmbedder{}, llm)
+
+	res := chat(t, srv, ChatRequest{Query: "Why do otters hold hands?"})
+	if len(res.Citations) != 0 {
+		t.Errorf("got %d citations from an empty store", len(res.Citations))
+	}
+}
+
+func TestServersKeepSeparateJobs(t *testing.T) {
+	t.Setenv("EMBED_CACHE_MODE", "off")
+	cfg := Config{RAGDataDir: t.TempDir(), EmbedModelName: "fake"}
+	a := NewServer(cfg, Deps{Store: newFakeStore("test_jobs_a"), Embedder: &fakeEmbedder{}, LLM: &fakeLLM{}})
+	b := NewServer(cfg, Deps{Store: newFakeStore("test_jobs_b"), Embedder: &fakeEmbedder{}, LLM: &fakeLLM{}})
+
+	job := a.createJob("otters.txt", "", "")
+	for _, tc := range []struct {
+		srv  *Server
+		want int
+	}{{a, http.StatusOK}, {b, http.StatusNotFound}} {
+		rec := httptest.NewRecorder()
+		tc.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET /jobs/%s: status %d, want %d", job.ID, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestUploadSkipsStoredChunks(t *testing.T) {
+	store := newFakeStore("test_skip")
+	embedder := &fakeEmbedder{}
+	srv := newTestServer(t, store, embedder, &fakeLLM{})
+
+	first := uploadFile(t, srv, "otters.txt", testDocument)
+	if first.SkippedDuplicates != 0 {
+		t.Errorf("first upload skipped %d chunks", first.SkippedDuplicates)
+	}
+	embedded := embedder.embedded
+
+	again := uploadFile(t, srv, "otters.txt", testDocument)
+	if again.SkippedDuplicates != first.Chunks {
+		t.Errorf("skipped %d chunks, want all %d", again.SkippedDuplicates, first.Chunks)
+	}
+	if embedder.embedded != embedded {
+		t.Errorf("embedded %d more chunks", embedder.embedded-embedded)
+	}
+	if n, _ := store.Count(t.Context()); n != first.Chunks {
+		t.Errorf("store holds %d chunks, want %d", n, first.Chunks)
+	}
+}
+
+func TestSearchNamedCollections(t *testing.T) {
+	srv := newTestServer(t, newFakeStore("test_named"), &fakeEmbedder{}, &fakeLLM{})
+
+	for _, tc := range []struct {
+		collections []string
+		want        int
+	}{
+		{[]string{"test_named"}, http.StatusOK},
+		{[]string{"rag_demo_20240101T000000_abcd"}, http.StatusBadRequest},
+		{[]string{"support_kb"}, http.StatusNotImplemented},
+	} {
+		raw, _ := json.Marshal(ChatRequest{Query: "otters", Collections: tc.collections})
+		resp, err := http.Post(srv.URL+"/search", "application/json", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("collections %v: status %d, want %d", tc.collections, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestEmbedCacheUnderDataDir(t *testing.T) {
+	t.Setenv("EMBED_CACHE_MODE", "auto")
+	cfg := Config{RAGDataDir: t.TempDir(), EmbedModelName: "fake"}
+	srv := httptest.NewServer(NewServer(cfg, Deps{Store: newFakeStore("test_cache"), Embedder: &fakeEmbedder{}, LLM: &fakeLLM{}}))
+	t.Cleanup(srv.Close)
+
+	uploadFile(t, srv, "otters.txt", testDocument)
+	files, err := filepath.Glob(filepath.Join(cfg.RAGDataDir, "embeddings_cache", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("found %d cache files under RAG_DATA_DIR, want 1", len(files))
+	}
+}
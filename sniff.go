@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// supportedUploads names what the upload pipeline reads, for rejections.
+const supportedUploads = ".txt and .md files (UTF-8, UTF-16 with a byte order mark, or Windows-1252 text), or a .zip, .tar.gz or .tgz of them"
+
+// unsupportedContentError rejects content that is not text, naming what it
+// looks like and what to do about it.
+type unsupportedContentError struct {
+	kind string // e.g. "a PDF document"
+	hint string
+}
+
+func (e *unsupportedContentError) Error() string {
+	return fmt.Sprintf("content looks like %s, which is not ingested as text; %s", e.kind, e.hint)
+}
+
+const (
+	hintConvert = "convert it to .txt or .md first"
+	hintArchive = "upload an archive under a .zip, .tar.gz or .tgz name to ingest the .txt and .md files in it"
+)
+
+// binarySignatures are the magic bytes of formats people upload by mistake,
+// at their offset in the file.
+var binarySignatures = []struct {
+	offset int
+	magic  string
+	kind   string
+	hint   string
+}{
+	{0, "%PDF-", "a PDF document", hintConvert},
+	{0, "PK\x03\x04", "a ZIP archive", hintArchive},
+	{0, "\x1f\x8b", "a gzip file", hintArchive},
+	{257, "ustar", "a tar archive", hintArchive},
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "a legacy Microsoft Office document (.doc, .xls or .ppt)", hintConvert},
+	{0, `{\rtf`, "an RTF document", hintConvert},
+	{0, "\x89PNG\r\n\x1a\n", "a PNG image", hintConvert},
+	{0, "\xff\xd8\xff", "a JPEG image", hintConvert},
+	{0, "GIF8", "a GIF image", hintConvert},
+	{0, "II*\x00", "a TIFF image", hintConvert},
+	{0, "MM\x00*", "a TIFF image", hintConvert},
+	{0, "RIFF", "a RIFF media file (WebP, WAV or AVI)", hintConvert},
+	{4, "ftyp", "an MP4, MOV or HEIC media file", hintConvert},
+	{0, "\x7fELF", "an executable", hintConvert},
+	{0, "7z\xbc\xaf\x27\x1c", "a 7z archive", hintConvert},
+	{0, "Rar!\x1a\x07", "a RAR archive", hintConvert},
+	{0, "SQLite format 3\x00", "an SQLite database", hintConvert},
+}
+
+// zipFormats tell documents that are ZIP archives apart by a member name;
+// the names are listed in the archive's central directory.
+var zipFormats = []struct {
+	member string
+	kind   string
+}{
+	{"word/document.xml", "a Word document (.docx)"},
+	{"xl/workbook.xml", "an Excel workbook (.xlsx)"},
+	{"ppt/presentation.xml", "a PowerPoint presentation (.pptx)"},
+	{"application/epub+zip", "an EPUB book"},
+	{"application/vnd.oasis.opendocument", "an OpenDocument file (.odt, .ods or .odp)"},
+}
+
+// sniffWindow is how much of the text is checked for control characters.
+const sniffWindow = 8 << 10
+
+// decodeText returns uploaded content as UTF-8 text. UTF-16 with a byte order
+// mark and content that is not valid UTF-8 (read as Windows-1252) are
+// converted; a UTF-8 byte order mark is dropped. Content in a known binary
+// format, or with NUL bytes or many control characters, fails with an
+// *unsupportedContentError.
+func decodeText(b []byte) (string, error) {
+	for _, sig := range binarySignatures {
+		if len(b) >= sig.offset+len(sig.magic) && string(b[sig.offset:sig.offset+len(sig.magic)]) == sig.magic {
+			kind, hint := sig.kind, sig.hint
+			if sig.magic == "PK\x03\x04" {
+				for _, z := range zipFormats {
+					if bytes.Contains(b, []byte(z.member)) {
+						kind, hint = z.kind, hintConvert
+						break
+					}
+				}
+			}
+			return "", &unsupportedContentError{kind: kind, hint: hint}
+		}
+	}
+
+	var text string
+	switch {
+	case bytes.HasPrefix(b, []byte("\xef\xbb\xbf")):
+		text = string(b[3:])
+	case bytes.HasPrefix(b, []byte("\xff\xfe")), bytes.HasPrefix(b, []byte("\xfe\xff")):
+		t, ok := decodeUTF16(b)
+		if !ok {
+			return "", &unsupportedContentError{kind: "truncated UTF-16 text", hint: "save it as UTF-8"}
+		}
+		text = t
+	case bytes.IndexByte(b, 0) >= 0:
+		return "", &unsupportedContentError{kind: "binary data", hint: hintConvert + ", saved as UTF-8"}
+	case utf8.Valid(b):
+		text = string(b)
+	default:
+		text = decodeWindows1252(b)
+	}
+	if !looksLikeText(text) {
+		return "", &unsupportedContentError{kind: "binary data", hint: hintConvert + ", saved as UTF-8"}
+	}
+	return text, nil
+}
+
+// decodeUTF16 decodes b, which starts with a UTF-16 byte order mark.
+func decodeUTF16(b []byte) (string, bool) {
+	if len(b)%2 != 0 {
+		return "", false
+	}
+	units := make([]uint16, 0, len(b)/2-1)
+	for i := 2; i < len(b); i += 2 {
+		if b[0] == 0xff {
+			units = append(units, uint16(b[i])|uint16(b[i+1])<<8)
+		} else {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+	}
+	return string(utf16.Decode(units)), true
+}
+
+// windows1252 maps the bytes 0x80-0x9F, where Windows-1252 differs from
+// Latin-1; the five it leaves undefined stay C1 control characters.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/8)
+	for _, c := range b {
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+		case c < 0xa0:
+			sb.WriteRune(windows1252[c-0x80])
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String()
+}
+
+// looksLikeText reports whether at most one in twenty of the first characters
+// of text are control characters other than whitespace. Binary data read as
+// Windows-1252 has about one in eight.
+func looksLikeText(text string) bool {
+	n, controls := 0, 0
+	for _, r := range text {
+		if n == sniffWindow {
+			break
+		}
+		n++
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			controls++
+		}
+	}
+	return controls*20 <= n
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// processStart is when the process started.
+var processStart = time.Now()
+
+// StatsResponse is the answer to GET /stats.
+type StatsResponse struct {
+	Since      time.Time       `json:"since"`
+	EmbedCache EmbedCacheStats `json:"embed_cache"`
+}
+
+// EmbedCacheStats counts embedding cache lookups, by uploads and /embed.
+type EmbedCacheStats struct {
+	Mode     string  `json:"mode"` // EMBED_CACHE_MODE; uploads may override it
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Saves    int64   `json:"saves"`
+	Bypassed int64   `json:"bypassed"` // embedded with the cache off
+	HitRate  float64 `json:"hit_rate"` // hits / (hits + misses)
+}
+
+// statsHandler implements GET /stats: counters since the server started, so
+// far of the embedding cache, to confirm repeated experiments are served from
+// it.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Stats request received")
+
+	c := EmbedCacheStats{
+		Mode:     embedCacheMode(),
+		Hits:     s.state.embedCache.hits.Load(),
+		Misses:   s.state.embedCache.misses.Load(),
+		Saves:    s.state.embedCache.saves.Load(),
+		Bypassed: s.state.embedCache.bypassed.Load(),
+	}
+	if n := c.Hits + c.Misses; n > 0 {
+		c.HitRate = float64(c.Hits) / float64(n)
+	}
+	writeJSON(w, http.StatusOK, StatsResponse{Since: s.state.started.UTC(), EmbedCache: c})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Metadata keys of the generated title and summary of a chunk.
+const (
+	metaChunkTitle   = "chunk_title"
+	metaChunkSummary = "chunk_summary"
+)
+
+// summaryBatchSize is how many chunks share one LLM call, and
+// summarySampleChars bounds how much of each chunk is sent; the opening of a
+// chunk is enough to say what it is about.
+const (
+	summaryBatchSize   = 8
+	summarySampleChars = 1500
+)
+
+// chunkSummary is the generated title and one-line summary of a chunk.
+type chunkSummary struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// summarizeChunks asks the LLM for a short title and a one-line summary of each
+// chunk, summaryBatchSize chunks per call, keyed by chunk ID. A batch whose
+// call or reply fails is logged and left out, so a chunk without a summary is
+// stored as it would be without CHUNK_SUMMARIES.
+func summarizeChunks(ctx context.Context, llm LLM, chunks []Chunk, progress func(done int)) map[string]chunkSummary {
+	out := make(map[string]chunkSummary, len(chunks))
+	for start := 0; start < len(chunks); start += summaryBatchSize {
+		if ctx.Err() != nil {
+			break
+		}
+		batch := chunks[start:min(start+summaryBatchSize, len(chunks))]
+		summaries, err := summarizeBatch(ctx, llm, batch)
+		if err != nil {
+			logf(ctx, "summarizing chunks %d-%d failed: %v", start, start+len(batch)-1, err)
+		}
+		for i, s := range summaries {
+			if s.Title != "" || s.Summary != "" {
+				out[batch[i].ID] = s
+			}
+		}
+		progress(start + len(batch))
+	}
+	return out
+}
+
+// summarizeBatch summarizes chunks in one call; the result is aligned with
+// chunks.
+func summarizeBatch(ctx context.Context, llm LLM, chunks []Chunk) ([]chunkSummary, error) {
+	var b strings.Builder
+	for i, c := range chunks {
+		text := c.Text
+		if len(text) > summarySampleChars {
+			text = text[:summarySampleChars]
+		}
+		fmt.Fprintf(&b, "Passage %d:\n%s\n\n", i+1, text)
+	}
+	prompt := fmt.Sprintf(
+		"%sFor each passage above, write a short title (at most 8 words) and a one-sentence summary of what it contains. "+
+			"Reply with only a JSON array with one object per passage, in order: "+
+			`[{"passage": 1, "title": "...", "summary": "..."}]`,
+		b.String(),
+	)
+
+	var answer string
+	err := retryCall(ctx, "summarize chunks", retryAlways, func() (err error) {
+		answer, err = llm.Generate(ctx, prompt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseChunkSummaries(answer, len(chunks))
+}
+
+// parseChunkSummaries reads the reply to a batch of n passages. Entries are
+// placed by their passage number, so a reply that skips a passage does not
+// shift the ones after it.
+func parseChunkSummaries(answer string, n int) ([]chunkSummary, error) {
+	raw := strings.TrimSpace(answer)
+	// models like to wrap JSON in a code fence
+	raw = strings.TrimPrefix(raw, "```json")
+	raw = strings.TrimPrefix(raw, "```")
+	raw = strings.TrimSuffix(raw, "```")
+	raw = strings.TrimSpace(raw)
+
+	var entries []struct {
+		Passage int `json:"passage"`
+		chunkSummary
+	}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("reply is not a JSON array of summaries: %v", err)
+	}
+	out := make([]chunkSummary, n)
+	for i, e := range entries {
+		pos := i
+		if e.Passage > 0 {
+			pos = e.Passage - 1
+		}
+		if pos >= n {
+			continue
+		}
+		out[pos] = chunkSummary{
+			Title:   strings.TrimSpace(e.Title),
+			Summary: strings.TrimSpace(e.Summary),
+		}
+	}
+	return out, nil
+}
+
+// summarizedText is what is embedded for c: its generated title and summary
+// ahead of its text, which gives terse chunks such as tables or lists of
+// figures words a question is likely to share. The stored text is unchanged.
+func summarizedText(c Chunk, s chunkSummary) string {
+	var parts []string
+	for _, p := range []string{s.Title, s.Summary, c.embedText()} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
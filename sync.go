@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	chroma "github.com/amikos-tech/chroma-go/pkg/api/v2"
+)
+
+// SyncSource is an external source kept in sync with the collection on a
+// schedule. Sources are read from the JSON array SYNC_FILE names.
+type SyncSource struct {
+	Name     string `json:"name"`     // prefixes the names of the source's documents
+	Type     string `json:"type"`     // urls | s3 | drive, or a type registered in Deps.Connectors
+	Schedule string `json:"schedule"` // cron expression, descriptor (@hourly) or @every <duration>
+
+	URLs []string `json:"urls,omitempty"` // urls
+
+	Bucket   string `json:"bucket,omitempty"`   // s3
+	Prefix   string `json:"prefix,omitempty"`   // s3
+	Region   string `json:"region,omitempty"`   // s3 (default us-east-1)
+	Endpoint string `json:"endpoint,omitempty"` // s3-compatible store, path-style
+
+	Folder string `json:"folder,omitempty"` // drive: the folder ID
+
+	// Namespace, Metadata, Owner and Groups apply to every document of the
+	// source, as the upload fields of the same names do.
+	Namespace string          `json:"namespace,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+	Owner     string          `json:"owner,omitempty"`
+	Groups    []string        `json:"groups,omitempty"`
+
+	schedule cronSchedule
+}
+
+// loadSyncSources reads and checks the sources in path; an empty path syncs none.
+func loadSyncSources(path string) ([]SyncSource, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var srcs []SyncSource
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&srcs); err != nil {
+		return nil, fmt.Errorf("invalid sources: %w", err)
+	}
+	seen := map[string]bool{}
+	for i := range srcs {
+		src := &srcs[i]
+		if err := validateDocumentID(src.Name); err != nil {
+			return nil, fmt.Errorf("sources[%d]: name: %w", i, err)
+		}
+		if seen[src.Name] {
+			return nil, fmt.Errorf("sources[%d]: duplicate name %q", i, src.Name)
+		}
+		seen[src.Name] = true
+		if src.schedule, err = parseCron(src.Schedule); err != nil {
+			return nil, fmt.Errorf("source %s: %w", src.Name, err)
+		}
+		if src.schedule.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("source %s: schedule %q never fires", src.Name, src.Schedule)
+		}
+		if src.Groups, err = cleanGroups(src.Groups); err != nil {
+			return nil, fmt.Errorf("source %s: %w", src.Name, err)
+		}
+	}
+	return srcs, nil
+}
+
+// SyncStats counts what one run of a source did.
+type SyncStats struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"` // items of a type the pipeline does not read
+	Failed    int `json:"failed"`
+}
+
+// syncState is what the last runs of a source stored, kept per source under
+// RAG_DATA_DIR/sync, so the next run can tell new, changed and deleted items.
+type syncState struct {
+	Items map[string]syncedItem `json:"items"` // by item key
+}
+
+type syncedItem struct {
+	Document string `json:"document"`
+	Version  string `json:"version,omitempty"`
+	SHA256   string `json:"sha256"`
+}
+
+func (s *Server) syncStatePath(name string) string {
+	return filepath.Join(s.cfg.RAGDataDir, "sync", name+".json")
+}
+
+func (s *Server) loadSyncState(name string) (syncState, error) {
+	st := syncState{Items: map[string]syncedItem{}}
+	b, err := os.ReadFile(s.syncStatePath(name))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, err
+	}
+	if st.Items == nil {
+		st.Items = map[string]syncedItem{}
+	}
+	return st, nil
+}
+
+// saveSyncState writes st through a temp file and a rename, so a crash
+// cannot leave a torn state behind.
+func (s *Server) saveSyncState(name string, st syncState) error {
+	path := s.syncStatePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runningSources holds the sources being synced, so a manual run cannot
+// overlap a scheduled one.
+type runningSources struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+var errSyncRunning = errors.New("sync already running")
+
+// connector builds the Connector for src from the registered and built-in types.
+func (s *Server) connector(src SyncSource) (Connector, error) {
+	factory, ok := s.deps.Connectors[src.Type]
+	if !ok {
+		factory, ok = builtinConnectors[src.Type]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown source type %q", src.Type)
+	}
+	return factory(src, s.cfg)
+}
+
+// syncSource brings the collection in line with src: new and changed items
+// are ingested (replacing the chunks of a changed one), and documents whose
+// item has disappeared are deleted. Every ingestion and deletion is audited,
+// and the run as a whole is recorded as a "sync" entry.
+func (s *Server) syncSource(ctx context.Context, src SyncSource, who string) (SyncStats, error) {
+	s.state.syncRunning.Lock()
+	if s.state.syncRunning.m[src.Name] {
+		s.state.syncRunning.Unlock()
+		return SyncStats{}, errSyncRunning
+	}
+	s.state.syncRunning.m[src.Name] = true
+	s.state.syncRunning.Unlock()
+	defer func() {
+		s.state.syncRunning.Lock()
+		delete(s.state.syncRunning.m, src.Name)
+		s.state.syncRunning.Unlock()
+	}()
+
+	start := time.Now()
+	stats, err := s.runSync(ctx, src)
+	audit := AuditEntry{
+		Time:       start.UTC(),
+		Who:        who,
+		Action:     "sync",
+		Document:   src.Name,
+		DurationMS: time.Since(start).Milliseconds(),
+		Outcome:    "ok",
+		Status:     http.StatusOK,
+		RequestID:  requestID(ctx),
+		Sync:       &stats,
+	}
+	if err != nil {
+		audit.Outcome = "error"
+		audit.Status = errorStatus(err)
+		audit.Error = err.Error()
+	}
+	s.appendAudit(audit)
+	return stats, err
+}
+
+func (s *Server) runSync(ctx context.Context, src SyncSource) (SyncStats, error) {
+	var stats SyncStats
+	conn, err := s.connector(src)
+	if err != nil {
+		return stats, err
+	}
+	// checked on every run, since the schema can change between runs
+	var base ingestRequest
+	if err := readUploadMetadata(string(src.Metadata), s.defaultSchema(), &base); err != nil {
+		return stats, statusErrorf(http.StatusBadRequest, "source %s: %v", src.Name, err)
+	}
+	st, err := s.loadSyncState(src.Name)
+	if err != nil {
+		return stats, fmt.Errorf("reading sync state: %w", err)
+	}
+	items, err := conn.List(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("listing %s: %w", src.Name, err)
+	}
+
+	who := "sync:" + src.Name
+	seen := map[string]bool{}
+	for _, item := range items {
+		prev, known := st.Items[item.Key]
+		if known && item.Version != "" && item.Version == prev.Version {
+			seen[item.Key] = true
+			stats.Unchanged++
+			continue
+		}
+		content, err := conn.Fetch(ctx, item)
+		if errors.Is(err, errItemGone) {
+			continue // removed below
+		}
+		seen[item.Key] = true
+		if errors.Is(err, errSkipItem) {
+			logf(ctx, "sync %s: skipping %s: %v", src.Name, item.Key, err)
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			logf(ctx, "sync %s: fetching %s failed: %v", src.Name, item.Key, err)
+			stats.Failed++
+			continue
+		}
+		sum := contentSHA256(content)
+		if known && sum == prev.SHA256 {
+			prev.Version = item.Version
+			st.Items[item.Key] = prev
+			stats.Unchanged++
+			continue
+		}
+
+		// a changed item replaces its document: ingestion adds chunks under
+		// the same IDs, which would not overwrite the old ones
+		doc := src.Name + "/" + item.Key
+		if known {
+			if err := s.deleteDocumentChunks(ctx, doc); err != nil {
+				logf(ctx, "sync %s: removing old chunks of %s failed: %v", src.Name, doc, err)
+				stats.Failed++
+				continue
+			}
+			delete(st.Items, item.Key)
+		}
+		req := base
+		req.FileName = doc
+		req.Content = content
+		req.Params = s.cfg.chunkParams()
+		req.Summarize = s.cfg.ChunkSummaries
+		req.Namespace = src.Namespace
+		req.Access = Access{Owner: src.Owner, Groups: src.Groups}
+		req.Who = who
+		// sync tracks its items by document name, so each gets its own
+		req.OnDuplicate = duplicateAllow
+		if _, err := s.ingest(ctx, req); err != nil {
+			logf(ctx, "sync %s: ingesting %s failed: %v", src.Name, doc, err)
+			stats.Failed++
+			continue
+		}
+		st.Items[item.Key] = syncedItem{Document: doc, Version: item.Version, SHA256: sum}
+		if known {
+			stats.Updated++
+		} else {
+			stats.Added++
+		}
+	}
+
+	for key, prev := range st.Items {
+		if seen[key] {
+			continue
+		}
+		entry := AuditEntry{
+			Time:      time.Now().UTC(),
+			Who:       who,
+			Action:    "delete",
+			Document:  prev.Document,
+			Outcome:   "ok",
+			Status:    http.StatusOK,
+			RequestID: requestID(ctx),
+		}
+		if err := s.deleteDocumentChunks(ctx, prev.Document); err != nil {
+			entry.Outcome, entry.Status, entry.Error = "error", http.StatusInternalServerError, err.Error()
+			s.appendAudit(entry)
+			logf(ctx, "sync %s: deleting %s failed: %v", src.Name, prev.Document, err)
+			stats.Failed++
+			continue
+		}
+		s.appendAudit(entry)
+		delete(st.Items, key)
+		stats.Removed++
+	}
+
+	if err := s.saveSyncState(src.Name, st); err != nil {
+		return stats, fmt.Errorf("saving sync state: %w", err)
+	}
+	return stats, nil
+}
+
+// deleteDocumentChunks removes every chunk of a document and its saved source.
+func (s *Server) deleteDocumentChunks(ctx context.Context, doc string) error {
+	ids, err := collectionIDs(ctx, s.store, chroma.EqString("context", doc))
+	if err != nil {
+		return err
+	}
+	if err := deleteIDs(ctx, s.store, ids); err != nil {
+		return err
+	}
+	s.removeSource(doc)
+	return nil
+}
+
+// runSyncLoop syncs each configured source on its schedule until ctx ends.
+func (s *Server) runSyncLoop(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, src := range s.cfg.SyncSources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				next := src.schedule.next(time.Now())
+				if next.IsZero() {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(next)):
+				}
+				runCtx := withRequestIDContext(ctx, "sync-"+newRequestID())
+				stats, err := s.syncSource(runCtx, src, "scheduler")
+				if err != nil {
+					logf(runCtx, "sync %s failed: %v", src.Name, err)
+					continue
+				}
+				logf(runCtx, "sync %s: %+v", src.Name, stats)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// syncHandler runs a configured source's sync right away and reports what it
+// did; a sync already in progress answers 409.
+func (s *Server) syncHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Sync request received")
+
+	name := r.PathValue("name")
+	for _, src := range s.cfg.SyncSources {
+		if src.Name != name {
+			continue
+		}
+		// the run outlives a client that disconnects, and reads every document
+		ctx := withRequestIDContext(context.WithoutCancel(context.Background()), requestID(r.Context()))
+		stats, err := s.syncSource(ctx, src, callerIdentity(r))
+		if errors.Is(err, errSyncRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+		return
+	}
+	http.Error(w, "unknown source: "+name, http.StatusNotFound)
+}
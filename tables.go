@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// metaTable holds the structure of a table chunk, as JSON.
+const metaTable = "table"
+
+// maxDescribedRows bounds how many rows of a table its description spells out;
+// embedding models only read so much of their input anyway.
+const maxDescribedRows = 20
+
+// Table is the structure of a table found in a document: its header cells, if
+// it has a header row, and the cells of each other row.
+type Table struct {
+	Columns []string   `json:"columns,omitempty"`
+	Rows    [][]string `json:"rows"`
+}
+
+// tableSpan is a table at the byte range [start, end) of a document.
+type tableSpan struct {
+	start, end int
+	table      Table
+}
+
+var (
+	htmlTable    = regexp.MustCompile(`(?is)<table\b.*?</table\s*>`)
+	htmlRow      = regexp.MustCompile(`(?is)<tr\b[^>]*>(.*?)</tr\s*>`)
+	htmlCell     = regexp.MustCompile(`(?is)<t([hd])\b[^>]*>(.*?)</t[hd]\s*>`)
+	htmlTag      = regexp.MustCompile(`(?s)<[^>]*>`)
+	markdownRule = regexp.MustCompile(`^\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?$`)
+)
+
+// findTables locates the Markdown pipe tables (a header row, a |---| rule and
+// the rows after it) and HTML <table> elements of text, in document order.
+func findTables(text string) []tableSpan {
+	var tables []tableSpan
+	for _, loc := range htmlTable.FindAllStringIndex(text, -1) {
+		if t, ok := parseHTMLTable(text[loc[0]:loc[1]]); ok {
+			tables = append(tables, tableSpan{start: loc[0], end: loc[1], table: t})
+		}
+	}
+
+	var lines []string
+	var offsets []int
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lines = append(lines, line)
+		offsets = append(offsets, offset)
+		offset += len(line)
+	}
+	for i := 0; i+1 < len(lines); i++ {
+		header := strings.TrimSpace(lines[i])
+		if !strings.Contains(header, "|") || !markdownRule.MatchString(strings.TrimSpace(lines[i+1])) {
+			continue
+		}
+		end := i + 2
+		for end < len(lines) && strings.Contains(lines[end], "|") && strings.TrimSpace(lines[end]) != "" {
+			end++
+		}
+		t := Table{Columns: markdownCells(header)}
+		for _, row := range lines[i+2 : end] {
+			t.Rows = append(t.Rows, markdownCells(strings.TrimSpace(row)))
+		}
+		start := offsets[i] + len(lines[i]) - len(strings.TrimLeft(lines[i], " \t"))
+		stop := offsets[end-1] + len(strings.TrimRight(lines[end-1], " \t\r\n"))
+		if !insideTable(tables, start) {
+			tables = append(tables, tableSpan{start: start, end: stop, table: t})
+		}
+		i = end - 1
+	}
+
+	// HTML tables were found first; put the Markdown ones among them
+	sort.Slice(tables, func(a, b int) bool { return tables[a].start < tables[b].start })
+	return tables
+}
+
+func insideTable(tables []tableSpan, offset int) bool {
+	for _, t := range tables {
+		if offset >= t.start && offset < t.end {
+			return true
+		}
+	}
+	return false
+}
+
+// markdownCells splits a pipe table row into its trimmed cells; "\|" is a
+// literal pipe inside a cell.
+func markdownCells(row string) []string {
+	row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+	row = strings.ReplaceAll(row, `\|`, "\x00")
+	cells := strings.Split(row, "|")
+	for i, c := range cells {
+		cells[i] = strings.ReplaceAll(strings.TrimSpace(c), "\x00", "|")
+	}
+	return cells
+}
+
+// parseHTMLTable reads the rows of an HTML table; a first row of <th> cells is
+// its header. Markup inside cells is dropped.
+func parseHTMLTable(src string) (Table, bool) {
+	var t Table
+	for i, row := range htmlRow.FindAllStringSubmatch(src, -1) {
+		var cells []string
+		header := true
+		for _, cell := range htmlCell.FindAllStringSubmatch(row[1], -1) {
+			header = header && strings.EqualFold(cell[1], "h")
+			text := html.UnescapeString(htmlTag.ReplaceAllString(cell[2], " "))
+			cells = append(cells, strings.Join(strings.Fields(text), " "))
+		}
+		if len(cells) == 0 {
+			continue
+		}
+		if i == 0 && header {
+			t.Columns = cells
+		} else {
+			t.Rows = append(t.Rows, cells)
+		}
+	}
+	return t, len(t.Columns) > 0 || len(t.Rows) > 0
+}
+
+// markdown renders t as a pipe table, the chunk text a table is stored and
+// prompted with whatever its source format.
+func (t Table) markdown() string {
+	row := func(cells []string) string {
+		escaped := make([]string, len(cells))
+		for i, c := range cells {
+			escaped[i] = strings.ReplaceAll(c, "|", `\|`)
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	}
+	var lines []string
+	if len(t.Columns) > 0 {
+		rule := make([]string, len(t.Columns))
+		for i := range rule {
+			rule[i] = "---"
+		}
+		lines = append(lines, row(t.Columns), row(rule))
+	}
+	for _, r := range t.Rows {
+		lines = append(lines, row(r))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describe is the natural-language text embedded for a table chunk in place
+// of its cells: what the table is about, its columns, and its rows spelled out
+// as "column: value" pairs, which read closer to a question than a grid of
+// pipes does.
+func (t Table) describe(headings string) string {
+	var b strings.Builder
+	b.WriteString("Table")
+	if headings != "" {
+		fmt.Fprintf(&b, " in %s", headings)
+	}
+	fmt.Fprintf(&b, " with %d rows", len(t.Rows))
+	if len(t.Columns) > 0 {
+		fmt.Fprintf(&b, " and columns %s", strings.Join(t.Columns, ", "))
+	}
+	b.WriteString(".")
+
+	for i, r := range t.Rows {
+		if i == maxDescribedRows {
+			fmt.Fprintf(&b, "\n... and %d more rows.", len(t.Rows)-i)
+			break
+		}
+		pairs := make([]string, 0, len(r))
+		for j, cell := range r {
+			if cell == "" {
+				continue
+			}
+			if j < len(t.Columns) && t.Columns[j] != "" {
+				cell = t.Columns[j] + ": " + cell
+			}
+			pairs = append(pairs, cell)
+		}
+		if len(pairs) > 0 {
+			b.WriteString("\n" + strings.Join(pairs, "; ") + ".")
+		}
+	}
+	return b.String()
+}
+
+// tableChunker keeps each table of a document whole, as a chunk of its own
+// holding the table's structure, and chunks the prose between tables with
+// prose, so a table is never cut at the periods in its cells.
+type tableChunker struct {
+	prose Chunker
+}
+
+func (c tableChunker) Chunk(docID, text string) []Chunk {
+	tables := findTables(text)
+	if len(tables) == 0 {
+		return c.prose.Chunk(docID, text)
+	}
+	layout := scanLayout(docID, text)
+
+	var chunks []Chunk
+	pos := 0
+	proseUntil := func(end int) {
+		// the prose chunker only sees the stretch between tables, so its
+		// chunks are renumbered and placed in the whole document
+		for _, ch := range c.prose.Chunk(docID, text[pos:end]) {
+			chunks = append(chunks, layout.chunk(docID, len(chunks), ch.Text, pos+ch.Start, pos+ch.End))
+		}
+	}
+	for _, t := range tables {
+		proseUntil(t.start)
+		ch := layout.chunk(docID, len(chunks), t.table.markdown(), t.start, t.end)
+		ch.Table = &t.table
+		chunks = append(chunks, ch)
+		pos = t.end
+	}
+	proseUntil(len(text))
+	return chunks
+}
+
+func hasTables(chunks []Chunk) bool {
+	for _, c := range chunks {
+		if c.Table != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// embedText is what is embedded for c: a table's description, or else the
+// chunk text itself.
+func (c Chunk) embedText() string {
+	if c.Table != nil {
+		return c.Table.describe(c.Headings)
+	}
+	return c.Text
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// maxInlineTemplate bounds the size of a template sent with a request.
+const maxInlineTemplate = 8 << 10
+
+// maxRenderedPrompt bounds the prompt a template renders; rendering fails
+// once it is exceeded.
+const maxRenderedPrompt = 1 << 20
+
+// maxRangeDepth bounds how deeply an inline template may nest range loops.
+const maxRangeDepth = 2
+
+var errPromptTooLarge = fmt.Errorf("rendered prompt exceeds %d bytes", maxRenderedPrompt)
+
+// promptData is what prompt templates are rendered with.
+type promptData struct {
+	Context  string        // retrieved chunks joined by newlines
+	Chunks   []string      // retrieved chunks
+	Question string        // the user's question
+	History  []ChatMessage // prior conversation turns, oldest first
+}
+
+var templateFuncs = template.FuncMap{"join": strings.Join}
+
+// loadPromptTemplates parses every *.tmpl file in dir into the server's
+// registry of named templates, keyed by file name without the extension. A
+// missing directory just yields an empty registry.
+func loadPromptTemplates(dir string) (map[string]*template.Template, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]*template.Template{}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(p), ".tmpl")
+		t, err := parsePromptTemplate(name, string(b), false)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", p, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// parsePromptTemplate parses text and renders it once with empty data, so a
+// reference to a field promptData does not have is reported up front. An
+// inline template, which comes with a request, must also pass
+// checkInlineTemplate before it is ever run.
+func parsePromptTemplate(name, text string, inline bool) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if inline {
+		if len(t.Templates()) > 1 {
+			return nil, fmt.Errorf("define and block are not allowed")
+		}
+		if err := checkInlineTemplate(t.Tree.Root, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.Execute(&cappedWriter{w: io.Discard}, promptData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkInlineTemplate keeps an inline template to what a prompt needs, so
+// rendering it stays cheap: text, fields, variables, literals and join,
+// if over any of them, and range over .Chunks or .History only, nested at
+// most maxRangeDepth deep. Everything else, such as ranging over a number or
+// calling another template, is rejected.
+func checkInlineTemplate(node parse.Node, depth int) error {
+	switch n := node.(type) {
+	case nil, *parse.TextNode, *parse.CommentNode, *parse.BreakNode, *parse.ContinueNode:
+		return nil
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkInlineTemplate(c, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parse.ActionNode:
+		return checkTemplatePipe(n.Pipe)
+	case *parse.IfNode:
+		if err := checkTemplatePipe(n.Pipe); err != nil {
+			return err
+		}
+		if err := checkInlineTemplate(n.List, depth); err != nil {
+			return err
+		}
+		return checkInlineTemplate(n.ElseList, depth)
+	case *parse.RangeNode:
+		if depth >= maxRangeDepth {
+			return fmt.Errorf("range loops may be nested at most %d deep", maxRangeDepth)
+		}
+		if !rangesOverList(n.Pipe) {
+			return fmt.Errorf("range is only allowed over .Chunks or .History")
+		}
+		if err := checkInlineTemplate(n.List, depth+1); err != nil {
+			return err
+		}
+		return checkInlineTemplate(n.ElseList, depth)
+	}
+	return fmt.Errorf("%s is not allowed in template_text", node)
+}
+
+// checkTemplatePipe allows a pipeline of fields, variables, literals and join.
+func checkTemplatePipe(p *parse.PipeNode) error {
+	if p == nil {
+		return nil
+	}
+	for _, cmd := range p.Cmds {
+		for i, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.FieldNode, *parse.VariableNode, *parse.DotNode,
+				*parse.StringNode, *parse.NumberNode, *parse.BoolNode:
+			case *parse.IdentifierNode:
+				if a.Ident != "join" || i != 0 {
+					return fmt.Errorf("function %s is not allowed in template_text", a.Ident)
+				}
+			case *parse.PipeNode:
+				if err := checkTemplatePipe(a); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s is not allowed in template_text", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// rangesOverList reports whether a range pipeline is just .Chunks or
+// .History, or the same through $.
+func rangesOverList(p *parse.PipeNode) bool {
+	if p == nil || len(p.Cmds) != 1 || len(p.Cmds[0].Args) != 1 {
+		return false
+	}
+	var fields []string
+	switch a := p.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		fields = a.Ident
+	case *parse.VariableNode:
+		if len(a.Ident) < 1 || a.Ident[0] != "$" {
+			return false
+		}
+		fields = a.Ident[1:]
+	default:
+		return false
+	}
+	return len(fields) == 1 && (fields[0] == "Chunks" || fields[0] == "History")
+}
+
+// cappedWriter passes at most maxRenderedPrompt bytes to w and fails after.
+type cappedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if c.n+len(p) > maxRenderedPrompt {
+		return 0, errPromptTooLarge
+	}
+	c.n += len(p)
+	return c.w.Write(p)
+}
+
+// requestTemplate resolves the template a chat request asks for: a named one
+// from the registry or an inline one. It returns nil for the built-in prompt.
+func (s *Server) requestTemplate(req ChatRequest) (*template.Template, error) {
+	switch {
+	case req.Template != "" && req.TemplateText != "":
+		return nil, fmt.Errorf("send either template or template_text, not both")
+	case req.Template != "":
+		t, ok := s.templates[req.Template]
+		if !ok {
+			return nil, fmt.Errorf("unknown template %q", req.Template)
+		}
+		return t, nil
+	case req.TemplateText != "":
+		if len(req.TemplateText) > maxInlineTemplate {
+			return nil, fmt.Errorf("template_text is too long (max %d bytes)", maxInlineTemplate)
+		}
+		t, err := parsePromptTemplate("inline", req.TemplateText, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template_text: %w", err)
+		}
+		return t, nil
+	}
+	return nil, nil
+}
+
+// renderPrompt builds the prompt with t, or with the built-in prompt when t is nil.
+func renderPrompt(t *template.Template, data promptData) (string, error) {
+	if t == nil {
+		return buildPrompt(data.Context, data.History, data.Question), nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&cappedWriter{w: &b}, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// templatesHandler lists the names of the registered templates.
+func (s *Server) templatesHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, map[string][]string{"templates": names})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInlineTemplateChecks(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		ok   bool
+	}{
+		{"Answer from:\n{{.Context}}\n\nQ: {{.Question}}", true},
+		{`{{join .Chunks "\n---\n"}}`, true},
+		{"{{range $i, $c := .Chunks}}[{{$i}}] {{$c}}\n{{end}}", true},
+		{"{{range .History}}{{.Role}}: {{.Content}}\n{{end}}{{.Question}}", true},
+		{"{{if .History}}Earlier:{{range .History}}{{.Content}}{{end}}{{else}}New{{end}}", true},
+		{"{{range .Chunks}}{{range $.History}}{{.Content}}{{end}}{{end}}", true},
+
+		{"{{range 1000000000}}{{range 1000000000}}x{{end}}{{end}}", false},
+		{"{{range .Question}}x{{end}}", false},
+		{"{{range .Chunks}}{{range $.Chunks}}{{range $.Chunks}}{{end}}{{end}}{{end}}", false},
+		{`{{define "x"}}{{.Context}}{{end}}{{template "x" .}}`, false},
+		{`{{block "x" .}}{{.Context}}{{end}}`, false},
+		{`{{printf "%099999999d" 1}}`, false},
+		{"{{with .Context}}{{.}}{{end}}", false},
+	} {
+		_, err := parsePromptTemplate("inline", tc.text, true)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%q: err = %v, want ok = %v", tc.text, err, tc.ok)
+		}
+	}
+}
+
+func TestRenderPromptIsCapped(t *testing.T) {
+	tmpl, err := parsePromptTemplate("inline", "{{range .Chunks}}{{range $.Chunks}}{{$.Context}}{{end}}{{end}}", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make([]string, 100)
+	for i := range chunks {
+		chunks[i] = "chunk"
+	}
+	data := promptData{Chunks: chunks, Context: strings.Repeat("x", 1000)}
+	if _, err := renderPrompt(tmpl, data); !errors.Is(err, errPromptTooLarge) {
+		t.Errorf("err = %v, want %v", err, errPromptTooLarge)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// version is the release the binary was built as, set at build time with
+// -ldflags "-X main.version=v1.4.0".
+var version = "dev"
+
+// BuildInfo identifies the running binary.
+type BuildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`      // VCS revision, when built from a checkout
+	CommitTime string `json:"commit_time,omitempty"` // RFC 3339
+	Modified   bool   `json:"modified,omitempty"`    // built with uncommitted changes
+	GoVersion  string `json:"go_version"`
+}
+
+// buildInfo reads the version and the VCS stamp Go records in the binary.
+func buildInfo() BuildInfo {
+	b := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Commit = s.Value
+		case "vcs.time":
+			b.CommitTime = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	if b.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		b.Version = info.Main.Version
+	}
+	return b
+}
+
+// ProvidersInfo names the backends the server answers with.
+type ProvidersInfo struct {
+	Embedders  []string `json:"embedders"` // in failover order
+	EmbedModel string   `json:"embed_model"`
+	LLM        string   `json:"llm"` // gemini | mock
+	LLMModel   string   `json:"llm_model,omitempty"`
+	VectorDB   string   `json:"vector_db"`
+	Chroma     string   `json:"chroma_url"`
+	Collection string   `json:"collection"`
+}
+
+func (cfg Config) providers() ProvidersInfo {
+	p := ProvidersInfo{
+		Embedders:  cfg.EmbedProviders,
+		EmbedModel: cfg.EmbedModelName,
+		LLM:        "gemini",
+		LLMModel:   cfg.LLMModelName,
+		VectorDB:   "chroma",
+		Chroma:     redactURL(cfg.ChromaDBHost),
+		Collection: defaultCollection,
+	}
+	if len(p.Embedders) == 0 {
+		p.Embedders = []string{providerHF}
+	}
+	if cfg.LLMMode == modeMock {
+		p.LLM, p.LLMModel = modeMock, ""
+	}
+	return p
+}
+
+// VersionResponse is the answer to GET /version.
+type VersionResponse struct {
+	Build     BuildInfo      `json:"build"`
+	StartedAt time.Time      `json:"started_at"`
+	Providers ProvidersInfo  `json:"providers"`
+	Config    map[string]any `json:"config"` // by environment variable
+}
+
+// redactURL hides the password of a URL, and the whole value when it does
+// not parse.
+func redactURL(v string) string {
+	if v == "" {
+		return ""
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
+// secretState says whether a secret is configured, without revealing it.
+func secretState(v string) string {
+	if v == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// effectiveConfig is the configuration the server runs with, by environment
+// variable. Secrets are only reported as set or unset, and the JSON files by
+// what they declare.
+func (cfg Config) effectiveConfig() map[string]any {
+	m := map[string]any{
+		"HF_API_KEY":       secretState(cfg.HFAPIKey),
+		"EMBED_MODEL_NAME": cfg.EmbedModelName,
+		"GEMINI_API_KEY":   secretState(cfg.GeminiAPIKey),
+		"LLM_MODEL_NAME":   cfg.LLMModelName,
+		"LLM_MODE":         cfg.LLMMode,
+		"EMBED_MODE":       cfg.EmbedMode,
+		"CHROMA_DB_HOST":   redactURL(cfg.ChromaDBHost),
+		"RAG_DATA_DIR":     cfg.RAGDataDir,
+		"CHUNK_STRATEGY":   cfg.ChunkStrategy,
+		"CHUNK_LENGTH":     cfg.ChunkLength,
+		"CHUNK_OVERLAP":    cfg.ChunkOverlap,
+		"PORT":             cfg.Port,
+		"DOC_CATEGORIES":   cfg.Categories,
+		"ADMIN_TOKEN":      secretState(cfg.AdminToken),
+		"CHUNK_SUMMARIES":  cfg.ChunkSummaries,
+
+		"CHROMA_DISTANCE":        cfg.ChromaDistance,
+		"HNSW_M":                 cfg.HNSWM,
+		"HNSW_CONSTRUCTION_EF":   cfg.HNSWConstructionEF,
+		"HNSW_SEARCH_EF":         cfg.HNSWSearchEF,
+		"EMBED_QUANTIZE":         cfg.EmbedQuantize,
+		"CHROMA_BATCH_SIZE":      cfg.ChromaBatchSize,
+		"CHROMA_HEALTH_INTERVAL": cfg.ChromaHealthInterval.String(),
+
+		"EMBED_PROVIDERS":  cfg.providers().Embedders,
+		"EMBED_SLO":        cfg.EmbedSLO.String(),
+		"EMBED_CACHE_MODE": embedCacheMode(),
+		"TEI_URL":          secretState(cfg.TEIURL), // may carry credentials in its path or query
+		"TEI_API_TOKEN":    secretState(cfg.TEIToken),
+
+		"MAINTENANCE_INTERVAL": cfg.MaintenanceInterval.String(),
+		"EMBED_CACHE_MAX_AGE":  cfg.EmbedCacheMaxAge.String(),
+		"ORPHAN_CLEANUP":       cfg.OrphanCleanup,
+		"RECENCY_HALF_LIFE":    cfg.RecencyHalfLife.String(),
+		"RECENCY_WEIGHT":       cfg.RecencyWeight,
+		"NEIGHBOR_CHUNKS":      cfg.NeighborChunks,
+
+		"PROMPT_TEMPLATES_DIR":  cfg.PromptTemplatesDir,
+		"GROUNDING_THRESHOLD":   cfg.GroundingThreshold,
+		"LLM_FALLBACK":          cfg.LLMFallback,
+		"LLM_STOP_SEQUENCES":    cfg.StopSequences,
+		"LLM_MAX_OUTPUT_TOKENS": cfg.MaxOutputTokens,
+
+		"QUERY_LOG":           cfg.QueryLog,
+		"QUERY_LOG_RETENTION": cfg.QueryLogRetention.String(),
+		"WEBHOOK_URL":         secretState(cfg.WebhookURL), // often a capability URL
+		"WEBHOOK_SECRET":      secretState(cfg.WebhookSecret),
+
+		"AWS_ACCESS_KEY_ID":     secretState(cfg.AWSAccessKeyID),
+		"AWS_SECRET_ACCESS_KEY": secretState(cfg.AWSSecretAccessKey),
+		"AWS_SESSION_TOKEN":     secretState(cfg.AWSSessionToken),
+		"DRIVE_API_KEY":         secretState(cfg.DriveAPIKey),
+	}
+
+	var experiment any
+	if e := cfg.Experiment; e != nil {
+		experiment = map[string]any{"name": e.Name}
+	}
+	m["EXPERIMENT_FILE"] = experiment
+	var pipelines any
+	if p := cfg.Pipelines; p != nil {
+		pipelines = map[string]any{"default": p.Default, "pipelines": sortedKeys(p.Pipelines)}
+	}
+	m["PIPELINE_FILE"] = pipelines
+	var profiles any
+	if p := cfg.Profiles; p != nil {
+		profiles = map[string]any{"default": p.Default, "profiles": sortedKeys(p.Profiles)}
+	}
+	m["PROFILE_FILE"] = profiles
+	m["QUOTA_FILE"] = map[string]bool{"limits": cfg.Quotas != nil}
+	sources := []string{}
+	for _, src := range cfg.SyncSources {
+		sources = append(sources, src.Name)
+	}
+	m["SYNC_FILE"] = map[string]any{"sources": sources}
+	var drive any
+	if c := cfg.DriveCredentials; c != nil {
+		drive = map[string]any{"client_email": c.ClientEmail}
+	}
+	m["DRIVE_CREDENTIALS_FILE"] = drive
+	return m
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// versionHandler implements GET /version: the build, the providers and the
+// effective configuration, to check what is running in an environment.
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Version request received")
+
+	writeJSON(w, http.StatusOK, VersionResponse{
+		Build:     buildInfo(),
+		StartedAt: processStart.UTC(),
+		Providers: s.cfg.providers(),
+		Config:    s.cfg.effectiveConfig(),
+	})
+}
+
+// logBanner logs what is starting: the build and the providers it answers with.
+func logBanner(cfg Config) {
+	b, p := buildInfo(), cfg.providers()
+	commit := b.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if commit == "" {
+		commit = "unknown"
+	} else if b.Modified {
+		commit += "+dirty"
+	}
+	llm := p.LLM
+	if p.LLMModel != "" {
+		llm += " (" + p.LLMModel + ")"
+	}
+	log.Printf("semanticRAG %s, commit %s, %s", b.Version, commit, b.GoVersion)
+	log.Printf("embedders %v (%s), LLM %s, chroma %s collection %s",
+		p.Embedders, p.EmbedModel, llm, p.Chroma, p.Collection)
+	log.Printf("listening on :%d", cfg.Port)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// webhookTimeout bounds each delivery attempt.
+const webhookTimeout = 10 * time.Second
+
+// webhookClient delivers to WEBHOOK_URL, which the operator chose and may be
+// an internal service.
+var webhookClient = &http.Client{Timeout: webhookTimeout, CheckRedirect: refuseRedirect}
+
+// callbackClient delivers to the callback_url of an upload, which any caller
+// can set. It only connects to public addresses, checked on the resolved
+// address of every connection so a DNS answer cannot change after the check,
+// and does not go through a proxy, which would hide the address.
+var callbackClient = &http.Client{
+	Timeout:       webhookTimeout,
+	CheckRedirect: refuseRedirect,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("callback address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+}
+
+// refuseRedirect fails deliveries that are redirected, so a receiver cannot
+// send them on to an address the client would not connect to itself.
+func refuseRedirect(req *http.Request, _ []*http.Request) error {
+	return errors.New("webhook redirects are not followed")
+}
+
+// publicIP reports whether ip may receive callbacks: not loopback, private
+// (RFC 1918, fc00::/7), link-local (such as 169.254.169.254), unspecified or
+// multicast.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkCallbackHost resolves the host of a caller's callback URL and rejects
+// it unless every address is public, so the upload fails up front rather than
+// its delivery later.
+func checkCallbackHost(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("invalid callback_url %q: %v", raw, err)
+	}
+	for _, a := range addrs {
+		if !publicIP(a.IP) {
+			return fmt.Errorf("invalid callback_url %q: %s is not a public address", raw, a.IP)
+		}
+	}
+	return nil
+}
+
+// webhookPayload is POSTed to the callback URL when a job finishes.
+type webhookPayload struct {
+	Event string `json:"event"` // "job.succeeded" | "job.failed"
+	Job   Job    `json:"job"`
+}
+
+// validateCallbackURL accepts absolute http(s) URLs only.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback_url %q: want an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret.
+// Covering the timestamp lets receivers reject replayed deliveries.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhook delivers the job result to target through client, retrying
+// failed attempts. When secret (WEBHOOK_SECRET) is set the payload is signed
+// with it.
+func notifyWebhook(ctx context.Context, client *http.Client, target, secret string, job Job) error {
+	event := "job.succeeded"
+	if job.Status == JobFailed {
+		event = "job.failed"
+	}
+	body, err := json.Marshal(webhookPayload{Event: event, Job: job})
+	if err != nil {
+		return err
+	}
+
+	return retryCall(ctx, "webhook", retryAlways, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setRequestIDHeader(ctx, req.Header)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Webhook-Timestamp", ts)
+		if secret != "" {
+			req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(secret, ts, body))
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	})
+}